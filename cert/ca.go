@@ -115,7 +115,7 @@ func (ncp *NebulaCAPool) isBlocklistedWithCache(c *NebulaCertificate, useCache b
 // No signature validation is performed
 func (ncp *NebulaCAPool) GetCAForCert(c *NebulaCertificate) (*NebulaCertificate, error) {
 	if c.Details.Issuer == "" {
-		return nil, fmt.Errorf("no issuer in certificate")
+		return nil, ErrNoIssuer
 	}
 
 	signer, ok := ncp.CAs[c.Details.Issuer]
@@ -123,7 +123,7 @@ func (ncp *NebulaCAPool) GetCAForCert(c *NebulaCertificate) (*NebulaCertificate,
 		return signer, nil
 	}
 
-	return nil, fmt.Errorf("could not find ca for the certificate")
+	return nil, ErrCANotFound
 }
 
 // GetFingerprints returns an array of trusted CA fingerprints
@@ -11,4 +11,6 @@ var (
 	ErrNotSelfSigned     = errors.New("certificate is not self-signed")
 	ErrBlockListed       = errors.New("certificate is in the block list")
 	ErrSignatureMismatch = errors.New("certificate signature did not match")
+	ErrNoIssuer          = errors.New("no issuer in certificate")
+	ErrCANotFound        = errors.New("could not find ca for the certificate")
 )
@@ -2,6 +2,7 @@ package cidr
 
 import (
 	"net"
+	"net/netip"
 
 	"github.com/slackhq/nebula/iputil"
 )
@@ -36,13 +37,30 @@ func NewTree4[T any]() *Tree4[T] {
 }
 
 func (tree *Tree4[T]) AddCIDR(cidr *net.IPNet, val T) {
+	tree.add(iputil.Ip2VpnIp(cidr.IP), iputil.Ip2VpnIp(cidr.Mask), cidr, val)
+}
+
+// AddPrefix is AddCIDR for a netip.Prefix, prefixes that are not ipv4 are ignored
+func (tree *Tree4[T]) AddPrefix(prefix netip.Prefix, val T) {
+	if !prefix.Addr().Is4() {
+		return
+	}
+
+	ip := iputil.Addr2VpnIp(prefix.Addr())
+	mask := iputil.VpnIp(0)
+	if prefix.Bits() > 0 {
+		mask = ^iputil.VpnIp(0) << (32 - prefix.Bits())
+	}
+	tree.add(ip, mask, nil, val)
+}
+
+// add puts val in the tree for ip and mask, cidr is the same range for List. A nil cidr is made from ip and mask
+// if the range is new to the tree.
+func (tree *Tree4[T]) add(ip, mask iputil.VpnIp, cidr *net.IPNet, val T) {
 	bit := startbit
 	node := tree.root
 	next := tree.root
 
-	ip := iputil.Ip2VpnIp(cidr.IP)
-	mask := iputil.Ip2VpnIp(cidr.Mask)
-
 	// Find our last ancestor in the tree
 	for bit&mask != 0 {
 		if ip&bit != 0 {
@@ -61,14 +79,20 @@ func (tree *Tree4[T]) AddCIDR(cidr *net.IPNet, val T) {
 
 	// We already have this range so update the value
 	if next != nil {
-		addCIDR := cidr.String()
 		for i, v := range tree.list {
-			if addCIDR == v.CIDR.String() {
+			if ip == iputil.Ip2VpnIp(v.CIDR.IP) && mask == iputil.Ip2VpnIp(v.CIDR.Mask) {
+				if cidr == nil {
+					cidr = v.CIDR
+				}
 				tree.list = append(tree.list[:i], tree.list[i+1:]...)
 				break
 			}
 		}
 
+		// The node may only have been on the way to a more specific cidr until now
+		if cidr == nil {
+			cidr = &net.IPNet{IP: ip.ToIP(), Mask: net.IPMask(mask.ToIP())}
+		}
 		tree.list = append(tree.list, entry[T]{CIDR: cidr, Value: val})
 		node.value = val
 		node.hasValue = true
@@ -93,6 +117,9 @@ func (tree *Tree4[T]) AddCIDR(cidr *net.IPNet, val T) {
 	// Final node marks our cidr, set the value
 	node.value = val
 	node.hasValue = true
+	if cidr == nil {
+		cidr = &net.IPNet{IP: ip.ToIP(), Mask: net.IPMask(mask.ToIP())}
+	}
 	tree.list = append(tree.list, entry[T]{CIDR: cidr, Value: val})
 }
 
@@ -142,6 +169,22 @@ func (tree *Tree4[T]) MostSpecificContains(ip iputil.VpnIp) (ok bool, value T) {
 	return ok, value
 }
 
+// ContainsAddr is Contains for a netip.Addr, an address that is not ipv4 is never contained
+func (tree *Tree4[T]) ContainsAddr(addr netip.Addr) (ok bool, value T) {
+	if !addr.Unmap().Is4() {
+		return false, value
+	}
+	return tree.Contains(iputil.Addr2VpnIp(addr))
+}
+
+// MostSpecificContainsAddr is MostSpecificContains for a netip.Addr, an address that is not ipv4 is never contained
+func (tree *Tree4[T]) MostSpecificContainsAddr(addr netip.Addr) (ok bool, value T) {
+	if !addr.Unmap().Is4() {
+		return false, value
+	}
+	return tree.MostSpecificContains(iputil.Addr2VpnIp(addr))
+}
+
 // Match finds the most specific match
 // TODO this is exact match
 func (tree *Tree4[T]) Match(ip iputil.VpnIp) (ok bool, value T) {
@@ -171,3 +214,25 @@ func (tree *Tree4[T]) Match(ip iputil.VpnIp) (ok bool, value T) {
 func (tree *Tree4[T]) List() []entry[T] {
 	return tree.list
 }
+
+// Each calls fn with every CIDR in the tree and its value, ordered by address and then by prefix length, until fn
+// returns false
+func (tree *Tree4[T]) Each(fn func(cidr *net.IPNet, val T) bool) {
+	tree.root.each(0, 0, fn)
+}
+
+func (node *Node[T]) each(ip iputil.VpnIp, ones int, fn func(cidr *net.IPNet, val T) bool) bool {
+	if node == nil {
+		return true
+	}
+
+	if node.hasValue && !fn(&net.IPNet{IP: ip.ToIP(), Mask: net.CIDRMask(ones, 32)}, node.value) {
+		return false
+	}
+
+	if !node.left.each(ip, ones+1, fn) {
+		return false
+	}
+
+	return node.right.each(ip|startbit>>ones, ones+1, fn)
+}
@@ -2,6 +2,7 @@ package cidr
 
 import (
 	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/slackhq/nebula/iputil"
@@ -22,6 +23,70 @@ func TestCIDRTree_List(t *testing.T) {
 	assert.Equal(t, "4", list[1].Value)
 }
 
+func TestCIDRTree_Each(t *testing.T) {
+	tree := NewTree4[string]()
+	tree.AddCIDR(Parse("4.1.1.1/32"), "1")
+	tree.AddCIDR(Parse("1.0.0.0/16"), "2")
+	tree.AddCIDR(Parse("1.0.0.0/8"), "3")
+	tree.AddCIDR(Parse("0.0.0.0/0"), "4")
+	tree.AddCIDR(Parse("1.0.0.0/16"), "5")
+
+	var got []string
+	tree.Each(func(cidr *net.IPNet, val string) bool {
+		got = append(got, cidr.String()+"="+val)
+		return true
+	})
+	assert.Equal(t, []string{"0.0.0.0/0=4", "1.0.0.0/8=3", "1.0.0.0/16=5", "4.1.1.1/32=1"}, got)
+
+	got = nil
+	tree.Each(func(cidr *net.IPNet, val string) bool {
+		got = append(got, val)
+		return len(got) < 2
+	})
+	assert.Equal(t, []string{"4", "3"}, got)
+
+	NewTree4[string]().Each(func(cidr *net.IPNet, val string) bool {
+		t.Fatal("empty tree should have nothing to iterate")
+		return true
+	})
+}
+
+func TestCIDRTree_Prefix(t *testing.T) {
+	tree := NewTree4[string]()
+	tree.AddPrefix(netip.MustParsePrefix("1.0.0.0/8"), "1")
+	tree.AddPrefix(netip.MustParsePrefix("1.2.3.0/24"), "2")
+	tree.AddPrefix(netip.MustParsePrefix("0.0.0.0/0"), "3")
+	tree.AddPrefix(netip.MustParsePrefix("fd00::/8"), "ignored")
+	tree.AddPrefix(netip.MustParsePrefix("1.2.0.0/16"), "5")
+
+	// A prefix lands on the same node as the same cidr
+	tree.AddCIDR(Parse("1.2.3.0/24"), "4")
+	list := tree.List()
+	assert.Len(t, list, 4)
+	assert.Equal(t, "1.0.0.0/8", list[0].CIDR.String())
+	assert.Equal(t, "0.0.0.0/0", list[1].CIDR.String())
+	assert.Equal(t, "1.2.0.0/16", list[2].CIDR.String())
+	assert.Equal(t, "1.2.3.0/24", list[3].CIDR.String())
+	assert.Equal(t, "4", list[3].Value)
+
+	ok, r := tree.MostSpecificContainsAddr(netip.MustParseAddr("1.2.3.4"))
+	assert.True(t, ok)
+	assert.Equal(t, "4", r)
+
+	ok, r = tree.MostSpecificContainsAddr(netip.MustParseAddr("::ffff:1.3.4.4"))
+	assert.True(t, ok)
+	assert.Equal(t, "1", r)
+
+	ok, r = tree.ContainsAddr(netip.MustParseAddr("1.2.3.4"))
+	assert.True(t, ok)
+	assert.Equal(t, "3", r)
+
+	ok, _ = tree.ContainsAddr(netip.MustParseAddr("fd00::1"))
+	assert.False(t, ok)
+	ok, _ = tree.ContainsAddr(netip.Addr{})
+	assert.False(t, ok)
+}
+
 func TestCIDRTree_Contains(t *testing.T) {
 	tree := NewTree4[string]()
 	tree.AddCIDR(Parse("1.0.0.0/8"), "1")
@@ -168,6 +233,32 @@ func BenchmarkCIDRTree_Contains(b *testing.B) {
 	})
 }
 
+func BenchmarkCIDRTree_Add(b *testing.B) {
+	cidrs := make([]*net.IPNet, 256)
+	prefixes := make([]netip.Prefix, 256)
+	for i := range cidrs {
+		cidrs[i] = &net.IPNet{IP: net.IPv4(10, byte(i), 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+		prefixes[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), 0, 0}), 16)
+	}
+
+	// Every cidr is added again on top of itself, as the same cidr in many rules is
+	b.Run("cidr", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := NewTree4[struct{}]()
+		for i := 0; i < b.N; i++ {
+			tree.AddCIDR(cidrs[i%len(cidrs)], struct{}{})
+		}
+	})
+
+	b.Run("prefix", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := NewTree4[struct{}]()
+		for i := 0; i < b.N; i++ {
+			tree.AddPrefix(prefixes[i%len(prefixes)], struct{}{})
+		}
+	})
+}
+
 func BenchmarkCIDRTree_Match(b *testing.B) {
 	tree := NewTree4[string]()
 	tree.AddCIDR(Parse("1.1.0.0/16"), "1")
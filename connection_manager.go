@@ -184,6 +184,7 @@ func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte,
 		if n.hostMap.DeleteHostInfo(hostinfo) {
 			// Only clearing the lighthouse cache if this is the last hostinfo for this vpn ip in the hostmap
 			n.intf.lightHouse.DeleteVpnIp(hostinfo.vpnIp)
+			n.intf.firewall.ForgetHostRTT(hostinfo.vpnIp)
 		}
 
 	case closeTunnel:
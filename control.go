@@ -9,6 +9,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/overlay"
@@ -87,9 +88,48 @@ func (c *Control) Stop() {
 	if err := c.f.Close(); err != nil {
 		c.l.WithError(err).Error("Close interface failed")
 	}
+
+	// No more packets can arrive, keep conntrack around for the next start
+	if err := c.f.firewall.SaveConntrackState(); err != nil {
+		c.l.WithError(err).Error("Failed to save conntrack state")
+	}
 	c.l.Info("Goodbye")
 }
 
+// SetFirewallDropLogger sets Firewall.DropLogger, fn is called with every packet the firewall drops and why. This must
+// be called before Control.Start()
+func (c *Control) SetFirewallDropLogger(fn func(fp firewall.Packet, incoming bool, reason error)) {
+	c.f.firewall.DropLogger = fn
+}
+
+// SetFirewallOnNewConn sets Firewall.OnNewConn, fn is called for every new conntrack entry and may store metadata for
+// the flow in meta. This must be called before Control.Start()
+func (c *Control) SetFirewallOnNewConn(fn func(fp firewall.Packet, incoming bool, meta *any)) {
+	c.f.firewall.OnNewConn = fn
+}
+
+// OnFirewallFlowEvent registers fn with Firewall.OnFlowEvent, it is called for every conntrack entry that is created
+// or removed
+func (c *Control) OnFirewallFlowEvent(fn func(ev FlowEvent)) {
+	c.f.firewall.OnFlowEvent(fn)
+}
+
+// RegisterFirewallDropHandler registers h with Firewall.RegisterDropHandler, it is handed every packet the firewall
+// denies
+func (c *Control) RegisterFirewallDropHandler(h DropHandler) {
+	c.f.firewall.RegisterDropHandler(h)
+}
+
+// UnregisterFirewallDropHandler removes h, registered with RegisterFirewallDropHandler
+func (c *Control) UnregisterFirewallDropHandler(h DropHandler) {
+	c.f.firewall.UnregisterDropHandler(h)
+}
+
+// GetHostRTTs returns Firewall.HostRTTs, a summary of the tcp round trip times of each peer being tracked
+func (c *Control) GetHostRTTs() []HostRTT {
+	return c.f.firewall.HostRTTs()
+}
+
 // ShutdownBlock will listen for and block on term and interrupt signals, calling Control.Stop() once signalled
 func (c *Control) ShutdownBlock() {
 	sigChan := make(chan os.Signal, 1)
@@ -8,10 +8,14 @@ import (
 	"fmt"
 	"hash/fnv"
 	"net"
+	"net/netip"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -20,33 +24,257 @@ import (
 	"github.com/slackhq/nebula/cidr"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"golang.org/x/net/ipv4"
 )
 
 const tcpACK = 0x10
 const tcpFIN = 0x01
+const tcpSYN = 0x02
+const tcpRST = 0x04
+const tcpPSH = 0x08
+const tcpURG = 0x20
+
+// defaultPurgeBudget is how many expired conntrack entries a packet may remove, when the sweeper is not running
+const defaultPurgeBudget = 8
+
+// ICMP message types that carry the header of the packet that caused them, RFC 792
+const (
+	icmpDestinationUnreachable = 3
+	icmpSourceQuench           = 4
+	icmpRedirect               = 5
+	icmpTimeExceeded           = 11
+	icmpParameterProblem       = 12
+)
+
+// ICMP message types that carry an identifier to tell sessions apart, RFC 792
+const (
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+)
 
 type FirewallInterface interface {
-	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error
+	AddRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, opts RuleOptions) error
+}
+
+// RuleOptions are the per rule settings that are not part of matching, the zero value is a plain rule
+type RuleOptions struct {
+	// ConntrackTimeout replaces the protocol timeout for flows allowed by this rule, only udp rules support it
+	ConntrackTimeout time.Duration
+
+	// Priority orders rule evaluation, higher goes first and the first rule to match decides. Plain rules have
+	// priority 0, at equal priority a deny wins over an allow.
+	Priority int
+
+	// Deny drops matching packets instead of allowing them
+	Deny bool
+
+	// Reject makes a deny rule send a reject for the packets it drops, whatever inbound_action or outbound_action say
+	Reject bool
+
+	// NoReject makes a deny rule drop packets silently, whatever inbound_action or outbound_action say
+	NoReject bool
+
+	// ICMPID limits an icmp rule to echo packets with this identifier, nil matches any identifier. ICMP messages other
+	// than echo have no identifier and are seen as identifier 0.
+	ICMPID *uint16
+
+	// MinLen and MaxLen limit the rule to packets of this length or more and of this length or less, the length of the
+	// whole ip packet. 0 leaves the bound open. Only the packet that starts a flow, or revalidates it after a reload,
+	// is checked, later packets of the flow are let through by conntrack.
+	MinLen int
+	MaxLen int
+
+	// TCPFlags limits a tcp rule to packets whose flags under TCPFlagsMask are exactly TCPFlags, so flags in the mask
+	// but not in TCPFlags must be clear. A zero mask matches any flags. See parseTCPFlags.
+	TCPFlags     uint8
+	TCPFlagsMask uint8
+
+	// Origin limits the rule to traffic for our own addresses or to traffic we forward, see RuleOrigin
+	Origin RuleOrigin
+
+	// SelfPeer limits the rule to packets whose peer certificate is our own, traffic from this node to its own overlay
+	// address. Set by host: self.
+	SelfPeer bool
+
+	// Expires is when the rule stops matching, zero for never. Flows the rule allowed are revalidated once it expires,
+	// see startRuleExpiry.
+	Expires time.Time
+
+	// SourcePortStart and SourcePortEnd limit a tcp or udp rule to packets whose source port is in the range, the
+	// remote port for inbound rules and the local port for outbound rules. The rule's own port range is always the
+	// destination port. 0 leaves the source port unconstrained, fragments never match a constrained rule.
+	SourcePortStart int32
+	SourcePortEnd   int32
+
+	// Name identifies the rule in debug logs in place of its rule string, see ruleName. It does not change what the
+	// rule matches.
+	Name string
+
+	// UnderlayCIDR limits an inbound rule to packets that arrived on an underlay address in the cidr, the address
+	// nebula listens on, see Firewall.DropFromUnderlay. The zero Prefix matches any underlay.
+	UnderlayCIDR netip.Prefix
+
+	// LogOnly makes the rule an audit rule, packets it matches are counted and logged but it does not decide whether
+	// they pass. The other rules are evaluated as if it were not there. See Firewall.logOnlyRules.
+	LogOnly bool
+
+	// MatchAll makes the rule require its host, groups, cidr and local cidr to all match the packet, rather than any
+	// one of them as rules do by default. A condition that is `any` or not set does not constrain the rule.
+	MatchAll bool
+}
+
+// inPortMaps returns true if a rule with these options belongs in the port maps of a FirewallTable, which only hold
+// allow rules at the default priority that match on nothing the port maps can't see
+func (o RuleOptions) inPortMaps() bool {
+	return o.Priority == 0 && !o.Deny && o.ICMPID == nil && o.MinLen == 0 && o.MaxLen == 0 && o.TCPFlagsMask == 0 &&
+		o.Origin == OriginAny && !o.SelfPeer && o.Expires.IsZero() && o.SourcePortStart == 0 && !o.LogOnly &&
+		!o.UnderlayCIDR.IsValid() && !o.MatchAll
+}
+
+// ruleOption is an option that is set on a rule, as it appears in the rule string and in the log of the rule added
+type ruleOption struct {
+	key   string
+	value any
+}
+
+// list returns the options that are set, in the order of the rule string. The rule string is part of the rule hash,
+// new options go last so the hashes of rules that don't use them do not change.
+func (o RuleOptions) list() []ruleOption {
+	var opts []ruleOption
+	add := func(key string, value any) {
+		opts = append(opts, ruleOption{key: key, value: value})
+	}
+
+	if o.ConntrackTimeout != 0 {
+		add("conntrackTimeout", o.ConntrackTimeout)
+	}
+	if o.Priority != 0 {
+		add("priority", o.Priority)
+	}
+	if o.Deny {
+		add("deny", true)
+	}
+	if o.Reject {
+		add("reject", true)
+	}
+	if o.NoReject {
+		add("reject", false)
+	}
+	if o.LogOnly {
+		add("logOnly", true)
+	}
+	if o.ICMPID != nil {
+		add("icmpId", *o.ICMPID)
+	}
+	if o.MinLen != 0 {
+		add("minLen", o.MinLen)
+	}
+	if o.MaxLen != 0 {
+		add("maxLen", o.MaxLen)
+	}
+	if o.TCPFlagsMask != 0 {
+		add("tcpFlags", tcpFlagsString(o.TCPFlags, o.TCPFlagsMask))
+	}
+	if o.Origin != OriginAny {
+		add("origin", o.Origin.String())
+	}
+	if o.SelfPeer {
+		add("host", hostSelf)
+	}
+	if !o.Expires.IsZero() {
+		add("expires", o.Expires.UTC().Format(time.RFC3339))
+	}
+	if o.SourcePortStart != 0 {
+		add("sourcePort", fmt.Sprintf("%v-%v", o.SourcePortStart, o.SourcePortEnd))
+	}
+	if o.UnderlayCIDR.IsValid() {
+		add("underlayCidr", o.UnderlayCIDR.String())
+	}
+	if o.MatchAll {
+		add("matchAll", true)
+	}
+	if o.Name != "" {
+		add("name", o.Name)
+	}
+	return opts
+}
+
+// ruleString returns the options for the rule string, empty for a plain rule so existing rule hashes do not change
+func (o RuleOptions) ruleString() string {
+	s := ""
+	for _, opt := range o.list() {
+		s += fmt.Sprintf(", %s: %v", opt.key, opt.value)
+	}
+	return s
 }
 
 type conn struct {
-	Expires time.Time // Time when this conntrack entry will expire
-	Sent    time.Time // If tcp rtt tracking is enabled this will be when Seq was last set
-	Seq     uint32    // If tcp rtt tracking is enabled this will be the seq we are looking for an ack
+	Expires time.Time     // Time when this conntrack entry will expire
+	Sent    time.Time     // If tcp rtt tracking is enabled this will be when Seq or tsVal was last set
+	started time.Time     // When this conntrack entry was created, used for flow export and the lifetime metrics
+	timeout time.Duration // The timeout from the rule that allowed this flow, 0 to use the protocol timeout
+	Meta    any           // Set by Firewall.OnNewConn, nil if it is not set
+	Seq     uint32        // If tcp rtt tracking is enabled this will be the seq we are looking for an ack
 
 	// record why the original connection passed the firewall, so we can re-validate
-	// after ruleset changes. Note, rulesVersion is a uint16 so that these two
+	// after ruleset changes. Note, rulesVersion is a uint16 so that these three
 	// fields pack for free after the uint32 above
 	incoming     bool
+	tcpState     tcpState
 	rulesVersion uint16
+
+	// Bumped each time newConn reuses this entry for another flow, so code that let go of the shard lock can tell the
+	// flow it was looking at from a new one given the same entry, see revalidateUnlocked
+	reuses uint16
+
+	// A pinned entry never expires and is not revalidated when the rules change, see Firewall.PinFlow
+	pinned bool
+
+	// If tcp rtt tracking is enabled and the flow carries the timestamps option, tsPending is set while we are looking
+	// for tsVal to be echoed back. Seq is not used then.
+	tsPending bool
+	tsVal     uint32
+	// The sequence number after the newest data we sent, so rtt tracking can tell retransmissions apart. 0 until a
+	// packet we could read was sent.
+	sentEnd uint32
+
+	// The sequence space of a tcp flow when firewall.conntrack.tcp_strict is on and its handshake was seen, nil if the
+	// flow is not checked
+	window *tcpWindow
+
+	// Packets and bytes seen for this flow in each direction, updated under the conntrack lock.
+	// This costs 32 bytes per entry. Packets allowed by a routine local ConntrackCache do not touch conntrack and
+	// are not counted.
+	inPackets  uint64
+	inBytes    uint64
+	outPackets uint64
+	outBytes   uint64
+}
+
+// bidirectional returns true once packets have been seen in both directions, caller must hold the conntrack lock
+func (c *conn) bidirectional() bool {
+	return c.inPackets > 0 && c.outPackets > 0
+}
+
+// count records a packet of length n for this flow, caller must hold the conntrack lock
+func (c *conn) count(incoming bool, n int) {
+	if incoming {
+		c.inPackets++
+		c.inBytes += uint64(n)
+	} else {
+		c.outPackets++
+		c.outBytes += uint64(n)
+	}
 }
 
 // TODO: need conntrack max tracked connections handling
 type Firewall struct {
 	Conntrack *FirewallConntrack
 
-	InRules  *FirewallTable
-	OutRules *FirewallTable
+	// The rules in use, see firewallRuleset. A new ruleset is only installed while every conntrack shard is locked, so
+	// it stays current for as long as a shard lock is held.
+	ruleset atomic.Pointer[firewallRuleset]
 
 	InSendReject  bool
 	OutSendReject bool
@@ -57,31 +285,452 @@ type Firewall struct {
 	UDPTimeout     time.Duration //linux: 180s max
 	DefaultTimeout time.Duration //linux: 600s
 
-	// Used to ensure we don't emit local packets for ips we don't own
-	localIps *cidr.Tree4[struct{}]
+	// Timeouts for each tcp state, see tcpState
+	tcpTimeouts [tcpStateMax]time.Duration
+	// Longest timeout for a tcp flow until packets have been seen in both directions
+	tcpSynTimeout time.Duration
+	// Timeout for a udp flow once packets have been seen in both directions, like udp-stream in linux conntrack
+	udpStreamTimeout time.Duration
 
-	rules        string
-	rulesVersion uint16
+	// Allow ICMP error messages that relate to a flow in conntrack, like the RELATED state in linux conntrack
+	allowRelated bool
+
+	// How many conntrack entries from an older rule set may be revalidated per conntrack tick, 0 is unlimited.
+	// Entries over budget are passed, or dropped if revalidateOverflowDrop is set, until their turn comes.
+	revalidateBudget       int
+	revalidateOverflowDrop bool
+
+	// Revalidate all of conntrack in the background after a reload instead of waiting for the next packet of each flow
+	revalidateOnReload bool
+
+	// Log at info the flows with traffic both ways that new rules stop when their next packet is checked
+	logRevalidationDrops bool
+
+	// In dry run Drop allows every packet, counting and logging the ones it would have dropped. nil if not in dry run.
+	dryRun *firewallDryRun
+
+	// Logs a sample of the packets Drop refuses, nil unless firewall.log_denied.enabled is set
+	deniedLog *deniedLog
 
-	trackTCPRTT     bool
-	metricTCPRTT    metrics.Histogram
-	incomingMetrics firewallMetrics
-	outgoingMetrics firewallMetrics
+	// Logs a sample of the packets dropped for a local ip we don't handle, nil unless firewall.log_spoofed_local is set
+	spoofedLocalLog *deniedLog
+
+	// DropLogger, if set, is called for every packet Drop refuses with the reason it was refused. It is called outside
+	// of any firewall lock on the routine handling the packet, so it must be quick, any sampling is up to it.
+	// Set it before the firewall sees packets, it is carried over to the firewall that replaces this one on reload.
+	DropLogger func(fp firewall.Packet, incoming bool, reason error)
+
+	// OnNewConn, if set, is called for every conntrack entry a packet the rules allowed adds, with where to put metadata
+	// for the flow. What it stores in meta is opaque to the firewall, it is in the ConntrackEntry and FlowEvent of the
+	// flow and carries over when the flow is readmitted. It is called under the conntrack shard lock so it must be
+	// quick and must not call into the firewall. Set it before the firewall sees packets, it is carried over to the
+	// firewall that replaces this one on reload.
+	OnNewConn func(fp firewall.Packet, incoming bool, meta *any)
+
+	// The certificate the local ips of the ruleset were built from, Reload builds them again
+	certificate *cert.NebulaCertificate
+	// The addresses in certificate, packets to or from any other local address are forwarded
+	selfIps []iputil.VpnIp
+
+	// rulesLock guards rules, the hashes may be read by other routines while rules are added or restored
+	rulesLock sync.RWMutex
+	rules     string
+
+	// The rule files the rules were loaded from, see firewall.inbound_file
+	ruleFiles ruleFiles
+
+	// Records changes to the rules, nil when firewall.audit_log is not configured
+	auditLog *firewallAuditLog
+
+	// Hands flow events to the callbacks registered with OnFlowEvent, nil until one is. flowEventsLock is only held to
+	// set it.
+	flowEventsLock sync.Mutex
+	flowEvents     atomic.Pointer[flowEvents]
+
+	// Hands denied packets to the handlers registered with RegisterDropHandler, nil until one is. dropEventsLock is
+	// only held to set it.
+	dropEventsLock sync.Mutex
+	dropEvents     atomic.Pointer[dropEvents]
+
+	// Sends finished flows to a collector, nil when firewall.flow_export is not configured
+	flowExporter *flowExporter
+
+	// Where conntrack is saved on shutdown and restored from on startup, empty if disabled
+	conntrackStateFile string
+
+	// Bumps rulesVersion as timed rules expire, nil without timed rules
+	ruleExpiry *ruleExpiry
+
+	// Expires conntrack entries in the background, nil if packets purge conntrack as they arrive
+	sweeper *conntrackSweeper
+
+	// Revalidates conntrack in the background after a reload, nil if not running
+	revalidator *conntrackRevalidator
+
+	// How many expired conntrack entries a packet may remove when the sweeper is not running, so a busy firewall keeps up
+	// with expiry while the work done for any one packet stays bounded
+	purgeBudget int
+
+	// New flows are dropped from peers whose certificate expires sooner than this, 0 disables the check
+	minCertRemaining time.Duration
+
+	// How many conntrack entries may be pinned at once, see PinFlow
+	maxPinned int64
+
+	// Check the sequence and ack numbers of tcp flows whose handshake was seen against their window
+	tcpStrict bool
+
+	// How long a flow of each conntrack protocol may stay in conntrack before it must pass the rules again, however
+	// busy it is. 0 is forever.
+	maxFlowLifetimes [conntrackProtoMax]time.Duration
+
+	// How many conntrack entries a single remote host may have, 0 is unlimited. New flows from a host at its limit are
+	// let through if a rule allows them but not tracked.
+	maxConnsPerHost int64
+
+	// How many entries conntrack may hold, 0 is unlimited, and each shard's share of it, see setMaxConns. A full shard
+	// makes room for a new flow with makeRoom.
+	maxConns         int
+	maxConnsPerShard int
+
+	// Check the per protocol conntrack counts against conntrack itself in EmitStats, for debugging
+	verifyConntrackCounts bool
+
+	// Limits how fast new flows are added to conntrack, nil when firewall.conntrack.new_connection_rate is not set
+	connRate *connRateLimiter
+
+	// Nothing is tracked and every packet is checked against the rules, see firewall.conntrack.enabled
+	conntrackDisabled bool
+
+	// Limits how many icmp rejects are sent a second, nil for no limit. See allowReject.
+	rejectICMPRate *connRateLimiter
+
+	// The destination unreachable code of icmp rejects, see firewall.reject_icmp_code
+	rejectICMPCode uint8
+
+	// Cuts off peers that are denied too often, nil when firewall.quarantine is not enabled
+	quarantine *firewallQuarantine
+
+	// The tcp rtt of each peer, nil when firewall.tcp_rtt.max_hosts is not set
+	hostRTTs *hostRTTs
+
+	// The least time between the packets a flow times for tcp rtt, see firewall.tcp_rtt.min_interval
+	tcpRTTMinInterval time.Duration
+
+	trackTCPRTT            bool
+	metricTCPRTT           metrics.Histogram
+	metricConntrackFlushed metrics.Counter
+	// Lifecycle of conntrack entries, together with metricConntrackFlushed these show churn that the count can't
+	metricConntrackCreated          metrics.Counter
+	metricConntrackRefreshed        metrics.Counter
+	metricConntrackExpired          metrics.Counter
+	metricConntrackRevalidateFailed metrics.Counter
+	metricConntrackLifetimeExceeded metrics.Counter
+	metricRevalidatedKept           metrics.Counter
+	metricRevalidatedDropped        metrics.Counter
+	metricLifetimeTCP               metrics.Histogram
+	metricLifetimeUDP               metrics.Histogram
+	metricLifetimeOther             metrics.Histogram
+	metricImportMalformed           metrics.Counter
+	metricSweepEvicted              metrics.Histogram
+	metricTCPClosedByRST            metrics.Counter
+	metricTCPHandshakeExpired       metrics.Counter
+	metricTCPOutOfWindow            metrics.Counter
+	metricCALookupFailures          metrics.Counter
+	metricConntrackFull             metrics.Counter
+	metricEvicted                   [evictClassMax]metrics.Counter
+	metricDroppedConnRate           metrics.Counter
+	metricAllowedConntrack          metrics.Counter
+	metricAllowedRule               metrics.Counter
+	metricDroppedCertExpiring       metrics.Counter
+	metricPerHostLimit              metrics.Counter
+	metricsRegistry                 metrics.Registry
+	incomingMetrics                 firewallMetrics
+	outgoingMetrics                 firewallMetrics
+
+	// Where conntrack and rule evaluation get the time, see firewallClock
+	clock firewallClock
 
 	l *logrus.Logger
 }
 
+// firewallRuleset is what the packet path needs from the rules. It is not changed once the firewall sees packets,
+// Reload, RestoreRules and InheritConntrack install a new one instead, so a packet that loads it once is checked
+// against tables, local ips and a version that belong together.
+type firewallRuleset struct {
+	in  *FirewallTable
+	out *FirewallTable
+
+	// Used to ensure we don't emit local packets for ips we don't own
+	localIps *cidr.Tree4[struct{}]
+
+	// Stamped on the conntrack entries these rules allow, entries with any other version are checked again
+	version uint16
+}
+
+// table returns the rules for a direction
+func (rs *firewallRuleset) table(incoming bool) *FirewallTable {
+	if incoming {
+		return rs.in
+	}
+	return rs.out
+}
+
 type firewallMetrics struct {
 	droppedLocalIP  metrics.Counter
 	droppedRemoteIP metrics.Counter
 	droppedNoRule   metrics.Counter
+	droppedDenyRule metrics.Counter
+
+	// Rejects written out for dropped packets, tcp resets and icmp alike, see Firewall.rejectSent
+	rejected metrics.Counter
+
+	// droppedNoRule split by protocol, droppedNoRule is still the total
+	droppedNoRuleTCP   metrics.Counter
+	droppedNoRuleUDP   metrics.Counter
+	droppedNoRuleICMP  metrics.Counter
+	droppedNoRuleOther metrics.Counter
+
+	// ICMP error messages allowed because they relate to a flow in conntrack
+	allowedRelated metrics.Counter
+
+	// New flows allowed because a conntrack helper expected them, see Firewall.Expect
+	allowedExpected metrics.Counter
+
+	// Packets matched by log only rules, see Firewall.logOnlyRules
+	logRuleHits metrics.Counter
+
+	// ICMP rejects sent and held back by the reject rate, see Firewall.allowReject and Firewall.rejectSent
+	rejectICMPSent    metrics.Counter
+	rejectICMPLimited metrics.Counter
+}
+
+// noRule counts a packet of protocol proto that was dropped because no rule allowed it
+func (m firewallMetrics) noRule(proto uint8) {
+	m.droppedNoRule.Inc(1)
+
+	switch proto {
+	case firewall.ProtoTCP:
+		m.droppedNoRuleTCP.Inc(1)
+	case firewall.ProtoUDP:
+		m.droppedNoRuleUDP.Inc(1)
+	case firewall.ProtoICMP:
+		m.droppedNoRuleICMP.Inc(1)
+	default:
+		m.droppedNoRuleOther.Inc(1)
+	}
 }
 
+// FirewallConntrack is split into shards by a hash of the flow tuple, each with its own lock, so routines handling
+// different flows do not contend with each other
 type FirewallConntrack struct {
+	shards []*conntrackShard
+	mask   uint32
+
+	// How many entries there are in every shard, shared with the shards
+	size *atomic.Int64
+	// The largest size seen by addConn since stats were last emitted, see Firewall.EmitStats
+	highWater atomic.Int64
+
+	// Flows conntrack helpers said to expect, see Firewall.Expect
+	expected *conntrackExpectations
+}
+
+type conntrackShard struct {
 	sync.Mutex
 
 	Conns      map[firewall.Packet]*conn
 	TimerWheel *TimerWheel[firewall.Packet]
+
+	// Revalidations remaining until revalidateRefill, see Firewall.revalidateBudget
+	revalidateLeft   int
+	revalidateRefill time.Time
+
+	// How many entries of each protocol are in Conns, kept in step by put, remove and clear
+	protoCounts [conntrackProtoMax]int
+	// How many entries each remote host has, shared by every shard and kept in step the same way
+	hosts *conntrackHosts
+	// How many entries are pinned, shared by every shard and kept in step the same way
+	pinned *atomic.Int64
+	// How many entries there are, shared by every shard and kept in step the same way
+	size *atomic.Int64
+
+	// Entries that have been removed, reused by newConn to avoid garbage collection. Up to connCacheMax are kept.
+	free []*conn
+}
+
+// How many removed conn objects each conntrack shard keeps for reuse
+const connCacheMax = 4096
+
+// Indexes of conntrackShard.protoCounts
+const (
+	conntrackProtoTCP = iota
+	conntrackProtoUDP
+	conntrackProtoICMP
+	conntrackProtoOther
+	conntrackProtoMax
+)
+
+var conntrackProtoNames = [conntrackProtoMax]string{"tcp", "udp", "icmp", "other"}
+
+func conntrackProto(proto uint8) int {
+	switch proto {
+	case firewall.ProtoTCP:
+		return conntrackProtoTCP
+	case firewall.ProtoUDP:
+		return conntrackProtoUDP
+	case firewall.ProtoICMP:
+		return conntrackProtoICMP
+	default:
+		return conntrackProtoOther
+	}
+}
+
+// newConn returns an empty entry, reusing a removed one if there is one. Caller must hold the shard lock.
+func (s *conntrackShard) newConn(incoming bool) *conn {
+	n := len(s.free)
+	if n == 0 {
+		return &conn{incoming: incoming}
+	}
+
+	c := s.free[n-1]
+	s.free = s.free[:n-1]
+	// Nothing from the previous flow, such as the tcp rtt Seq and Sent, may carry over
+	*c = conn{incoming: incoming, reuses: c.reuses + 1}
+	return c
+}
+
+// release keeps a removed entry for newConn, caller must hold the shard lock and must not use c afterwards
+func (s *conntrackShard) release(c *conn) {
+	if len(s.free) < connCacheMax {
+		s.free = append(s.free, c)
+	}
+}
+
+// put stores c for fp, releasing any entry it replaces. Caller must hold the shard lock.
+func (s *conntrackShard) put(fp firewall.Packet, c *conn) {
+	old, ok := s.Conns[fp]
+	if !ok {
+		s.protoCounts[conntrackProto(fp.Protocol)]++
+		s.hosts.add(fp.RemoteIP, 1)
+		s.size.Add(1)
+	} else if old != c {
+		if old.pinned {
+			s.pinned.Add(-1)
+		}
+		s.release(old)
+	}
+	s.Conns[fp] = c
+}
+
+// remove deletes and releases the entry for fp, caller must hold the shard lock and must be done with the entry
+func (s *conntrackShard) remove(fp firewall.Packet) {
+	if c, ok := s.Conns[fp]; ok {
+		s.protoCounts[conntrackProto(fp.Protocol)]--
+		s.hosts.add(fp.RemoteIP, -1)
+		s.size.Add(-1)
+		if c.pinned {
+			s.pinned.Add(-1)
+		}
+		delete(s.Conns, fp)
+		s.release(c)
+	}
+}
+
+// clear removes and releases every entry, caller must hold the shard lock
+func (s *conntrackShard) clear() {
+	for fp, c := range s.Conns {
+		s.hosts.add(fp.RemoteIP, -1)
+		if c.pinned {
+			s.pinned.Add(-1)
+		}
+		s.release(c)
+	}
+	s.size.Add(-int64(len(s.Conns)))
+	s.Conns = make(map[firewall.Packet]*conn)
+	s.protoCounts = [conntrackProtoMax]int{}
+}
+
+// reconcile counts the entries in Conns by protocol and corrects protoCounts if they disagree, returning the counts
+// that were kept before. Caller must hold the shard lock.
+func (s *conntrackShard) reconcile() (kept [conntrackProtoMax]int, ok bool) {
+	var counted [conntrackProtoMax]int
+	for fp := range s.Conns {
+		counted[conntrackProto(fp.Protocol)]++
+	}
+
+	kept = s.protoCounts
+	s.protoCounts = counted
+	for i := range counted {
+		s.size.Add(int64(counted[i] - kept[i]))
+	}
+	return kept, kept == counted
+}
+
+// newFirewallConntrack creates a conntrack with shards rounded up to a power of two, each with a TimerWheel for min
+// and max
+func newFirewallConntrack(shards int, min, max time.Duration) *FirewallConntrack {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+
+	ct := &FirewallConntrack{
+		shards:   make([]*conntrackShard, n),
+		mask:     uint32(n - 1),
+		expected: newConntrackExpectations(),
+	}
+
+	hosts := &conntrackHosts{}
+	pinned := &atomic.Int64{}
+	ct.size = &atomic.Int64{}
+	for i := range ct.shards {
+		ct.shards[i] = &conntrackShard{
+			Conns:      make(map[firewall.Packet]*conn),
+			TimerWheel: NewTimerWheel[firewall.Packet](min, max),
+			hosts:      hosts,
+			pinned:     pinned,
+			size:       ct.size,
+		}
+	}
+
+	return ct
+}
+
+// shard returns the shard that holds fp
+func (ct *FirewallConntrack) shard(fp firewall.Packet) *conntrackShard {
+	if ct.mask == 0 {
+		return ct.shards[0]
+	}
+
+	h := uint32(fp.LocalIP)*0x9e3779b1 ^ uint32(fp.RemoteIP)*0x85ebca77 ^
+		(uint32(fp.LocalPort)<<16|uint32(fp.RemotePort))*0xc2b2ae3d ^ uint32(fp.Protocol)
+	h ^= h >> 16
+	return ct.shards[h&ct.mask]
+}
+
+// raiseHighWater moves highWater up to the current size if it is larger
+func (ct *FirewallConntrack) raiseHighWater() {
+	size := ct.size.Load()
+	for {
+		hw := ct.highWater.Load()
+		if size <= hw || ct.highWater.CompareAndSwap(hw, size) {
+			return
+		}
+	}
+}
+
+// lockAll takes the lock of every shard, in order
+func (ct *FirewallConntrack) lockAll() {
+	for _, s := range ct.shards {
+		s.Lock()
+	}
+}
+
+func (ct *FirewallConntrack) unlockAll() {
+	for _, s := range ct.shards {
+		s.Unlock()
+	}
 }
 
 type FirewallTable struct {
@@ -89,6 +738,35 @@ type FirewallTable struct {
 	UDP      firewallPort
 	ICMP     firewallPort
 	AnyProto firewallPort
+
+	// Rules that carry options, sorted by priority and then in the order they were added. Deny rules and rules with
+	// a priority are only here, plain allow rules with other options are in the port maps above as well.
+	ordered []*orderedRule
+
+	// Rules that are only in the port maps, which can't say which rule matched, kept to name it in debug logs
+	plain []*plainRule
+
+	// Rules with action log, checked before the others but never deciding a packet, see Firewall.logOnlyRules
+	logOnly []*logOnlyRule
+
+	// Some rule matches on ca_name, see Firewall.checkCALookup
+	caNames bool
+
+	// Some rule has an expiry, see startRuleExpiry
+	timed bool
+}
+
+// orderedRule is a single rule that has RuleOptions
+type orderedRule struct {
+	proto uint8
+	ports firewallPort
+	opts  RuleOptions
+
+	// The rule ports was built from, for logging
+	rule portRule
+
+	// See ruleName
+	name string
 }
 
 func newFirewallTable() *FirewallTable {
@@ -113,6 +791,9 @@ type FirewallRule struct {
 	Groups    [][]string
 	CIDR      *cidr.Tree4[struct{}]
 	LocalCIDR *cidr.Tree4[struct{}]
+
+	// MatchAll requires every one of Hosts, Groups, CIDR and LocalCIDR that is set to match, see RuleOptions.MatchAll
+	MatchAll bool
 }
 
 // Even though ports are uint16, int32 maps are faster for lookup
@@ -120,7 +801,8 @@ type FirewallRule struct {
 type firewallPort map[int32]*FirewallCA
 
 // NewFirewall creates a new Firewall object. A TimerWheel is created for you from the provided timeouts.
-func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.Duration, c *cert.NebulaCertificate) *Firewall {
+// Metrics are registered with the provided registry, the global metrics registry is used if nil.
+func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.Duration, c *cert.NebulaCertificate, r metrics.Registry) *Firewall {
 	//TODO: error on 0 duration
 	var min, max time.Duration
 
@@ -139,39 +821,123 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 	}
 
 	localIps := cidr.NewTree4[struct{}]()
+	var selfIps []iputil.VpnIp
 	for _, ip := range c.Details.Ips {
 		localIps.AddCIDR(&net.IPNet{IP: ip.IP, Mask: net.IPMask{255, 255, 255, 255}}, struct{}{})
+		selfIps = append(selfIps, iputil.Ip2VpnIp(ip.IP))
 	}
 
 	for _, n := range c.Details.Subnets {
 		localIps.AddCIDR(n, struct{}{})
 	}
 
-	return &Firewall{
-		Conntrack: &FirewallConntrack{
-			Conns:      make(map[firewall.Packet]*conn),
-			TimerWheel: NewTimerWheel[firewall.Packet](min, max),
-		},
-		InRules:        newFirewallTable(),
-		OutRules:       newFirewallTable(),
-		TCPTimeout:     tcpTimeout,
-		UDPTimeout:     UDPTimeout,
-		DefaultTimeout: defaultTimeout,
-		localIps:       localIps,
-		l:              l,
-
-		metricTCPRTT: metrics.GetOrRegisterHistogram("network.tcp.rtt", nil, metrics.NewExpDecaySample(1028, 0.015)),
+	var tcpTimeouts [tcpStateMax]time.Duration
+	for i := range tcpTimeouts {
+		tcpTimeouts[i] = tcpTimeout
+	}
+
+	fw := &Firewall{
+		tcpTimeouts:      tcpTimeouts,
+		tcpSynTimeout:    tcpTimeout,
+		udpStreamTimeout: UDPTimeout,
+		purgeBudget:      defaultPurgeBudget,
+		maxPinned:        defaultMaxPinned,
+		Conntrack:        newFirewallConntrack(1, min, max),
+		TCPTimeout:       tcpTimeout,
+		UDPTimeout:       UDPTimeout,
+		DefaultTimeout:   defaultTimeout,
+		certificate:      c,
+		selfIps:          selfIps,
+		clock:            systemClock{},
+		rejectICMPRate:   newConnRateLimiter(defaultRejectICMPRate, defaultRejectICMPRate),
+		rejectICMPCode:   iputil.RejectICMPCodePortUnreachable,
+		l:                l,
+
+		metricsRegistry: r,
+
+		metricTCPRTT:                    metrics.GetOrRegisterHistogram("network.tcp.rtt", r, metrics.NewExpDecaySample(1028, 0.015)),
+		metricConntrackFlushed:          metrics.GetOrRegisterCounter("firewall.conntrack.flushed", r),
+		metricConntrackCreated:          metrics.GetOrRegisterCounter("firewall.conntrack.created", r),
+		metricConntrackRefreshed:        metrics.GetOrRegisterCounter("firewall.conntrack.refreshed", r),
+		metricConntrackExpired:          metrics.GetOrRegisterCounter("firewall.conntrack.expired", r),
+		metricConntrackRevalidateFailed: metrics.GetOrRegisterCounter("firewall.conntrack.revalidate_failed", r),
+		metricConntrackLifetimeExceeded: metrics.GetOrRegisterCounter("firewall.conntrack.lifetime_exceeded", r),
+		metricRevalidatedKept:           metrics.GetOrRegisterCounter("firewall.conntrack.revalidated.kept", r),
+		metricRevalidatedDropped:        metrics.GetOrRegisterCounter("firewall.conntrack.revalidated.dropped", r),
+		metricLifetimeTCP:               metrics.GetOrRegisterHistogram("firewall.conntrack.lifetime.tcp", r, metrics.NewExpDecaySample(1028, 0.015)),
+		metricLifetimeUDP:               metrics.GetOrRegisterHistogram("firewall.conntrack.lifetime.udp", r, metrics.NewExpDecaySample(1028, 0.015)),
+		metricLifetimeOther:             metrics.GetOrRegisterHistogram("firewall.conntrack.lifetime.other", r, metrics.NewExpDecaySample(1028, 0.015)),
+		metricImportMalformed:           metrics.GetOrRegisterCounter("firewall.conntrack.import.malformed", r),
+		metricSweepEvicted:              metrics.GetOrRegisterHistogram("firewall.conntrack.sweep.evicted", r, metrics.NewExpDecaySample(1028, 0.015)),
+		metricTCPClosedByRST:            metrics.GetOrRegisterCounter("firewall.conntrack.tcp.closed_by_rst", r),
+		metricTCPHandshakeExpired:       metrics.GetOrRegisterCounter("firewall.conntrack.tcp.handshake_expired", r),
+		metricTCPOutOfWindow:            metrics.GetOrRegisterCounter("firewall.conntrack.tcp.out_of_window", r),
+		metricCALookupFailures:          metrics.GetOrRegisterCounter("firewall.ca_lookup.failures", r),
+		metricConntrackFull:             metrics.GetOrRegisterCounter("firewall.conntrack.full", r),
+		metricEvicted:                   newEvictMetrics(r),
+		metricDroppedConnRate:           metrics.GetOrRegisterCounter("firewall.dropped.conn_rate", r),
+		metricAllowedConntrack:          metrics.GetOrRegisterCounter("firewall.allowed.conntrack", r),
+		metricAllowedRule:               metrics.GetOrRegisterCounter("firewall.allowed.rule", r),
+		metricDroppedCertExpiring:       metrics.GetOrRegisterCounter("firewall.dropped.cert_expiring", r),
+		metricPerHostLimit:              metrics.GetOrRegisterCounter("firewall.conntrack.per_host_limit", r),
 		incomingMetrics: firewallMetrics{
-			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.local_ip", nil),
-			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.incoming.dropped.remote_ip", nil),
-			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", nil),
+			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.local_ip", r),
+			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.incoming.dropped.remote_ip", r),
+			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", r),
+			droppedDenyRule: metrics.GetOrRegisterCounter("firewall.incoming.dropped.deny_rule", r),
+			rejected:        metrics.GetOrRegisterCounter("firewall.incoming.rejected", r),
+
+			droppedNoRuleTCP:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule.tcp", r),
+			droppedNoRuleUDP:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule.udp", r),
+			droppedNoRuleICMP:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule.icmp", r),
+			droppedNoRuleOther: metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule.other", r),
+
+			allowedRelated:  metrics.GetOrRegisterCounter("firewall.incoming.allowed.related", r),
+			allowedExpected: metrics.GetOrRegisterCounter("firewall.incoming.allowed.expected", r),
+			logRuleHits:     metrics.GetOrRegisterCounter("firewall.incoming.log_rule.hits", r),
+
+			rejectICMPSent:    metrics.GetOrRegisterCounter("firewall.incoming.reject.icmp.sent", r),
+			rejectICMPLimited: metrics.GetOrRegisterCounter("firewall.incoming.reject.icmp.rate_limited", r),
 		},
 		outgoingMetrics: firewallMetrics{
-			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.local_ip", nil),
-			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.remote_ip", nil),
-			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule", nil),
+			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.local_ip", r),
+			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.remote_ip", r),
+			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule", r),
+			droppedDenyRule: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.deny_rule", r),
+			rejected:        metrics.GetOrRegisterCounter("firewall.outgoing.rejected", r),
+
+			droppedNoRuleTCP:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule.tcp", r),
+			droppedNoRuleUDP:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule.udp", r),
+			droppedNoRuleICMP:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule.icmp", r),
+			droppedNoRuleOther: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule.other", r),
+
+			allowedRelated:  metrics.GetOrRegisterCounter("firewall.outgoing.allowed.related", r),
+			allowedExpected: metrics.GetOrRegisterCounter("firewall.outgoing.allowed.expected", r),
+			logRuleHits:     metrics.GetOrRegisterCounter("firewall.outgoing.log_rule.hits", r),
+
+			rejectICMPSent:    metrics.GetOrRegisterCounter("firewall.outgoing.reject.icmp.sent", r),
+			rejectICMPLimited: metrics.GetOrRegisterCounter("firewall.outgoing.reject.icmp.rate_limited", r),
 		},
 	}
+	fw.ruleset.Store(&firewallRuleset{in: newFirewallTable(), out: newFirewallTable(), localIps: localIps})
+
+	return fw
+}
+
+// InRules returns the inbound rules in use
+func (f *Firewall) InRules() *FirewallTable {
+	return f.ruleset.Load().in
+}
+
+// OutRules returns the outbound rules in use
+func (f *Firewall) OutRules() *FirewallTable {
+	return f.ruleset.Load().out
+}
+
+// rulesVersion returns the version of the rules in use. It only holds still while a conntrack shard lock is held, the
+// packet path uses the version of the ruleset it loaded.
+func (f *Firewall) rulesVersion() uint16 {
+	return f.ruleset.Load().version
 }
 
 func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *config.C) (*Firewall, error) {
@@ -181,9 +947,137 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		c.GetDuration("firewall.conntrack.udp_timeout", time.Minute*3),
 		c.GetDuration("firewall.conntrack.default_timeout", time.Minute*10),
 		nc,
-		//TODO: max_connections
+		firewallMetricsRegistry(c),
 	)
 
+	if err := addExtraLocalCIDRs(c, fw.ruleset.Load().localIps); err != nil {
+		return nil, err
+	}
+
+	// Spread conntrack over enough shards that routines rarely wait on each other
+	shards := c.GetInt("firewall.conntrack.shards", runtime.GOMAXPROCS(0))
+	if shards < 1 {
+		return nil, fmt.Errorf("firewall.conntrack.shards must be positive")
+	}
+	tw := fw.Conntrack.shards[0].TimerWheel
+	fw.Conntrack = newFirewallConntrack(shards, tw.tickDuration, tw.wheelDuration)
+
+	maxConns := c.GetInt("firewall.conntrack.max_connections", 0)
+	if maxConns < 0 {
+		return nil, fmt.Errorf("firewall.conntrack.max_connections must not be negative")
+	}
+	fw.setMaxConns(maxConns)
+
+	err := fw.loadTCPTimeouts(c)
+	if err != nil {
+		return nil, err
+	}
+	fw.tcpStrict = c.GetBool("firewall.conntrack.tcp_strict", false)
+
+	fw.udpStreamTimeout = c.GetDuration("firewall.conntrack.udp_stream_timeout", time.Minute*30)
+	if fw.udpStreamTimeout <= 0 {
+		return nil, fmt.Errorf("firewall.conntrack.udp_stream_timeout must be positive")
+	}
+	fw.fitTimerWheel(fw.udpStreamTimeout)
+
+	// allow_related is the older name
+	fw.allowRelated = c.GetBool("firewall.conntrack.allow_related_icmp", c.GetBool("firewall.conntrack.allow_related", true))
+	fw.conntrackStateFile = c.GetString("firewall.conntrack.state_file", "")
+	fw.verifyConntrackCounts = c.GetBool("firewall.conntrack.verify_counts", false)
+
+	fw.maxPinned = int64(c.GetInt("firewall.conntrack.max_pinned", defaultMaxPinned))
+	if fw.maxPinned < 0 {
+		return nil, fmt.Errorf("firewall.conntrack.max_pinned must not be negative")
+	}
+
+	if err := fw.loadMaxFlowLifetimes(c); err != nil {
+		return nil, err
+	}
+
+	fw.maxConnsPerHost = int64(c.GetInt("firewall.conntrack.max_connections_per_host", 0))
+	if fw.maxConnsPerHost < 0 {
+		return nil, fmt.Errorf("firewall.conntrack.max_connections_per_host must not be negative")
+	}
+
+	fw.purgeBudget = c.GetInt("firewall.conntrack.purge_budget", defaultPurgeBudget)
+	if fw.purgeBudget < 1 {
+		return nil, fmt.Errorf("firewall.conntrack.purge_budget must be positive")
+	}
+
+	fw.revalidateBudget = c.GetInt("firewall.conntrack.revalidate_budget", 0)
+	if fw.revalidateBudget < 0 {
+		return nil, fmt.Errorf("firewall.conntrack.revalidate_budget must not be negative")
+	}
+
+	fw.conntrackDisabled = !c.GetBool("firewall.conntrack.enabled", true)
+
+	connRate := c.GetInt("firewall.conntrack.new_connection_rate", 0)
+	if connRate < 0 {
+		return nil, fmt.Errorf("firewall.conntrack.new_connection_rate must not be negative")
+	}
+
+	if connRate > 0 {
+		connBurst := c.GetInt("firewall.conntrack.new_connection_burst", connRate)
+		if connBurst < 1 {
+			return nil, fmt.Errorf("firewall.conntrack.new_connection_burst must be positive")
+		}
+		fw.connRate = newConnRateLimiter(connRate, connBurst)
+
+		if fw.conntrackDisabled {
+			l.Warn("firewall.conntrack.new_connection_rate is ignored, conntrack is disabled so there are no new flows to limit")
+		}
+	}
+
+	if c.GetBool("firewall.dry_run", false) {
+		fw.dryRun = newFirewallDryRun(fw.metricsRegistry)
+		l.Warn("Firewall is in dry run, packets that do not pass the rules are logged but not dropped")
+	}
+
+	if err := fw.loadDeniedLog(c); err != nil {
+		return nil, err
+	}
+	fw.loadSpoofedLocalLog(c)
+
+	if err := fw.loadQuarantine(c); err != nil {
+		return nil, err
+	}
+
+	if err := fw.loadHostRTTs(c); err != nil {
+		return nil, err
+	}
+
+	fw.tcpRTTMinInterval = c.GetDuration("firewall.tcp_rtt.min_interval", 0)
+	if fw.tcpRTTMinInterval < 0 {
+		return nil, fmt.Errorf("firewall.tcp_rtt.min_interval must not be negative")
+	}
+
+	fw.minCertRemaining = c.GetDuration("firewall.min_cert_remaining", 0)
+	if fw.minCertRemaining < 0 {
+		return nil, fmt.Errorf("firewall.min_cert_remaining must not be negative")
+	}
+
+	fw.revalidateOnReload = c.GetBool("firewall.conntrack.revalidate_on_reload", false)
+	fw.logRevalidationDrops = c.GetBool("firewall.conntrack.log_revalidation_drops", false)
+
+	revalidateOverflow := c.GetString("firewall.conntrack.revalidate_overflow", "pass")
+	switch revalidateOverflow {
+	case "pass":
+		fw.revalidateOverflowDrop = false
+	case "drop":
+		fw.revalidateOverflowDrop = true
+	default:
+		l.WithField("action", revalidateOverflow).Warn("invalid firewall.conntrack.revalidate_overflow, defaulting to `pass`")
+		fw.revalidateOverflowDrop = false
+	}
+
+	if err := fw.loadRejectICMPRate(c); err != nil {
+		return nil, err
+	}
+
+	if err := fw.loadRejectICMPCode(c); err != nil {
+		return nil, err
+	}
+
 	inboundAction := c.GetString("firewall.inbound_action", "drop")
 	switch inboundAction {
 	case "reject":
@@ -206,135 +1100,581 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		fw.OutSendReject = false
 	}
 
-	err := AddFirewallRulesFromConfig(l, false, c, fw)
+	err = loadFirewallRules(l, c, fw)
 	if err != nil {
 		return nil, err
 	}
 
-	err = AddFirewallRulesFromConfig(l, true, c, fw)
+	// Replies are not let through by conntrack, they need rules of their own
+	if fw.conntrackDisabled {
+		if fw.InRules().empty() != fw.OutRules().empty() {
+			l.Warn("Conntrack is disabled but only one direction has firewall rules, replies to the flows it allows will be dropped")
+		} else {
+			l.Info("Conntrack is disabled, every packet is checked against the firewall rules")
+		}
+	}
+
+	// Rule timeouts can be shorter than any protocol timeout
+	for _, ft := range []*FirewallTable{fw.InRules(), fw.OutRules()} {
+		fw.fitTimerWheel(ft.conntrackTimeouts()...)
+	}
+
+	// Last so nothing is left running if the config is rejected
+	fw.flowExporter, err = newFlowExporterFromConfig(l, c, fw.metricsRegistry)
 	if err != nil {
 		return nil, err
 	}
 
+	// Enabled after the rules from config are loaded, AddRule only records rules added at runtime
+	fw.auditLog = newFirewallAuditLog(l, c.GetString("firewall.audit_log", ""))
+
 	return fw, nil
 }
 
-// AddRule properly creates the in memory rule structure for a firewall table.
-func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error {
-	// Under gomobile, stringing a nil pointer with fmt causes an abort in debug mode for iOS
-	// https://github.com/golang/go/issues/14131
-	sIp := ""
-	if ip != nil {
-		sIp = ip.String()
-	}
-	lIp := ""
-	if localIp != nil {
-		lIp = localIp.String()
+// addExtraLocalCIDRs adds firewall.extra_local_cidrs to localIps.
+// These are destinations we route for that are not covered by our certificate, such as unsafe_routes. Packets for these
+// are dropped as ErrInvalidLocalIP unless listed here, rules can then filter them further with local_cidr.
+func addExtraLocalCIDRs(c *config.C, localIps *cidr.Tree4[struct{}]) error {
+	for i, s := range c.GetStringSlice("firewall.extra_local_cidrs", []string{}) {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("firewall.extra_local_cidrs entry #%v; %s did not parse; %s", i, s, err)
+		}
+		localIps.AddCIDR(n, struct{}{})
 	}
 
+	return nil
+}
+
+// fitTimerWheel replaces the conntrack timer wheel if it can not precisely handle all of timeouts. This must be called
+// before conntrack has any entries.
+func (f *Firewall) fitTimerWheel(timeouts ...time.Duration) {
+	tw := f.Conntrack.shards[0].TimerWheel
+	min, max := timerWheelBounds(tw, timeouts...)
+	if min != tw.tickDuration || max != tw.wheelDuration {
+		f.Conntrack = newFirewallConntrack(len(f.Conntrack.shards), min, max)
+	}
+}
+
+// timerWheelBounds returns the tick and wheel durations needed to precisely handle what tw does and all of timeouts
+func timerWheelBounds(tw *TimerWheel[firewall.Packet], timeouts ...time.Duration) (min, max time.Duration) {
+	min, max = tw.tickDuration, tw.wheelDuration
+	for _, t := range timeouts {
+		if t < min {
+			min = t
+		}
+		if t > max {
+			max = t
+		}
+	}
+
+	return min, max
+}
+
+// refitTimerWheels gives every shard a new timer wheel with min and max as its tick and wheel durations, unless it
+// already has them. Each entry is added back for the time it has left. Returns true if the timer wheels were replaced.
+// Caller must hold every conntrack shard lock.
+func (ct *FirewallConntrack) refitTimerWheels(now time.Time, min, max time.Duration) bool {
+	tw := ct.shards[0].TimerWheel
+	if min == tw.tickDuration && max == tw.wheelDuration {
+		return false
+	}
+
+	for _, s := range ct.shards {
+		tw := NewTimerWheel[firewall.Packet](min, max)
+		tw.Advance(now)
+		for fp, c := range s.Conns {
+			tw.Add(fp, c.Expires.Sub(now))
+		}
+		s.TimerWheel = tw
+	}
+
+	return true
+}
+
+// conntrackTimeouts returns the conntrack_timeout of every rule in ft that has one
+func (ft *FirewallTable) conntrackTimeouts() []time.Duration {
+	var timeouts []time.Duration
+	for _, or := range ft.ordered {
+		if or.opts.ConntrackTimeout != 0 {
+			timeouts = append(timeouts, or.opts.ConntrackTimeout)
+		}
+	}
+
+	return timeouts
+}
+
+// AddRule properly creates the in memory rule structure for a firewall table.
+func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error {
+	return f.AddRuleWithOptions(incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha, RuleOptions{})
+}
+
+// AddRuleWithOptions is AddRule for a rule that carries RuleOptions.
+func (f *Firewall) AddRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, opts RuleOptions) error {
+	return f.AddRulePrefix(incoming, proto, startPort, endPort, groups, host, iputil.IPNet2Prefix(ip), iputil.IPNet2Prefix(localIp), caName, caSha, opts)
+}
+
+// AddRulePrefix is AddRuleWithOptions with the cidrs as netip.Prefix, a zero Prefix is no cidr.
+func (f *Firewall) AddRulePrefix(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip netip.Prefix, localIp netip.Prefix, caName string, caSha string, opts RuleOptions) error {
+	r := portRule{startPort: startPort, endPort: endPort, groups: groups, host: host, ip: ip, localIp: localIp, caName: caName, caSha: caSha}
+
 	// We need this rule string because we generate a hash. Removing this will break firewall reload.
+	ruleString := f.logRule(incoming, proto, r, opts)
+	if err := checkRuleDirection(incoming, opts); err != nil {
+		return err
+	}
+
+	f.rulesLock.Lock()
+	oldRules := f.rules
+	f.rules += ruleString + "\n"
+	rules := f.rules
+	f.rulesLock.Unlock()
+
+	if err := f.ruleset.Load().table(incoming).addRule(proto, r, opts, ruleName(opts, ruleString)); err != nil {
+		return err
+	}
+
+	f.auditLog.Record(auditTriggerAddRule, oldRules, rules, f.rulesVersion())
+	return nil
+}
+
+// logRule logs that a rule is being added and returns the string it adds to the rule hashes
+func (f *Firewall) logRule(incoming bool, proto uint8, r portRule, opts RuleOptions) string {
+	// Under gomobile, stringing a nil pointer with fmt causes an abort in debug mode for iOS
+	// https://github.com/golang/go/issues/14131
+	sIp := ""
+	if r.ip.IsValid() {
+		sIp = r.ip.String()
+	}
+	lIp := ""
+	if r.localIp.IsValid() {
+		lIp = r.localIp.String()
+	}
+
 	ruleString := fmt.Sprintf(
 		"incoming: %v, proto: %v, startPort: %v, endPort: %v, groups: %v, host: %v, ip: %v, localIp: %v, caName: %v, caSha: %s",
-		incoming, proto, startPort, endPort, groups, host, sIp, lIp, caName, caSha,
-	)
-	f.rules += ruleString + "\n"
+		incoming, proto, r.startPort, r.endPort, r.groups, r.host, sIp, lIp, r.caName, r.caSha,
+	) + opts.ruleString()
+
+	fields := ruleFields(incoming, proto, r, opts)
+	if opts.LogOnly {
+		f.l.WithField("firewallRule", fields).Info("Firewall log only rule added, it is not enforced")
+	} else {
+		f.l.WithField("firewallRule", fields).Info("Firewall rule added")
+	}
+
+	return ruleString
+}
 
+// ruleFields returns the fields to log a rule with, the same ones as its rule string
+func ruleFields(incoming bool, proto uint8, r portRule, opts RuleOptions) m {
 	direction := "incoming"
 	if !incoming {
 		direction = "outgoing"
 	}
-	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha}).
-		Info("Firewall rule added")
 
-	var (
-		ft *FirewallTable
-		fp firewallPort
-	)
+	// See logRule for why the cidrs are not left to fmt
+	sIp := ""
+	if r.ip.IsValid() {
+		sIp = r.ip.String()
+	}
+	lIp := ""
+	if r.localIp.IsValid() {
+		lIp = r.localIp.String()
+	}
 
-	if incoming {
-		ft = f.InRules
+	fields := m{"direction": direction, "proto": proto, "startPort": r.startPort, "endPort": r.endPort, "groups": r.groups, "host": r.host, "ip": sIp, "localIp": lIp, "caName": r.caName, "caSha": r.caSha}
+	for _, opt := range opts.list() {
+		fields[opt.key] = opt.value
+	}
+
+	return fields
+}
+
+// addRule checks a rule and adds it to the table under name
+func (ft *FirewallTable) addRule(proto uint8, r portRule, opts RuleOptions, name string) error {
+	if err := checkRule(proto, r, opts); err != nil {
+		return err
+	}
+	if r.caName != "" {
+		ft.caNames = true
+	}
+	if !opts.Expires.IsZero() {
+		ft.timed = true
+	}
+
+	// Log only rules never decide a packet, they are kept apart from the rules that do
+	if opts.LogOnly {
+		or := &orderedRule{proto: proto, ports: orderedPorts(r, opts, 1), opts: opts, rule: r, name: name}
+		ft.logOnly = append(ft.logOnly, &logOnlyRule{orderedRule: or})
+		return nil
+	}
+
+	// The port maps are all evaluated together at the default priority, so they can only hold plain allow rules
+	if opts.inPortMaps() {
+		if err := ft.ports(proto).addRule(r.startPort, r.endPort, r.groups, r.host, r.ip, r.localIp, r.caName, r.caSha); err != nil {
+			return err
+		}
+	}
+
+	if !opts.plain() {
+		or := &orderedRule{proto: proto, ports: orderedPorts(r, opts, 1), opts: opts, rule: r, name: name}
+		ft.addOrdered(or)
 	} else {
-		ft = f.OutRules
+		ft.plain = append(ft.plain, newPlainRule(proto, r, name))
 	}
 
+	return nil
+}
+
+// empty returns true if no rule that decides packets was added to the table, log only rules don't count
+func (ft *FirewallTable) empty() bool {
+	return len(ft.ordered) == 0 && len(ft.plain) == 0
+}
+
+// ports returns the port map for proto, which checkRule must have accepted
+func (ft *FirewallTable) ports(proto uint8) firewallPort {
 	switch proto {
 	case firewall.ProtoTCP:
-		fp = ft.TCP
+		return ft.TCP
 	case firewall.ProtoUDP:
-		fp = ft.UDP
+		return ft.UDP
 	case firewall.ProtoICMP:
-		fp = ft.ICMP
-	case firewall.ProtoAny:
-		fp = ft.AnyProto
+		return ft.ICMP
+	default:
+		return ft.AnyProto
+	}
+}
+
+// checkRule returns an error if a rule can not be added to a FirewallTable
+func checkRule(proto uint8, r portRule, opts RuleOptions) error {
+	switch proto {
+	case firewall.ProtoTCP, firewall.ProtoUDP, firewall.ProtoICMP, firewall.ProtoAny:
 	default:
 		return fmt.Errorf("unknown protocol %v", proto)
 	}
 
-	return fp.addRule(startPort, endPort, groups, host, ip, localIp, caName, caSha)
+	if r.startPort > r.endPort {
+		return fmt.Errorf("start port was lower than end port")
+	}
+
+	if opts.ConntrackTimeout != 0 && proto != firewall.ProtoUDP {
+		return fmt.Errorf("conntrack timeout is only supported for udp rules")
+	}
+
+	if opts.ConntrackTimeout != 0 && opts.Deny {
+		return fmt.Errorf("conntrack timeout is not supported for deny rules")
+	}
+
+	if (opts.Reject || opts.NoReject) && !opts.Deny {
+		return fmt.Errorf("reject is only supported for deny rules")
+	}
+
+	if opts.Reject && opts.NoReject {
+		return fmt.Errorf("a rule can not both reject and not reject")
+	}
+
+	if opts.LogOnly && (opts.Deny || opts.ConntrackTimeout != 0) {
+		return fmt.Errorf("log only rules can not deny or set a conntrack timeout")
+	}
+
+	if opts.ICMPID != nil && proto != firewall.ProtoICMP {
+		return fmt.Errorf("icmp id is only supported for icmp rules")
+	}
+
+	if opts.MinLen < 0 || opts.MaxLen < 0 {
+		return fmt.Errorf("packet length bounds must not be negative")
+	}
+
+	if opts.MaxLen != 0 && opts.MinLen > opts.MaxLen {
+		return fmt.Errorf("min length is greater than max length")
+	}
+
+	if opts.TCPFlagsMask != 0 && proto != firewall.ProtoTCP {
+		return fmt.Errorf("tcp flags are only supported for tcp rules")
+	}
+
+	if opts.TCPFlags&^opts.TCPFlagsMask != 0 {
+		return fmt.Errorf("tcp flags are not all in the tcp flags mask")
+	}
+
+	if opts.Origin > OriginForwarded {
+		return fmt.Errorf("unknown origin %v", opts.Origin)
+	}
+
+	if opts.SourcePortStart != 0 || opts.SourcePortEnd != 0 {
+		if proto != firewall.ProtoTCP && proto != firewall.ProtoUDP {
+			return fmt.Errorf("source port is only supported for tcp and udp rules")
+		}
+
+		if opts.SourcePortStart < 1 || opts.SourcePortEnd > 65535 || opts.SourcePortStart > opts.SourcePortEnd {
+			return fmt.Errorf("source port range %v-%v is not valid", opts.SourcePortStart, opts.SourcePortEnd)
+		}
+	}
+
+	return nil
+}
+
+// getRules returns the rule strings that make up the hashes, it is safe to call while rules are being changed
+func (f *Firewall) getRules() string {
+	f.rulesLock.RLock()
+	defer f.rulesLock.RUnlock()
+	return f.rules
 }
 
 // GetRuleHash returns a hash representation of all inbound and outbound rules
 func (f *Firewall) GetRuleHash() string {
-	sum := sha256.Sum256([]byte(f.rules))
+	return ruleHash(f.getRules())
+}
+
+func ruleHash(rules string) string {
+	sum := sha256.Sum256([]byte(rules))
 	return hex.EncodeToString(sum[:])
 }
 
 // GetRuleHashFNV returns a uint32 FNV-1 hash representation the rules, for use as a metric value
 func (f *Firewall) GetRuleHashFNV() uint32 {
+	return ruleHashFNV(f.getRules())
+}
+
+func ruleHashFNV(rules string) uint32 {
 	h := fnv.New32a()
-	h.Write([]byte(f.rules))
+	h.Write([]byte(rules))
 	return h.Sum32()
 }
 
 // GetRuleHashes returns both the sha256 and FNV-1 hashes, suitable for logging
 func (f *Firewall) GetRuleHashes() string {
-	return "SHA:" + f.GetRuleHash() + ",FNV:" + strconv.FormatUint(uint64(f.GetRuleHashFNV()), 10)
+	// Both hashes must describe the same rules
+	rules := f.getRules()
+	return "SHA:" + ruleHash(rules) + ",FNV:" + strconv.FormatUint(uint64(ruleHashFNV(rules)), 10)
 }
 
-func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw FirewallInterface) error {
-	var table string
-	if inbound {
-		table = "firewall.inbound"
-	} else {
-		table = "firewall.outbound"
+// RuleSnapshot is a point in time capture of a compiled ruleset, see SnapshotRules and RestoreRules
+type RuleSnapshot struct {
+	inRules  *FirewallTable
+	outRules *FirewallTable
+	rules    string
+}
+
+// SnapshotRules captures the currently installed ruleset so it can be put back in place later with RestoreRules.
+// The rule tables are shared with the firewall rather than copied, they are not modified once rules are loaded.
+func (f *Firewall) SnapshotRules() *RuleSnapshot {
+	conntrack := f.Conntrack
+	conntrack.lockAll()
+	defer conntrack.unlockAll()
+
+	return &RuleSnapshot{
+		inRules:  f.InRules(),
+		outRules: f.OutRules(),
+		rules:    f.getRules(),
 	}
+}
 
-	r := c.Get(table)
-	if r == nil {
-		return nil
+// RestoreRules installs a ruleset previously captured with SnapshotRules. Just like a reload the rulesVersion is bumped
+// so existing conntrack entries are revalidated against the restored ruleset.
+func (f *Firewall) RestoreRules(s *RuleSnapshot) {
+	oldRules, oldHashes, rulesVersion := f.swapRules(s.inRules, s.outRules, s.rules, nil)
+
+	f.auditLog.Record(auditTriggerRestore, oldRules, s.rules, rulesVersion)
+	f.l.WithField("firewallHashes", f.GetRuleHashes()).
+		WithField("oldFirewallHashes", oldHashes).
+		WithField("rulesVersion", rulesVersion).
+		Info("Firewall rules have been restored")
+}
+
+// Reload replaces the rules and extra local cidrs with the ones in c and bumps the rulesVersion, so existing conntrack
+// entries are revalidated against the new rules. Nothing is changed if c is rejected. The rest of the firewall, such as
+// conntrack and its timeouts, is left as it is, a firewall from NewFirewallFromConfig is needed to change those. The
+// conntrack timer wheels are widened for the conntrack_timeout of any new rule but never narrowed.
+func (f *Firewall) Reload(c *config.C) error {
+	// Everything is loaded into a scratch firewall first so a bad rule leaves us untouched
+	nf := NewFirewall(f.l, f.TCPTimeout, f.UDPTimeout, f.DefaultTimeout, f.certificate, f.metricsRegistry)
+	if err := addExtraLocalCIDRs(c, nf.ruleset.Load().localIps); err != nil {
+		return err
 	}
 
-	rs, ok := r.([]interface{})
-	if !ok {
-		return fmt.Errorf("%s failed to parse, should be an array of rules", table)
+	if err := loadFirewallRules(f.l, c, nf); err != nil {
+		return err
+	}
+
+	newRules := nf.ruleset.Load()
+	rules := nf.getRules()
+	f.ruleFiles = nf.ruleFiles
+	oldRules, oldHashes, rulesVersion := f.swapRules(newRules.in, newRules.out, rules, newRules.localIps)
+	f.startRuleExpiry()
+
+	f.auditLog.Record(auditTriggerReload, oldRules, rules, rulesVersion)
+	f.l.WithField("firewallHashes", f.GetRuleHashes()).
+		WithField("oldFirewallHashes", oldHashes).
+		WithField("rulesVersion", rulesVersion).
+		Info("Firewall rules have been reloaded")
+
+	return nil
+}
+
+// swapRules installs a new ruleset and bumps the rulesVersion with every conntrack shard locked, returning what was
+// installed before and the new rulesVersion. localIps is left as it is if nil.
+func (f *Firewall) swapRules(inRules, outRules *FirewallTable, rules string, localIps *cidr.Tree4[struct{}]) (oldRules, oldHashes string, rulesVersion uint16) {
+	conntrack := f.Conntrack
+	conntrack.lockAll()
+
+	oldRules = f.getRules()
+	oldHashes = f.GetRuleHashes()
+	old := f.ruleset.Load()
+	if localIps == nil {
+		localIps = old.localIps
+	}
+	f.ruleset.Store(&firewallRuleset{in: inRules, out: outRules, localIps: localIps, version: old.version})
+	f.rulesLock.Lock()
+	f.rules = rules
+	f.rulesLock.Unlock()
+	rulesVersion = f.bumpRulesVersion(oldHashes)
+
+	// A conntrack_timeout of the new rules may need a shorter tick or a longer wheel than conntrack has
+	tw := conntrack.shards[0].TimerWheel
+	min, max := timerWheelBounds(tw, append(inRules.conntrackTimeouts(), outRules.conntrackTimeouts()...)...)
+	refit := conntrack.refitTimerWheels(f.clock.Now(), min, max)
+	conntrack.unlockAll()
+
+	if refit {
+		f.resetConntrackSweeper(min)
+	}
+
+	return oldRules, oldHashes, rulesVersion
+}
+
+// bumpRulesVersion moves to the next rulesVersion so every conntrack entry is revalidated and returns it, oldHashes
+// are the rule hashes before the change for the log. Caller must hold every conntrack shard lock.
+func (f *Firewall) bumpRulesVersion(oldHashes string) uint16 {
+	rs := *f.ruleset.Load()
+	rs.version++
+	f.ruleset.Store(&rs)
+
+	// If rulesVersion is back to zero, we have wrapped all the way around. Be
+	// safe and just reset conntrack in this case.
+	if rs.version == 0 {
+		f.l.WithField("firewallHashes", f.GetRuleHashes()).
+			WithField("oldFirewallHashes", oldHashes).
+			WithField("rulesVersion", rs.version).
+			Warn("firewall rulesVersion has overflowed, resetting conntrack")
+		for _, s := range f.Conntrack.shards {
+			for fp, c := range s.Conns {
+				f.exportFlow(fp, c)
+			}
+			s.clear()
+		}
+	}
+
+	return rs.version
+}
+
+// InheritConntrack takes over conntrack from the previous firewall, this must be called before f starts seeing packets.
+// rulesVersion carries on from previous so inherited entries are revalidated against our rules on their next packet.
+// Routines still using previous during the swap share the same conntrack, entries they add are stamped with the older
+// rulesVersion and revalidated the same way.
+func (f *Firewall) InheritConntrack(previous *Firewall) {
+	// A revalidation still running for previous would stamp entries with its older rulesVersion
+	previous.stopConntrackRevalidation()
+
+	conntrack := previous.Conntrack
+	conntrack.lockAll()
+	defer conntrack.unlockAll()
+
+	rs := *f.ruleset.Load()
+	rs.version = previous.rulesVersion() + 1
+	f.ruleset.Store(&rs)
+	// If rulesVersion is back to zero, we have wrapped all the way around. Be
+	// safe and just start with an empty conntrack in this case.
+	if rs.version == 0 {
+		f.l.WithField("firewallHashes", f.GetRuleHashes()).
+			WithField("oldFirewallHashes", previous.GetRuleHashes()).
+			WithField("rulesVersion", rs.version).
+			Warn("firewall rulesVersion has overflowed, resetting conntrack")
+		return
 	}
 
-	for i, t := range rs {
-		var groups []string
-		r, err := convertRule(l, t, table, i)
+	// The timer wheels of previous were fit to its timeouts, ours may need a shorter tick or a longer wheel
+	tw := f.Conntrack.shards[0].TimerWheel
+	conntrack.refitTimerWheels(f.clock.Now(), tw.tickDuration, tw.wheelDuration)
+
+	f.Conntrack = conntrack
+	// The inherited conntrack keeps the shards it was built with, our cap is spread over those
+	f.setMaxConns(f.maxConns)
+}
+
+// RuleConfigError is returned by AddFirewallRulesFromConfig for a rule that could not be loaded, so tools can point at
+// the offending rule and field. Error formats it as "<table> rule #<index>; <error>".
+type RuleConfigError struct {
+	// Table is firewall.inbound or firewall.outbound, or for a rule from a rule file firewall.inbound_file or
+	// firewall.outbound_file followed by the path of the file
+	Table string
+	// Index is the position of the rule in Table, starting at 0
+	Index int
+	// Field is the config key of the rule that is wrong, empty when no single field is to blame
+	Field string
+	Err   error
+}
+
+// newRuleConfigError returns a RuleConfigError for field of rule i in table, Err is formatted like fmt.Errorf
+func newRuleConfigError(table string, i int, field string, format string, a ...interface{}) error {
+	return &RuleConfigError{Table: table, Index: i, Field: field, Err: fmt.Errorf(format, a...)}
+}
+
+func (e *RuleConfigError) Error() string {
+	return fmt.Sprintf("%s rule #%v; %s", e.Table, e.Index, e.Err)
+}
+
+func (e *RuleConfigError) Unwrap() error {
+	return e.Err
+}
+
+func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw FirewallInterface) error {
+	key := "firewall.outbound"
+	if inbound {
+		key = "firewall.inbound"
+	}
+
+	rs, err := configRules(c, key)
+	if err != nil {
+		return err
+	}
+
+	lint := make([]lintRule, 0, len(rs))
+	for _, cr := range rs {
+		table, i := cr.table, cr.index
+		var groups [][]string
+		r, err := convertRule(l, cr.rule, table, i)
 		if err != nil {
-			return fmt.Errorf("%s rule #%v; %s", table, i, err)
+			return &RuleConfigError{Table: table, Index: i, Err: err}
 		}
 
 		if r.Code != "" && r.Port != "" {
-			return fmt.Errorf("%s rule #%v; only one of port or code should be provided", table, i)
+			return newRuleConfigError(table, i, "code", "only one of port or code should be provided")
 		}
 
-		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
-			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided", table, i)
+		if r.Host == "" && len(r.Groups) == 0 && len(r.GroupSets) == 0 && r.Group == "" && r.Cidr == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
+			return newRuleConfigError(table, i, "", "at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided")
 		}
 
-		if len(r.Groups) > 0 {
-			groups = r.Groups
+		// Each set of groups is added as a rule of its own, rules are OR'd just like the sets
+		if len(r.GroupSets) > 0 {
+			groups = r.GroupSets
+		} else if len(r.Groups) > 0 {
+			groups = [][]string{r.Groups}
 		}
 
 		if r.Group != "" {
 			// Check if we have both groups and group provided in the rule config
 			if len(groups) > 0 {
-				return fmt.Errorf("%s rule #%v; only one of group or groups should be defined, both provided", table, i)
+				return newRuleConfigError(table, i, "groups", "only one of group or groups should be defined, both provided")
 			}
 
-			groups = []string{r.Group}
+			groups = [][]string{{r.Group}}
+		}
+
+		if len(groups) == 0 {
+			groups = [][]string{nil}
 		}
 
 		var sPort, errPort string
@@ -348,28 +1688,29 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 
 		startPort, endPort, err := parsePort(sPort)
 		if err != nil {
-			return fmt.Errorf("%s rule #%v; %s %s", table, i, errPort, err)
+			return newRuleConfigError(table, i, errPort, "%s %w", errPort, err)
 		}
 
-		var proto uint8
-		switch r.Proto {
-		case "any":
-			proto = firewall.ProtoAny
-		case "tcp":
-			proto = firewall.ProtoTCP
-		case "udp":
-			proto = firewall.ProtoUDP
-		case "icmp":
-			proto = firewall.ProtoICMP
-		default:
-			return fmt.Errorf("%s rule #%v; proto was not understood; `%s`", table, i, r.Proto)
+		protos, err := parseProtos(r.Protos)
+		if err != nil {
+			return newRuleConfigError(table, i, "proto", "%w", err)
+		}
+
+		// Code and port share the same matching, a mismatch with proto is allowed but likely not what was intended
+		for _, proto := range protos {
+			switch {
+			case r.Code != "" && (proto == firewall.ProtoTCP || proto == firewall.ProtoUDP):
+				l.Warnf("%s rule #%v; code is only meaningful for icmp, it will be matched as a %s port", table, i, firewall.ProtoName(proto))
+			case r.Port != "" && proto == firewall.ProtoICMP && startPort != firewall.PortAny && startPort != firewall.PortFragment:
+				l.Warnf("%s rule #%v; port is not meaningful for icmp, this rule can only match with port `any`", table, i)
+			}
 		}
 
 		var cidr *net.IPNet
 		if r.Cidr != "" {
 			_, cidr, err = net.ParseCIDR(r.Cidr)
 			if err != nil {
-				return fmt.Errorf("%s rule #%v; cidr did not parse; %s", table, i, err)
+				return newRuleConfigError(table, i, "cidr", "cidr did not parse; %w", err)
 			}
 		}
 
@@ -377,231 +1718,1275 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 		if r.LocalCidr != "" {
 			_, localCidr, err = net.ParseCIDR(r.LocalCidr)
 			if err != nil {
-				return fmt.Errorf("%s rule #%v; local_cidr did not parse; %s", table, i, err)
+				return newRuleConfigError(table, i, "local_cidr", "local_cidr did not parse; %w", err)
 			}
 		}
 
-		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
-		if err != nil {
-			return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
+		var opts RuleOptions
+
+		// host: self is not a certificate name, it is matched by the signature of our own certificate
+		host := r.Host
+		if host == hostSelf {
+			host = ""
+			opts.SelfPeer = true
 		}
-	}
 
-	return nil
-}
+		switch r.Action {
+		case "", "allow":
+		case "deny":
+			opts.Deny = true
+		case "reject":
+			opts.Deny = true
+			opts.Reject = true
+		case "drop":
+			opts.Deny = true
+			opts.NoReject = true
+		case "log":
+			opts.LogOnly = true
+		default:
+			return newRuleConfigError(table, i, "action", "action was not understood; `%s`", r.Action)
+		}
 
-var ErrInvalidRemoteIP = errors.New("remote IP is not in remote certificate subnets")
-var ErrInvalidLocalIP = errors.New("local IP is not in list of handled local IPs")
-var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
+		switch r.Reject {
+		case "", "false":
+		case "true":
+			if !opts.Deny {
+				return newRuleConfigError(table, i, "reject", "reject is only supported with action deny")
+			}
+			if opts.NoReject {
+				return newRuleConfigError(table, i, "reject", "reject can not be true with action drop")
+			}
+			opts.Reject = true
+		default:
+			return newRuleConfigError(table, i, "reject", "reject was not understood; `%s`", r.Reject)
+		}
+
+		if r.Priority != "" {
+			opts.Priority, err = strconv.Atoi(r.Priority)
+			if err != nil {
+				return newRuleConfigError(table, i, "priority", "priority did not parse; %w", err)
+			}
+		}
+
+		if r.ICMPID != "" {
+			if !onlyProtos(protos, firewall.ProtoICMP) {
+				return newRuleConfigError(table, i, "icmp_id", "icmp_id is only supported with proto icmp")
+			}
+
+			id, err := strconv.ParseUint(r.ICMPID, 10, 16)
+			if err != nil {
+				return newRuleConfigError(table, i, "icmp_id", "icmp_id did not parse; %w", err)
+			}
+			icmpID := uint16(id)
+			opts.ICMPID = &icmpID
+		}
+
+		if r.MinLen != "" {
+			opts.MinLen, err = strconv.Atoi(r.MinLen)
+			if err != nil {
+				return newRuleConfigError(table, i, "min_len", "min_len did not parse; %w", err)
+			}
+
+			if opts.MinLen <= 0 {
+				return newRuleConfigError(table, i, "min_len", "min_len must be positive")
+			}
+		}
+
+		if r.MaxLen != "" {
+			opts.MaxLen, err = strconv.Atoi(r.MaxLen)
+			if err != nil {
+				return newRuleConfigError(table, i, "max_len", "max_len did not parse; %w", err)
+			}
+
+			if opts.MaxLen <= 0 {
+				return newRuleConfigError(table, i, "max_len", "max_len must be positive")
+			}
+
+			if opts.MinLen > opts.MaxLen {
+				return newRuleConfigError(table, i, "max_len", "min_len is greater than max_len")
+			}
+		}
+
+		if r.TCPFlags != "" {
+			if !onlyProtos(protos, firewall.ProtoTCP) {
+				return newRuleConfigError(table, i, "tcp_flags", "tcp_flags is only supported with proto tcp")
+			}
+
+			opts.TCPFlags, opts.TCPFlagsMask, err = parseTCPFlags(r.TCPFlags)
+			if err != nil {
+				return newRuleConfigError(table, i, "tcp_flags", "tcp_flags did not parse; %w", err)
+			}
+		}
+
+		if r.Origin != "" {
+			opts.Origin, err = parseRuleOrigin(r.Origin)
+			if err != nil {
+				return newRuleConfigError(table, i, "origin", "origin was not understood; %w", err)
+			}
+		}
+
+		if r.Expires != "" {
+			opts.Expires, err = parseRuleExpires(r.Expires, time.Now())
+			if err != nil {
+				return newRuleConfigError(table, i, "expires", "expires was not understood; %w", err)
+			}
+		}
+
+		opts.Name = r.Name
+
+		switch r.MatchAll {
+		case "", "false":
+		case "true":
+			opts.MatchAll = true
+		default:
+			return newRuleConfigError(table, i, "match_all", "match_all was not understood; `%s`", r.MatchAll)
+		}
+
+		if r.UnderlayCidr != "" {
+			if !inbound {
+				return newRuleConfigError(table, i, "underlay_cidr", "underlay_cidr is only supported for inbound rules")
+			}
+
+			_, underlay, err := net.ParseCIDR(r.UnderlayCidr)
+			if err != nil {
+				return newRuleConfigError(table, i, "underlay_cidr", "underlay_cidr did not parse; %w", err)
+			}
+			opts.UnderlayCIDR = iputil.IPNet2Prefix(underlay)
+		}
+
+		if r.SourcePort != "" && r.SourcePort != "any" {
+			if !onlyProtos(protos, firewall.ProtoTCP, firewall.ProtoUDP) {
+				return newRuleConfigError(table, i, "source_port", "source_port is only supported with proto tcp or udp")
+			}
+
+			if r.SourcePort == "fragment" {
+				return newRuleConfigError(table, i, "source_port", "source_port can not be fragment")
+			}
+
+			opts.SourcePortStart, opts.SourcePortEnd, err = parsePort(r.SourcePort)
+			if err != nil {
+				return newRuleConfigError(table, i, "source_port", "source_port %w", err)
+			}
+		}
+
+		if r.ConntrackTimeout != "" {
+			if !onlyProtos(protos, firewall.ProtoUDP) {
+				return newRuleConfigError(table, i, "conntrack_timeout", "conntrack_timeout is only supported with proto udp")
+			}
+
+			opts.ConntrackTimeout, err = time.ParseDuration(r.ConntrackTimeout)
+			if err != nil {
+				return newRuleConfigError(table, i, "conntrack_timeout", "conntrack_timeout did not parse; %w", err)
+			}
+
+			if opts.ConntrackTimeout <= 0 {
+				return newRuleConfigError(table, i, "conntrack_timeout", "conntrack_timeout must be positive")
+			}
+		}
+
+		for _, proto := range protos {
+			for _, g := range groups {
+				err = fw.AddRuleWithOptions(inbound, proto, startPort, endPort, g, host, cidr, localCidr, r.CAName, r.CASha, opts)
+				if err != nil {
+					return newRuleConfigError(table, i, "", "`%w`", err)
+				}
+
+				lint = append(lint, lintRule{
+					table:     table,
+					index:     i,
+					proto:     proto,
+					startPort: startPort,
+					endPort:   endPort,
+					groups:    g,
+					host:      host,
+					cidr:      iputil.IPNet2Prefix(cidr),
+					localCidr: iputil.IPNet2Prefix(localCidr),
+					caName:    r.CAName,
+					caSha:     r.CASha,
+					opts:      opts,
+				})
+			}
+		}
+	}
+
+	lintRules(l, lint)
+	return nil
+}
+
+var ErrInvalidRemoteIP = errors.New("remote IP is not in remote certificate subnets")
+var ErrInvalidLocalIP = errors.New("local IP is not in list of handled local IPs")
+var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
+var ErrRevalidationDeferred = errors.New("conntrack entry is waiting to be revalidated against new rules")
+var ErrDeniedByRule = errors.New("denied by a firewall rule")
+var ErrConnRateExceeded = errors.New("new connection rate exceeded")
+var ErrCertExpiringSoon = errors.New("remote certificate expires sooner than firewall.min_cert_remaining")
+
+// ErrRejectedByRule is returned when the packet was denied by a rule with reject set, a reject should be sent for it
+// regardless of inbound_action or outbound_action. See ShouldReject.
+var ErrRejectedByRule = errors.New("rejected by a firewall rule")
+
+// ErrDroppedByRule is returned when the packet was denied by a rule with action drop, it should be dropped silently
+// regardless of inbound_action or outbound_action. See ShouldReject.
+var ErrDroppedByRule = errors.New("dropped by a firewall rule")
+
+// ShouldReject returns true if a reject should be sent for a packet that Drop returned dropReason for. sendReject is
+// the inbound_action or outbound_action setting, which applies unless the rule that denied the packet says otherwise.
+// Quarantined peers are never sent a reject.
+func ShouldReject(dropReason error, sendReject bool) bool {
+	switch dropReason {
+	case ErrRejectedByRule:
+		return true
+	case ErrDroppedByRule, ErrPeerQuarantined:
+		return false
+	default:
+		return sendReject
+	}
+}
+
+// dropAction names what is done with a packet that Drop returned reason for, `reject` or `drop`, for logs
+func (f *Firewall) dropAction(reason error, incoming bool) string {
+	sendReject := f.OutSendReject
+	if incoming {
+		sendReject = f.InSendReject
+	}
+
+	if ShouldReject(reason, sendReject) {
+		return "reject"
+	}
+	return "drop"
+}
+
+// Drop returns an error if the packet should be dropped, explaining why. It
+// returns nil if the packet should not be dropped. Every drop is passed to DropLogger and the DropHandlers as well.
+// In dry run nil is always returned, packets that would have been dropped are counted and logged instead.
+func (f *Firewall) Drop(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache *firewall.ConntrackCache) error {
+	return f.DropFromUnderlayAddr(packet, fp, incoming, h, caPool, localCache, netip.Addr{})
+}
+
+// DropFromUnderlay is Drop for a packet that arrived on the underlay address underlay, which rules with an
+// underlay_cidr are matched against. A nil underlay is unknown, as for outbound packets, see RuleOptions.UnderlayCIDR.
+func (f *Firewall) DropFromUnderlay(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache *firewall.ConntrackCache, underlay net.IP) error {
+	addr, _ := netip.AddrFromSlice(underlay)
+	return f.DropFromUnderlayAddr(packet, fp, incoming, h, caPool, localCache, addr)
+}
+
+// DropFromUnderlayAddr is DropFromUnderlay with the underlay address as a netip.Addr, the zero Addr is unknown.
+func (f *Firewall) DropFromUnderlayAddr(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache *firewall.ConntrackCache, underlay netip.Addr) error {
+	err := f.drop(packet, fp, incoming, h, caPool, localCache, underlay.Unmap())
+	if err != nil && incoming && f.quarantine != nil {
+		f.countDenial(h, err)
+	}
+
+	if err != nil && f.dryRun != nil {
+		f.wouldDrop(fp, incoming, h, err)
+		return nil
+	}
+
+	if err != nil && f.deniedLog != nil {
+		f.logDenied(fp, incoming, h, err)
+	}
+
+	if err != nil {
+		f.dropped(fp, incoming, h, err)
+	}
+
+	if err != nil && f.DropLogger != nil {
+		f.DropLogger(fp, incoming, err)
+	}
+
+	return err
+}
+
+// drop is Drop without the DropLogger
+func (f *Firewall) drop(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache *firewall.ConntrackCache, underlay netip.Addr) error {
+	// Quarantined peers are cut off before anything else, flows in conntrack included
+	if f.quarantine != nil && f.quarantined(h) {
+		return ErrPeerQuarantined
+	}
+
+	// The whole packet is checked against the same rules, a reload that lands part way through is seen by the next one
+	rs := f.ruleset.Load()
+
+	// Check if we spoke to this tuple, if we did then allow this packet
+	if !f.conntrackDisabled {
+		if ok, err := f.inConns(rs, packet, fp, incoming, h, caPool, localCache, underlay); ok || err != nil {
+			if err == nil {
+				f.metricAllowedConntrack.Inc(1)
+			}
+			return err
+		}
+	}
+
+	// Make sure remote address matches nebula certificate
+	if !validRemoteIP(h, fp.RemoteIP) {
+		f.metrics(incoming).droppedRemoteIP.Inc(1)
+		return ErrInvalidRemoteIP
+	}
+
+	// Make sure we are supposed to be handling this local ip address
+	ok, _ := rs.localIps.Contains(fp.LocalIP)
+	if !ok {
+		f.metrics(incoming).droppedLocalIP.Inc(1)
+		if f.spoofedLocalLog != nil {
+			f.logSpoofedLocal(fp, incoming, h)
+		}
+		return ErrInvalidLocalIP
+	}
+
+	// ICMP errors about a flow we are tracking don't need a rule of their own
+	if f.allowRelated && !f.conntrackDisabled && f.inRelatedConns(packet, fp, incoming, h) {
+		f.metrics(incoming).allowedRelated.Inc(1)
+		return nil
+	}
+
+	// Peers close to their certificate expiring may finish what they started but not start anything new
+	peerCert := h.ConnectionState.peerCert
+	if f.minCertRemaining > 0 && peerCert.Details.NotAfter.Sub(f.clock.Now()) < f.minCertRemaining {
+		f.metricDroppedCertExpiring.Inc(1)
+		return ErrCertExpiringSoon
+	}
+
+	// The data channel of a control channel a conntrack helper has read
+	if !f.conntrackDisabled && f.Conntrack.expected.take(fp, f.clock.Now().UnixNano()) {
+		f.metrics(incoming).allowedExpected.Inc(1)
+		f.trackConn(packet, fp, incoming, RuleOptions{}, rs.version)
+		return nil
+	}
+
+	// We now know which firewall table to check against
+	table := rs.table(incoming)
+	pi := f.packetInfo(packet, fp, peerCert)
+	pi.underlay = underlay
+	if len(table.logOnly) > 0 {
+		f.logOnlyRules(h, table, fp, pi, incoming, caPool)
+	}
+	ok, rule := table.evaluate(fp, pi, incoming, h.ConnectionState.peerCert, caPool)
+	if f.l.Level >= logrus.DebugLevel {
+		f.logMatchedRule(h, table, fp, pi, incoming, ok, caPool)
+	}
+
+	if !ok {
+		if rule == nil {
+			f.metrics(incoming).noRule(fp.Protocol)
+			if table.caNames {
+				f.checkCALookup(h, caPool)
+			}
+			return ErrNoMatchingRule
+		}
+
+		f.metrics(incoming).droppedDenyRule.Inc(1)
+		if rule.opts.Reject {
+			return ErrRejectedByRule
+		}
+		if rule.opts.NoReject {
+			return ErrDroppedByRule
+		}
+		return ErrDeniedByRule
+	}
+
+	// Without conntrack every packet passes the rules on its own
+	if f.conntrackDisabled {
+		f.metricAllowedRule.Inc(1)
+		return nil
+	}
+
+	// Only new flows are limited, packets for flows in conntrack were let through by inConns
+	if f.connRate != nil && !f.connRate.allow(f.clock.Now().UnixNano()) {
+		f.metricDroppedConnRate.Inc(1)
+		return ErrConnRateExceeded
+	}
+
+	// We always want to conntrack since it is a faster operation
+	f.trackConn(packet, fp, incoming, rule.options(), rs.version)
+	f.metricAllowedRule.Inc(1)
+
+	return nil
+}
+
+// validRemoteIP returns true if the remote ip is one the hosts certificate allows it to use
+func validRemoteIP(h *HostInfo, ip iputil.VpnIp) bool {
+	if remoteCidr := h.remoteCidr; remoteCidr != nil {
+		ok, _ := remoteCidr.Contains(ip)
+		return ok
+	}
+
+	// Simple case: Certificate has one IP and no subnets
+	return ip == h.vpnIp
+}
+
+func (f *Firewall) metrics(incoming bool) firewallMetrics {
+	if incoming {
+		return f.incomingMetrics
+	} else {
+		return f.outgoingMetrics
+	}
+}
+
+// Destroy cleans up any known cyclical references so the object can be free'd my GC. This should be called if a new
+// firewall object is created
+func (f *Firewall) Destroy() {
+	//TODO: clean references if/when needed
+	f.stopConntrackSweeper()
+	f.stopConntrackRevalidation()
+	f.stopRuleExpiry()
+	f.auditLog.Close()
+	f.flowExporter.Close()
+	f.flowEvents.Load().close()
+	f.dropEvents.Load().close()
+}
+
+func (f *Firewall) EmitStats() {
+	conntrackCount := 0
+	pending := 0
+	expired := 0
+	var rulesVersion uint16
+	var tcpStates [tcpStateMax]int64
+	var halfOpenInbound int64
+	var protoCounts [conntrackProtoMax]int
+	// When the oldest and newest entries were created
+	var oldest, newest time.Time
+	for _, s := range f.Conntrack.shards {
+		s.Lock()
+		// rulesVersion can't change while we hold a shard lock
+		rulesVersion = f.rulesVersion()
+		conntrackCount += len(s.Conns)
+		expired += s.TimerWheel.Expired()
+		if f.verifyConntrackCounts {
+			if kept, ok := s.reconcile(); !ok {
+				f.l.WithField("kept", kept).WithField("counted", s.protoCounts).
+					Error("conntrack protocol counts were out of step with conntrack, corrected")
+			}
+		}
+		for i, n := range s.protoCounts {
+			protoCounts[i] += n
+		}
+		for fp, c := range s.Conns {
+			if c.rulesVersion != rulesVersion && !c.pinned {
+				pending++
+			}
+			if fp.Protocol == firewall.ProtoTCP && c.tcpState < tcpStateMax {
+				tcpStates[c.tcpState]++
+				if c.incoming && c.tcpState.halfOpen() {
+					halfOpenInbound++
+				}
+			}
+			if oldest.IsZero() || c.started.Before(oldest) {
+				oldest = c.started
+			}
+			if c.started.After(newest) {
+				newest = c.started
+			}
+		}
+		s.Unlock()
+	}
+
+	// Ages are in nanoseconds like the lifetime histograms, 0 when conntrack is empty
+	var oldestAge, newestAge int64
+	if !oldest.IsZero() {
+		now := f.clock.Now()
+		oldestAge = now.Sub(oldest).Nanoseconds()
+		newestAge = now.Sub(newest).Nanoseconds()
+	}
+	metrics.GetOrRegisterGauge("firewall.conntrack.oldest_age", f.metricsRegistry).Update(oldestAge)
+	metrics.GetOrRegisterGauge("firewall.conntrack.newest_age", f.metricsRegistry).Update(newestAge)
+	metrics.GetOrRegisterGauge("firewall.conntrack.count", f.metricsRegistry).Update(int64(conntrackCount))
+	// The peak since the last emission, starting over from here
+	highWater := f.Conntrack.highWater.Swap(0)
+	if highWater < int64(conntrackCount) {
+		highWater = int64(conntrackCount)
+	}
+	metrics.GetOrRegisterGauge("firewall.conntrack.high_water", f.metricsRegistry).Update(highWater)
+	for i, n := range protoCounts {
+		metrics.GetOrRegisterGauge("firewall.conntrack.count."+conntrackProtoNames[i], f.metricsRegistry).Update(int64(n))
+	}
+	metrics.GetOrRegisterGauge("firewall.conntrack.expired_pending", f.metricsRegistry).Update(int64(expired))
+	if f.revalidateBudget > 0 {
+		metrics.GetOrRegisterGauge("firewall.conntrack.revalidate_pending", f.metricsRegistry).Update(int64(pending))
+	}
+	for s, n := range tcpStates {
+		metrics.GetOrRegisterGauge("firewall.conntrack.tcp."+tcpState(s).String(), f.metricsRegistry).Update(n)
+	}
+	metrics.GetOrRegisterGauge("firewall.conntrack.tcp.half_open_inbound", f.metricsRegistry).Update(halfOpenInbound)
+	metrics.GetOrRegisterGauge("firewall.rules.version", f.metricsRegistry).Update(int64(rulesVersion))
+	metrics.GetOrRegisterGauge("firewall.rules.hash", f.metricsRegistry).Update(int64(f.GetRuleHashFNV()))
+}
+
+// FlushConntrack removes every entry from conntrack and returns how many were removed.
+// Flows will need to match the rules again on their next packet.
+func (f *Firewall) FlushConntrack() int {
+	n := 0
+	for _, s := range f.Conntrack.shards {
+		s.Lock()
+		n += len(s.Conns)
+		for fp, c := range s.Conns {
+			f.exportFlow(fp, c)
+			f.observeLifetime(fp, c)
+			f.flowEnded(fp, c, FlowFlushed)
+		}
+		s.clear()
+		tw := s.TimerWheel
+		s.TimerWheel = NewTimerWheel[firewall.Packet](tw.tickDuration, tw.wheelDuration)
+		s.Unlock()
+	}
+
+	f.metricConntrackFlushed.Inc(int64(n))
+	return n
+}
+
+// FlushConntrackFor removes every conntrack entry for the provided remote vpn ip and returns how many were removed
+func (f *Firewall) FlushConntrackFor(vpnIp iputil.VpnIp) int {
+	return f.flushConntrack(func(fp firewall.Packet) bool {
+		return fp.RemoteIP == vpnIp
+	})
+}
+
+// FlushConntrackProto removes every conntrack entry for the provided protocol and returns how many were removed
+func (f *Firewall) FlushConntrackProto(proto uint8) int {
+	return f.flushConntrack(func(fp firewall.Packet) bool {
+		return fp.Protocol == proto
+	})
+}
+
+// flushConntrack removes the conntrack entries the filter returns true for. Timer wheel entries are left alone,
+// evict will ignore them once they expire.
+func (f *Firewall) flushConntrack(filter func(firewall.Packet) bool) int {
+	n := 0
+	for _, s := range f.Conntrack.shards {
+		s.Lock()
+		for fp, c := range s.Conns {
+			if filter(fp) {
+				f.exportFlow(fp, c)
+				f.observeLifetime(fp, c)
+				f.flowEnded(fp, c, FlowFlushed)
+				s.remove(fp)
+				n++
+			}
+		}
+		s.Unlock()
+	}
+
+	f.metricConntrackFlushed.Inc(int64(n))
+	return n
+}
+
+// ConntrackFilter selects the entries returned by ListConntrack, zero values match everything
+type ConntrackFilter struct {
+	RemoteIP iputil.VpnIp
+	LocalIP  iputil.VpnIp
+	Protocol uint8
+	// Port matches either the local or remote port
+	Port uint16
+	// Limit is the maximum number of entries to return, 0 is unlimited
+	Limit int
+}
+
+func (cf *ConntrackFilter) match(fp firewall.Packet) bool {
+	if cf.RemoteIP != 0 && cf.RemoteIP != fp.RemoteIP {
+		return false
+	}
+
+	if cf.LocalIP != 0 && cf.LocalIP != fp.LocalIP {
+		return false
+	}
+
+	if cf.Protocol != firewall.ProtoAny && cf.Protocol != fp.Protocol {
+		return false
+	}
+
+	if cf.Port != 0 && cf.Port != fp.LocalPort && cf.Port != fp.RemotePort {
+		return false
+	}
+
+	return true
+}
+
+// ConntrackEntry is a copy of a single conntrack entry, see ListConntrack
+type ConntrackEntry struct {
+	Packet       firewall.Packet `json:"packet"`
+	Incoming     bool            `json:"incoming"`
+	Expires      time.Time       `json:"expires"`
+	RulesVersion uint16          `json:"rulesVersion"`
+	// Pinned entries never expire and are not revalidated, see Firewall.PinFlow
+	Pinned bool `json:"pinned,omitempty"`
+	// TCPState is only set for tcp flows
+	TCPState string `json:"tcpState,omitempty"`
+	// RTTTracking is true while we are waiting on the ack for RTTSeq, or for RTTTSVal to be echoed if the flow carries
+	// tcp timestamps
+	RTTTracking bool      `json:"rttTracking"`
+	RTTSeq      uint32    `json:"rttSeq,omitempty"`
+	RTTTSVal    uint32    `json:"rttTsVal,omitempty"`
+	RTTSent     time.Time `json:"rttSent,omitempty"`
+	// Meta is what Firewall.OnNewConn stored for the flow
+	Meta any `json:"meta,omitempty"`
+
+	InPackets  uint64 `json:"inPackets"`
+	InBytes    uint64 `json:"inBytes"`
+	OutPackets uint64 `json:"outPackets"`
+	OutBytes   uint64 `json:"outBytes"`
+}
+
+// ListConntrack returns a copy of the conntrack entries that match the filter. The lock of each conntrack shard is
+// only held while copying from it so use a Limit when dumping a large table.
+func (f *Firewall) ListConntrack(filter ConntrackFilter) []ConntrackEntry {
+	var entries []ConntrackEntry
+
+	for _, s := range f.Conntrack.shards {
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+
+		s.Lock()
+		entries = s.list(filter, entries)
+		s.Unlock()
+	}
+
+	return entries
+}
+
+// ConntrackForHost returns a copy of every conntrack entry for the remote vpn ip. Hosts without any entries are
+// answered from the per host counts without taking a shard lock.
+func (f *Firewall) ConntrackForHost(vpnIp iputil.VpnIp) []ConntrackEntry {
+	if f.Conntrack.shards[0].hosts.count(vpnIp) == 0 {
+		return nil
+	}
+
+	return f.ListConntrack(ConntrackFilter{RemoteIP: vpnIp})
+}
+
+// list appends the entries that match the filter to entries, caller must hold the shard lock
+func (s *conntrackShard) list(filter ConntrackFilter, entries []ConntrackEntry) []ConntrackEntry {
+	for fp, c := range s.Conns {
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+
+		if !filter.match(fp) {
+			continue
+		}
+
+		var state string
+		if fp.Protocol == firewall.ProtoTCP {
+			state = c.tcpState.String()
+		}
+
+		entries = append(entries, ConntrackEntry{
+			Packet:       fp,
+			TCPState:     state,
+			Incoming:     c.incoming,
+			Expires:      c.Expires,
+			RulesVersion: c.rulesVersion,
+			Pinned:       c.pinned,
+			RTTTracking:  c.Seq != 0 || c.tsPending,
+			RTTSeq:       c.Seq,
+			RTTTSVal:     c.tsVal,
+			RTTSent:      c.Sent,
+			Meta:         c.Meta,
+			InPackets:    c.inPackets,
+			InBytes:      c.inBytes,
+			OutPackets:   c.outPackets,
+			OutBytes:     c.outBytes,
+		})
+	}
+
+	return entries
+}
+
+// revalidate checks a conntrack entry from an older rule set against the rules of rs, removing it if they no longer
+// allow it and stamping it with the version of rs if they do. pi describes the packet being checked, see
+// packetInfo for when there is none. Returns true if the entry was kept, caller must hold the shard lock.
+func (f *Firewall) revalidate(conntrack *conntrackShard, rs *firewallRuleset, fp firewall.Packet, c *conn, pi packetInfo, peerCert *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+	allowed, timeout := rs.table(c.incoming).revalidation(fp, pi, c.incoming, peerCert, caPool)
+	return f.applyRevalidation(conntrack, rs, fp, c, allowed, timeout)
+}
+
+// revalidateUnlocked is revalidate for the packet path, the shard lock is released while the rules are evaluated so
+// other packets on the shard are not held up by the ca pool lookups and cidr tree walks. The entry may change while
+// the lock is released, it is looked up again after and checked again if it is still from an older rule set. Returns
+// the entry for fp, which may have been replaced while unlocked, and true if there is one that the rules of rs allow.
+// Caller must hold the shard lock, it is held again on return.
+func (f *Firewall) revalidateUnlocked(conntrack *conntrackShard, rs *firewallRuleset, fp firewall.Packet, c *conn, pi packetInfo, peerCert *cert.NebulaCertificate, caPool *cert.NebulaCAPool) (*conn, bool) {
+	for {
+		incoming := c.incoming
+		reuses := c.reuses
+
+		conntrack.Unlock()
+		allowed, timeout := rs.table(incoming).revalidation(fp, pi, incoming, peerCert, caPool)
+		conntrack.Lock()
+
+		cur, ok := conntrack.Conns[fp]
+		if !ok {
+			// Expired or removed by another routine, the packet goes through the rules like any other
+			return nil, false
+		}
+
+		if cur.rulesVersion == rs.version || cur.pinned {
+			// Revalidated, replaced or pinned by another routine
+			return cur, true
+		}
+
+		if cur != c || cur.reuses != reuses {
+			// Replaced by an entry that still needs checking, perhaps a new flow given the entry we had, what we found
+			// is stale
+			c = cur
+			continue
+		}
+
+		return c, f.applyRevalidation(conntrack, rs, fp, c, allowed, timeout)
+	}
+}
+
+// revalidation returns whether the table allows a conntrack entry and, for udp, the conntrack timeout of the rule
+// that allows it. It does not touch conntrack so no lock is required.
+func (ft *FirewallTable) revalidation(fp firewall.Packet, pi packetInfo, incoming bool, peerCert *cert.NebulaCertificate, caPool *cert.NebulaCAPool) (bool, time.Duration) {
+	ok, rule := ft.evaluate(fp, pi, incoming, peerCert, caPool)
+	if !ok {
+		return false, 0
+	}
+
+	if fp.Protocol == firewall.ProtoUDP {
+		// The rule that allows this flow now may have a different timeout
+		return true, rule.options().ConntrackTimeout
+	}
+
+	return true, 0
+}
+
+// applyRevalidation removes c if it is no longer allowed or stamps it with the version of rs and timeout if it is,
+// returning true if it was kept. Caller must hold the shard lock.
+func (f *Firewall) applyRevalidation(conntrack *conntrackShard, rs *firewallRuleset, fp firewall.Packet, c *conn, allowed bool, timeout time.Duration) bool {
+	if !allowed {
+		f.metricConntrackRevalidateFailed.Inc(1)
+		f.exportFlow(fp, c)
+		f.observeLifetime(fp, c)
+		f.flowEnded(fp, c, FlowRevalidationFailed)
+		conntrack.remove(fp)
+		return false
+	}
+
+	c.rulesVersion = rs.version
+	if fp.Protocol == firewall.ProtoUDP {
+		c.timeout = timeout
+	}
+
+	return true
+}
+
+// inConns returns true if the packet belongs to a flow in conntrack that the rules of rs allow. An error is returned if
+// the packet belongs to a flow in conntrack but must be dropped anyway. underlay is the address the packet arrived on,
+// the zero Addr if unknown.
+func (f *Firewall) inConns(rs *firewallRuleset, packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache *firewall.ConntrackCache, underlay netip.Addr) (bool, error) {
+	// Only trust the cache if the entry was allowed by the current rules
+	if localCache.Lookup(fp, rs.version) {
+		return true, nil
+	}
+
+	conntrack := f.Conntrack.shard(fp)
+	conntrack.Lock()
+
+	// Purge every time we test, unless the sweeper takes care of it
+	if f.sweeper == nil {
+		for i := 0; i < f.purgeBudget; i++ {
+			ep, has := conntrack.TimerWheel.Purge()
+			if !has {
+				break
+			}
+			f.evict(conntrack, ep)
+		}
+	}
+
+	c, ok := conntrack.Conns[fp]
+
+	if !ok {
+		conntrack.Unlock()
+		return false, nil
+	}
+
+	// Pinned entries carry over to new rules without being checked against them
+	if c.pinned {
+		c.rulesVersion = rs.version
+	}
+
+	// A flow past its lifetime must pass the rules again, as if the rules had changed, before it is readmitted
+	expired := f.pastLifetime(fp, c, f.clock.Now())
+	if expired && c.rulesVersion == rs.version {
+		c.rulesVersion = rs.version - 1
+	}
+
+	// Only a packet that arrived on the underlay can check an inbound flow against an underlay_cidr, until one does the
+	// flow keeps the verdict of the older rule set
+	needsUnderlay := c.rulesVersion != rs.version && c.incoming && !underlay.IsValid() && rs.in.hasUnderlayRules()
+
+	// When over the revalidation budget an entry from an older rule set waits for its turn
+	deferred := c.rulesVersion != rs.version && (needsUnderlay || !f.takeRevalidation(conntrack))
+	if deferred && !needsUnderlay && f.revalidateOverflowDrop {
+		conntrack.Unlock()
+		return false, ErrRevalidationDeferred
+	}
+
+	if c.rulesVersion != rs.version && !deferred {
+		// This conntrack entry was for an older rule set, validate
+		// it still passes with the current rule set
+		oldRulesVersion := c.rulesVersion
+		oldIncoming := c.incoming
+		established := c.bidirectional()
+		pi := f.packetInfo(packet, fp, h.ConnectionState.peerCert)
+		pi.underlay = underlay
+		if c, ok = f.revalidateUnlocked(conntrack, rs, fp, c, pi, h.ConnectionState.peerCert, caPool); !ok {
+			table := rs.table(oldIncoming)
+			conntrack.Unlock()
+			f.metricRevalidatedDropped.Inc(1)
+			if established && f.logRevalidationDrops {
+				h.logger(f.l).
+					WithField("fwPacket", fp).
+					WithField("incoming", oldIncoming).
+					WithField("rulesVersion", rs.version).
+					WithField("oldRulesVersion", oldRulesVersion).
+					Info("New firewall rules dropped an established flow")
+			} else if f.l.Level >= logrus.DebugLevel {
+				h.logger(f.l).
+					WithField("fwPacket", fp).
+					WithField("incoming", oldIncoming).
+					WithField("rulesVersion", rs.version).
+					WithField("oldRulesVersion", oldRulesVersion).
+					WithField("rule", table.matchedRule(fp, pi, oldIncoming, h.ConnectionState.peerCert, caPool)).
+					Debugln("dropping old conntrack entry, does not match new ruleset")
+			}
+			return false, nil
+		}
+
+		f.metricRevalidatedKept.Inc(1)
+		if f.l.Level >= logrus.DebugLevel {
+			h.logger(f.l).
+				WithField("fwPacket", fp).
+				WithField("incoming", c.incoming).
+				WithField("rulesVersion", rs.version).
+				WithField("oldRulesVersion", oldRulesVersion).
+				WithField("rule", rs.table(c.incoming).matchedRule(fp, pi, c.incoming, h.ConnectionState.peerCert, caPool)).
+				Debugln("keeping old conntrack entry, does match new ruleset")
+		}
+
+		// Another routine may have readmitted it while the rules were checked
+		if f.pastLifetime(fp, c, f.clock.Now()) {
+			c = f.readmit(conntrack, fp, c)
+		}
+	}
+
+	// A packet that could not belong to the flow is dropped without touching the entry
+	if c.window != nil && !c.window.check(packet, fp, incoming == c.incoming) {
+		conntrack.Unlock()
+		f.metricTCPOutOfWindow.Inc(1)
+		return false, ErrTCPOutOfWindow
+	}
+
+	c.count(incoming, len(packet))
+	f.metricConntrackRefreshed.Inc(1)
+
+	switch fp.Protocol {
+	case firewall.ProtoTCP:
+		timeout := f.updateTCPState(c, packet, fp, incoming)
+		now := f.clock.Now()
+		expires := now.Add(timeout)
+		if expires.Before(c.Expires) {
+			// The new state has a shorter timeout, the timer wheel needs to know to check sooner
+			conntrack.TimerWheel.Advance(now)
+			conntrack.TimerWheel.Add(fp, timeout)
+		}
+		c.Expires = expires
+		if incoming {
+			if f.checkTCPRTT(c, packet, now) && f.hostRTTs != nil {
+				f.hostRTTs.update(h, now.Sub(c.Sent), now)
+			}
+		} else {
+			f.setTCPRTTTracking(c, packet, now)
+		}
+	case firewall.ProtoUDP:
+		// Replies refresh the flow with the timeout of the rule that allowed it, not the general udp timeout. The first
+		// reply moves a flow without one to the longer udp_stream_timeout.
+		c.Expires = f.clock.Now().Add(f.udpTimeout(c))
+	default:
+		c.Expires = f.clock.Now().Add(f.DefaultTimeout)
+	}
+
+	// Replies must reach conntrack so a tcp or udp flow can be seen to be bidirectional, and every packet of a flow with
+	// a window must be checked against it
+	cache := !deferred && c.window == nil && ((fp.Protocol != firewall.ProtoTCP && fp.Protocol != firewall.ProtoUDP) || c.bidirectional())
+	conntrack.Unlock()
+
+	if cache {
+		localCache.Add(fp, rs.version)
+	}
+
+	return true, nil
+}
+
+// takeRevalidation returns true if there is budget left in the shard to revalidate a conntrack entry from an older
+// rule set. The budget is split evenly between shards and refilled every conntrack tick, caller must hold the shard lock.
+func (f *Firewall) takeRevalidation(conntrack *conntrackShard) bool {
+	if f.revalidateBudget == 0 {
+		return true
+	}
+
+	now := f.clock.Now()
+	if !now.Before(conntrack.revalidateRefill) {
+		shards := len(f.Conntrack.shards)
+		conntrack.revalidateLeft = (f.revalidateBudget + shards - 1) / shards
+		conntrack.revalidateRefill = now.Add(conntrack.TimerWheel.tickDuration)
+	}
+
+	if conntrack.revalidateLeft == 0 {
+		return false
+	}
+
+	conntrack.revalidateLeft--
+	return true
+}
+
+// inRelatedConns returns true if the packet is an ICMP error message caused by a flow we have in conntrack.
+// The packet that caused the error is parsed out of the ICMP payload and looked up, it must belong to the same host.
+func (f *Firewall) inRelatedConns(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo) bool {
+	if fp.Protocol != firewall.ProtoICMP || fp.Fragment {
+		return false
+	}
+
+	if len(packet) < ipv4.HeaderLen {
+		return false
+	}
+
+	// We need the 8 byte icmp header followed by at least an ip header
+	ihl := int(packet[0]&0x0f) << 2
+	if ihl < ipv4.HeaderLen || len(packet) < ihl+8+ipv4.HeaderLen {
+		return false
+	}
+
+	switch packet[ihl] {
+	case icmpDestinationUnreachable, icmpSourceQuench, icmpRedirect, icmpTimeExceeded, icmpParameterProblem:
+	default:
+		return false
+	}
+
+	// The offending packet was travelling in the opposite direction of the error
+	var related firewall.Packet
+	if err := newPacket(packet[ihl+8:], !incoming, &related); err != nil {
+		return false
+	}
+
+	// Errors are only sent about the first fragment, which has the ports we need to find the flow
+	if related.Fragment {
+		return false
+	}
+
+	if !validRemoteIP(h, related.RemoteIP) {
+		return false
+	}
+
+	conntrack := f.Conntrack.shard(related)
+	conntrack.Lock()
+	_, ok := conntrack.Conns[related]
+	conntrack.Unlock()
+
+	return ok
+}
+
+func (f *Firewall) addConn(packet []byte, fp firewall.Packet, incoming bool, opts RuleOptions) {
+	f.trackConn(packet, fp, incoming, opts, f.rulesVersion())
+}
+
+// trackConn is addConn for a flow that was allowed by the rules of rulesVersion
+func (f *Firewall) trackConn(packet []byte, fp firewall.Packet, incoming bool, opts RuleOptions, rulesVersion uint16) {
+	conntrack := f.Conntrack.shard(fp)
+	conntrack.Lock()
+	if f.maxConnsPerHost > 0 && conntrack.hosts.count(fp.RemoteIP) >= f.maxConnsPerHost {
+		// Replacing an entry the host already has does not take more of conntrack
+		if _, ok := conntrack.Conns[fp]; !ok {
+			conntrack.Unlock()
+			f.metricPerHostLimit.Inc(1)
+			return
+		}
+	}
+
+	if f.maxConnsPerShard > 0 && len(conntrack.Conns) >= f.maxConnsPerShard {
+		if _, ok := conntrack.Conns[fp]; !ok && !f.makeRoom(conntrack) {
+			conntrack.Unlock()
+			f.metricConntrackFull.Inc(1)
+			return
+		}
+	}
+
+	var timeout time.Duration
+	c := conntrack.newConn(incoming)
+
+	switch fp.Protocol {
+	case firewall.ProtoTCP:
+		timeout = f.updateTCPState(c, packet, fp, incoming)
+		if f.tcpStrict {
+			c.window = newTCPWindow(packet, fp)
+		}
+		if !incoming {
+			f.setTCPRTTTracking(c, packet, f.clock.Now())
+		}
+	case firewall.ProtoUDP:
+		c.timeout = opts.ConntrackTimeout
+		timeout = f.udpTimeout(c)
+	default:
+		timeout = f.DefaultTimeout
+	}
+
+	// Record which rulesVersion allowed this connection, so we can retest after
+	// firewall reload
+	f.storeConn(conntrack, fp, c, timeout, rulesVersion)
+	c.count(incoming, len(packet))
+	if f.OnNewConn != nil {
+		f.OnNewConn(fp, incoming, &c.Meta)
+	}
+	f.flowStarted(fp, c)
+	conntrack.Unlock()
+
+	f.Conntrack.raiseHighWater()
+
+	f.metricConntrackCreated.Inc(1)
+}
 
-// Drop returns an error if the packet should be dropped, explaining why. It
-// returns nil if the packet should not be dropped.
-func (f *Firewall) Drop(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) error {
-	// Check if we spoke to this tuple, if we did then allow this packet
-	if f.inConns(packet, fp, incoming, h, caPool, localCache) {
-		return nil
+// storeConn puts c in the conntrack shard for fp, replacing any existing entry, and stamps it with rulesVersion.
+// Caller must hold the shard lock.
+func (f *Firewall) storeConn(conntrack *conntrackShard, fp firewall.Packet, c *conn, timeout time.Duration, rulesVersion uint16) {
+	now := f.clock.Now()
+	if _, ok := conntrack.Conns[fp]; !ok {
+		conntrack.TimerWheel.Advance(now)
+		conntrack.TimerWheel.Add(fp, timeout)
 	}
 
-	// Make sure remote address matches nebula certificate
-	if remoteCidr := h.remoteCidr; remoteCidr != nil {
-		ok, _ := remoteCidr.Contains(fp.RemoteIP)
-		if !ok {
-			f.metrics(incoming).droppedRemoteIP.Inc(1)
-			return ErrInvalidRemoteIP
-		}
-	} else {
-		// Simple case: Certificate has one IP and no subnets
-		if fp.RemoteIP != h.vpnIp {
-			f.metrics(incoming).droppedRemoteIP.Inc(1)
-			return ErrInvalidRemoteIP
-		}
-	}
+	c.rulesVersion = rulesVersion
+	c.started = now
+	c.Expires = c.started.Add(timeout)
+	conntrack.put(fp, c)
+}
 
-	// Make sure we are supposed to be handling this local ip address
-	ok, _ := f.localIps.Contains(fp.LocalIP)
+// Evict checks if a conntrack entry has expired, if so it is removed and true is returned, if not it is re-added to
+// the wheel of its shard. Caller must own the shard lock!
+func (f *Firewall) evict(conntrack *conntrackShard, p firewall.Packet) bool {
+	// Are we still tracking this conn?
+	t, ok := conntrack.Conns[p]
 	if !ok {
-		f.metrics(incoming).droppedLocalIP.Inc(1)
-		return ErrInvalidLocalIP
+		return false
 	}
 
-	table := f.OutRules
-	if incoming {
-		table = f.InRules
+	now := f.clock.Now()
+	newT := t.Expires.Sub(now)
+	if t.pinned {
+		// Check back as late as the wheel allows in case it is unpinned
+		newT = conntrack.TimerWheel.wheelDuration
 	}
 
-	// We now know which firewall table to check against
-	if !table.match(fp, incoming, h.ConnectionState.peerCert, caPool) {
-		f.metrics(incoming).droppedNoRule.Inc(1)
-		return ErrNoMatchingRule
+	// Timeout is in the future, re-add the timer
+	if newT > 0 {
+		conntrack.TimerWheel.Advance(now)
+		conntrack.TimerWheel.Add(p, newT)
+		return false
 	}
 
-	// We always want to conntrack since it is a faster operation
-	f.addConn(packet, fp, incoming)
+	// This conn is done. A flow that never finished its handshake never resolved its rtt tracking either.
+	if p.Protocol == firewall.ProtoTCP && t.tcpState.halfOpen() {
+		f.metricTCPHandshakeExpired.Inc(1)
+	}
+	f.exportFlow(p, t)
+	f.metricConntrackExpired.Inc(1)
+	f.observeLifetime(p, t)
+	f.flowEnded(p, t, FlowExpired)
+	conntrack.remove(p)
+	return true
+}
 
-	return nil
+// observeLifetime records how long the conntrack entry c for fp lived, in nanoseconds like network.tcp.rtt
+func (f *Firewall) observeLifetime(fp firewall.Packet, c *conn) {
+	h := f.metricLifetimeOther
+	switch fp.Protocol {
+	case firewall.ProtoTCP:
+		h = f.metricLifetimeTCP
+	case firewall.ProtoUDP:
+		h = f.metricLifetimeUDP
+	}
+
+	h.Update(f.clock.Now().Sub(c.started).Nanoseconds())
 }
 
-func (f *Firewall) metrics(incoming bool) firewallMetrics {
-	if incoming {
-		return f.incomingMetrics
-	} else {
-		return f.outgoingMetrics
+// udpTimeout returns the timeout for a udp conn, the timeout of the rule that allowed it if it had one and otherwise
+// udp_stream_timeout once packets have been seen in both directions. Caller must hold the conntrack lock.
+func (f *Firewall) udpTimeout(c *conn) time.Duration {
+	if c.timeout != 0 {
+		return c.timeout
 	}
+	if c.bidirectional() {
+		return f.udpStreamTimeout
+	}
+	return f.UDPTimeout
 }
 
-// Destroy cleans up any known cyclical references so the object can be free'd my GC. This should be called if a new
-// firewall object is created
-func (f *Firewall) Destroy() {
-	//TODO: clean references if/when needed
+// addOrdered inserts or after any rule of the same or higher priority
+func (ft *FirewallTable) addOrdered(or *orderedRule) {
+	i := sort.Search(len(ft.ordered), func(i int) bool {
+		return ft.ordered[i].opts.Priority < or.opts.Priority
+	})
+
+	ft.ordered = append(ft.ordered, nil)
+	copy(ft.ordered[i+1:], ft.ordered[i:])
+	ft.ordered[i] = or
 }
 
-func (f *Firewall) EmitStats() {
-	conntrack := f.Conntrack
-	conntrack.Lock()
-	conntrackCount := len(conntrack.Conns)
-	conntrack.Unlock()
-	metrics.GetOrRegisterGauge("firewall.conntrack.count", nil).Update(int64(conntrackCount))
-	metrics.GetOrRegisterGauge("firewall.rules.version", nil).Update(int64(f.rulesVersion))
-	metrics.GetOrRegisterGauge("firewall.rules.hash", nil).Update(int64(f.GetRuleHashFNV()))
+// options returns the options of a rule returned by evaluate, a nil rule is a plain rule from the port maps which has
+// none
+func (or *orderedRule) options() RuleOptions {
+	if or == nil {
+		return RuleOptions{}
+	}
+	return or.opts
 }
 
-func (f *Firewall) inConns(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) bool {
-	if localCache != nil {
-		if _, ok := localCache[fp]; ok {
-			return true
-		}
+func (or *orderedRule) match(p firewall.Packet, pi packetInfo, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+	if or.proto != firewall.ProtoAny && or.proto != p.Protocol {
+		return false
 	}
-	conntrack := f.Conntrack
-	conntrack.Lock()
 
-	// Purge every time we test
-	ep, has := conntrack.TimerWheel.Purge()
-	if has {
-		f.evict(ep)
+	// newPacket puts the echo identifier in both ports
+	if or.opts.ICMPID != nil && (p.Fragment || p.LocalPort != *or.opts.ICMPID) {
+		return false
 	}
 
-	c, ok := conntrack.Conns[fp]
+	// A negative length is unknown, as when conntrack is revalidated without a packet, and is taken to be in bounds
+	if pi.length >= 0 && (pi.length < or.opts.MinLen || (or.opts.MaxLen != 0 && pi.length > or.opts.MaxLen)) {
+		return false
+	}
 
-	if !ok {
-		conntrack.Unlock()
+	if !or.opts.matchTCPFlags(pi) {
 		return false
 	}
 
-	if c.rulesVersion != f.rulesVersion {
-		// This conntrack entry was for an older rule set, validate
-		// it still passes with the current rule set
-		table := f.OutRules
-		if c.incoming {
-			table = f.InRules
-		}
+	if !or.opts.Origin.match(pi.forwarded) {
+		return false
+	}
 
-		// We now know which firewall table to check against
-		if !table.match(fp, c.incoming, h.ConnectionState.peerCert, caPool) {
-			if f.l.Level >= logrus.DebugLevel {
-				h.logger(f.l).
-					WithField("fwPacket", fp).
-					WithField("incoming", c.incoming).
-					WithField("rulesVersion", f.rulesVersion).
-					WithField("oldRulesVersion", c.rulesVersion).
-					Debugln("dropping old conntrack entry, does not match new ruleset")
-			}
-			delete(conntrack.Conns, fp)
-			conntrack.Unlock()
-			return false
-		}
+	if or.opts.expired(pi.now) {
+		return false
+	}
 
-		if f.l.Level >= logrus.DebugLevel {
-			h.logger(f.l).
-				WithField("fwPacket", fp).
-				WithField("incoming", c.incoming).
-				WithField("rulesVersion", f.rulesVersion).
-				WithField("oldRulesVersion", c.rulesVersion).
-				Debugln("keeping old conntrack entry, does match new ruleset")
-		}
+	if !or.opts.matchSelf(pi.self) {
+		return false
+	}
 
-		c.rulesVersion = f.rulesVersion
+	if !or.opts.matchUnderlay(pi.underlay) {
+		return false
 	}
 
-	switch fp.Protocol {
-	case firewall.ProtoTCP:
-		c.Expires = time.Now().Add(f.TCPTimeout)
-		if incoming {
-			f.checkTCPRTT(c, packet)
-		} else {
-			setTCPRTTTracking(c, packet)
-		}
-	case firewall.ProtoUDP:
-		c.Expires = time.Now().Add(f.UDPTimeout)
-	default:
-		c.Expires = time.Now().Add(f.DefaultTimeout)
+	if !or.opts.matchSourcePort(p, incoming) {
+		return false
 	}
 
-	conntrack.Unlock()
+	return or.ports.match(p, incoming, c, caPool)
+}
+
+// packetInfo is what rules may match on beyond the flow in firewall.Packet. These change from packet to packet so they
+// can't be part of firewall.Packet, which is the conntrack key. A negative length means there is no packet, as when
+// conntrack is revalidated in the background, and rules take anything they can't check to match.
+type packetInfo struct {
+	// Length of the whole ip packet
+	length int
+	// Flags from the tcp header, only valid if hasTCPFlags is set
+	tcpFlags    uint8
+	hasTCPFlags bool
+	// The local address is not one of ours, see Firewall.forwarded. Unlike the rest it is always known.
+	forwarded bool
+	// When the rules are evaluated, for rules that expire
+	now time.Time
+	// The peer certificate is our own, see Firewall.isSelf. Always known like forwarded.
+	self bool
+	// The underlay address the packet arrived on, the zero Addr if unknown
+	underlay netip.Addr
+}
 
-	if localCache != nil {
-		localCache[fp] = struct{}{}
+// newPacketInfo returns the packetInfo for packet, fp must have come from packet
+func newPacketInfo(packet []byte, fp firewall.Packet) packetInfo {
+	pi := packetInfo{length: len(packet)}
+	if fp.Protocol != firewall.ProtoTCP || fp.Fragment || len(packet) < ipv4.HeaderLen {
+		return pi
 	}
 
-	return true
+	ihl := int(packet[0]&0x0f) << 2
+	if len(packet) >= ihl+14 {
+		pi.tcpFlags = packet[ihl+13]
+		pi.hasTCPFlags = true
+	}
+
+	return pi
 }
 
-func (f *Firewall) addConn(packet []byte, fp firewall.Packet, incoming bool) {
-	var timeout time.Duration
-	c := &conn{}
+// match returns true if p is allowed, see evaluate
+func (ft *FirewallTable) match(p firewall.Packet, pi packetInfo, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+	ok, _ := ft.evaluate(p, pi, incoming, c, caPool)
+	return ok
+}
 
-	switch fp.Protocol {
-	case firewall.ProtoTCP:
-		timeout = f.TCPTimeout
-		if !incoming {
-			setTCPRTTTracking(c, packet)
+// evaluate returns true if p is allowed along with the rule with options that decided it, nil if no rule matched or a
+// plain rule without options allowed it. pi has what rules may match on beyond p, such as the length of the whole
+// packet.
+// Rules are evaluated by priority, the first rule to match decides:
+//   - ordered rules with a priority above 0
+//   - deny rules at priority 0
+//   - the port maps, which hold every plain allow rule
+//   - allow rules at priority 0 that are not in the port maps, such as rules with an icmp id or length bounds
+//   - ordered rules with a priority below 0
+//
+// Without deny rules or priorities this is only the port map lookup. Otherwise every ordered rule at or above
+// priority 0 is checked before the port maps, which costs a lookup per ordered rule when a flow is first seen.
+// Packets of flows in conntrack do not get here.
+func (ft *FirewallTable) evaluate(p firewall.Packet, pi packetInfo, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) (bool, *orderedRule) {
+	i := 0
+	for ; i < len(ft.ordered) && ft.ordered[i].opts.Priority > 0; i++ {
+		if ft.ordered[i].match(p, pi, incoming, c, caPool) {
+			return ft.ordered[i].verdict()
 		}
-	case firewall.ProtoUDP:
-		timeout = f.UDPTimeout
-	default:
-		timeout = f.DefaultTimeout
 	}
 
-	conntrack := f.Conntrack
-	conntrack.Lock()
-	if _, ok := conntrack.Conns[fp]; !ok {
-		conntrack.TimerWheel.Advance(time.Now())
-		conntrack.TimerWheel.Add(fp, timeout)
+	// Most allow rules at priority 0 are also in the port maps
+	start := i
+	for ; i < len(ft.ordered) && ft.ordered[i].opts.Priority == 0; i++ {
+		if ft.ordered[i].opts.Deny && ft.ordered[i].match(p, pi, incoming, c, caPool) {
+			return false, ft.ordered[i]
+		}
 	}
 
-	// Record which rulesVersion allowed this connection, so we can retest after
-	// firewall reload
-	c.incoming = incoming
-	c.rulesVersion = f.rulesVersion
-	c.Expires = time.Now().Add(timeout)
-	conntrack.Conns[fp] = c
-	conntrack.Unlock()
-}
-
-// Evict checks if a conntrack entry has expired, if so it is removed, if not it is re-added to the wheel
-// Caller must own the connMutex lock!
-func (f *Firewall) evict(p firewall.Packet) {
-	//TODO: report a stat if the tcp rtt tracking was never resolved?
-	// Are we still tracking this conn?
-	conntrack := f.Conntrack
-	t, ok := conntrack.Conns[p]
-	if !ok {
-		return
+	if ft.matchPorts(p, incoming, c, caPool) {
+		// Allow rules with options the port maps don't need to see, such as a conntrack timeout, are in both. The port
+		// maps can't say which rule matched, so the first of those that does is taken to have allowed p.
+		for j := start; j < i; j++ {
+			if or := ft.ordered[j]; or.opts.inPortMaps() && or.match(p, pi, incoming, c, caPool) {
+				return true, or
+			}
+		}
+		return true, nil
 	}
 
-	newT := t.Expires.Sub(time.Now())
+	for j := start; j < i; j++ {
+		or := ft.ordered[j]
+		if !or.opts.Deny && !or.opts.inPortMaps() && or.match(p, pi, incoming, c, caPool) {
+			return true, or
+		}
+	}
 
-	// Timeout is in the future, re-add the timer
-	if newT > 0 {
-		conntrack.TimerWheel.Advance(time.Now())
-		conntrack.TimerWheel.Add(p, newT)
-		return
+	for ; i < len(ft.ordered); i++ {
+		if ft.ordered[i].match(p, pi, incoming, c, caPool) {
+			return ft.ordered[i].verdict()
+		}
 	}
 
-	// This conn is done
-	delete(conntrack.Conns, p)
+	return false, nil
 }
 
-func (ft *FirewallTable) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+// verdict returns the result of evaluate for a packet this rule matched
+func (or *orderedRule) verdict() (bool, *orderedRule) {
+	return !or.opts.Deny, or
+}
+
+// matchPorts returns true if a plain allow rule matches p
+func (ft *FirewallTable) matchPorts(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
 	if ft.AnyProto.match(p, incoming, c, caPool) {
 		return true
 	}
@@ -624,7 +3009,7 @@ func (ft *FirewallTable) match(p firewall.Packet, incoming bool, c *cert.NebulaC
 	return false
 }
 
-func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error {
+func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string, host string, ip netip.Prefix, localIp netip.Prefix, caName string, caSha string) error {
 	if startPort > endPort {
 		return fmt.Errorf("start port was lower than end port")
 	}
@@ -651,24 +3036,28 @@ func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.NebulaCer
 		return false
 	}
 
-	var port int32
-
-	if p.Fragment {
-		port = firewall.PortFragment
-	} else if incoming {
-		port = int32(p.LocalPort)
-	} else {
-		port = int32(p.RemotePort)
-	}
-
-	if fp[port].match(p, c, caPool) {
+	if fp[packetPort(p, incoming)].match(p, c, caPool) {
 		return true
 	}
 
 	return fp[firewall.PortAny].match(p, c, caPool)
 }
 
-func (fc *FirewallCA) addRule(groups []string, host string, ip, localIp *net.IPNet, caName, caSha string) error {
+// packetPort returns the port of p that rules match on, the local port inbound and the remote port outbound
+func packetPort(p firewall.Packet, incoming bool) int32 {
+	if p.Fragment {
+		return firewall.PortFragment
+	} else if p.Protocol == firewall.ProtoICMP || p.Protocol == firewall.ProtoESP || p.Protocol == firewall.ProtoGRE {
+		// The ports of an icmp packet hold the echo identifier and those of esp and gre the tunnel key, both only for
+		// conntrack, rules do not match on them
+		return firewall.PortAny
+	} else if incoming {
+		return int32(p.LocalPort)
+	}
+	return int32(p.RemotePort)
+}
+
+func (fc *FirewallCA) addRule(groups []string, host string, ip, localIp netip.Prefix, caName, caSha string) error {
 	fr := func() *FirewallRule {
 		return &FirewallRule{
 			Hosts:     make(map[string]struct{}),
@@ -724,7 +3113,13 @@ func (fc *FirewallCA) match(p firewall.Packet, c *cert.NebulaCertificate, caPool
 		}
 	}
 
-	s, err := caPool.GetCAForCert(c)
+	// Avoid the CA lookup when there is nothing to match it against
+	if len(fc.CANames) == 0 {
+		return false
+	}
+
+	// Failures are looked into by Firewall.checkCALookup if the packet ends up dropped
+	s, err := lookupCA(c, caPool)
 	if err != nil {
 		return false
 	}
@@ -732,7 +3127,7 @@ func (fc *FirewallCA) match(p firewall.Packet, c *cert.NebulaCertificate, caPool
 	return fc.CANames[s.Details.Name].match(p, c)
 }
 
-func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet, localIp *net.IPNet) error {
+func (fr *FirewallRule) addRule(groups []string, host string, ip netip.Prefix, localIp netip.Prefix) error {
 	if fr.Any {
 		return nil
 	}
@@ -753,20 +3148,20 @@ func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet, loc
 			fr.Hosts[host] = struct{}{}
 		}
 
-		if ip != nil {
-			fr.CIDR.AddCIDR(ip, struct{}{})
+		if ip.IsValid() {
+			fr.CIDR.AddPrefix(ip, struct{}{})
 		}
 
-		if localIp != nil {
-			fr.LocalCIDR.AddCIDR(localIp, struct{}{})
+		if localIp.IsValid() {
+			fr.LocalCIDR.AddPrefix(localIp, struct{}{})
 		}
 	}
 
 	return nil
 }
 
-func (fr *FirewallRule) isAny(groups []string, host string, ip, localIp *net.IPNet) bool {
-	if len(groups) == 0 && host == "" && ip == nil && localIp == nil {
+func (fr *FirewallRule) isAny(groups []string, host string, ip, localIp netip.Prefix) bool {
+	if len(groups) == 0 && host == "" && !ip.IsValid() && !localIp.IsValid() {
 		return true
 	}
 
@@ -780,11 +3175,11 @@ func (fr *FirewallRule) isAny(groups []string, host string, ip, localIp *net.IPN
 		return true
 	}
 
-	if ip != nil && ip.Contains(net.IPv4(0, 0, 0, 0)) {
+	if ip.IsValid() && ip.Contains(netip.IPv4Unspecified()) {
 		return true
 	}
 
-	if localIp != nil && localIp.Contains(net.IPv4(0, 0, 0, 0)) {
+	if localIp.IsValid() && localIp.Contains(netip.IPv4Unspecified()) {
 		return true
 	}
 
@@ -801,6 +3196,10 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 		return true
 	}
 
+	if fr.MatchAll {
+		return fr.matchAll(p, c)
+	}
+
 	// Need any of group, host, or cidr to match
 	for _, sg := range fr.Groups {
 		found := false
@@ -819,6 +3218,7 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 		}
 	}
 
+	// Details.Name is the only identity a certificate has, there are no alternative names to consult
 	if fr.Hosts != nil {
 		if _, ok := fr.Hosts[c.Details.Name]; ok {
 			return true
@@ -846,14 +3246,30 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 type rule struct {
 	Port      string
 	Code      string
-	Proto     string
+	Protos    []string // A proto list, or just the one proto
 	Host      string
 	Group     string
 	Groups    []string
+	GroupSets [][]string // The nested form of groups, nil when groups is flat
 	Cidr      string
 	LocalCidr string
 	CAName    string
 	CASha     string
+
+	ConntrackTimeout string
+	Priority         string
+	Action           string
+	Reject           string
+	ICMPID           string
+	MinLen           string
+	MaxLen           string
+	TCPFlags         string
+	Origin           string
+	Expires          string
+	SourcePort       string
+	Name             string
+	UnderlayCidr     string
+	MatchAll         string
 }
 
 func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, error) {
@@ -874,12 +3290,33 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 
 	r.Port = toString("port", m)
 	r.Code = toString("code", m)
-	r.Proto = toString("proto", m)
+	if v, ok := m["proto"].([]interface{}); ok {
+		r.Protos = make([]string, len(v))
+		for j, p := range v {
+			r.Protos[j] = fmt.Sprintf("%v", p)
+		}
+	} else {
+		r.Protos = []string{toString("proto", m)}
+	}
 	r.Host = toString("host", m)
 	r.Cidr = toString("cidr", m)
 	r.LocalCidr = toString("local_cidr", m)
 	r.CAName = toString("ca_name", m)
 	r.CASha = toString("ca_sha", m)
+	r.ConntrackTimeout = toString("conntrack_timeout", m)
+	r.Priority = toString("priority", m)
+	r.Action = toString("action", m)
+	r.Reject = toString("reject", m)
+	r.ICMPID = toString("icmp_id", m)
+	r.MinLen = toString("min_len", m)
+	r.MaxLen = toString("max_len", m)
+	r.TCPFlags = toString("tcp_flags", m)
+	r.Origin = toString("origin", m)
+	r.Expires = toString("expires", m)
+	r.SourcePort = toString("source_port", m)
+	r.UnderlayCidr = toString("underlay_cidr", m)
+	r.MatchAll = toString("match_all", m)
+	r.Name = toString("name", m)
 
 	// Make sure group isn't an array
 	if v, ok := m["group"].([]interface{}); ok {
@@ -895,6 +3332,15 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 	if rg, ok := m["groups"]; ok {
 		switch reflect.TypeOf(rg).Kind() {
 		case reflect.Slice:
+			if isGroupSets(rg) {
+				sets, err := convertGroupSets(rg)
+				if err != nil {
+					return r, err
+				}
+				r.GroupSets = sets
+				break
+			}
+
 			v := reflect.ValueOf(rg)
 			r.Groups = make([]string, v.Len())
 			for i := 0; i < v.Len(); i++ {
@@ -910,6 +3356,95 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 	return r, nil
 }
 
+// isGroupSets returns true if groups is in the nested form, a list of lists of groups
+func isGroupSets(groups interface{}) bool {
+	v := reflect.ValueOf(groups)
+	for i := 0; i < v.Len(); i++ {
+		if t := reflect.TypeOf(v.Index(i).Interface()); t != nil && t.Kind() == reflect.Slice {
+			return true
+		}
+	}
+	return false
+}
+
+// convertGroupSets returns the sets of the nested form of groups. A certificate must have every group of a set and
+// any one set will do.
+func convertGroupSets(groups interface{}) ([][]string, error) {
+	v := reflect.ValueOf(groups)
+	sets := make([][]string, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		sv := reflect.ValueOf(v.Index(i).Interface())
+		if sv.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("groups mixes groups and lists of groups, entry #%v should be a list", i)
+		}
+
+		if sv.Len() == 0 {
+			return nil, fmt.Errorf("groups entry #%v is an empty list", i)
+		}
+
+		sets[i] = make([]string, sv.Len())
+		for j := 0; j < sv.Len(); j++ {
+			sets[i][j] = fmt.Sprintf("%v", sv.Index(j).Interface())
+		}
+	}
+
+	return sets, nil
+}
+
+// parseProtos returns the protocols of a rule sorted and without duplicates, so the rules added for a proto list and
+// their hash do not depend on the order it was written in. `any` already covers every protocol and can't be listed
+// with others.
+func parseProtos(names []string) ([]uint8, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("proto list is empty")
+	}
+
+	var protos []uint8
+	for _, name := range names {
+		var proto uint8
+		switch name {
+		case "any":
+			proto = firewall.ProtoAny
+		case "tcp":
+			proto = firewall.ProtoTCP
+		case "udp":
+			proto = firewall.ProtoUDP
+		case "icmp":
+			proto = firewall.ProtoICMP
+		default:
+			return nil, fmt.Errorf("proto was not understood; `%s`", name)
+		}
+
+		if !onlyProtos([]uint8{proto}, protos...) {
+			protos = append(protos, proto)
+		}
+	}
+
+	if len(protos) > 1 && !onlyProtos(protos, firewall.ProtoTCP, firewall.ProtoUDP, firewall.ProtoICMP) {
+		return nil, fmt.Errorf("proto any can not be listed with other protos")
+	}
+
+	sort.Slice(protos, func(i, j int) bool { return protos[i] < protos[j] })
+	return protos, nil
+}
+
+// onlyProtos returns true if every proto in protos is one of allowed
+func onlyProtos(protos []uint8, allowed ...uint8) bool {
+	for _, p := range protos {
+		found := false
+		for _, a := range allowed {
+			if p == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 func parsePort(s string) (startPort, endPort int32, err error) {
 	if s == "any" {
 		startPort = firewall.PortAny
@@ -924,10 +3459,19 @@ func parsePort(s string) (startPort, endPort int32, err error) {
 		sPorts[0] = strings.Trim(sPorts[0], " ")
 		sPorts[1] = strings.Trim(sPorts[1], " ")
 
-		if len(sPorts) != 2 || sPorts[0] == "" || sPorts[1] == "" {
+		if len(sPorts) != 2 || (sPorts[0] == "" && sPorts[1] == "") {
 			return 0, 0, fmt.Errorf("appears to be a range but could not be parsed; `%s`", s)
 		}
 
+		// Open ended ranges run to the first or last port. The first port is 1 since 0 means any
+		if sPorts[0] == "" {
+			sPorts[0] = "1"
+		}
+
+		if sPorts[1] == "" {
+			sPorts[1] = "65535"
+		}
+
 		rStartPort, err := strconv.Atoi(sPorts[0])
 		if err != nil {
 			return 0, 0, fmt.Errorf("beginning range was not a number; `%s`", sPorts[0])
@@ -957,41 +3501,154 @@ func parsePort(s string) (startPort, endPort int32, err error) {
 	return
 }
 
-// TODO: write tests for these
-func setTCPRTTTracking(c *conn, p []byte) {
-	if c.Seq != 0 {
-		return
+// tcpRTTHeaderLen is how much of the tcp header the rtt helpers need, up to and including the flags
+const tcpRTTHeaderLen = 14
+
+// tcpRTTHeader returns the tcp header and what follows it in p for the rtt helpers, false if the ip header length is
+// below the minimum or p is too short to hold the fields they always read. Packets get here once conntrack has parsed
+// them, a truncated or malformed one must not take the process down.
+func tcpRTTHeader(p []byte) ([]byte, bool) {
+	if len(p) < 1 {
+		return nil, false
 	}
 
 	ihl := int(p[0]&0x0f) << 2
+	if ihl < ipv4.HeaderLen || len(p) < ihl+tcpRTTHeaderLen {
+		return nil, false
+	}
+
+	return p[ihl:], true
+}
+
+// tcpRTTTimestamps returns the timestamps option of tcp, from tcpRTTHeader, false if there is none or the data offset
+// doesn't fit in the packet
+func tcpRTTTimestamps(tcp []byte) (tsVal, tsEcr uint32, ok bool) {
+	doff := int(tcp[12]>>4) << 2
+	if doff < 20 || len(tcp) < doff {
+		return 0, 0, false
+	}
+
+	return tcpTimestamps(tcp[20:doff])
+}
+
+// tcpRTTDataLen returns how much sequence space the segment in tcp, from tcpRTTHeader, takes up. SYN and FIN take one
+// each. False if the data offset doesn't fit in the packet.
+func tcpRTTDataLen(tcp []byte) (uint32, bool) {
+	doff := int(tcp[12]>>4) << 2
+	if doff < 20 || len(tcp) < doff {
+		return 0, false
+	}
+
+	n := uint32(len(tcp) - doff)
+	if tcp[13]&tcpSYN != 0 {
+		n++
+	}
+	if tcp[13]&tcpFIN != 0 {
+		n++
+	}
+	return n, true
+}
+
+// setTCPRTTTracking remembers an outbound tcp packet and when it was sent, for checkTCPRTT to time the ack. If the
+// packet carries the timestamps option its TSval is remembered, otherwise its sequence number. Once the ack is seen the
+// next packet is timed, so long lived flows keep adding samples, but no sooner than firewall.tcp_rtt.min_interval after
+// the last one was sent.
+//
+// Only one packet per flow is timed at once. FIN packets, packets too short to read and packets that carry no data are
+// not timed, the last are never acked on their own. Neither are retransmissions, and one while a packet is being timed
+// gives up on it since there is no telling which of the two an ack is for.
+func (f *Firewall) setTCPRTTTracking(c *conn, p []byte, now time.Time) {
+	tcp, ok := tcpRTTHeader(p)
+	if !ok {
+		return
+	}
+
+	n, ok := tcpRTTDataLen(tcp)
+	if !ok || n == 0 {
+		return
+	}
+
+	seq := binary.BigEndian.Uint32(tcp[4:8])
+	if c.sentEnd != 0 && seqBefore(seq, c.sentEnd) {
+		// A retransmission
+		c.Seq = 0
+		c.tsPending = false
+		c.tsVal = 0
+		if seqAfter(seq+n, c.sentEnd) {
+			c.sentEnd = seq + n
+		}
+		return
+	}
+	c.sentEnd = seq + n
+
+	if c.Seq != 0 || c.tsPending {
+		return
+	}
 
 	// Don't track FIN packets
-	if p[ihl+13]&tcpFIN != 0 {
+	if tcp[13]&tcpFIN != 0 {
+		return
+	}
+
+	if f.tcpRTTMinInterval > 0 && !c.Sent.IsZero() && now.Sub(c.Sent) < f.tcpRTTMinInterval {
+		return
+	}
+
+	if tsVal, _, ok := tcpRTTTimestamps(tcp); ok {
+		c.tsVal = tsVal
+		c.tsPending = true
+		c.Sent = now
 		return
 	}
 
-	c.Seq = binary.BigEndian.Uint32(p[ihl+4 : ihl+8])
-	c.Sent = time.Now()
+	c.Seq = seq
+	c.Sent = now
 }
 
-func (f *Firewall) checkTCPRTT(c *conn, p []byte) bool {
-	if c.Seq == 0 {
+// checkTCPRTT records the round trip time in network.tcp.rtt if the inbound tcp packet p acks the packet
+// setTCPRTTTracking is timing, returning true if it did. Packets too short to read never do.
+func (f *Firewall) checkTCPRTT(c *conn, p []byte, now time.Time) bool {
+	if c.Seq == 0 && !c.tsPending {
 		return false
 	}
 
-	ihl := int(p[0]&0x0f) << 2
-	if p[ihl+13]&tcpACK == 0 {
+	tcp, ok := tcpRTTHeader(p)
+	if !ok || tcp[13]&tcpACK == 0 {
 		return false
 	}
 
+	if c.tsPending {
+		_, tsEcr, ok := tcpRTTTimestamps(tcp)
+		if !ok {
+			return false
+		}
+
+		// An echo of an earlier TSval is an ack for something sent before, keep waiting. An echo of a later one means
+		// the ack we were waiting on was lost or reordered, the time since we sent would be too long so start over with
+		// the next packet.
+		d := int32(tsEcr - c.tsVal)
+		if d < 0 {
+			return false
+		}
+
+		c.tsPending = false
+		c.tsVal = 0
+		if d > 0 {
+			return false
+		}
+
+		f.metricTCPRTT.Update(now.Sub(c.Sent).Nanoseconds())
+		return true
+	}
+
 	// Deal with wrap around, signed int cuts the ack window in half
 	// 0 is a bad ack, no data acknowledged
 	// positive number is a bad ack, ack is over half the window away
-	if int32(c.Seq-binary.BigEndian.Uint32(p[ihl+8:ihl+12])) >= 0 {
+	if int32(c.Seq-binary.BigEndian.Uint32(tcp[8:12])) >= 0 {
 		return false
 	}
 
-	f.metricTCPRTT.Update(time.Since(c.Sent).Nanoseconds())
+	f.metricTCPRTT.Update(now.Sub(c.Sent).Nanoseconds())
 	c.Seq = 0
 	return true
 }
@@ -4,27 +4,82 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 )
 
 // ConntrackCache is used as a local routine cache to know if a given flow
 // has been seen in the conntrack table.
-type ConntrackCache map[Packet]struct{}
+//
+// Each packet reading routine owns its own cache, obtained from a ConntrackCacheTicker, so no locking is required.
+// The value of each entry is the firewall rulesVersion that allowed the flow, a cached entry is only trusted while
+// it matches the current rulesVersion, so a firewall reload invalidates cached entries immediately. The whole cache
+// is thrown away every tick so flows removed from conntrack for other reasons stop being cached within one tick.
+type ConntrackCache struct {
+	Entries map[Packet]uint16
+
+	// How the cache was used since the last tick. These are plain counters only touched by the owning routine, the
+	// ConntrackCacheTicker adds them to the shared metrics once per tick.
+	Hits    uint64
+	Misses  uint64
+	Created uint64
+}
+
+// NewConntrackCache returns an empty cache, a nil *ConntrackCache is a disabled cache
+func NewConntrackCache() *ConntrackCache {
+	return &ConntrackCache{Entries: map[Packet]uint16{}}
+}
+
+// Lookup returns true if fp was cached while rulesVersion was current, counting a hit or a miss
+func (c *ConntrackCache) Lookup(fp Packet, rulesVersion uint16) bool {
+	if c == nil {
+		return false
+	}
+
+	if v, ok := c.Entries[fp]; ok && v == rulesVersion {
+		c.Hits++
+		return true
+	}
+
+	c.Misses++
+	return false
+}
+
+// Add caches fp as allowed by rulesVersion
+func (c *ConntrackCache) Add(fp Packet, rulesVersion uint16) {
+	if c == nil {
+		return
+	}
+
+	if _, ok := c.Entries[fp]; !ok {
+		c.Created++
+	}
+	c.Entries[fp] = rulesVersion
+}
 
 type ConntrackCacheTicker struct {
 	cacheV    uint64
 	cacheTick atomic.Uint64
 
-	cache ConntrackCache
+	cache *ConntrackCache
+
+	metricHits    metrics.Counter
+	metricMisses  metrics.Counter
+	metricCreated metrics.Counter
 }
 
-func NewConntrackCacheTicker(d time.Duration) *ConntrackCacheTicker {
+// NewConntrackCacheTicker returns a ticker that resets its cache every d, nil if d is 0. The cache counters are
+// registered with r, the registry of the firewall the cache is for, the global metrics registry is used if nil.
+func NewConntrackCacheTicker(d time.Duration, r metrics.Registry) *ConntrackCacheTicker {
 	if d == 0 {
 		return nil
 	}
 
 	c := &ConntrackCacheTicker{
-		cache: ConntrackCache{},
+		cache:         NewConntrackCache(),
+		metricHits:    metrics.GetOrRegisterCounter("firewall.conntrack.cache.hits", r),
+		metricMisses:  metrics.GetOrRegisterCounter("firewall.conntrack.cache.misses", r),
+		metricCreated: metrics.GetOrRegisterCounter("firewall.conntrack.cache.created", r),
 	}
 
 	go c.tick(d)
@@ -40,20 +95,29 @@ func (c *ConntrackCacheTicker) tick(d time.Duration) {
 }
 
 // Get checks if the cache ticker has moved to the next version before returning
-// the map. If it has moved, we reset the map.
-func (c *ConntrackCacheTicker) Get(l *logrus.Logger) ConntrackCache {
+// the cache. If it has moved, we reset the cache and publish its counters.
+func (c *ConntrackCacheTicker) Get(l *logrus.Logger) *ConntrackCache {
 	if c == nil {
 		return nil
 	}
 	if tick := c.cacheTick.Load(); tick != c.cacheV {
 		c.cacheV = tick
-		if ll := len(c.cache); ll > 0 {
+		c.flush()
+		if ll := len(c.cache.Entries); ll > 0 {
 			if l.Level == logrus.DebugLevel {
 				l.WithField("len", ll).Debug("resetting conntrack cache")
 			}
-			c.cache = make(ConntrackCache, ll)
+			c.cache.Entries = make(map[Packet]uint16, ll)
 		}
 	}
 
 	return c.cache
 }
+
+// flush adds the cache counters to the shared metrics and zeroes them
+func (c *ConntrackCacheTicker) flush() {
+	c.metricHits.Inc(int64(c.cache.Hits))
+	c.metricMisses.Inc(int64(c.cache.Misses))
+	c.metricCreated.Inc(int64(c.cache.Created))
+	c.cache.Hits, c.cache.Misses, c.cache.Created = 0, 0, 0
+}
@@ -0,0 +1,71 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConntrackCache(t *testing.T) {
+	fp := Packet{LocalPort: 1, RemotePort: 2, Protocol: ProtoUDP}
+
+	var disabled *ConntrackCache
+	assert.False(t, disabled.Lookup(fp, 1))
+	disabled.Add(fp, 1)
+
+	c := NewConntrackCache()
+	assert.False(t, c.Lookup(fp, 1))
+	c.Add(fp, 1)
+	c.Add(fp, 1)
+	assert.True(t, c.Lookup(fp, 1))
+
+	// An entry from another rules version is a miss
+	assert.False(t, c.Lookup(fp, 2))
+	c.Add(fp, 2)
+	assert.True(t, c.Lookup(fp, 2))
+
+	assert.Equal(t, uint64(2), c.Hits)
+	assert.Equal(t, uint64(2), c.Misses)
+	assert.Equal(t, uint64(1), c.Created)
+}
+
+func TestConntrackCacheTicker_Flush(t *testing.T) {
+	assert.Nil(t, NewConntrackCacheTicker(0, nil))
+
+	// The counters belong to the registry of the firewall
+	r := metrics.NewRegistry()
+	NewConntrackCacheTicker(time.Hour, r)
+	assert.NotNil(t, r.Get("firewall.conntrack.cache.hits"))
+	assert.NotNil(t, r.Get("firewall.conntrack.cache.misses"))
+	assert.NotNil(t, r.Get("firewall.conntrack.cache.created"))
+
+	l := logrus.New()
+	c := &ConntrackCacheTicker{
+		cache:         NewConntrackCache(),
+		metricHits:    metrics.GetOrRegisterCounter("hits", r),
+		metricMisses:  metrics.GetOrRegisterCounter("misses", r),
+		metricCreated: metrics.GetOrRegisterCounter("created", r),
+	}
+
+	fp := Packet{LocalPort: 1, RemotePort: 2, Protocol: ProtoUDP}
+	cache := c.Get(l)
+	cache.Lookup(fp, 1)
+	cache.Add(fp, 1)
+	cache.Lookup(fp, 1)
+
+	// Nothing is published until the next tick
+	assert.Equal(t, int64(0), c.metricHits.Count())
+
+	c.cacheTick.Add(1)
+	cache = c.Get(l)
+	assert.Empty(t, cache.Entries)
+	assert.Equal(t, int64(1), c.metricHits.Count())
+	assert.Equal(t, int64(1), c.metricMisses.Count())
+	assert.Equal(t, int64(1), c.metricCreated.Count())
+	assert.Equal(t, uint64(0), cache.Hits)
+	assert.Equal(t, uint64(0), cache.Misses)
+	assert.Equal(t, uint64(0), cache.Created)
+}
@@ -14,6 +14,8 @@ const (
 	ProtoTCP  = 6
 	ProtoUDP  = 17
 	ProtoICMP = 1
+	ProtoGRE  = 47
+	ProtoESP  = 50
 
 	PortAny      = 0  // Special value for matching `port: any`
 	PortFragment = -1 // Special value for matching `port: fragment`
@@ -39,24 +41,31 @@ func (fp *Packet) Copy() *Packet {
 	}
 }
 
-func (fp Packet) MarshalJSON() ([]byte, error) {
-	var proto string
-	switch fp.Protocol {
+// ProtoName returns the name of an ip protocol for logs
+func ProtoName(proto uint8) string {
+	switch proto {
 	case ProtoTCP:
-		proto = "tcp"
+		return "tcp"
 	case ProtoICMP:
-		proto = "icmp"
+		return "icmp"
 	case ProtoUDP:
-		proto = "udp"
+		return "udp"
+	case ProtoGRE:
+		return "gre"
+	case ProtoESP:
+		return "esp"
 	default:
-		proto = fmt.Sprintf("unknown %v", fp.Protocol)
+		return fmt.Sprintf("unknown %v", proto)
 	}
+}
+
+func (fp Packet) MarshalJSON() ([]byte, error) {
 	return json.Marshal(m{
 		"LocalIP":    fp.LocalIP.String(),
 		"RemoteIP":   fp.RemoteIP.String(),
 		"LocalPort":  fp.LocalPort,
 		"RemotePort": fp.RemotePort,
-		"Protocol":   proto,
+		"Protocol":   ProtoName(fp.Protocol),
 		"Fragment":   fp.Fragment,
 	})
 }
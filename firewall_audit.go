@@ -0,0 +1,170 @@
+package nebula
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditTriggerStartup = "startup"
+	auditTriggerReload  = "reload"
+	auditTriggerRestore = "restore"
+	auditTriggerAddRule = "runtime_add_rule"
+)
+
+// firewallAuditEvent is a single line in the firewall audit log
+type firewallAuditEvent struct {
+	Time         time.Time `json:"time"`
+	Trigger      string    `json:"trigger"`
+	OldHash      string    `json:"oldHash,omitempty"`
+	NewHash      string    `json:"newHash"`
+	RulesVersion uint16    `json:"rulesVersion"`
+	Added        []string  `json:"added"`
+	Removed      []string  `json:"removed"`
+}
+
+// firewallAuditLog records every change to the firewall policy as json lines in a file.
+// Failing to write an event only results in a warning, it never interferes with the firewall.
+type firewallAuditLog struct {
+	sync.Mutex
+	path string
+	f    *os.File
+	l    *logrus.Logger
+}
+
+// newFirewallAuditLog returns nil if path is empty, all methods are safe to call on a nil firewallAuditLog
+func newFirewallAuditLog(l *logrus.Logger, path string) *firewallAuditLog {
+	if path == "" {
+		return nil
+	}
+
+	return &firewallAuditLog{path: path, l: l}
+}
+
+// Record writes the difference between the old and new rules to the audit log
+func (a *firewallAuditLog) Record(trigger string, oldRules, newRules string, rulesVersion uint16) {
+	if a == nil {
+		return
+	}
+
+	added, removed := diffRules(oldRules, newRules)
+	ev := firewallAuditEvent{
+		Time:         time.Now(),
+		Trigger:      trigger,
+		NewHash:      ruleHash(newRules),
+		RulesVersion: rulesVersion,
+		Added:        added,
+		Removed:      removed,
+	}
+
+	if trigger != auditTriggerStartup {
+		ev.OldHash = ruleHash(oldRules)
+	}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		a.l.WithError(err).Warn("Failed to encode firewall audit event")
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if err := a.open(); err != nil {
+		a.l.WithError(err).WithField("path", a.path).Warn("Failed to open firewall audit log")
+		return
+	}
+
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		a.l.WithError(err).WithField("path", a.path).Warn("Failed to write firewall audit log")
+		// Try again with a fresh file handle next time
+		a.close()
+	}
+}
+
+// Reopen closes the current file handle so the next event is written to a freshly opened file, used after the log
+// has been rotated
+func (a *firewallAuditLog) Reopen() {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	a.close()
+	a.Unlock()
+}
+
+// Close releases the file handle
+func (a *firewallAuditLog) Close() {
+	a.Reopen()
+}
+
+// open makes sure we have a file handle for the file currently at path, if the file was moved or removed by a log
+// rotation a new file is opened. Caller must hold the lock.
+func (a *firewallAuditLog) open() error {
+	if a.f != nil {
+		cur, err := a.f.Stat()
+		if err == nil {
+			disk, err := os.Stat(a.path)
+			if err == nil && os.SameFile(cur, disk) {
+				return nil
+			}
+		}
+
+		a.close()
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	a.f = f
+	return nil
+}
+
+// close releases the file handle, caller must hold the lock
+func (a *firewallAuditLog) close() {
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+}
+
+// diffRules returns the rule lines that are present in newRules but not oldRules and the reverse
+func diffRules(oldRules, newRules string) (added []string, removed []string) {
+	oldLines := map[string]int{}
+	for _, r := range strings.Split(oldRules, "\n") {
+		if r != "" {
+			oldLines[r]++
+		}
+	}
+
+	added = []string{}
+	for _, r := range strings.Split(newRules, "\n") {
+		if r == "" {
+			continue
+		}
+
+		if oldLines[r] > 0 {
+			oldLines[r]--
+		} else {
+			added = append(added, r)
+		}
+	}
+
+	removed = []string{}
+	for _, r := range strings.Split(oldRules, "\n") {
+		if oldLines[r] > 0 {
+			oldLines[r]--
+			removed = append(removed, r)
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,98 @@
+package nebula
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditEvents(t *testing.T, path string) []firewallAuditEvent {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var evs []firewallAuditEvent
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var ev firewallAuditEvent
+		require.NoError(t, json.Unmarshal(s.Bytes(), &ev))
+		evs = append(evs, ev)
+	}
+
+	return evs
+}
+
+func TestFirewallAuditLog(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoTCP, 1, 1, []string{}, "h1", nil, nil, "", ""))
+	fw.auditLog = newFirewallAuditLog(l, path)
+	fw.auditLog.Record(auditTriggerStartup, "", fw.rules, fw.rulesVersion())
+	startRules := fw.rules
+	snap := fw.SnapshotRules()
+
+	// Runtime insertion
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 2, 2, []string{}, "h2", nil, nil, "", ""))
+
+	// Restoring is a change as well
+	fw.RestoreRules(snap)
+
+	evs := readAuditEvents(t, path)
+	require.Len(t, evs, 3)
+
+	assert.Equal(t, auditTriggerStartup, evs[0].Trigger)
+	assert.Empty(t, evs[0].OldHash)
+	assert.Equal(t, ruleHash(startRules), evs[0].NewHash)
+	assert.Len(t, evs[0].Added, 1)
+	assert.Empty(t, evs[0].Removed)
+
+	assert.Equal(t, auditTriggerAddRule, evs[1].Trigger)
+	assert.Equal(t, ruleHash(startRules), evs[1].OldHash)
+	assert.Len(t, evs[1].Added, 1)
+	assert.Contains(t, evs[1].Added[0], "host: h2")
+	assert.Empty(t, evs[1].Removed)
+
+	assert.Equal(t, auditTriggerRestore, evs[2].Trigger)
+	assert.Equal(t, ruleHash(startRules), evs[2].NewHash)
+	assert.Equal(t, uint16(1), evs[2].RulesVersion)
+	assert.Empty(t, evs[2].Added)
+	assert.Len(t, evs[2].Removed, 1)
+
+	// A rotated log results in a new file
+	require.NoError(t, os.Rename(path, path+".1"))
+	fw.auditLog.Record(auditTriggerReload, fw.rules, fw.rules, fw.rulesVersion())
+	assert.Len(t, readAuditEvents(t, path), 1)
+	assert.Len(t, readAuditEvents(t, path+".1"), 3)
+
+	// Failing to write is not fatal
+	fw.auditLog.path = filepath.Join(path, "nope")
+	fw.auditLog.Reopen()
+	fw.auditLog.Record(auditTriggerReload, fw.rules, fw.rules, fw.rulesVersion())
+	fw.Destroy()
+
+	// A nil audit log is a no-op
+	var nilLog *firewallAuditLog
+	nilLog.Record(auditTriggerReload, "", "", 0)
+	nilLog.Reopen()
+}
+
+func Test_diffRules(t *testing.T) {
+	added, removed := diffRules("a\nb\nb\n", "b\nc\n")
+	assert.Equal(t, []string{"c"}, added)
+	assert.Equal(t, []string{"a", "b"}, removed)
+
+	added, removed = diffRules("", "")
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+}
@@ -0,0 +1,45 @@
+package nebula
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+)
+
+// errNoCAPool is what a CA lookup fails with when there is no pool to look in
+var errNoCAPool = errors.New("no ca pool")
+
+// lookupCA returns the CA that signed c
+func lookupCA(c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) (*cert.NebulaCertificate, error) {
+	if caPool == nil {
+		return nil, errNoCAPool
+	}
+	return caPool.GetCAForCert(c)
+}
+
+// checkCALookup is called for a packet no rule matched in a table with ca_name rules. Those rules can't match when the
+// CA of the peer can't be found, which is expected for a CA that is not in the pool but otherwise points at a broken
+// pool, so the failure is counted and logged at debug.
+func (f *Firewall) checkCALookup(h *HostInfo, caPool *cert.NebulaCAPool) {
+	peerCert := h.ConnectionState.peerCert
+	_, err := lookupCA(peerCert, caPool)
+	if err == nil {
+		return
+	}
+
+	f.metricCALookupFailures.Inc(1)
+	if f.l.Level < logrus.DebugLevel {
+		return
+	}
+
+	l := h.logger(f.l).
+		WithField("certName", peerCert.Details.Name).
+		WithField("issuer", peerCert.Details.Issuer).
+		WithError(err)
+	if errors.Is(err, cert.ErrCANotFound) {
+		l.Debug("Firewall ca_name rules skipped, the CA of the peer certificate is not in the CA pool")
+	} else {
+		l.Debug("Firewall ca_name rules skipped, the CA of the peer certificate could not be looked up")
+	}
+}
@@ -0,0 +1,66 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirewall_CALookupFailures(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	l.SetLevel(logrus.DebugLevel)
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:   "host1",
+		Issuer: "signer-shasum",
+	})
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  22,
+		RemotePort: 1000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	assert.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{"any"}, "", nil, nil, "ca-good", ""))
+	assert.True(t, fw.InRules().caNames)
+
+	// The CA is not in the pool
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, h, cert.NewCAPool(), nil))
+	assert.Equal(t, int64(1), fw.metricCALookupFailures.Count())
+	assert.Contains(t, ob.String(), "the CA of the peer certificate is not in the CA pool")
+	assert.Contains(t, ob.String(), "issuer=signer-shasum")
+
+	// No pool at all
+	ob.Reset()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, h, nil, nil))
+	assert.Equal(t, int64(2), fw.metricCALookupFailures.Count())
+	assert.Contains(t, ob.String(), "the CA of the peer certificate could not be looked up")
+	assert.Contains(t, ob.String(), "no ca pool")
+
+	// A good lookup is not a failure
+	cp := cert.NewCAPool()
+	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Equal(t, int64(2), fw.metricCALookupFailures.Count())
+
+	// Nor is a drop by a table without ca_name rules
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	assert.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 23, 23, []string{"any"}, "", nil, nil, "", ""))
+	assert.False(t, fw.InRules().caNames)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, h, cert.NewCAPool(), nil))
+	assert.Zero(t, fw.metricCALookupFailures.Count())
+}
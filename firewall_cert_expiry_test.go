@@ -0,0 +1,64 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_DropCertExpiringSoon(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:     "host1",
+		NotAfter: time.Now().Add(48 * time.Hour),
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"min_cert_remaining": "24h",
+		"inbound":            []interface{}{map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "any"}},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	other := p
+	other.RemotePort = 91
+
+	// Plenty of time left
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+
+	// Within the threshold new flows are dropped but the existing flow carries on
+	c.Details.NotAfter = time.Now().Add(time.Hour)
+	assert.Equal(t, ErrCertExpiringSoon, fw.Drop([]byte{}, other, true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Equal(t, int64(1), fw.metricDroppedCertExpiring.Count())
+
+	// The check is off by default
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "any"}},
+	}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.NoError(t, fw.Drop([]byte{}, other, true, h, cp, nil))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"min_cert_remaining": "-1h"}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.min_cert_remaining must not be negative")
+}
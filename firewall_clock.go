@@ -0,0 +1,17 @@
+package nebula
+
+import "time"
+
+// firewallClock is where the firewall gets the time for conntrack expiry, flow lifetimes, rtt tracking and rule
+// evaluation, so tests can move it along without sleeping
+type firewallClock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock a firewall uses unless a test replaces it. time.Now carries a monotonic reading that
+// time.Time comparisons and Sub prefer, so a step of the wall clock neither expires flows early nor keeps them forever.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,133 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a firewallClock that only moves when told to
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+// newClockedFirewall returns a firewall with a 1 second tcp, 1 minute udp and 1 hour default timeout driven by a fake
+// clock
+func newClockedFirewall() (*Firewall, *fakeClock, metrics.Registry) {
+	r := metrics.NewRegistry()
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+	clock := newFakeClock()
+	fw.clock = clock
+	return fw, clock, r
+}
+
+func TestFirewall_ClockExpiry(t *testing.T) {
+	fw, clock, _ := newClockedFirewall()
+	udp := firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoUDP}
+	icmp := firewall.Packet{RemotePort: 2, Protocol: firewall.ProtoICMP}
+	fw.addConn([]byte{}, udp, true, RuleOptions{})
+	fw.addConn([]byte{}, icmp, true, RuleOptions{})
+	assert.Equal(t, clock.Now().Add(time.Minute), fw.Conntrack.shard(udp).Conns[udp].Expires)
+
+	// A packet refreshes the flow from the time it is seen
+	clock.advance(50 * time.Second)
+	ok, err := fw.inConns(fw.ruleset.Load(), []byte{}, udp, false, nil, nil, nil, netip.Addr{})
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, clock.Now().Add(time.Minute), fw.Conntrack.shard(udp).Conns[udp].Expires)
+
+	clock.advance(50 * time.Second)
+	assert.Zero(t, fw.sweepConntrack())
+	assert.Len(t, fw.Conntrack.conns(), 2)
+
+	// The timer wheel is a tick late at most
+	clock.advance(10*time.Second + time.Second)
+	assert.Equal(t, 1, fw.sweepConntrack())
+	assert.Len(t, fw.Conntrack.conns(), 1)
+	assert.Equal(t, int64(1), fw.metricConntrackExpired.Count())
+
+	// Without a sweeper the wheel is moved along by new flows and purged by the next packet
+	clock.advance(time.Hour + time.Second)
+	fw.addConn([]byte{}, udp, true, RuleOptions{})
+	ok, _ = fw.inConns(fw.ruleset.Load(), []byte{}, icmp, true, nil, nil, nil, netip.Addr{})
+	assert.False(t, ok)
+	assert.Len(t, fw.Conntrack.conns(), 1)
+}
+
+func TestFirewall_ClockAges(t *testing.T) {
+	fw, clock, r := newClockedFirewall()
+	fw.addConn([]byte{}, firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoICMP}, true, RuleOptions{})
+	clock.advance(time.Minute)
+	fw.addConn([]byte{}, firewall.Packet{RemotePort: 2, Protocol: firewall.ProtoICMP}, true, RuleOptions{})
+	clock.advance(time.Second)
+
+	fw.EmitStats()
+	assert.Equal(t, (time.Minute + time.Second).Nanoseconds(), r.Get("firewall.conntrack.oldest_age").(metrics.Gauge).Value())
+	assert.Equal(t, time.Second.Nanoseconds(), r.Get("firewall.conntrack.newest_age").(metrics.Gauge).Value())
+}
+
+func TestFirewall_ClockRevalidationBudget(t *testing.T) {
+	fw, clock, _ := newClockedFirewall()
+	fw.revalidateBudget = 2
+	conntrack := fw.Conntrack.shards[0]
+
+	assert.True(t, fw.takeRevalidation(conntrack))
+	assert.True(t, fw.takeRevalidation(conntrack))
+	assert.False(t, fw.takeRevalidation(conntrack))
+
+	// Refilled once a conntrack tick has passed
+	clock.advance(conntrack.TimerWheel.tickDuration - time.Nanosecond)
+	assert.False(t, fw.takeRevalidation(conntrack))
+	clock.advance(time.Nanosecond)
+	assert.True(t, fw.takeRevalidation(conntrack))
+}
+
+func TestFirewall_ClockTCPRTT(t *testing.T) {
+	fw, clock, r := newClockedFirewall()
+	fp := firewall.Packet{LocalPort: 5000, RemotePort: 22, Protocol: firewall.ProtoTCP}
+
+	segment := func(flags uint8, seq, ack uint32) []byte {
+		b := make([]byte, 40)
+		b[0] = 0x45
+		binary.BigEndian.PutUint32(b[24:28], seq)
+		binary.BigEndian.PutUint32(b[28:32], ack)
+		b[32] = 5 << 4
+		b[33] = flags
+		return b
+	}
+
+	fw.addConn(segment(tcpSYN, 1000, 0), fp, false, RuleOptions{})
+	clock.advance(250 * time.Millisecond)
+	ok, err := fw.inConns(fw.ruleset.Load(), segment(tcpSYN|tcpACK, 5000, 1001), fp, true, nil, nil, nil, netip.Addr{})
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	rtt := r.Get("network.tcp.rtt").(metrics.Histogram)
+	assert.Equal(t, int64(1), rtt.Count())
+	assert.Equal(t, (250 * time.Millisecond).Nanoseconds(), rtt.Max())
+}
@@ -0,0 +1,52 @@
+package nebula
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connRateLimiter is a token bucket for new conntrack entries. It is kept as a generic cell rate algorithm, the time
+// the bucket would next be full, so checking a packet is an atomic load and compare and swap instead of a lock.
+type connRateLimiter struct {
+	// How long one token takes to refill
+	interval int64
+	// How far ahead of now the bucket may run, the burst in time
+	limit int64
+	// Theoretical arrival time of the next new flow, in unix nanoseconds
+	tat atomic.Int64
+}
+
+// newConnRateLimiter returns a limiter that allows rate new flows per second on average and burst at once
+func newConnRateLimiter(rate, burst int) *connRateLimiter {
+	interval := int64(time.Second) / int64(rate)
+	return &connRateLimiter{
+		interval: interval,
+		limit:    interval * int64(burst),
+	}
+}
+
+// allow takes a token, returning false if the bucket is empty
+func (r *connRateLimiter) allow(now int64) bool {
+	return r.allowFrom(&r.tat, now)
+}
+
+// allowFrom is allow for a bucket kept elsewhere, so many buckets can share the rate and burst of r
+func (r *connRateLimiter) allowFrom(bucket *atomic.Int64, now int64) bool {
+	for {
+		old := bucket.Load()
+		tat := old
+		if tat < now {
+			tat = now
+		}
+
+		next := tat + r.interval
+		if next-now > r.limit {
+			return false
+		}
+
+		// Another routine took a token first if this fails, try again with the bucket it left
+		if bucket.CompareAndSwap(old, next) {
+			return true
+		}
+	}
+}
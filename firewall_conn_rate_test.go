@@ -0,0 +1,131 @@
+package nebula
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnRateLimiter(t *testing.T) {
+	r := newConnRateLimiter(10, 3)
+	now := time.Now().UnixNano()
+
+	// The burst is available right away
+	assert.True(t, r.allow(now))
+	assert.True(t, r.allow(now))
+	assert.True(t, r.allow(now))
+	assert.False(t, r.allow(now))
+
+	// Then one token every 100ms
+	now += int64(50 * time.Millisecond)
+	assert.False(t, r.allow(now))
+	now += int64(50 * time.Millisecond)
+	assert.True(t, r.allow(now))
+	assert.False(t, r.allow(now))
+
+	// A quiet period refills the bucket but no further than the burst
+	now += int64(time.Hour)
+	assert.True(t, r.allow(now))
+	assert.True(t, r.allow(now))
+	assert.True(t, r.allow(now))
+	assert.False(t, r.allow(now))
+}
+
+func TestConnRateLimiter_Concurrent(t *testing.T) {
+	r := newConnRateLimiter(1, 100)
+	now := time.Now().UnixNano()
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if r.allow(now) {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// No token is handed out twice
+	assert.Equal(t, int64(100), allowed.Load())
+}
+
+func TestFirewall_DropConnRate(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"new_connection_rate": 1, "new_connection_burst": 2},
+		"inbound":   []interface{}{map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "any"}},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	flow := func(port uint16) firewall.Packet {
+		fp := p
+		fp.RemotePort = port
+		return fp
+	}
+
+	// The burst of new flows is let through, the next one is not
+	assert.NoError(t, fw.Drop([]byte{}, flow(1), true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, flow(2), true, h, cp, nil))
+	assert.Equal(t, ErrConnRateExceeded, fw.Drop([]byte{}, flow(3), true, h, cp, nil))
+	assert.Equal(t, int64(1), fw.metricDroppedConnRate.Count())
+	assert.Len(t, fw.Conntrack.conns(), 2)
+
+	// Flows in conntrack are never limited
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, fw.Drop([]byte{}, flow(1), true, h, cp, nil))
+		assert.NoError(t, fw.Drop([]byte{}, flow(2), false, h, cp, nil))
+	}
+	assert.Equal(t, int64(1), fw.metricDroppedConnRate.Count())
+
+	// The reject decision follows the direction's action
+	assert.False(t, ShouldReject(ErrConnRateExceeded, fw.InSendReject))
+	assert.True(t, ShouldReject(ErrConnRateExceeded, true))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"new_connection_rate": -1},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.new_connection_rate must not be negative")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"new_connection_rate": 10, "new_connection_burst": 0},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.new_connection_burst must be positive")
+
+	// Unlimited by default
+	conf.Settings["firewall"] = map[interface{}]interface{}{}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Nil(t, fw.connRate)
+}
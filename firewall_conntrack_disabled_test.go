@@ -0,0 +1,86 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_ConntrackDisabled(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"enabled": false},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.True(t, fw.conntrackDisabled)
+	assert.Contains(t, ob.String(), "only one direction has firewall rules")
+
+	// The sweeper has nothing to do
+	fw.startConntrackSweeper()
+	assert.Nil(t, fw.sweeper)
+
+	cp := cert.NewCAPool()
+	in := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+
+	// Allowed packets are checked every time and never tracked
+	assert.NoError(t, fw.Drop(b, in, true, h, cp, nil))
+	assert.NoError(t, fw.Drop(b, in, true, h, cp, nil))
+	assert.Zero(t, fw.Conntrack.size.Load())
+
+	// So the reply needs an outbound rule
+	out := in
+	out.LocalPort, out.RemotePort = in.RemotePort, in.LocalPort
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, out, false, h, cp, nil))
+
+	require.NoError(t, fw.AddRule(false, firewall.ProtoTCP, 0, 0, []string{}, "any", nil, nil, "", ""))
+	assert.NoError(t, fw.Drop(b, out, false, h, cp, nil))
+	assert.Zero(t, fw.Conntrack.size.Load())
+
+	// Rules both ways are what it takes
+	ob.Reset()
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"enabled": false},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any"},
+		},
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "tcp", "host": "any"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.NotContains(t, ob.String(), "only one direction has firewall rules")
+}
@@ -0,0 +1,119 @@
+package nebula
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// evictScanMax is how many timer wheel entries a full conntrack shard looks at for one to evict, so the cost of a new
+// flow stays bounded however big conntrack is
+const evictScanMax = 64
+
+// evictClass orders conntrack entries by how little it hurts to evict them when conntrack is full, cheapest first
+type evictClass int
+
+const (
+	// Expired entries that have not been purged yet
+	evictExpired evictClass = iota
+	// udp, icmp and other flows, which carry no connection state
+	evictStateless
+	// tcp flows that never finished their handshake or are closing
+	evictTCPUnestablished
+	// tcp flows that are up, the last resort
+	evictTCPEstablished
+	evictClassMax
+)
+
+var evictClassNames = [evictClassMax]string{"expired", "stateless", "tcp_unestablished", "tcp_established"}
+
+func newEvictMetrics(r metrics.Registry) [evictClassMax]metrics.Counter {
+	var m [evictClassMax]metrics.Counter
+	for i, name := range evictClassNames {
+		m[i] = metrics.GetOrRegisterCounter("firewall.conntrack.evicted."+name, r)
+	}
+	return m
+}
+
+// setMaxConns caps conntrack at n entries, 0 for unlimited. Each shard gets its share, rounded up so the cap is never
+// below what was asked for. It must be set again if conntrack is replaced.
+func (f *Firewall) setMaxConns(n int) {
+	shards := len(f.Conntrack.shards)
+	f.maxConns = n
+	f.maxConnsPerShard = (n + shards - 1) / shards
+}
+
+// evictClassOf returns the class of c, an entry that has not expired. Caller must hold the conntrack lock.
+func evictClassOf(fp firewall.Packet, c *conn) evictClass {
+	if fp.Protocol != firewall.ProtoTCP {
+		return evictStateless
+	}
+
+	switch c.tcpState {
+	case tcpStateEstablished:
+		return evictTCPEstablished
+	case tcpStateNone:
+		// The handshake was missed, go by whether both sides are talking
+		if c.bidirectional() {
+			return evictTCPEstablished
+		}
+	}
+
+	return evictTCPUnestablished
+}
+
+// makeRoom removes an entry from a full conntrack shard for a new flow, returning false if there was nothing it could
+// remove. Expired entries go first, then the entry of the cheapest class that expires soonest. Only the expired list
+// and the first evictScanMax entries of the timer wheel are looked at, pinned entries are never evicted.
+// Caller must hold the shard lock.
+func (f *Firewall) makeRoom(conntrack *conntrackShard) bool {
+	now := f.clock.Now()
+	conntrack.TimerWheel.Advance(now)
+	for i := 0; i < f.purgeBudget; i++ {
+		ep, has := conntrack.TimerWheel.Purge()
+		if !has {
+			break
+		}
+		if f.evict(conntrack, ep) {
+			f.metricEvicted[evictExpired].Inc(1)
+			return true
+		}
+	}
+
+	var victims [evictClassMax]firewall.Packet
+	var found [evictClassMax]bool
+	conntrack.TimerWheel.Soonest(evictScanMax, func(fp firewall.Packet) bool {
+		c, ok := conntrack.Conns[fp]
+		if !ok || c.pinned {
+			// Removed or re-added since, or never to be evicted
+			return true
+		}
+
+		class := evictExpired
+		if c.Expires.After(now) {
+			class = evictClassOf(fp, c)
+		}
+		if !found[class] {
+			victims[class], found[class] = fp, true
+		}
+
+		// Nothing beats what we have in hand
+		return class > evictStateless
+	})
+
+	for class := evictExpired; class < evictClassMax; class++ {
+		if !found[class] {
+			continue
+		}
+
+		fp := victims[class]
+		c := conntrack.Conns[fp]
+		f.exportFlow(fp, c)
+		f.observeLifetime(fp, c)
+		f.flowEnded(fp, c, FlowEvicted)
+		conntrack.remove(fp)
+		f.metricEvicted[class].Inc(1)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,138 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_MaxConnectionsEviction(t *testing.T) {
+	l := test.NewLogger()
+	fw := NewFirewall(l, time.Hour, time.Minute, time.Hour, &cert.NebulaCertificate{}, metrics.NewRegistry())
+	fw.maxConnsPerShard = 3
+
+	flow := func(proto uint8, port uint16) firewall.Packet {
+		return firewall.Packet{RemotePort: port, Protocol: proto}
+	}
+	add := func(fp firewall.Packet, state tcpState) {
+		t.Helper()
+		fw.addConn([]byte{}, fp, true, RuleOptions{})
+		if c, ok := fw.Conntrack.conns()[fp]; ok && state != tcpStateNone {
+			c.tcpState = state
+		}
+	}
+	evicted := func() []int64 {
+		var v []int64
+		for _, m := range fw.metricEvicted {
+			v = append(v, m.Count())
+		}
+		return v
+	}
+
+	established := flow(firewall.ProtoTCP, 1)
+	add(established, tcpStateEstablished)
+	add(flow(firewall.ProtoTCP, 2), tcpStateSynSent)
+	add(flow(firewall.ProtoUDP, 3), tcpStateNone)
+
+	// Stateless flows go first
+	add(flow(firewall.ProtoUDP, 4), tcpStateNone)
+	assert.NotContains(t, fw.Conntrack.conns(), flow(firewall.ProtoUDP, 3))
+	add(flow(firewall.ProtoTCP, 5), tcpStateNone)
+	assert.NotContains(t, fw.Conntrack.conns(), flow(firewall.ProtoUDP, 4))
+	assert.Equal(t, []int64{0, 2, 0, 0}, evicted())
+
+	// Then tcp flows that are not established, the one expiring soonest
+	add(flow(firewall.ProtoTCP, 6), tcpStateNone)
+	assert.NotContains(t, fw.Conntrack.conns(), flow(firewall.ProtoTCP, 2))
+	assert.Equal(t, []int64{0, 2, 1, 0}, evicted())
+
+	// Anything expired beats them all
+	fw.Conntrack.conns()[flow(firewall.ProtoTCP, 6)].Expires = time.Now().Add(-time.Second)
+	add(flow(firewall.ProtoTCP, 7), tcpStateNone)
+	assert.NotContains(t, fw.Conntrack.conns(), flow(firewall.ProtoTCP, 6))
+	assert.Equal(t, []int64{1, 2, 1, 0}, evicted())
+
+	// Replacing an entry needs no room
+	add(flow(firewall.ProtoTCP, 7), tcpStateNone)
+	assert.Equal(t, []int64{1, 2, 1, 0}, evicted())
+
+	// Pinned flows are never evicted, with nothing to evict the new flow is not tracked
+	for _, fp := range []firewall.Packet{established, flow(firewall.ProtoTCP, 5), flow(firewall.ProtoTCP, 7)} {
+		require.NoError(t, fw.PinFlow(fp))
+	}
+	add(flow(firewall.ProtoTCP, 8), tcpStateNone)
+	assert.NotContains(t, fw.Conntrack.conns(), flow(firewall.ProtoTCP, 8))
+	assert.Equal(t, int64(1), fw.metricConntrackFull.Count())
+
+	// Established flows are the last resort
+	assert.True(t, fw.UnpinFlow(established))
+	add(flow(firewall.ProtoTCP, 8), tcpStateNone)
+	assert.NotContains(t, fw.Conntrack.conns(), established)
+	assert.Contains(t, fw.Conntrack.conns(), flow(firewall.ProtoTCP, 8))
+	assert.Equal(t, []int64{1, 2, 1, 1}, evicted())
+	assert.Len(t, fw.Conntrack.conns(), 3)
+}
+
+func TestNewFirewallFromConfig_MaxConnections(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections": 10, "shards": 4},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fw.maxConnsPerShard)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Zero(t, fw.maxConnsPerShard)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections": -1},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.max_connections must not be negative")
+}
+
+func TestFirewall_MaxConnectionsReload(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections": 8, "shards": 4},
+	}
+	oldFw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, oldFw.maxConnsPerShard)
+
+	// The new shard count only applies to a new conntrack, the cap is spread over the 4 shards that are kept
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections": 16, "shards": 8},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fw.maxConnsPerShard)
+	fw.InheritConntrack(oldFw)
+	assert.Len(t, fw.Conntrack.shards, 4)
+	assert.Equal(t, 4, fw.maxConnsPerShard)
+
+	// And the other way
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections": 8, "shards": 2},
+	}
+	newFw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	newFw.InheritConntrack(fw)
+	assert.Equal(t, 2, newFw.maxConnsPerShard)
+}
@@ -0,0 +1,97 @@
+package nebula
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slackhq/nebula/firewall"
+)
+
+// maxExpectations is how many flows may be expected at once, see Firewall.Expect
+const maxExpectations = 1024
+
+var ErrTooManyExpectations = errors.New("too many expected flows")
+var ErrInvalidExpectation = errors.New("expected flow is not valid")
+
+// conntrackExpectations are the flows conntrack helpers said to expect, see Firewall.Expect. They belong to
+// FirewallConntrack so they carry over to new rules along with it.
+type conntrackExpectations struct {
+	sync.Mutex
+
+	// When each expectation runs out, in unix nanoseconds
+	flows map[firewall.Packet]int64
+
+	// How many flows are expected, read without the lock so packets don't take it while nothing is expected
+	size atomic.Int64
+}
+
+func newConntrackExpectations() *conntrackExpectations {
+	return &conntrackExpectations{flows: make(map[firewall.Packet]int64)}
+}
+
+// Expect lets the first packet of the flow fp through the firewall in either direction within ttl, whatever the rules
+// say, and tracks the flow from then on as if a rule had allowed it. It is meant for conntrack helpers that read the
+// control channel of protocols like FTP or SIP to learn the ports of the data channel it negotiates, the helper
+// decides which control channels it trusts. fp is seen from this host, a RemotePort of 0 matches any remote port
+// since the peer usually picks its own. An expectation is used up by the flow it lets through.
+//
+// Flows let through by an expectation are checked against the rules like any other once the rules change.
+func (f *Firewall) Expect(fp firewall.Packet, ttl time.Duration) error {
+	if fp.Fragment || ttl <= 0 || f.conntrackDisabled {
+		return ErrInvalidExpectation
+	}
+
+	e := f.Conntrack.expected
+	now := f.clock.Now().UnixNano()
+
+	e.Lock()
+	defer e.Unlock()
+
+	if _, ok := e.flows[fp]; !ok && len(e.flows) >= maxExpectations {
+		e.prune(now)
+		if len(e.flows) >= maxExpectations {
+			return ErrTooManyExpectations
+		}
+	}
+
+	e.flows[fp] = now + int64(ttl)
+	e.size.Store(int64(len(e.flows)))
+	return nil
+}
+
+// take returns true if fp is expected, using up the expectation
+func (e *conntrackExpectations) take(fp firewall.Packet, now int64) bool {
+	if e.size.Load() == 0 || fp.Fragment {
+		return false
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	key := fp
+	expires, ok := e.flows[key]
+	if !ok {
+		key.RemotePort = 0
+		expires, ok = e.flows[key]
+	}
+
+	if !ok {
+		return false
+	}
+
+	delete(e.flows, key)
+	e.size.Store(int64(len(e.flows)))
+	return now < expires
+}
+
+// prune removes expectations that have run out, caller must hold the lock
+func (e *conntrackExpectations) prune(now int64) {
+	for fp, expires := range e.flows {
+		if now >= expires {
+			delete(e.flows, fp)
+		}
+	}
+	e.size.Store(int64(len(e.flows)))
+}
@@ -0,0 +1,87 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirewall_Expect(t *testing.T) {
+	fw, clock, _ := newClockedFirewall()
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	fw.ruleset.Load().localIps.AddCIDR(&ipNet, struct{}{})
+
+	peerIp := net.IPNet{IP: net.IPv4(1, 2, 3, 5), Mask: net.IPMask{255, 255, 255, 0}}
+	h, _ := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host2",
+		Ips:  []*net.IPNet{&peerIp},
+	})
+	cp := cert.NewCAPool()
+
+	data := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(peerIp.IP),
+		LocalPort:  50000,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, data, true, h, cp, nil))
+
+	// The peer picks its own port
+	expect := data
+	expect.RemotePort = 0
+	assert.NoError(t, fw.Expect(expect, time.Second))
+	assert.NoError(t, fw.Drop(b, data, true, h, cp, nil))
+	assert.Equal(t, int64(1), fw.incomingMetrics.allowedExpected.Count())
+
+	// The flow is tracked from then on, the expectation is used up
+	assert.NoError(t, fw.Drop(b, data, true, h, cp, nil))
+	other := data
+	other.RemotePort = 40001
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, other, true, h, cp, nil))
+
+	// Expectations run out
+	data.LocalPort = 50001
+	assert.NoError(t, fw.Expect(data, time.Second))
+	clock.advance(time.Second)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, data, false, h, cp, nil))
+	assert.Zero(t, fw.Conntrack.expected.size.Load())
+
+	// Either direction may start the flow
+	data.LocalPort = 50002
+	assert.NoError(t, fw.Expect(data, time.Second))
+	assert.NoError(t, fw.Drop(b, data, false, h, cp, nil))
+	assert.Equal(t, int64(1), fw.outgoingMetrics.allowedExpected.Count())
+
+	// Expectations carry over to new rules
+	data.LocalPort = 50003
+	assert.NoError(t, fw.Expect(data, time.Second))
+	fw2, _, _ := newClockedFirewall()
+	fw2.ruleset.Load().localIps = fw.ruleset.Load().localIps
+	fw2.InheritConntrack(fw)
+	assert.NoError(t, fw2.Drop(b, data, true, h, cp, nil))
+
+	// There is a limit, expired expectations make room
+	for i := 0; i < maxExpectations; i++ {
+		data.LocalPort = uint16(i)
+		assert.NoError(t, fw.Expect(data, time.Second))
+	}
+	data.LocalPort = 60000
+	assert.Equal(t, ErrTooManyExpectations, fw.Expect(data, time.Second))
+	clock.advance(time.Second)
+	assert.NoError(t, fw.Expect(data, time.Second))
+	assert.Equal(t, int64(1), fw.Conntrack.expected.size.Load())
+
+	data.Fragment = true
+	assert.Equal(t, ErrInvalidExpectation, fw.Expect(data, time.Second))
+	data.Fragment = false
+	assert.Equal(t, ErrInvalidExpectation, fw.Expect(data, 0))
+}
@@ -0,0 +1,33 @@
+package nebula
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/slackhq/nebula/iputil"
+)
+
+// conntrackHosts counts conntrack entries per remote vpn ip across every shard, for
+// firewall.conntrack.max_connections_per_host. A host keeps its counter once it has been seen, even at zero, so there
+// is at most one per remote address allowed by the certificates of our peers.
+type conntrackHosts struct {
+	counts sync.Map // iputil.VpnIp -> *atomic.Int64
+}
+
+// add changes the count for ip by n
+func (h *conntrackHosts) add(ip iputil.VpnIp, n int64) {
+	v, ok := h.counts.Load(ip)
+	if !ok {
+		v, _ = h.counts.LoadOrStore(ip, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Add(n)
+}
+
+// count returns how many conntrack entries ip has
+func (h *conntrackHosts) count(ip iputil.VpnIp) int64 {
+	v, ok := h.counts.Load(ip)
+	if !ok {
+		return 0
+	}
+	return v.(*atomic.Int64).Load()
+}
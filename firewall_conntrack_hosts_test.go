@@ -0,0 +1,81 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_MaxConnectionsPerHost(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections_per_host": 2, "shards": 4},
+		"inbound":   []interface{}{map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "any"}},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	flow := func(port uint16) firewall.Packet {
+		fp := p
+		fp.RemotePort = port
+		return fp
+	}
+
+	// The count is kept across shards, flows past the limit are allowed but not tracked
+	for i := uint16(1); i <= 5; i++ {
+		assert.NoError(t, fw.Drop([]byte{}, flow(i), true, h, cp, nil))
+	}
+	assert.Len(t, fw.Conntrack.conns(), 2)
+	assert.Equal(t, int64(2), fw.Conntrack.shards[0].hosts.count(p.RemoteIP))
+	assert.Equal(t, int64(3), fw.metricPerHostLimit.Count())
+
+	// A tracked flow is still refreshed at the limit
+	assert.NoError(t, fw.Drop([]byte{}, flow(1), true, h, cp, nil))
+	assert.Equal(t, int64(3), fw.metricPerHostLimit.Count())
+
+	// Another host has its own count
+	other := flow(1)
+	other.RemoteIP = iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5))
+	fw.addConn([]byte{}, other, true, RuleOptions{})
+	assert.Len(t, fw.Conntrack.conns(), 3)
+	assert.Equal(t, int64(1), fw.Conntrack.shards[0].hosts.count(other.RemoteIP))
+
+	// Flushing a host frees its room
+	fw.FlushConntrackFor(p.RemoteIP)
+	assert.Equal(t, int64(0), fw.Conntrack.shards[0].hosts.count(p.RemoteIP))
+	assert.Equal(t, int64(1), fw.Conntrack.shards[0].hosts.count(other.RemoteIP))
+	assert.NoError(t, fw.Drop([]byte{}, flow(3), true, h, cp, nil))
+	assert.Equal(t, int64(1), fw.Conntrack.shards[0].hosts.count(p.RemoteIP))
+
+	// So does flushing everything
+	fw.FlushConntrack()
+	assert.Equal(t, int64(0), fw.Conntrack.shards[0].hosts.count(p.RemoteIP))
+	assert.Equal(t, int64(0), fw.Conntrack.shards[0].hosts.count(other.RemoteIP))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"max_connections_per_host": -1},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.max_connections_per_host must not be negative")
+}
@@ -0,0 +1,56 @@
+package nebula
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// loadMaxFlowLifetimes reads firewall.conntrack.max_flow_lifetime for each conntrack protocol, 0 leaves flows of that
+// protocol to live as long as they see traffic
+func (f *Firewall) loadMaxFlowLifetimes(c *config.C) error {
+	for i, name := range conntrackProtoNames {
+		key := "firewall.conntrack.max_flow_lifetime." + name
+		f.maxFlowLifetimes[i] = c.GetDuration(key, 0)
+		if f.maxFlowLifetimes[i] < 0 {
+			return fmt.Errorf("%s must not be negative", key)
+		}
+	}
+
+	return nil
+}
+
+// pastLifetime returns true if c has been in conntrack for longer than the max flow lifetime of its protocol. Pinned
+// entries never are. Caller must hold the conntrack lock.
+func (f *Firewall) pastLifetime(fp firewall.Packet, c *conn, now time.Time) bool {
+	lifetime := f.maxFlowLifetimes[conntrackProto(fp.Protocol)]
+	return lifetime > 0 && !c.pinned && now.Sub(c.started) > lifetime
+}
+
+// readmit replaces c, an entry past its lifetime that the current rules still allow, with a new entry for the same
+// flow. The old entry ends as if it had expired, the new one keeps the direction, tcp state, tcp window and rule
+// timeout so the flow carries on where it left off. Caller must hold the shard lock, c must not be used after.
+func (f *Firewall) readmit(conntrack *conntrackShard, fp firewall.Packet, c *conn) *conn {
+	f.exportFlow(fp, c)
+	f.observeLifetime(fp, c)
+	f.flowEnded(fp, c, FlowLifetimeExceeded)
+	f.metricConntrackLifetimeExceeded.Inc(1)
+
+	n := conntrack.newConn(c.incoming)
+	n.tcpState = c.tcpState
+	n.timeout = c.timeout
+	n.Seq = c.Seq
+	n.Sent = c.Sent
+	n.tsPending = c.tsPending
+	n.tsVal = c.tsVal
+	n.sentEnd = c.sentEnd
+	n.Meta = c.Meta
+	n.window = c.window
+
+	// The timer for the old entry is still in the wheel and now covers the new one
+	f.storeConn(conntrack, fp, n, c.Expires.Sub(f.clock.Now()), c.rulesVersion)
+	f.flowStarted(fp, n)
+	return n
+}
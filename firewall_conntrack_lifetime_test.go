@@ -0,0 +1,120 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_MaxFlowLifetime(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{
+			"max_flow_lifetime": map[interface{}]interface{}{"udp": "1h"},
+		},
+	}
+	fw := NewFirewall(l, time.Second, time.Second, time.Second, c, metrics.NewRegistry())
+	require.NoError(t, fw.loadMaxFlowLifetimes(conf))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoUDP, 10, 10, []string{"any"}, "", nil, nil, "", ""))
+	assert.Equal(t, time.Hour, fw.maxFlowLifetimes[conntrackProtoUDP])
+	assert.Zero(t, fw.maxFlowLifetimes[conntrackProtoTCP])
+	none := NewFirewall(l, time.Second, time.Second, time.Second, c, metrics.NewRegistry()).SnapshotRules()
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	age := func() *conn {
+		conntrack := fw.Conntrack.shard(p)
+		conntrack.Lock()
+		defer conntrack.Unlock()
+		ct := conntrack.Conns[p]
+		ct.started = ct.started.Add(-2 * time.Hour)
+		return ct
+	}
+
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
+
+	// A reply past the lifetime is checked against the inbound rules that allowed the flow and carries on
+	age()
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
+	assert.Equal(t, int64(1), fw.metricConntrackLifetimeExceeded.Count())
+	ct := fw.Conntrack.shard(p).Conns[p]
+	assert.True(t, ct.incoming)
+	assert.Less(t, time.Since(ct.started), time.Minute)
+
+	// Within the lifetime the flow does not touch the rules
+	fw.RestoreRules(none)
+	fw.Conntrack.shard(p).Conns[p].rulesVersion = fw.rulesVersion()
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+
+	// Pinned flows live forever
+	require.NoError(t, fw.PinFlow(p))
+	age()
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Equal(t, int64(1), fw.metricConntrackLifetimeExceeded.Count())
+
+	// Once the rules no longer allow it, the flow ends at its lifetime however busy it is
+	assert.True(t, fw.UnpinFlow(p))
+	fw.Conntrack.shard(p).Conns[p].rulesVersion = fw.rulesVersion()
+	age()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.NotContains(t, fw.Conntrack.conns(), p)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{
+			"max_flow_lifetime": map[interface{}]interface{}{"tcp": "-1s"},
+		},
+	}
+	assert.EqualError(t, fw.loadMaxFlowLifetimes(conf), "firewall.conntrack.max_flow_lifetime.tcp must not be negative")
+}
+
+func TestFirewall_readmit(t *testing.T) {
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Second, time.Second, &cert.NebulaCertificate{}, metrics.NewRegistry())
+	p := firewall.Packet{LocalPort: 10, RemotePort: 90, Protocol: firewall.ProtoTCP}
+	conntrack := fw.Conntrack.shard(p)
+
+	// The state of the flow carries over, rtt tracking included so a packet being timed is still timed, as does what
+	// OnNewConn stored for it
+	sent := time.Now()
+	conntrack.Lock()
+	old := conntrack.newConn(false)
+	old.tcpState = tcpStateEstablished
+	old.tsPending = true
+	old.tsVal = 7
+	old.Sent = sent
+	old.sentEnd = 1000
+	old.Meta = "meta"
+	fw.storeConn(conntrack, p, old, time.Minute, fw.rulesVersion())
+	n := fw.readmit(conntrack, p, old)
+	conntrack.Unlock()
+
+	assert.Same(t, n, conntrack.Conns[p])
+	assert.Equal(t, tcpStateEstablished, n.tcpState)
+	assert.True(t, n.tsPending)
+	assert.Equal(t, uint32(7), n.tsVal)
+	assert.Equal(t, sent, n.Sent)
+	assert.Equal(t, uint32(1000), n.sentEnd)
+	assert.Equal(t, "meta", n.Meta)
+}
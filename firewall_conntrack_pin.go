@@ -0,0 +1,70 @@
+package nebula
+
+import (
+	"errors"
+
+	"github.com/slackhq/nebula/firewall"
+)
+
+// defaultMaxPinned is how many conntrack entries may be pinned unless firewall.conntrack.max_pinned says otherwise
+const defaultMaxPinned = 16
+
+var ErrFlowNotTracked = errors.New("flow is not in conntrack")
+var ErrTooManyPinnedFlows = errors.New("too many pinned flows, see firewall.conntrack.max_pinned")
+
+// PinFlow pins the conntrack entry for fp, so it never expires and carries over to new rules without being checked
+// against them, even if they would no longer allow it. The flow must already be in conntrack. Pins are kept across
+// reloads and may be removed by UnpinFlow or by flushing conntrack.
+func (f *Firewall) PinFlow(fp firewall.Packet) error {
+	conntrack := f.Conntrack.shard(fp)
+	conntrack.Lock()
+	defer conntrack.Unlock()
+
+	c, ok := conntrack.Conns[fp]
+	if !ok {
+		return ErrFlowNotTracked
+	}
+
+	if c.pinned {
+		return nil
+	}
+
+	if conntrack.pinned.Add(1) > f.maxPinned {
+		conntrack.pinned.Add(-1)
+		return ErrTooManyPinnedFlows
+	}
+
+	c.pinned = true
+	f.l.WithField("fwPacket", fp).
+		WithField("incoming", c.incoming).
+		WithField("pinned", conntrack.pinned.Load()).
+		Warn("Pinned a conntrack entry, it will not expire or be checked against new rules until it is unpinned")
+
+	return nil
+}
+
+// UnpinFlow undoes PinFlow. The entry is checked against the current rules with its next packet and expires as usual
+// from then on. Returns false if fp was not pinned.
+func (f *Firewall) UnpinFlow(fp firewall.Packet) bool {
+	conntrack := f.Conntrack.shard(fp)
+	conntrack.Lock()
+	defer conntrack.Unlock()
+
+	c, ok := conntrack.Conns[fp]
+	if !ok || !c.pinned {
+		return false
+	}
+
+	c.pinned = false
+	conntrack.pinned.Add(-1)
+
+	// Rules may have changed while it was pinned, any other version forces the check
+	c.rulesVersion = f.rulesVersion() - 1
+
+	f.l.WithField("fwPacket", fp).
+		WithField("incoming", c.incoming).
+		WithField("pinned", conntrack.pinned.Load()).
+		Warn("Unpinned a conntrack entry")
+
+	return true
+}
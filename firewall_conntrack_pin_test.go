@@ -0,0 +1,77 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirewall_PinFlow(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	fw := NewFirewall(l, time.Second, time.Second, time.Second, c, metrics.NewRegistry())
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 10, 11, []string{"any"}, "", nil, nil, "", ""))
+	fw.maxPinned = 1
+	allowed := fw.SnapshotRules()
+	none := NewFirewall(l, time.Second, time.Second, time.Second, c, metrics.NewRegistry()).SnapshotRules()
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	other := p
+	other.LocalPort = 11
+
+	assert.Equal(t, ErrFlowNotTracked, fw.PinFlow(p))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, other, true, h, cp, nil))
+
+	assert.NoError(t, fw.PinFlow(p))
+	assert.NoError(t, fw.PinFlow(p), "pinning again is fine")
+	assert.Equal(t, ErrTooManyPinnedFlows, fw.PinFlow(other))
+
+	entries := fw.ListConntrack(ConntrackFilter{Protocol: firewall.ProtoUDP, Port: 10})
+	if assert.Len(t, entries, 1) {
+		assert.True(t, entries[0].Pinned)
+	}
+
+	// New rules that no longer allow either flow keep the pinned one
+	fw.RestoreRules(none)
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, other, true, h, cp, nil))
+
+	// It does not expire either
+	time.Sleep(2100 * time.Millisecond)
+	fw.Conntrack.shard(p).TimerWheel.Advance(time.Now())
+	assert.Zero(t, fw.sweepConntrack())
+	assert.Contains(t, fw.Conntrack.conns(), p)
+
+	// Once unpinned it is checked against the rules again
+	assert.True(t, fw.UnpinFlow(p))
+	assert.False(t, fw.UnpinFlow(p))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.NotContains(t, fw.Conntrack.conns(), p)
+
+	// Removing a pinned entry frees its pin
+	fw.RestoreRules(allowed)
+	assert.NoError(t, fw.Drop([]byte{}, other, true, h, cp, nil))
+	assert.NoError(t, fw.PinFlow(other))
+	assert.Equal(t, 1, fw.FlushConntrackProto(firewall.ProtoUDP))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.NoError(t, fw.PinFlow(p))
+}
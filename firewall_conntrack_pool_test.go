@@ -0,0 +1,89 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConntrackShard_newConn(t *testing.T) {
+	l := test.NewLogger()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, metrics.NewRegistry())
+
+	// An outgoing tcp flow with rtt tracking in progress
+	fp := firewall.Packet{LocalPort: 1, RemotePort: 2, Protocol: firewall.ProtoTCP}
+	packet := make([]byte, 40)
+	packet[0] = 0x45
+	packet[32] = 5 << 4
+	packet[33] = tcpSYN
+	packet[27] = 7
+	fw.addConn(packet, fp, false, RuleOptions{})
+
+	shard := fw.Conntrack.shard(fp)
+	c := shard.Conns[fp]
+	assert.Equal(t, uint32(7), c.Seq)
+	assert.False(t, c.Sent.IsZero())
+
+	// Removing it keeps it for reuse
+	shard.remove(fp)
+	assert.Len(t, shard.free, 1)
+
+	// The next flow reuses it with nothing left over
+	other := firewall.Packet{LocalPort: 3, RemotePort: 4, Protocol: firewall.ProtoUDP}
+	fw.addConn([]byte{}, other, true, RuleOptions{})
+	assert.Same(t, c, shard.Conns[other])
+	assert.Empty(t, shard.free)
+	assert.Zero(t, c.Seq)
+	assert.True(t, c.Sent.IsZero())
+	assert.True(t, c.incoming)
+	assert.Equal(t, tcpState(0), c.tcpState)
+	assert.Equal(t, uint64(1), c.inPackets)
+	assert.Zero(t, c.outPackets)
+	// It can be told apart from the flow that had it before, see revalidateUnlocked
+	assert.Equal(t, uint16(1), c.reuses)
+
+	// Replacing an entry releases the old one
+	fw.addConn([]byte{}, other, true, RuleOptions{})
+	assert.NotSame(t, c, shard.Conns[other])
+	assert.Len(t, shard.free, 1)
+
+	// The cache is bounded
+	for i := 0; i < connCacheMax+10; i++ {
+		shard.release(&conn{})
+	}
+	assert.Len(t, shard.free, connCacheMax)
+
+	// Flushing releases everything
+	shard.free = nil
+	fw.FlushConntrack()
+	assert.Len(t, shard.free, 1)
+}
+
+func BenchmarkFirewall_addConn(b *testing.B) {
+	l := test.NewLogger()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, metrics.NewRegistry())
+	packet := make([]byte, 100)
+
+	// Every flow is removed right after it is added, like a busy firewall where flows expire as fast as they start
+	run := func(b *testing.B, reuse bool) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			fp := firewall.Packet{LocalPort: uint16(n), RemotePort: uint16(n >> 16), Protocol: firewall.ProtoUDP}
+			fw.addConn(packet, fp, true, RuleOptions{})
+
+			shard := fw.Conntrack.shard(fp)
+			shard.remove(fp)
+			if !reuse {
+				shard.free = shard.free[:0]
+			}
+		}
+	}
+
+	b.Run("without reuse", func(b *testing.B) { run(b, false) })
+	b.Run("with reuse", func(b *testing.B) { run(b, true) })
+}
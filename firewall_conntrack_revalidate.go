@@ -0,0 +1,129 @@
+package nebula
+
+import (
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// conntrackRevalidator walks conntrack in the background after a reload, see startConntrackRevalidation
+type conntrackRevalidator struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// startConntrackRevalidation starts a goroutine that checks every conntrack entry from an older rule set against our
+// rules, removing the ones that are no longer allowed without waiting for their next packet. lookup finds the tunnel
+// for a remote vpn ip, entries for hosts it returns nil for are left to be revalidated by their next packet. It is
+// stopped by Destroy, or by InheritConntrack on the firewall that replaces us.
+// This must be called after InheritConntrack.
+func (f *Firewall) startConntrackRevalidation(lookup func(iputil.VpnIp) *HostInfo, caPool *cert.NebulaCAPool) {
+	if f.revalidator != nil {
+		return
+	}
+
+	r := &conntrackRevalidator{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	f.revalidator = r
+
+	go func() {
+		defer close(r.done)
+
+		start := time.Now()
+		kept, dropped, ok := f.revalidateConntrack(lookup, caPool, r.stop)
+		if !ok {
+			return
+		}
+
+		f.l.WithField("kept", kept).
+			WithField("dropped", dropped).
+			WithField("rulesVersion", f.rulesVersion()).
+			WithField("duration", time.Since(start)).
+			Info("Revalidated conntrack against the new rules")
+	}()
+}
+
+// stopConntrackRevalidation stops the revalidation and waits for it to exit, it is safe to call if it is not running.
+func (f *Firewall) stopConntrackRevalidation() {
+	if f.revalidator == nil {
+		return
+	}
+
+	f.revalidator.stopOnce.Do(func() {
+		close(f.revalidator.stop)
+	})
+	<-f.revalidator.done
+}
+
+// revalidateConntrack checks every conntrack entry from an older rule set, returning how many were kept and dropped.
+// The stale entries of a shard are gathered under one lock and then checked conntrackSweepBatch at a time, so packets
+// waiting on the lock are not held up for long. ok is false if stop was closed before the walk was done.
+func (f *Firewall) revalidateConntrack(lookup func(iputil.VpnIp) *HostInfo, caPool *cert.NebulaCAPool, stop <-chan struct{}) (kept, dropped int, ok bool) {
+	var stale []firewall.Packet
+	hosts := make([]*HostInfo, 0, conntrackSweepBatch)
+
+	for _, conntrack := range f.Conntrack.shards {
+		stale = stale[:0]
+		conntrack.Lock()
+		rulesVersion := f.rulesVersion()
+		for fp, c := range conntrack.Conns {
+			if c.rulesVersion != rulesVersion && !c.pinned {
+				stale = append(stale, fp)
+			}
+		}
+		conntrack.Unlock()
+
+		for len(stale) > 0 {
+			select {
+			case <-stop:
+				return kept, dropped, false
+			default:
+			}
+
+			batch := stale
+			if len(batch) > conntrackSweepBatch {
+				batch = batch[:conntrackSweepBatch]
+			}
+			stale = stale[len(batch):]
+
+			// Look up the tunnels before taking the shard lock, the hostmap has locks of its own
+			hosts = hosts[:0]
+			for _, fp := range batch {
+				hosts = append(hosts, lookup(fp.RemoteIP))
+			}
+
+			conntrack.Lock()
+			// The rules can't change while we hold a shard lock
+			rs := f.ruleset.Load()
+			// Without the underlay an inbound flow arrived on it can't be checked against an underlay_cidr
+			underlayRules := rs.in.hasUnderlayRules()
+			for i, fp := range batch {
+				h := hosts[i]
+				if h == nil || h.ConnectionState == nil {
+					continue
+				}
+
+				// The entry may have expired or been revalidated by a packet since it was gathered
+				c, has := conntrack.Conns[fp]
+				if !has || c.rulesVersion == rs.version || c.pinned || (underlayRules && c.incoming) {
+					continue
+				}
+
+				if f.revalidate(conntrack, rs, fp, c, packetInfo{length: -1, forwarded: f.forwarded(fp), now: f.clock.Now(), self: f.isSelf(h.ConnectionState.peerCert)}, h.ConnectionState.peerCert, caPool) {
+					kept++
+				} else {
+					dropped++
+				}
+			}
+			conntrack.Unlock()
+		}
+	}
+
+	return kept, dropped, true
+}
@@ -0,0 +1,260 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_RevalidateConntrack(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	flow := func(port uint16) firewall.Packet {
+		fp := p
+		fp.LocalPort = port
+		return fp
+	}
+	// 1.2.3.5 has no tunnel
+	gone := flow(11)
+	gone.RemoteIP = iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5))
+
+	lookup := func(ip iputil.VpnIp) *HostInfo {
+		if ip == h.vpnIp {
+			return h
+		}
+		return nil
+	}
+
+	oldFw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.NoError(t, oldFw.AddRule(true, firewall.ProtoUDP, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	for _, fp := range []firewall.Packet{flow(10), flow(11), flow(12), gone} {
+		oldFw.addConn([]byte{}, fp, true, RuleOptions{})
+	}
+
+	// The new rules only allow port 10, and port 12 with a length bound that can't be checked without a packet
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.NoError(t, fw.AddRule(true, firewall.ProtoUDP, 10, 10, []string{"any"}, "", nil, nil, "", ""))
+	assert.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 12, 12, []string{"any"}, "", nil, nil, "", "", RuleOptions{MinLen: 100}))
+	fw.InheritConntrack(oldFw)
+
+	kept, dropped, ok := fw.revalidateConntrack(lookup, cp, make(chan struct{}))
+	assert.True(t, ok)
+	assert.Equal(t, 2, kept)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, int64(1), fw.metricConntrackRevalidateFailed.Count())
+
+	conns := fw.Conntrack.conns()
+	assert.Len(t, conns, 3)
+	assert.Equal(t, fw.rulesVersion(), conns[flow(10)].rulesVersion)
+	assert.Equal(t, fw.rulesVersion(), conns[flow(12)].rulesVersion)
+	assert.NotContains(t, conns, flow(11))
+	// Left for its next packet
+	assert.Equal(t, oldFw.rulesVersion(), conns[gone].rulesVersion)
+
+	// Nothing is left to do for the same rules
+	kept, dropped, ok = fw.revalidateConntrack(lookup, cp, make(chan struct{}))
+	assert.True(t, ok)
+	assert.Equal(t, 0, kept+dropped)
+
+	// A stopped walk gives up
+	newFw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	newFw.InheritConntrack(fw)
+	stop := make(chan struct{})
+	close(stop)
+	_, _, ok = newFw.revalidateConntrack(lookup, cp, stop)
+	assert.False(t, ok)
+	assert.Len(t, newFw.Conntrack.conns(), 3)
+
+	// The background walk runs to completion and the next reload stops it if it hasn't
+	newFw.startConntrackRevalidation(lookup, cp)
+	<-newFw.revalidator.done
+	assert.Len(t, newFw.Conntrack.conns(), 1)
+	NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil).InheritConntrack(newFw)
+}
+
+func TestFirewall_DropDuringReload(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	rule := func(port string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"port": port, "proto": "udp", "host": "any"}
+	}
+	allowAll := map[interface{}]interface{}{"inbound": []interface{}{rule("any")}}
+	allowSome := map[interface{}]interface{}{"inbound": []interface{}{rule("1-50")}}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = allowAll
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	fw.Conntrack = newFirewallConntrack(4, time.Second, time.Minute)
+	cp := cert.NewCAPool()
+
+	flow := func(port int) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+			RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+			LocalPort:  uint16(port),
+			RemotePort: 90,
+			Protocol:   firewall.ProtoUDP,
+		}
+	}
+
+	flows := 100
+	for i := 1; i <= flows; i++ {
+		require.NoError(t, fw.Drop([]byte{}, flow(i), true, h, cp, nil))
+	}
+
+	// Every routine sends packets for all the flows while the rules flip back and forth
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for {
+				for i := 1; i <= flows; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					_ = fw.Drop([]byte{}, flow((i+r*13)%flows+1), true, h, cp, nil)
+				}
+			}
+		}(r)
+	}
+
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			conf.Settings["firewall"] = allowSome
+		} else {
+			conf.Settings["firewall"] = allowAll
+		}
+		require.NoError(t, fw.Reload(conf))
+		time.Sleep(time.Millisecond)
+	}
+
+	conf.Settings["firewall"] = allowSome
+	require.NoError(t, fw.Reload(conf))
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("routines calling Drop did not finish, deadlock?")
+	}
+
+	// Whatever happened during the reloads, the final rules decide
+	for i := 1; i <= flows; i++ {
+		err := fw.Drop([]byte{}, flow(i), true, h, cp, nil)
+		if i <= 50 {
+			assert.NoError(t, err, "flow %d", i)
+		} else {
+			assert.Equal(t, ErrNoMatchingRule, err, "flow %d", i)
+		}
+	}
+
+	for fp, c := range fw.Conntrack.conns() {
+		assert.LessOrEqual(t, int(fp.LocalPort), 50)
+		assert.Equal(t, fw.rulesVersion(), c.rulesVersion)
+	}
+}
+
+func TestFirewall_RevalidatedMetrics(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+	cp := cert.NewCAPool()
+
+	flow := func(port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+			RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+			LocalPort:  port,
+			RemotePort: 90,
+			Protocol:   firewall.ProtoUDP,
+		}
+	}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "10-12", "proto": "udp", "host": "any"},
+		},
+	}
+	oldFw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	for _, port := range []uint16{10, 11, 12} {
+		require.NoError(t, oldFw.Drop([]byte{}, flow(port), true, h, cp, nil))
+	}
+	// Only port 11 has seen a reply
+	require.NoError(t, oldFw.Drop([]byte{}, flow(11), false, h, cp, nil))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"log_revalidation_drops": true},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "10", "proto": "udp", "host": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	fw.InheritConntrack(oldFw)
+
+	// The counters are in the default registry, shared with other tests
+	kept, dropped := fw.metricRevalidatedKept.Count(), fw.metricRevalidatedDropped.Count()
+	ob.Reset()
+	assert.NoError(t, fw.Drop([]byte{}, flow(10), true, h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, flow(11), true, h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, flow(12), true, h, cp, nil))
+	assert.Equal(t, kept+1, fw.metricRevalidatedKept.Count())
+	assert.Equal(t, dropped+2, fw.metricRevalidatedDropped.Count())
+
+	// Only the flow with traffic both ways is logged
+	assert.Equal(t, 1, strings.Count(ob.String(), "New firewall rules dropped an established flow"))
+	assert.Contains(t, ob.String(), "1.2.3.4 1.2.3.4 11 90")
+
+	// Later packets are not counted again
+	assert.NoError(t, fw.Drop([]byte{}, flow(10), true, h, cp, nil))
+	assert.Equal(t, kept+1, fw.metricRevalidatedKept.Count())
+}
@@ -0,0 +1,237 @@
+package nebula
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// conntrackStateVersion must be bumped if the meaning of conntrackState changes, files with a different version are ignored
+const conntrackStateVersion = 1
+
+// conntrackState is the on disk format of conntrack, see SaveConntrackState
+type conntrackState struct {
+	Version int                   `json:"version"`
+	Saved   time.Time             `json:"saved"`
+	Entries []conntrackStateEntry `json:"entries"`
+}
+
+type conntrackStateEntry struct {
+	// VpnIp marshals to a string, keep the raw value so it can be read back
+	LocalIP    uint32        `json:"localIp"`
+	RemoteIP   uint32        `json:"remoteIp"`
+	LocalPort  uint16        `json:"localPort"`
+	RemotePort uint16        `json:"remotePort"`
+	Protocol   uint8         `json:"protocol"`
+	Fragment   bool          `json:"fragment"`
+	Incoming   bool          `json:"incoming"`
+	TCPState   tcpState      `json:"tcpState,omitempty"`
+	Timeout    time.Duration `json:"timeout,omitempty"`
+	Started    time.Time     `json:"started"`
+	Expires    time.Time     `json:"expires"`
+}
+
+// SaveConntrackState writes conntrack to firewall.conntrack.state_file so it can be restored by LoadConntrackState
+// after a restart. Does nothing if the state file is not configured.
+func (f *Firewall) SaveConntrackState() error {
+	if f.conntrackStateFile == "" {
+		return nil
+	}
+
+	// The file is read back by another process so times are written against the wall clock, not the firewall clock
+	s := conntrackState{Version: conntrackStateVersion, Saved: time.Now()}
+	now := f.clock.Now()
+
+	for _, shard := range f.Conntrack.shards {
+		shard.Lock()
+		for fp, c := range shard.Conns {
+			s.Entries = append(s.Entries, conntrackStateEntry{
+				LocalIP:    uint32(fp.LocalIP),
+				RemoteIP:   uint32(fp.RemoteIP),
+				LocalPort:  fp.LocalPort,
+				RemotePort: fp.RemotePort,
+				Protocol:   fp.Protocol,
+				Fragment:   fp.Fragment,
+				Incoming:   c.incoming,
+				TCPState:   c.tcpState,
+				Timeout:    c.timeout,
+				Started:    s.Saved.Add(c.started.Sub(now)),
+				Expires:    s.Saved.Add(c.Expires.Sub(now)),
+			})
+		}
+		shard.Unlock()
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash mid write can't leave a partial state file behind
+	tmp, err := os.CreateTemp(filepath.Dir(f.conntrackStateFile), filepath.Base(f.conntrackStateFile)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), f.conntrackStateFile); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	f.l.WithField("path", f.conntrackStateFile).WithField("entries", len(s.Entries)).Info("Saved conntrack state")
+	return nil
+}
+
+// LoadConntrackState restores conntrack entries saved by SaveConntrackState and removes the state file, returning how
+// many entries were restored. Expired entries and entries with an unknown tcp state or a negative timeout are
+// discarded. Restored entries must match the current rules again on their next packet, the rules may have changed
+// while we were down. A missing state file is not an error.
+func (f *Firewall) LoadConntrackState() (int, error) {
+	if f.conntrackStateFile == "" {
+		return 0, nil
+	}
+
+	b, err := os.ReadFile(f.conntrackStateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	// The state only applies to the run that saved it
+	if err := os.Remove(f.conntrackStateFile); err != nil {
+		f.l.WithError(err).WithField("path", f.conntrackStateFile).Warn("Failed to remove conntrack state file")
+	}
+
+	var s conntrackState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return 0, fmt.Errorf("failed to parse conntrack state file: %w", err)
+	}
+
+	if s.Version != conntrackStateVersion {
+		return 0, fmt.Errorf("conntrack state file has unknown version %d", s.Version)
+	}
+
+	wallNow := time.Now()
+	now := f.clock.Now()
+	// Anything that isn't stamped with the current rulesVersion is revalidated on its next packet
+	rulesVersion := f.rulesVersion() - 1
+	n := 0
+
+	conntrack := f.Conntrack
+	conntrack.lockAll()
+	defer conntrack.unlockAll()
+
+	for _, e := range s.Entries {
+		timeout := e.Expires.Sub(wallNow)
+		if timeout <= 0 {
+			continue
+		}
+
+		// The file may have been edited or written by something else, an unknown tcp state would index past
+		// tcpTimeouts
+		if e.TCPState >= tcpStateMax || e.Timeout < 0 {
+			continue
+		}
+
+		fp := firewall.Packet{
+			LocalIP:    iputil.VpnIp(e.LocalIP),
+			RemoteIP:   iputil.VpnIp(e.RemoteIP),
+			LocalPort:  e.LocalPort,
+			RemotePort: e.RemotePort,
+			Protocol:   e.Protocol,
+			Fragment:   e.Fragment,
+		}
+
+		shard := conntrack.shard(fp)
+		if _, ok := shard.Conns[fp]; ok {
+			continue
+		}
+
+		c := &conn{incoming: e.Incoming, tcpState: e.TCPState, timeout: e.Timeout}
+		f.storeConn(shard, fp, c, timeout, rulesVersion)
+		// The flow started before we went down, not when it was restored
+		c.started = now.Add(e.Started.Sub(wallNow))
+		n++
+	}
+
+	return n, nil
+}
+
+// FlowSpec describes a flow for ImportFlows
+type FlowSpec struct {
+	// The tuple and protocol of the flow, as seen by this node
+	Packet firewall.Packet
+	// Incoming is true if the flow was started by the remote host
+	Incoming bool
+	// TTL is how much longer the flow should be kept without seeing a packet
+	TTL time.Duration
+}
+
+// ImportFlows adds flows from an outside source to conntrack, such as the flow table of the active node in a failover
+// pair, returning how many were added. Flows we already track are left alone. Imported flows must match the current
+// rules on their next packet, just like flows restored by LoadConntrackState. Malformed flows are skipped and counted
+// in the firewall.conntrack.import.malformed metric.
+func (f *Firewall) ImportFlows(flows []FlowSpec) int {
+	conntrack := f.Conntrack
+	conntrack.lockAll()
+	defer conntrack.unlockAll()
+
+	// Anything that isn't stamped with the current rulesVersion is revalidated on its next packet
+	rulesVersion := f.rulesVersion() - 1
+	n := 0
+
+	for _, fs := range flows {
+		if !validFlowSpec(fs) {
+			f.metricImportMalformed.Inc(1)
+			continue
+		}
+
+		shard := conntrack.shard(fs.Packet)
+		if _, ok := shard.Conns[fs.Packet]; ok {
+			continue
+		}
+
+		f.storeConn(shard, fs.Packet, &conn{incoming: fs.Incoming}, fs.TTL, rulesVersion)
+		n++
+	}
+
+	return n
+}
+
+// validFlowSpec returns false if fs could never describe a flow that passed the firewall
+func validFlowSpec(fs FlowSpec) bool {
+	fp := fs.Packet
+	if fs.TTL <= 0 || fp.LocalIP == 0 || fp.RemoteIP == 0 {
+		return false
+	}
+
+	switch fp.Protocol {
+	case firewall.ProtoTCP, firewall.ProtoUDP:
+		// Only fragments go without ports
+		if !fp.Fragment && (fp.LocalPort == 0 || fp.RemotePort == 0) {
+			return false
+		}
+	case firewall.ProtoAny:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,166 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_ConntrackState(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	path := filepath.Join(t.TempDir(), "conntrack.json")
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	p1 := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	p2 := p1
+	p2.LocalPort = 11
+	p3 := p1
+	p3.LocalPort = 12
+
+	fw := NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+	fw.conntrackStateFile = path
+	fw.addConn([]byte{}, p1, false, RuleOptions{})
+	fw.addConn([]byte{}, p2, true, RuleOptions{})
+	fw.addConn([]byte{}, p3, true, RuleOptions{})
+	fw.Conntrack.conns()[p3].Expires = time.Now().Add(-time.Second)
+	require.NoError(t, fw.SaveConntrackState())
+
+	// Only allow p2 inbound after the restart
+	fw = NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+	fw.conntrackStateFile = path
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 11, 11, []string{"any"}, "", nil, nil, "", ""))
+
+	n, err := fw.LoadConntrackState()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Len(t, fw.Conntrack.conns(), 2)
+	assert.False(t, fw.Conntrack.conns()[p1].incoming)
+	assert.True(t, fw.Conntrack.conns()[p2].incoming)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Restored entries are checked against the current rules
+	cp := cert.NewCAPool()
+	assert.NoError(t, fw.Drop([]byte{}, p2, true, h, cp, nil))
+	assert.Equal(t, fw.rulesVersion(), fw.Conntrack.conns()[p2].rulesVersion)
+	assert.Equal(t, fw.Drop([]byte{}, p1, false, h, cp, nil), ErrNoMatchingRule)
+
+	// A missing file is fine
+	n, err = fw.LoadConntrackState()
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	// A corrupt file or one from another version is ignored and removed
+	require.NoError(t, os.WriteFile(path, []byte("{nope"), 0600))
+	n, err = fw.LoadConntrackState()
+	assert.Error(t, err)
+	assert.Zero(t, n)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"version":99,"entries":[{"localPort":1,"expires":"2999-01-01T00:00:00Z"}]}`), 0600))
+	n, err = fw.LoadConntrackState()
+	assert.EqualError(t, err, "conntrack state file has unknown version 99")
+	assert.Zero(t, n)
+	assert.Len(t, fw.Conntrack.conns(), 1)
+
+	// Entries with a tcp state or timeout we can't use are skipped
+	require.NoError(t, os.WriteFile(path, []byte(`{"version":1,"entries":[
+		{"localPort":1,"protocol":6,"tcpState":200,"expires":"2999-01-01T00:00:00Z"},
+		{"localPort":2,"protocol":17,"timeout":-5,"expires":"2999-01-01T00:00:00Z"},
+		{"localPort":3,"protocol":6,"tcpState":3,"started":"2000-01-01T00:00:00Z","expires":"2999-01-01T00:00:00Z"}]}`), 0600))
+	n, err = fw.LoadConntrackState()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, fw.Conntrack.conns(), 2)
+	restored := fw.Conntrack.conns()[firewall.Packet{LocalPort: 3, Protocol: firewall.ProtoTCP}]
+	require.NotNil(t, restored)
+	assert.Equal(t, tcpStateEstablished, restored.tcpState)
+	assert.True(t, restored.started.Before(time.Now().Add(-time.Hour)))
+
+	// Nothing to do when not configured
+	fw.conntrackStateFile = ""
+	assert.NoError(t, fw.SaveConntrackState())
+	n, err = fw.LoadConntrackState()
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestFirewall_ImportFlows(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	p1 := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	p2 := p1
+	p2.LocalPort = 11
+	noPort := p1
+	noPort.LocalPort = 0
+	noIP := p1
+	noIP.RemoteIP = 0
+	icmp := p1
+	icmp.Protocol = firewall.ProtoICMP
+	icmp.LocalPort = 0
+	icmp.RemotePort = 0
+
+	fw := NewFirewall(l, time.Hour, time.Hour, time.Hour, c, metrics.NewRegistry())
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 11, 11, []string{"any"}, "", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoICMP, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	fw.addConn([]byte{}, p2, false, RuleOptions{})
+
+	now := time.Now()
+	n := fw.ImportFlows([]FlowSpec{
+		{Packet: p1, Incoming: true, TTL: time.Minute},
+		{Packet: p2, Incoming: true, TTL: time.Minute},
+		{Packet: icmp, TTL: time.Minute},
+		{Packet: noPort, TTL: time.Minute},
+		{Packet: noIP, TTL: time.Minute},
+		{Packet: p1, TTL: 0},
+	})
+	assert.Equal(t, 2, n)
+	assert.Equal(t, int64(3), fw.metricImportMalformed.Count())
+	assert.Len(t, fw.Conntrack.conns(), 3)
+	assert.True(t, fw.Conntrack.conns()[p1].incoming)
+	assert.WithinDuration(t, now.Add(time.Minute), fw.Conntrack.conns()[p1].Expires, time.Second)
+
+	// Existing flows are left alone
+	assert.False(t, fw.Conntrack.conns()[p2].incoming)
+	assert.Equal(t, fw.rulesVersion(), fw.Conntrack.conns()[p2].rulesVersion)
+
+	// Imported flows are checked against the current rules
+	cp := cert.NewCAPool()
+	assert.Equal(t, fw.Drop([]byte{}, p1, true, h, cp, nil), ErrNoMatchingRule)
+	assert.NotContains(t, fw.Conntrack.conns(), p1)
+	assert.NoError(t, fw.Drop([]byte{}, icmp, false, h, cp, nil))
+	assert.Equal(t, fw.rulesVersion(), fw.Conntrack.conns()[icmp].rulesVersion)
+}
@@ -0,0 +1,120 @@
+package nebula
+
+import (
+	"sync"
+	"time"
+)
+
+// conntrackSweepBatch is how many timer wheel items are handled per conntrack shard lock, so packets waiting on the lock
+// are not held up for long by a large sweep
+const conntrackSweepBatch = 256
+
+// conntrackSweeper expires conntrack entries in the background, see startConntrackSweeper
+type conntrackSweeper struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	// A new tick duration after the conntrack timer wheels were refit, see resetConntrackSweeper
+	tick chan time.Duration
+}
+
+// startConntrackSweeper starts a goroutine that expires conntrack entries every conntrack tick, so entries are removed
+// even when no packets arrive. Packets no longer purge conntrack while it runs. It is stopped by Destroy.
+// This must be called after InheritConntrack and LoadConntrackState.
+func (f *Firewall) startConntrackSweeper() {
+	// Nothing is tracked, there is nothing to sweep
+	if f.sweeper != nil || f.conntrackDisabled {
+		return
+	}
+
+	s := &conntrackSweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		tick: make(chan time.Duration),
+	}
+	f.sweeper = s
+	// Read now, swapRules may give the shards new timer wheels while we run
+	tick := f.Conntrack.shards[0].TimerWheel.tickDuration
+
+	go func() {
+		defer close(s.done)
+
+		t := time.NewTicker(tick)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case d := <-s.tick:
+				t.Reset(d)
+			case <-t.C:
+				f.metricSweepEvicted.Update(int64(f.sweepConntrack()))
+			}
+		}
+	}()
+}
+
+// resetConntrackSweeper makes a running sweeper tick every d, it must be called after the conntrack timer wheels are
+// given a new tick duration. The shard locks must not be held, the sweeper may be waiting on them.
+func (f *Firewall) resetConntrackSweeper(d time.Duration) {
+	if f.sweeper == nil {
+		return
+	}
+
+	select {
+	case f.sweeper.tick <- d:
+	case <-f.sweeper.done:
+	}
+}
+
+// stopConntrackSweeper stops the sweeper and waits for it to exit, it is safe to call if the sweeper is not running.
+// Packets still do not purge conntrack afterwards, routines may be using this firewall while its replacement, which
+// inherited conntrack, sweeps it.
+func (f *Firewall) stopConntrackSweeper() {
+	if f.sweeper == nil {
+		return
+	}
+
+	f.sweeper.stopOnce.Do(func() {
+		close(f.sweeper.stop)
+	})
+	<-f.sweeper.done
+}
+
+// sweepConntrack evicts every expired conntrack entry, returning how many were removed. Each shard lock is taken
+// for conntrackSweepBatch timer wheel items at a time.
+func (f *Firewall) sweepConntrack() int {
+	n := 0
+	for _, s := range f.Conntrack.shards {
+		n += f.sweepConntrackShard(s)
+	}
+
+	return n
+}
+
+func (f *Firewall) sweepConntrackShard(conntrack *conntrackShard) int {
+	n := 0
+
+	for {
+		conntrack.Lock()
+		conntrack.TimerWheel.Advance(f.clock.Now())
+
+		i := 0
+		for ; i < conntrackSweepBatch; i++ {
+			ep, has := conntrack.TimerWheel.Purge()
+			if !has {
+				break
+			}
+
+			if f.evict(conntrack, ep) {
+				n++
+			}
+		}
+		conntrack.Unlock()
+
+		if i < conntrackSweepBatch {
+			return n
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirewall_sweepConntrack(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	fw := NewFirewall(l, time.Second, time.Second, time.Second, c, metrics.NewRegistry())
+
+	// More than a batch worth of entries
+	n := conntrackSweepBatch*2 + 10
+	for i := 0; i < n; i++ {
+		fw.addConn([]byte{}, firewall.Packet{LocalPort: uint16(i + 1), Protocol: firewall.ProtoUDP}, true, RuleOptions{})
+	}
+	keep := firewall.Packet{LocalPort: 60000, Protocol: firewall.ProtoUDP}
+	fw.addConn([]byte{}, keep, true, RuleOptions{})
+	fw.Conntrack.conns()[keep].Expires = time.Now().Add(time.Hour)
+
+	// Nothing is due yet
+	assert.Zero(t, fw.sweepConntrack())
+	assert.Len(t, fw.Conntrack.conns(), n+1)
+
+	time.Sleep(2100 * time.Millisecond)
+	assert.Equal(t, n, fw.sweepConntrack())
+	assert.Len(t, fw.Conntrack.conns(), 1)
+	assert.Contains(t, fw.Conntrack.conns(), keep)
+}
+
+func TestFirewall_ConntrackSweeper(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	other := p
+	other.LocalPort = 11
+
+	r := metrics.NewRegistry()
+	fw := NewFirewall(l, 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond, c, r)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	fw.startConntrackSweeper()
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+
+	// The entry goes away without any more packets
+	assert.Eventually(t, func() bool {
+		return len(fw.Conntrack.conns()) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	fw.Destroy()
+	assert.NotZero(t, fw.metricSweepEvicted.Count())
+	assert.Equal(t, int64(1), fw.metricSweepEvicted.Sum())
+
+	// Packets do not purge once the sweeper has run, even after it is stopped
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	time.Sleep(30 * time.Millisecond)
+	fw.Conntrack.shard(other).TimerWheel.Advance(time.Now())
+	assert.NoError(t, fw.Drop([]byte{}, other, true, h, cp, nil))
+	assert.Contains(t, fw.Conntrack.conns(), p)
+
+	// Stopping again is fine
+	fw.Destroy()
+}
+
+func TestFirewall_PurgeBudget(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	r := metrics.NewRegistry()
+	fw := NewFirewall(l, time.Second, time.Second, time.Second, c, r)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	fw.purgeBudget = 3
+	cp := cert.NewCAPool()
+
+	n := 10
+	for i := 0; i < n; i++ {
+		fw.addConn([]byte{}, firewall.Packet{LocalPort: uint16(i + 1), Protocol: firewall.ProtoUDP}, true, RuleOptions{})
+	}
+
+	// Expire everything and move it out of the wheel
+	tw := fw.Conntrack.shards[0].TimerWheel
+	for fp := range fw.Conntrack.conns() {
+		fw.Conntrack.conns()[fp].Expires = time.Time{}
+	}
+	tw.Advance(time.Now().Add(time.Minute))
+	assert.Equal(t, n, tw.Expired())
+
+	fw.EmitStats()
+	assert.Equal(t, int64(n), metrics.GetOrRegisterGauge("firewall.conntrack.expired_pending", r).Value())
+
+	// Each packet removes up to the budget
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  60000,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Equal(t, n-3, tw.Expired())
+	assert.Len(t, fw.Conntrack.conns(), n-3+1)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	}
+	assert.Zero(t, tw.Expired())
+	assert.Len(t, fw.Conntrack.conns(), 1)
+
+	fw.EmitStats()
+	assert.Zero(t, metrics.GetOrRegisterGauge("firewall.conntrack.expired_pending", r).Value())
+}
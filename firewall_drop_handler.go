@@ -0,0 +1,161 @@
+package nebula
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// dropEventQueueSize is how many drop events may wait for the handlers before new ones are discarded
+const dropEventQueueSize = 4096
+
+// DropEvent is a packet the firewall denied, see Firewall.RegisterDropHandler
+type DropEvent struct {
+	Packet firewall.Packet
+	// Incoming is the direction of the denied packet
+	Incoming bool
+	// Reason is the error Drop returned, one of the Err values such as ErrNoMatchingRule
+	Reason error
+	// PeerName is the name on the certificate of the host the packet was to or from, empty if there is none
+	PeerName string
+	Time     time.Time
+}
+
+// DropHandler is handed every packet the firewall denies. Handlers are compared to unregister them so they must be
+// comparable, a pointer is best.
+type DropHandler interface {
+	HandleDrop(ev DropEvent)
+}
+
+// dropEvents queues drop events for the registered handlers, which are called one at a time by a single routine so a
+// slow handler only ever holds up the others, never Drop
+type dropEvents struct {
+	events chan DropEvent
+	stop   chan struct{}
+
+	// The handlers, replaced rather than changed so the routine can read them without a lock
+	lock     sync.Mutex
+	handlers atomic.Pointer[[]DropHandler]
+
+	metricDropped metrics.Counter
+}
+
+func newDropEvents(r metrics.Registry) *dropEvents {
+	de := &dropEvents{
+		events:        make(chan DropEvent, dropEventQueueSize),
+		stop:          make(chan struct{}),
+		metricDropped: metrics.GetOrRegisterCounter("firewall.drop_events.dropped", r),
+	}
+	go de.run()
+	return de
+}
+
+// RegisterDropHandler registers h to be handed every packet Drop denies, packets let through by dry run are not.
+// Handlers are called in order on a separate routine, outside of any firewall lock. Events are queued in between, if
+// the handlers can't keep up events are discarded and counted in firewall.drop_events.dropped. Handlers are carried
+// over to the firewall that replaces this one on reload.
+func (f *Firewall) RegisterDropHandler(h DropHandler) {
+	f.dropEventsLock.Lock()
+	de := f.dropEvents.Load()
+	if de == nil {
+		de = newDropEvents(f.metricsRegistry)
+		f.dropEvents.Store(de)
+	}
+	f.dropEventsLock.Unlock()
+
+	de.lock.Lock()
+	defer de.lock.Unlock()
+	var handlers []DropHandler
+	if old := de.handlers.Load(); old != nil {
+		handlers = append(handlers, *old...)
+	}
+	handlers = append(handlers, h)
+	de.handlers.Store(&handlers)
+}
+
+// UnregisterDropHandler removes h, registered with RegisterDropHandler. It may still be handed events that were
+// queued before it was removed.
+func (f *Firewall) UnregisterDropHandler(h DropHandler) {
+	de := f.dropEvents.Load()
+	if de == nil {
+		return
+	}
+
+	de.lock.Lock()
+	defer de.lock.Unlock()
+	old := de.handlers.Load()
+	if old == nil {
+		return
+	}
+
+	handlers := make([]DropHandler, 0, len(*old))
+	for _, v := range *old {
+		if v != h {
+			handlers = append(handlers, v)
+		}
+	}
+	de.handlers.Store(&handlers)
+}
+
+// inheritDropEvents takes over the drop handlers of old, which must not send any more events
+func (f *Firewall) inheritDropEvents(old *Firewall) {
+	f.dropEvents.Store(old.dropEvents.Swap(nil))
+}
+
+func (de *dropEvents) run() {
+	for {
+		select {
+		case <-de.stop:
+			return
+		case ev := <-de.events:
+			handlers := de.handlers.Load()
+			if handlers == nil {
+				// Sent before the first handler was stored
+				continue
+			}
+			for _, h := range *handlers {
+				h.HandleDrop(ev)
+			}
+		}
+	}
+}
+
+// close stops the routine, queued events that have not been handed to the handlers are lost
+func (de *dropEvents) close() {
+	if de != nil {
+		close(de.stop)
+	}
+}
+
+// dropped sends a DropEvent for a packet Drop denied for reason
+func (f *Firewall) dropped(fp firewall.Packet, incoming bool, h *HostInfo, reason error) {
+	de := f.dropEvents.Load()
+	if de == nil {
+		return
+	}
+
+	var name string
+	if h != nil && h.ConnectionState != nil && h.ConnectionState.peerCert != nil {
+		name = h.ConnectionState.peerCert.Details.Name
+	}
+
+	de.send(DropEvent{
+		Packet:   fp,
+		Incoming: incoming,
+		Reason:   reason,
+		PeerName: name,
+		Time:     f.clock.Now(),
+	})
+}
+
+// send queues ev without blocking
+func (de *dropEvents) send(ev DropEvent) {
+	select {
+	case de.events <- ev:
+	default:
+		de.metricDropped.Inc(1)
+	}
+}
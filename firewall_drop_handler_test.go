@@ -0,0 +1,107 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDropHandler struct {
+	events chan DropEvent
+}
+
+func (h *testDropHandler) HandleDrop(ev DropEvent) {
+	h.events <- ev
+}
+
+func (h *testDropHandler) next(t *testing.T) DropEvent {
+	t.Helper()
+	select {
+	case ev := <-h.events:
+		return ev
+	case <-time.After(time.Second):
+		require.FailNow(t, "no drop event")
+		return DropEvent{}
+	}
+}
+
+func TestFirewall_RegisterDropHandler(t *testing.T) {
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host1", Ips: []*net.IPNet{&ipNet}}}
+
+	peerIp := net.IPNet{IP: net.IPv4(1, 2, 3, 5), Mask: net.IPMask{255, 255, 255, 0}}
+	h, _ := newTestHost(cert.NebulaCertificateDetails{Name: "host2", Ips: []*net.IPNet{&peerIp}})
+
+	r := metrics.NewRegistry()
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, c, r)
+	defer fw.Destroy()
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", ""))
+
+	fp := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(peerIp.IP),
+		LocalPort:  80,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+	cp := cert.NewCAPool()
+
+	// No handlers, nothing queued
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, true, h, cp, nil))
+	assert.Nil(t, fw.dropEvents.Load())
+
+	h1 := &testDropHandler{events: make(chan DropEvent, 10)}
+	h2 := &testDropHandler{events: make(chan DropEvent, 10)}
+	fw.RegisterDropHandler(h1)
+	fw.RegisterDropHandler(h2)
+
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, true, h, cp, nil))
+	for _, dh := range []*testDropHandler{h1, h2} {
+		ev := dh.next(t)
+		assert.Equal(t, fp, ev.Packet)
+		assert.True(t, ev.Incoming)
+		assert.Equal(t, ErrNoMatchingRule, ev.Reason)
+		assert.Equal(t, "host2", ev.PeerName)
+		assert.False(t, ev.Time.IsZero())
+	}
+
+	// Allowed packets are not handed over
+	fp.LocalPort = 22
+	assert.NoError(t, fw.Drop(b, fp, true, h, cp, nil))
+
+	fw.UnregisterDropHandler(h1)
+	fp.LocalPort = 80
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, false, h, cp, nil))
+	ev := h2.next(t)
+	assert.False(t, ev.Incoming)
+	assert.Equal(t, uint16(80), ev.Packet.LocalPort)
+	assert.Empty(t, h1.events)
+
+	// Handlers are carried over on reload
+	nfw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, c, r)
+	defer nfw.Destroy()
+	nfw.inheritDropEvents(fw)
+	assert.Nil(t, fw.dropEvents.Load())
+	assert.Equal(t, ErrNoMatchingRule, nfw.Drop(b, fp, true, h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, h2.next(t).Reason)
+}
+
+func TestDropEvents_Dropped(t *testing.T) {
+	de := &dropEvents{
+		events:        make(chan DropEvent, 1),
+		metricDropped: metrics.NewCounter(),
+	}
+
+	de.send(DropEvent{})
+	de.send(DropEvent{})
+	assert.Equal(t, int64(1), de.metricDropped.Count())
+}
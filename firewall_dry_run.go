@@ -0,0 +1,101 @@
+package nebula
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// dryRunLogInterval is how often a packet the firewall would have dropped in dry run is logged, the rest are only
+// counted
+const dryRunLogInterval = time.Second
+
+// dryRunReasons names the drop reasons for the firewall.dry_run.would_drop metrics, after the dropped metrics they
+// mirror. Anything else is counted as other.
+var dryRunReasons = []struct {
+	err  error
+	name string
+}{
+	{ErrInvalidRemoteIP, "remote_ip"},
+	{ErrInvalidLocalIP, "local_ip"},
+	{ErrNoMatchingRule, "no_rule"},
+	{ErrDeniedByRule, "deny_rule"},
+	{ErrRejectedByRule, "deny_rule"},
+	{ErrDroppedByRule, "deny_rule"},
+	{ErrConnRateExceeded, "conn_rate"},
+	{ErrCertExpiringSoon, "cert_expiring"},
+	{ErrRevalidationDeferred, "revalidation_deferred"},
+	{ErrTCPOutOfWindow, "tcp_out_of_window"},
+	{ErrPeerQuarantined, "quarantined"},
+}
+
+// firewallDryRun turns the packets the firewall would drop into sampled logs and counters, see firewall.dry_run
+type firewallDryRun struct {
+	incoming dryRunMetrics
+	outgoing dryRunMetrics
+
+	// When the next would-be drop may be logged, in unix nanoseconds, and how many were not logged since the last one
+	nextLog    atomic.Int64
+	suppressed atomic.Int64
+}
+
+// dryRunMetrics are the firewall.dry_run.would_drop counters for one direction
+type dryRunMetrics struct {
+	reasons map[error]metrics.Counter
+	other   metrics.Counter
+}
+
+func newFirewallDryRun(r metrics.Registry) *firewallDryRun {
+	return &firewallDryRun{
+		incoming: newDryRunMetrics("incoming", r),
+		outgoing: newDryRunMetrics("outgoing", r),
+	}
+}
+
+func newDryRunMetrics(direction string, r metrics.Registry) dryRunMetrics {
+	m := dryRunMetrics{
+		reasons: map[error]metrics.Counter{},
+		other:   metrics.GetOrRegisterCounter("firewall.dry_run.would_drop."+direction+".other", r),
+	}
+
+	for _, reason := range dryRunReasons {
+		m.reasons[reason.err] = metrics.GetOrRegisterCounter("firewall.dry_run.would_drop."+direction+"."+reason.name, r)
+	}
+
+	return m
+}
+
+func (m dryRunMetrics) count(reason error) {
+	if c, ok := m.reasons[reason]; ok {
+		c.Inc(1)
+	} else {
+		m.other.Inc(1)
+	}
+}
+
+// wouldDrop counts and maybe logs a packet that Drop would have dropped for reason
+func (f *Firewall) wouldDrop(fp firewall.Packet, incoming bool, h *HostInfo, reason error) {
+	d := f.dryRun
+	if incoming {
+		d.incoming.count(reason)
+	} else {
+		d.outgoing.count(reason)
+	}
+
+	now := time.Now().UnixNano()
+	next := d.nextLog.Load()
+	if now < next || !d.nextLog.CompareAndSwap(next, now+int64(dryRunLogInterval)) {
+		d.suppressed.Add(1)
+		return
+	}
+
+	h.logger(f.l).
+		WithField("fwPacket", fp).
+		WithField("incoming", incoming).
+		WithField("reason", reason).
+		WithField("action", f.dropAction(reason, incoming)).
+		WithField("suppressed", d.suppressed.Swap(0)).
+		Info("Firewall dry run, allowing a packet that would have been dropped")
+}
@@ -0,0 +1,82 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_DryRun(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"dry_run": true,
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "10", "proto": "udp", "host": "any"},
+			map[interface{}]interface{}{"port": "11", "proto": "udp", "host": "any", "action": "deny"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	var dropped []error
+	fw.DropLogger = func(fp firewall.Packet, incoming bool, reason error) {
+		dropped = append(dropped, reason)
+	}
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	denied := p
+	denied.LocalPort = 11
+	noRule := p
+	noRule.LocalPort = 12
+
+	// Allowed packets are unaffected
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Contains(t, fw.Conntrack.conns(), p)
+
+	// The rest are let through but counted, without a conntrack entry
+	assert.NoError(t, fw.Drop([]byte{}, denied, true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, noRule, true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, noRule, true, h, cp, nil))
+	assert.NotContains(t, fw.Conntrack.conns(), noRule)
+	assert.Empty(t, dropped)
+
+	r := fw.metricsRegistry
+	assert.Equal(t, int64(1), metrics.GetOrRegisterCounter("firewall.dry_run.would_drop.incoming.deny_rule", r).Count())
+	assert.Equal(t, int64(2), metrics.GetOrRegisterCounter("firewall.dry_run.would_drop.incoming.no_rule", r).Count())
+	assert.Zero(t, metrics.GetOrRegisterCounter("firewall.dry_run.would_drop.outgoing.no_rule", r).Count())
+
+	// Logging is sampled, only the first would-be drop within the interval is logged
+	assert.Equal(t, 1, bytes.Count(ob.Bytes(), []byte("would have been dropped")))
+	assert.Contains(t, ob.String(), ErrDeniedByRule.Error())
+	assert.Equal(t, int64(2), fw.dryRun.suppressed.Load())
+
+	// Off by default
+	conf.Settings["firewall"] = map[interface{}]interface{}{}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, noRule, true, h, cp, nil))
+}
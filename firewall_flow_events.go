@@ -0,0 +1,200 @@
+package nebula
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// flowEventQueueSize is how many flow events may wait for the callbacks before new ones are dropped
+const flowEventQueueSize = 4096
+
+// FlowEventType is what happened to a flow
+type FlowEventType uint8
+
+const (
+	// FlowStarted is sent when a conntrack entry is created
+	FlowStarted FlowEventType = iota
+	// FlowEnded is sent when a conntrack entry is removed, FlowEvent.Reason says why
+	FlowEnded
+)
+
+func (t FlowEventType) String() string {
+	switch t {
+	case FlowStarted:
+		return "started"
+	case FlowEnded:
+		return "ended"
+	default:
+		return fmt.Sprintf("FlowEventType(%d)", uint8(t))
+	}
+}
+
+// FlowEndReason is why a conntrack entry was removed
+type FlowEndReason uint8
+
+const (
+	// FlowExpired flows saw no packets for their timeout
+	FlowExpired FlowEndReason = iota
+	// FlowFlushed flows were removed by one of the FlushConntrack calls
+	FlowFlushed
+	// FlowRevalidationFailed flows were no longer allowed by the rules after a reload
+	FlowRevalidationFailed
+	// FlowEvicted flows made room for a new flow in a full conntrack, see firewall.conntrack.max_connections
+	FlowEvicted
+	// FlowLifetimeExceeded flows reached firewall.conntrack.max_flow_lifetime, a FlowStarted follows if the flow was
+	// readmitted
+	FlowLifetimeExceeded
+)
+
+var flowEndReasonNames = []string{"expired", "flushed", "revalidation_failed", "evicted", "lifetime_exceeded"}
+
+func (r FlowEndReason) String() string {
+	if int(r) < len(flowEndReasonNames) {
+		return flowEndReasonNames[r]
+	}
+	return fmt.Sprintf("FlowEndReason(%d)", uint8(r))
+}
+
+// FlowEvent is a conntrack entry starting or ending, see Firewall.OnFlowEvent
+type FlowEvent struct {
+	Type FlowEventType
+	// Reason is only set for FlowEnded
+	Reason FlowEndReason
+
+	Packet firewall.Packet
+	// Incoming is the direction of the packet that started the flow
+	Incoming bool
+
+	// When the conntrack entry was created and, for FlowEnded, when it was removed
+	Started time.Time
+	Ended   time.Time
+
+	// Packets and bytes seen in each direction. Packets let through by a routine local conntrack cache are not counted.
+	InPackets  uint64
+	InBytes    uint64
+	OutPackets uint64
+	OutBytes   uint64
+
+	// Meta is what Firewall.OnNewConn stored for the flow
+	Meta any
+}
+
+// flowEvents queues flow events for the registered callbacks, which are called one at a time by a single routine so a
+// slow callback only ever holds up the others, never the firewall
+type flowEvents struct {
+	events chan FlowEvent
+	stop   chan struct{}
+
+	// The callbacks, replaced rather than changed so the routine can read them without a lock
+	lock      sync.Mutex
+	callbacks atomic.Pointer[[]func(FlowEvent)]
+
+	metricDropped metrics.Counter
+}
+
+func newFlowEvents(r metrics.Registry) *flowEvents {
+	fe := &flowEvents{
+		events:        make(chan FlowEvent, flowEventQueueSize),
+		stop:          make(chan struct{}),
+		metricDropped: metrics.GetOrRegisterCounter("firewall.flow_events.dropped", r),
+	}
+	go fe.run()
+	return fe
+}
+
+// OnFlowEvent registers fn to be called for every conntrack entry that is created or removed. Callbacks are called in
+// order on a separate routine, outside of any firewall lock. Events are queued in between, if the callbacks can't keep
+// up events are dropped and counted in firewall.flow_events.dropped. The callbacks are carried over to the firewall
+// that replaces this one on reload.
+func (f *Firewall) OnFlowEvent(fn func(ev FlowEvent)) {
+	f.flowEventsLock.Lock()
+	fe := f.flowEvents.Load()
+	if fe == nil {
+		fe = newFlowEvents(f.metricsRegistry)
+		f.flowEvents.Store(fe)
+	}
+	f.flowEventsLock.Unlock()
+
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	var callbacks []func(FlowEvent)
+	if old := fe.callbacks.Load(); old != nil {
+		callbacks = append(callbacks, *old...)
+	}
+	callbacks = append(callbacks, fn)
+	fe.callbacks.Store(&callbacks)
+}
+
+// inheritFlowEvents takes over the flow event callbacks of old, which must not send any more events
+func (f *Firewall) inheritFlowEvents(old *Firewall) {
+	f.flowEvents.Store(old.flowEvents.Swap(nil))
+}
+
+func (fe *flowEvents) run() {
+	for {
+		select {
+		case <-fe.stop:
+			return
+		case ev := <-fe.events:
+			callbacks := fe.callbacks.Load()
+			if callbacks == nil {
+				// Sent before the first callback was stored
+				continue
+			}
+			for _, fn := range *callbacks {
+				fn(ev)
+			}
+		}
+	}
+}
+
+// close stops the routine, queued events that have not been handed to the callbacks are lost
+func (fe *flowEvents) close() {
+	if fe != nil {
+		close(fe.stop)
+	}
+}
+
+// flowStarted sends a FlowStarted event for c, caller must hold the conntrack lock
+func (f *Firewall) flowStarted(fp firewall.Packet, c *conn) {
+	if fe := f.flowEvents.Load(); fe != nil {
+		fe.send(newFlowEvent(FlowStarted, 0, fp, c, time.Time{}))
+	}
+}
+
+// flowEnded sends a FlowEnded event for c, caller must hold the conntrack lock
+func (f *Firewall) flowEnded(fp firewall.Packet, c *conn, reason FlowEndReason) {
+	if fe := f.flowEvents.Load(); fe != nil {
+		fe.send(newFlowEvent(FlowEnded, reason, fp, c, f.clock.Now()))
+	}
+}
+
+func newFlowEvent(t FlowEventType, reason FlowEndReason, fp firewall.Packet, c *conn, ended time.Time) FlowEvent {
+	return FlowEvent{
+		Type:       t,
+		Reason:     reason,
+		Packet:     fp,
+		Incoming:   c.incoming,
+		Started:    c.started,
+		Ended:      ended,
+		InPackets:  c.inPackets,
+		InBytes:    c.inBytes,
+		OutPackets: c.outPackets,
+		OutBytes:   c.outBytes,
+		Meta:       c.Meta,
+	}
+}
+
+// send queues ev without blocking
+func (fe *flowEvents) send(ev FlowEvent) {
+	select {
+	case fe.events <- ev:
+	default:
+		fe.metricDropped.Inc(1)
+	}
+}
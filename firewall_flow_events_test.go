@@ -0,0 +1,138 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_OnFlowEvent(t *testing.T) {
+	r := metrics.NewRegistry()
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+	defer fw.Destroy()
+
+	// No callbacks, nothing queued
+	fp := firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoUDP}
+	fw.addConn([]byte{}, fp, true, RuleOptions{})
+	fw.FlushConntrack()
+	assert.Nil(t, fw.flowEvents.Load())
+
+	events := make(chan FlowEvent, 10)
+	fw.OnFlowEvent(func(ev FlowEvent) { events <- ev })
+	next := func() FlowEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			require.FailNow(t, "no flow event")
+			return FlowEvent{}
+		}
+	}
+
+	fw.addConn(make([]byte, 100), fp, true, RuleOptions{})
+	ev := next()
+	assert.Equal(t, FlowStarted, ev.Type)
+	assert.Equal(t, fp, ev.Packet)
+	assert.True(t, ev.Incoming)
+	assert.False(t, ev.Started.IsZero())
+	assert.True(t, ev.Ended.IsZero())
+	assert.Equal(t, uint64(1), ev.InPackets)
+	assert.Equal(t, uint64(100), ev.InBytes)
+
+	assert.Equal(t, 1, fw.FlushConntrack())
+	ev = next()
+	assert.Equal(t, FlowEnded, ev.Type)
+	assert.Equal(t, FlowFlushed, ev.Reason)
+	assert.Equal(t, fp, ev.Packet)
+	assert.False(t, ev.Ended.Before(ev.Started))
+
+	// Callbacks are carried over on reload
+	nfw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+	defer nfw.Destroy()
+	nfw.inheritFlowEvents(fw)
+	assert.Nil(t, fw.flowEvents.Load())
+	nfw.addConn([]byte{}, fp, false, RuleOptions{})
+	ev = next()
+	assert.Equal(t, FlowStarted, ev.Type)
+	assert.False(t, ev.Incoming)
+}
+
+func TestFlowEvents_Dropped(t *testing.T) {
+	fe := &flowEvents{
+		events:        make(chan FlowEvent, 1),
+		metricDropped: metrics.NewCounter(),
+	}
+
+	fe.send(FlowEvent{})
+	fe.send(FlowEvent{})
+	assert.Equal(t, int64(1), fe.metricDropped.Count())
+}
+
+func TestFlowEndReason_String(t *testing.T) {
+	assert.Equal(t, "revalidation_failed", FlowRevalidationFailed.String())
+	assert.Equal(t, "FlowEndReason(9)", FlowEndReason(9).String())
+	assert.Equal(t, "ended", FlowEnded.String())
+}
+
+func TestFirewall_OnNewConn(t *testing.T) {
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, metrics.NewRegistry())
+	defer fw.Destroy()
+
+	// What an embedder might keep per flow
+	type account struct {
+		fp       firewall.Packet
+		incoming bool
+	}
+	var calls int
+	fw.OnNewConn = func(fp firewall.Packet, incoming bool, meta *any) {
+		calls++
+		assert.Nil(t, *meta)
+		*meta = &account{fp: fp, incoming: incoming}
+	}
+
+	events := make(chan FlowEvent, 10)
+	fw.OnFlowEvent(func(ev FlowEvent) { events <- ev })
+	next := func() FlowEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			require.FailNow(t, "no flow event")
+			return FlowEvent{}
+		}
+	}
+
+	fp := firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoUDP}
+	fw.addConn([]byte{}, fp, true, RuleOptions{})
+	assert.Equal(t, 1, calls)
+	want := &account{fp: fp, incoming: true}
+
+	entries := fw.ListConntrack(ConntrackFilter{})
+	require.Len(t, entries, 1)
+	assert.Equal(t, want, entries[0].Meta)
+
+	ev := next()
+	assert.Equal(t, FlowStarted, ev.Type)
+	assert.Equal(t, want, ev.Meta)
+	assert.Equal(t, 1, fw.FlushConntrack())
+	ev = next()
+	assert.Equal(t, FlowEnded, ev.Type)
+	assert.Equal(t, want, ev.Meta)
+
+	// A reused entry starts without the metadata of the flow it was
+	fw.OnNewConn = nil
+	fw.addConn([]byte{}, fp, false, RuleOptions{})
+	assert.Equal(t, 1, calls)
+	entries = fw.ListConntrack(ConntrackFilter{})
+	require.Len(t, entries, 1)
+	assert.Nil(t, entries[0].Meta)
+	assert.Nil(t, next().Meta)
+}
@@ -0,0 +1,317 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+const (
+	ipfixVersion          = 10
+	ipfixHeaderLen        = 16
+	ipfixSetHeaderLen     = 4
+	ipfixTemplateSetID    = 2
+	ipfixTemplateID       = 256
+	ipfixMaxMessageLen    = 1400
+	flowExportDefaultSize = 4096
+)
+
+// ipfixFields are the information elements we export, in order, as {id, length}. See the IANA IPFIX registry.
+var ipfixFields = [][2]uint16{
+	{8, 4},   // sourceIPv4Address
+	{12, 4},  // destinationIPv4Address
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{61, 1},  // flowDirection, 0 is ingress and 1 is egress
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+	{298, 8}, // initiatorPackets
+	{231, 8}, // initiatorOctets
+	{299, 8}, // responderPackets
+	{232, 8}, // responderOctets
+}
+
+const ipfixRecordLen = 4 + 4 + 2 + 2 + 1 + 1 + 8 + 8 + 8 + 8 + 8 + 8
+
+// flowRecord is a finished conntrack flow. Source is always the side that started the flow.
+type flowRecord struct {
+	fp         firewall.Packet
+	incoming   bool
+	start      time.Time
+	end        time.Time
+	inPackets  uint64
+	inBytes    uint64
+	outPackets uint64
+	outBytes   uint64
+}
+
+// flowExporter sends finished conntrack flows to an IPFIX collector over UDP.
+// Records are queued on a buffered channel and sent from a separate routine, if the queue is full the record is
+// dropped and counted so a slow collector never holds up the firewall.
+type flowExporter struct {
+	l               *logrus.Logger
+	conn            net.Conn
+	records         chan flowRecord
+	stop            chan struct{}
+	interval        time.Duration
+	templateRefresh time.Duration
+
+	// Number of data records sent so far, used as the ipfix sequence number
+	seq uint32
+
+	metricDropped metrics.Counter
+	metricSent    metrics.Counter
+	metricErrors  metrics.Counter
+}
+
+// newFlowExporterFromConfig returns nil if firewall.flow_export.collector is not configured
+func newFlowExporterFromConfig(l *logrus.Logger, c *config.C, r metrics.Registry) (*flowExporter, error) {
+	collector := c.GetString("firewall.flow_export.collector", "")
+	if collector == "" {
+		return nil, nil
+	}
+
+	interval := c.GetDuration("firewall.flow_export.interval", time.Second*10)
+	if interval <= 0 {
+		return nil, fmt.Errorf("firewall.flow_export.interval must be positive")
+	}
+
+	templateRefresh := c.GetDuration("firewall.flow_export.template_refresh", time.Minute*10)
+	if templateRefresh <= 0 {
+		return nil, fmt.Errorf("firewall.flow_export.template_refresh must be positive")
+	}
+
+	size := c.GetInt("firewall.flow_export.buffer", flowExportDefaultSize)
+	if size <= 0 {
+		return nil, fmt.Errorf("firewall.flow_export.buffer must be positive")
+	}
+
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up firewall.flow_export.collector %s: %w", collector, err)
+	}
+
+	fe := newFlowExporter(l, conn, interval, templateRefresh, size, r)
+	go fe.run()
+	return fe, nil
+}
+
+func newFlowExporter(l *logrus.Logger, conn net.Conn, interval, templateRefresh time.Duration, size int, r metrics.Registry) *flowExporter {
+	return &flowExporter{
+		l:               l,
+		conn:            conn,
+		records:         make(chan flowRecord, size),
+		stop:            make(chan struct{}),
+		interval:        interval,
+		templateRefresh: templateRefresh,
+		metricDropped:   metrics.GetOrRegisterCounter("firewall.flow_export.dropped", r),
+		metricSent:      metrics.GetOrRegisterCounter("firewall.flow_export.sent", r),
+		metricErrors:    metrics.GetOrRegisterCounter("firewall.flow_export.errors", r),
+	}
+}
+
+// Export queues a flow record without blocking, it is safe to call on a nil flowExporter
+func (fe *flowExporter) Export(r flowRecord) {
+	if fe == nil {
+		return
+	}
+
+	select {
+	case fe.records <- r:
+	default:
+		fe.metricDropped.Inc(1)
+	}
+}
+
+// Close stops the sending routine, queued records that have not been sent yet are lost
+func (fe *flowExporter) Close() {
+	if fe == nil {
+		return
+	}
+
+	close(fe.stop)
+}
+
+func (fe *flowExporter) run() {
+	defer fe.conn.Close()
+
+	ticker := time.NewTicker(fe.interval)
+	defer ticker.Stop()
+
+	var lastTemplate time.Time
+	var pending []flowRecord
+
+	for {
+		select {
+		case <-fe.stop:
+			return
+		case <-ticker.C:
+		}
+
+		pending = fe.drain(pending[:0])
+		now := time.Now()
+		if now.Sub(lastTemplate) >= fe.templateRefresh {
+			fe.send(fe.templateMessage(now))
+			lastTemplate = now
+		}
+
+		for _, b := range fe.dataMessages(now, pending) {
+			fe.send(b)
+		}
+	}
+}
+
+// drain appends everything currently queued to pending
+func (fe *flowExporter) drain(pending []flowRecord) []flowRecord {
+	for {
+		select {
+		case r := <-fe.records:
+			pending = append(pending, r)
+		default:
+			return pending
+		}
+	}
+}
+
+func (fe *flowExporter) send(b []byte) {
+	if _, err := fe.conn.Write(b); err != nil {
+		fe.metricErrors.Inc(1)
+		if fe.l.Level >= logrus.DebugLevel {
+			fe.l.WithError(err).Debug("Failed to send flow export message")
+		}
+	}
+}
+
+// templateMessage returns an ipfix message containing only our template
+func (fe *flowExporter) templateMessage(now time.Time) []byte {
+	setLen := ipfixSetHeaderLen + 4 + len(ipfixFields)*4
+	b := make([]byte, ipfixHeaderLen+setLen)
+	fe.putHeader(b, now)
+
+	s := b[ipfixHeaderLen:]
+	binary.BigEndian.PutUint16(s[0:2], ipfixTemplateSetID)
+	binary.BigEndian.PutUint16(s[2:4], uint16(setLen))
+	binary.BigEndian.PutUint16(s[4:6], ipfixTemplateID)
+	binary.BigEndian.PutUint16(s[6:8], uint16(len(ipfixFields)))
+
+	s = s[8:]
+	for _, f := range ipfixFields {
+		binary.BigEndian.PutUint16(s[0:2], f[0])
+		binary.BigEndian.PutUint16(s[2:4], f[1])
+		s = s[4:]
+	}
+
+	return b
+}
+
+// dataMessages encodes the records into as many ipfix messages as needed to stay under ipfixMaxMessageLen
+func (fe *flowExporter) dataMessages(now time.Time, records []flowRecord) [][]byte {
+	perMessage := (ipfixMaxMessageLen - ipfixHeaderLen - ipfixSetHeaderLen) / ipfixRecordLen
+
+	var out [][]byte
+	for len(records) > 0 {
+		n := len(records)
+		if n > perMessage {
+			n = perMessage
+		}
+
+		setLen := ipfixSetHeaderLen + n*ipfixRecordLen
+		b := make([]byte, ipfixHeaderLen+setLen)
+		fe.putHeader(b, now)
+
+		s := b[ipfixHeaderLen:]
+		binary.BigEndian.PutUint16(s[0:2], ipfixTemplateID)
+		binary.BigEndian.PutUint16(s[2:4], uint16(setLen))
+		s = s[ipfixSetHeaderLen:]
+		for _, r := range records[:n] {
+			r.encode(s)
+			s = s[ipfixRecordLen:]
+		}
+
+		fe.seq += uint32(n)
+		fe.metricSent.Inc(int64(n))
+		out = append(out, b)
+		records = records[n:]
+	}
+
+	return out
+}
+
+// putHeader writes the ipfix message header, b must already be the full length of the message
+func (fe *flowExporter) putHeader(b []byte, now time.Time) {
+	binary.BigEndian.PutUint16(b[0:2], ipfixVersion)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:8], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:12], fe.seq)
+	// Observation domain is left as 0
+	binary.BigEndian.PutUint32(b[12:16], 0)
+}
+
+// encode writes the record in ipfixFields order, b must be at least ipfixRecordLen long
+func (r *flowRecord) encode(b []byte) {
+	srcIp, dstIp := r.fp.LocalIP, r.fp.RemoteIP
+	srcPort, dstPort := r.fp.LocalPort, r.fp.RemotePort
+	initPackets, initBytes, respPackets, respBytes := r.outPackets, r.outBytes, r.inPackets, r.inBytes
+	var direction uint8 = 1
+	if r.incoming {
+		srcIp, dstIp = dstIp, srcIp
+		srcPort, dstPort = dstPort, srcPort
+		initPackets, initBytes, respPackets, respBytes = respPackets, respBytes, initPackets, initBytes
+		direction = 0
+	}
+
+	binary.BigEndian.PutUint32(b[0:4], uint32(srcIp))
+	binary.BigEndian.PutUint32(b[4:8], uint32(dstIp))
+	binary.BigEndian.PutUint16(b[8:10], srcPort)
+	binary.BigEndian.PutUint16(b[10:12], dstPort)
+	b[12] = r.fp.Protocol
+	b[13] = direction
+	binary.BigEndian.PutUint64(b[14:22], uint64(r.start.UnixMilli()))
+	binary.BigEndian.PutUint64(b[22:30], uint64(r.end.UnixMilli()))
+	binary.BigEndian.PutUint64(b[30:38], initPackets)
+	binary.BigEndian.PutUint64(b[38:46], initBytes)
+	binary.BigEndian.PutUint64(b[46:54], respPackets)
+	binary.BigEndian.PutUint64(b[54:62], respBytes)
+}
+
+// exportFlow hands a finished conntrack entry to the flow exporter, caller must hold the conntrack lock
+func (f *Firewall) exportFlow(fp firewall.Packet, c *conn) {
+	if f.flowExporter == nil {
+		return
+	}
+
+	// Expires was last pushed out by the timeout when the final packet was seen
+	var timeout time.Duration
+	switch fp.Protocol {
+	case firewall.ProtoTCP:
+		timeout = f.tcpTimeout(c)
+	case firewall.ProtoUDP:
+		timeout = f.udpTimeout(c)
+	default:
+		timeout = f.DefaultTimeout
+	}
+
+	end := c.Expires.Add(-timeout)
+	if end.Before(c.started) {
+		// The timeouts changed during a reload
+		end = c.started
+	}
+
+	f.flowExporter.Export(flowRecord{
+		fp:         fp,
+		incoming:   c.incoming,
+		start:      c.started,
+		end:        end,
+		inPackets:  c.inPackets,
+		inBytes:    c.inBytes,
+		outPackets: c.outPackets,
+		outBytes:   c.outBytes,
+	})
+}
@@ -0,0 +1,158 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_FlowExport(t *testing.T) {
+	l := test.NewLogger()
+
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer collector.Close()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"flow_export": map[interface{}]interface{}{
+			"collector": collector.LocalAddr().String(),
+			"interval":  "10ms",
+		},
+		"conntrack": map[interface{}]interface{}{
+			"udp_timeout": "1ms",
+		},
+	}
+
+	fw, err := NewFirewallFromConfig(l, &cert.NebulaCertificate{}, conf)
+	require.NoError(t, err)
+	require.NotNil(t, fw.flowExporter)
+	defer fw.Destroy()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	// An incoming flow with 2 packets in and 1 packet out that has since expired
+	fw.addConn(make([]byte, 100), p, true, RuleOptions{})
+	conntrack := fw.Conntrack.shard(p)
+	conntrack.Lock()
+	c := conntrack.Conns[p]
+	c.count(true, 50)
+	c.count(false, 1000)
+	c.Expires = time.Now().Add(fw.UDPTimeout)
+	time.Sleep(fw.UDPTimeout * 2)
+	fw.evict(conntrack, p)
+	conntrack.Unlock()
+
+	b := make([]byte, 2000)
+	require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	// The template comes first
+	n, err := collector.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(ipfixVersion), binary.BigEndian.Uint16(b[0:2]))
+	assert.Equal(t, uint16(n), binary.BigEndian.Uint16(b[2:4]))
+	assert.Equal(t, uint16(ipfixTemplateSetID), binary.BigEndian.Uint16(b[16:18]))
+	assert.Equal(t, uint16(ipfixTemplateID), binary.BigEndian.Uint16(b[20:22]))
+	assert.Equal(t, uint16(len(ipfixFields)), binary.BigEndian.Uint16(b[22:24]))
+
+	n, err = collector.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, ipfixHeaderLen+ipfixSetHeaderLen+ipfixRecordLen, n)
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(b[8:12]))
+	assert.Equal(t, uint16(ipfixTemplateID), binary.BigEndian.Uint16(b[16:18]))
+
+	r := b[ipfixHeaderLen+ipfixSetHeaderLen:]
+	// The remote side started the flow so it is the source
+	assert.Equal(t, uint32(p.RemoteIP), binary.BigEndian.Uint32(r[0:4]))
+	assert.Equal(t, uint32(p.LocalIP), binary.BigEndian.Uint32(r[4:8]))
+	assert.Equal(t, p.RemotePort, binary.BigEndian.Uint16(r[8:10]))
+	assert.Equal(t, p.LocalPort, binary.BigEndian.Uint16(r[10:12]))
+	assert.Equal(t, uint8(firewall.ProtoUDP), r[12])
+	assert.Equal(t, uint8(0), r[13])
+	assert.LessOrEqual(t, binary.BigEndian.Uint64(r[14:22]), binary.BigEndian.Uint64(r[22:30]))
+	assert.Equal(t, uint64(2), binary.BigEndian.Uint64(r[30:38]))
+	assert.Equal(t, uint64(150), binary.BigEndian.Uint64(r[38:46]))
+	assert.Equal(t, uint64(1), binary.BigEndian.Uint64(r[46:54]))
+	assert.Equal(t, uint64(1000), binary.BigEndian.Uint64(r[54:62]))
+}
+
+func TestFlowExporter_Overflow(t *testing.T) {
+	l := test.NewLogger()
+	r := metrics.NewRegistry()
+	a, b := net.Pipe()
+	defer b.Close()
+
+	// Nothing is reading the queue, the second record must be dropped without blocking
+	fe := newFlowExporter(l, a, time.Hour, time.Hour, 1, r)
+	fe.Export(flowRecord{})
+	fe.Export(flowRecord{})
+	assert.Equal(t, int64(1), fe.metricDropped.Count())
+
+	// Large batches are split across messages
+	records := make([]flowRecord, 50)
+	msgs := fe.dataMessages(time.Now(), records)
+	perMessage := (ipfixMaxMessageLen - ipfixHeaderLen - ipfixSetHeaderLen) / ipfixRecordLen
+	assert.Len(t, msgs, (50+perMessage-1)/perMessage)
+	for _, m := range msgs {
+		assert.LessOrEqual(t, len(m), ipfixMaxMessageLen)
+	}
+	assert.Equal(t, uint32(perMessage), binary.BigEndian.Uint32(msgs[1][8:12]))
+	assert.Equal(t, int64(50), fe.metricSent.Count())
+
+	// A nil exporter is a no-op
+	var nilExporter *flowExporter
+	nilExporter.Export(flowRecord{})
+	nilExporter.Close()
+}
+
+func TestFirewall_FlowExportEnded(t *testing.T) {
+	l := test.NewLogger()
+	a, b := net.Pipe()
+	defer b.Close()
+
+	c := &cert.NebulaCertificate{}
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, c, metrics.NewRegistry())
+	fw.flowExporter = newFlowExporter(l, a, time.Hour, time.Hour, 10, metrics.NewRegistry())
+
+	flow := func(port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+			RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5)),
+			LocalPort:  port,
+			RemotePort: 90,
+			Protocol:   firewall.ProtoUDP,
+		}
+	}
+
+	// Every way conntrack lets go of a flow exports it, not only expiry
+	fw.addConn([]byte{}, flow(10), true, RuleOptions{})
+	conntrack := fw.Conntrack.shard(flow(10))
+	conntrack.Lock()
+	assert.False(t, fw.applyRevalidation(conntrack, fw.ruleset.Load(), flow(10), conntrack.Conns[flow(10)], false, 0))
+	conntrack.Unlock()
+	assert.Len(t, fw.flowExporter.records, 1)
+
+	fw.addConn([]byte{}, flow(11), true, RuleOptions{})
+	assert.Equal(t, 1, fw.FlushConntrackProto(firewall.ProtoUDP))
+	assert.Len(t, fw.flowExporter.records, 2)
+
+	fw.addConn([]byte{}, flow(12), true, RuleOptions{})
+	assert.Equal(t, 1, fw.FlushConntrack())
+	assert.Len(t, fw.flowExporter.records, 3)
+}
@@ -0,0 +1,229 @@
+package nebula
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// hostRTTMinIdle is how long a peer must go without a sample before another peer may take its place once
+// firewall.tcp_rtt.max_hosts peers are tracked. It keeps the tracked peers from churning on a busy host.
+const hostRTTMinIdle = time.Minute
+
+// hostRTTMetricPrefix is the name of the rtt histogram of a peer, followed by its vpn ip
+const hostRTTMetricPrefix = "network.tcp.rtt.host."
+
+// hostRTTs keeps a tcp rtt histogram for each of up to max peers, the ones that most recently had a sample. See
+// firewall.tcp_rtt.max_hosts.
+type hostRTTs struct {
+	max int
+	r   metrics.Registry
+
+	lock  sync.Mutex
+	hosts map[iputil.VpnIp]*hostRTT
+	// While every tracked peer has had a sample within hostRTTMinIdle this is the earliest one could be replaced, so
+	// samples from untracked peers don't look through every tracked one
+	noRoomUntil int64
+
+	metricEvicted   metrics.Counter
+	metricUntracked metrics.Counter
+}
+
+// hostRTT is the rtt histogram of one peer, registered as network.tcp.rtt.host.<vpn ip>. The firewall collector
+// exports it with the vpn ip and certificate name of the peer as labels.
+type hostRTT struct {
+	metrics.Histogram
+	vpnIp iputil.VpnIp
+	name  string
+	// When the last sample was taken, in unix nanoseconds
+	last int64
+}
+
+// HostRTT is a summary of the tcp round trip times measured to one peer, see Firewall.HostRTTs
+type HostRTT struct {
+	VpnIp iputil.VpnIp `json:"vpnIp"`
+	// Name is the name on the certificate of the peer when the first sample was taken
+	Name       string        `json:"name"`
+	Count      int64         `json:"count"`
+	Min        time.Duration `json:"min"`
+	Mean       time.Duration `json:"mean"`
+	P50        time.Duration `json:"p50"`
+	P95        time.Duration `json:"p95"`
+	P99        time.Duration `json:"p99"`
+	Max        time.Duration `json:"max"`
+	LastSample time.Time     `json:"lastSample"`
+}
+
+// loadHostRTTs reads firewall.tcp_rtt.max_hosts
+func (f *Firewall) loadHostRTTs(c *config.C) error {
+	max := c.GetInt("firewall.tcp_rtt.max_hosts", 0)
+	if max < 0 {
+		return fmt.Errorf("firewall.tcp_rtt.max_hosts must not be negative")
+	}
+	if max == 0 {
+		return nil
+	}
+
+	r := f.metricsRegistry
+	if r == nil {
+		r = metrics.DefaultRegistry
+	}
+
+	f.hostRTTs = &hostRTTs{
+		max:             max,
+		r:               r,
+		hosts:           map[iputil.VpnIp]*hostRTT{},
+		metricEvicted:   metrics.GetOrRegisterCounter("network.tcp.rtt.host_evicted", r),
+		metricUntracked: metrics.GetOrRegisterCounter("network.tcp.rtt.host_untracked", r),
+	}
+	return nil
+}
+
+// inheritHostRTTs takes over the peers old is tracking, so their histograms carry over a reload. They are unregistered
+// if tracking is now off, and the least recent are dropped if there is no longer room for them.
+func (f *Firewall) inheritHostRTTs(old *Firewall) {
+	if old.hostRTTs == nil {
+		return
+	}
+
+	old.hostRTTs.lock.Lock()
+	defer old.hostRTTs.lock.Unlock()
+	hosts := old.hostRTTs.hosts
+	old.hostRTTs.hosts = map[iputil.VpnIp]*hostRTT{}
+
+	if f.hostRTTs == nil {
+		for _, h := range hosts {
+			old.hostRTTs.r.Unregister(hostRTTMetricPrefix + h.vpnIp.String())
+		}
+		return
+	}
+
+	f.hostRTTs.lock.Lock()
+	defer f.hostRTTs.lock.Unlock()
+	f.hostRTTs.hosts = hosts
+	for len(f.hostRTTs.hosts) > f.hostRTTs.max {
+		f.hostRTTs.evict(f.hostRTTs.oldest())
+	}
+}
+
+// update records an rtt sample for the peer h, taking it on if there is room
+func (hr *hostRTTs) update(h *HostInfo, rtt time.Duration, now time.Time) {
+	n := now.UnixNano()
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+
+	t := hr.hosts[h.vpnIp]
+	if t == nil {
+		if t = hr.add(h, n); t == nil {
+			hr.metricUntracked.Inc(1)
+			return
+		}
+	}
+
+	t.Update(rtt.Nanoseconds())
+	t.last = n
+}
+
+// add starts tracking h, replacing the least recent peer if there are max already and it has been idle long enough.
+// Returns nil if there is no room. Caller must hold the lock.
+func (hr *hostRTTs) add(h *HostInfo, now int64) *hostRTT {
+	if len(hr.hosts) >= hr.max {
+		if now < hr.noRoomUntil {
+			return nil
+		}
+
+		oldest := hr.oldest()
+		if now-oldest.last < int64(hostRTTMinIdle) {
+			hr.noRoomUntil = oldest.last + int64(hostRTTMinIdle)
+			return nil
+		}
+
+		hr.evict(oldest)
+		hr.metricEvicted.Inc(1)
+	}
+
+	t := &hostRTT{
+		Histogram: metrics.NewHistogram(metrics.NewExpDecaySample(256, 0.015)),
+		vpnIp:     h.vpnIp,
+	}
+	if h.ConnectionState != nil && h.ConnectionState.peerCert != nil {
+		t.name = h.ConnectionState.peerCert.Details.Name
+	}
+
+	// Replace anything left under the name, Register won't
+	name := hostRTTMetricPrefix + h.vpnIp.String()
+	hr.r.Unregister(name)
+	_ = hr.r.Register(name, t)
+	hr.hosts[h.vpnIp] = t
+	return t
+}
+
+// oldest returns the tracked peer with the least recent sample, caller must hold the lock and there must be one
+func (hr *hostRTTs) oldest() *hostRTT {
+	var oldest *hostRTT
+	for _, t := range hr.hosts {
+		if oldest == nil || t.last < oldest.last {
+			oldest = t
+		}
+	}
+	return oldest
+}
+
+// evict stops tracking t, caller must hold the lock
+func (hr *hostRTTs) evict(t *hostRTT) {
+	delete(hr.hosts, t.vpnIp)
+	hr.r.Unregister(hostRTTMetricPrefix + t.vpnIp.String())
+	hr.noRoomUntil = 0
+}
+
+// ForgetHostRTT stops tracking the rtt of vpnIp and unregisters its histogram, it is called when the last tunnel to
+// the peer is closed
+func (f *Firewall) ForgetHostRTT(vpnIp iputil.VpnIp) {
+	hr := f.hostRTTs
+	if hr == nil {
+		return
+	}
+
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	if t := hr.hosts[vpnIp]; t != nil {
+		hr.evict(t)
+	}
+}
+
+// HostRTTs returns a summary of the tcp round trip times of every peer being tracked, in vpn ip order. It is empty
+// unless firewall.tcp_rtt.max_hosts is set.
+func (f *Firewall) HostRTTs() []HostRTT {
+	hr := f.hostRTTs
+	if hr == nil {
+		return nil
+	}
+
+	hr.lock.Lock()
+	out := make([]HostRTT, 0, len(hr.hosts))
+	for _, t := range hr.hosts {
+		s := t.Snapshot()
+		p := s.Percentiles([]float64{0.5, 0.95, 0.99})
+		out = append(out, HostRTT{
+			VpnIp:      t.vpnIp,
+			Name:       t.name,
+			Count:      s.Count(),
+			Min:        time.Duration(s.Min()),
+			Mean:       time.Duration(s.Mean()),
+			P50:        time.Duration(p[0]),
+			P95:        time.Duration(p[1]),
+			P99:        time.Duration(p[2]),
+			Max:        time.Duration(s.Max()),
+			LastSample: time.Unix(0, t.last),
+		})
+	}
+	hr.lock.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].VpnIp < out[j].VpnIp })
+	return out
+}
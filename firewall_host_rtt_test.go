@@ -0,0 +1,247 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHostRTTFirewall returns a firewall with its own registry that tracks the rtt of up to max peers
+func newHostRTTFirewall(t *testing.T, max int) (*Firewall, metrics.Registry) {
+	l := test.NewLogger()
+	r := metrics.NewRegistry()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"tcp_rtt": map[interface{}]interface{}{"max_hosts": max},
+	}
+	require.NoError(t, fw.loadHostRTTs(conf))
+	return fw, r
+}
+
+func newHostRTTPeer(ip net.IP, name string) *HostInfo {
+	peer := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: name}}
+	return &HostInfo{ConnectionState: &ConnectionState{peerCert: peer}, vpnIp: iputil.Ip2VpnIp(ip)}
+}
+
+func TestFirewall_loadHostRTTs(t *testing.T) {
+	l := test.NewLogger()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, metrics.NewRegistry())
+
+	conf := config.NewC(l)
+	require.NoError(t, fw.loadHostRTTs(conf))
+	assert.Nil(t, fw.hostRTTs)
+	assert.Nil(t, fw.HostRTTs())
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"tcp_rtt": map[interface{}]interface{}{"max_hosts": -1},
+	}
+	assert.EqualError(t, fw.loadHostRTTs(conf), "firewall.tcp_rtt.max_hosts must not be negative")
+
+	fw, _ = newHostRTTFirewall(t, 5)
+	require.NotNil(t, fw.hostRTTs)
+	assert.Equal(t, 5, fw.hostRTTs.max)
+}
+
+func TestFirewall_HostRTTs(t *testing.T) {
+	fw, r := newHostRTTFirewall(t, 2)
+	now := time.Now()
+	h1 := newHostRTTPeer(net.IPv4(10, 0, 0, 2), "host2")
+	h2 := newHostRTTPeer(net.IPv4(10, 0, 0, 1), "host1")
+	h3 := newHostRTTPeer(net.IPv4(10, 0, 0, 3), "host3")
+
+	fw.hostRTTs.update(h1, 10*time.Millisecond, now)
+	fw.hostRTTs.update(h1, 30*time.Millisecond, now)
+	fw.hostRTTs.update(h2, 5*time.Millisecond, now.Add(time.Second))
+
+	rtts := fw.HostRTTs()
+	require.Len(t, rtts, 2)
+	assert.Equal(t, HostRTT{
+		VpnIp:      h2.vpnIp,
+		Name:       "host1",
+		Count:      1,
+		Min:        5 * time.Millisecond,
+		Mean:       5 * time.Millisecond,
+		P50:        5 * time.Millisecond,
+		P95:        5 * time.Millisecond,
+		P99:        5 * time.Millisecond,
+		Max:        5 * time.Millisecond,
+		LastSample: time.Unix(0, now.Add(time.Second).UnixNano()),
+	}, rtts[0])
+	assert.Equal(t, h1.vpnIp, rtts[1].VpnIp)
+	assert.Equal(t, int64(2), rtts[1].Count)
+	assert.Equal(t, 20*time.Millisecond, rtts[1].Mean)
+	assert.Equal(t, 30*time.Millisecond, rtts[1].Max)
+
+	hist, ok := r.Get("network.tcp.rtt.host.10.0.0.2").(metrics.Histogram)
+	require.True(t, ok)
+	assert.Equal(t, int64(2), hist.Count())
+
+	// There is no room for a third peer while the others have had a sample within hostRTTMinIdle
+	fw.hostRTTs.update(h3, time.Millisecond, now.Add(hostRTTMinIdle-time.Second))
+	fw.hostRTTs.update(h3, time.Millisecond, now.Add(hostRTTMinIdle-time.Second))
+	assert.Len(t, fw.HostRTTs(), 2)
+	assert.Nil(t, r.Get("network.tcp.rtt.host.10.0.0.3"))
+	assert.Equal(t, int64(2), fw.hostRTTs.metricUntracked.Count())
+
+	// Once the least recent has been idle long enough it makes room
+	fw.hostRTTs.update(h3, time.Millisecond, now.Add(hostRTTMinIdle))
+	rtts = fw.HostRTTs()
+	require.Len(t, rtts, 2)
+	assert.Equal(t, h2.vpnIp, rtts[0].VpnIp)
+	assert.Equal(t, h3.vpnIp, rtts[1].VpnIp)
+	assert.Equal(t, int64(1), rtts[1].Count)
+	assert.Nil(t, r.Get("network.tcp.rtt.host.10.0.0.2"))
+	assert.NotNil(t, r.Get("network.tcp.rtt.host.10.0.0.3"))
+	assert.Equal(t, int64(1), fw.hostRTTs.metricEvicted.Count())
+
+	// Closing the last tunnel to a peer forgets it
+	fw.ForgetHostRTT(h3.vpnIp)
+	fw.ForgetHostRTT(h1.vpnIp)
+	rtts = fw.HostRTTs()
+	require.Len(t, rtts, 1)
+	assert.Equal(t, h2.vpnIp, rtts[0].VpnIp)
+	assert.Nil(t, r.Get("network.tcp.rtt.host.10.0.0.3"))
+
+	// A forgotten peer is taken back with a fresh histogram
+	fw.hostRTTs.update(h3, 7*time.Millisecond, now.Add(hostRTTMinIdle))
+	rtts = fw.HostRTTs()
+	require.Len(t, rtts, 2)
+	assert.Equal(t, int64(1), rtts[1].Count)
+	assert.Equal(t, 7*time.Millisecond, rtts[1].Max)
+}
+
+func TestFirewall_HostRTTs_Drop(t *testing.T) {
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host1", Ips: []*net.IPNet{&ipNet}}}
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	clock := newFakeClock()
+	fw.clock = clock
+	conf := config.NewC(test.NewLogger())
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"tcp_rtt": map[interface{}]interface{}{"max_hosts": 10},
+	}
+	require.NoError(t, fw.loadHostRTTs(conf))
+	require.NoError(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
+
+	peerIp := net.IPNet{IP: net.IPv4(1, 2, 3, 5), Mask: net.IPMask{255, 255, 255, 0}}
+	h, _ := newTestHost(cert.NebulaCertificateDetails{Name: "host2", Ips: []*net.IPNet{&peerIp}})
+
+	fp := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   h.vpnIp,
+		LocalPort:  40000,
+		RemotePort: 22,
+		Protocol:   firewall.ProtoTCP,
+	}
+	cp := cert.NewCAPool()
+
+	syn := tcpTestPacket(tcpSYN)
+	binary.BigEndian.PutUint32(syn[20+4:], 100)
+	require.NoError(t, fw.Drop(syn, fp, false, h, cp, nil))
+
+	clock.advance(25 * time.Millisecond)
+	synAck := tcpTestPacket(tcpSYN | tcpACK)
+	binary.BigEndian.PutUint32(synAck[20+8:], 101)
+	require.NoError(t, fw.Drop(synAck, fp, true, h, cp, nil))
+
+	rtts := fw.HostRTTs()
+	require.Len(t, rtts, 1)
+	assert.Equal(t, h.vpnIp, rtts[0].VpnIp)
+	assert.Equal(t, "host2", rtts[0].Name)
+	assert.Equal(t, int64(1), rtts[0].Count)
+	assert.Equal(t, 25*time.Millisecond, rtts[0].Max)
+}
+
+func TestFirewall_inheritHostRTTs(t *testing.T) {
+	now := time.Now()
+	old, r := newHostRTTFirewall(t, 3)
+	for i := 1; i <= 3; i++ {
+		h := newHostRTTPeer(net.IPv4(10, 0, 0, byte(i)), "")
+		old.hostRTTs.update(h, time.Millisecond, now.Add(time.Duration(i)*time.Second))
+	}
+
+	// A firewall with less room keeps the most recent
+	fw, _ := newHostRTTFirewall(t, 2)
+	fw.hostRTTs.r = r
+	fw.inheritHostRTTs(old)
+	assert.Empty(t, old.HostRTTs())
+	rtts := fw.HostRTTs()
+	require.Len(t, rtts, 2)
+	assert.Equal(t, iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 2)), rtts[0].VpnIp)
+	assert.Equal(t, iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 3)), rtts[1].VpnIp)
+	assert.Nil(t, r.Get("network.tcp.rtt.host.10.0.0.1"))
+	assert.NotNil(t, r.Get("network.tcp.rtt.host.10.0.0.3"))
+
+	// Turning it off unregisters everything
+	off := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+	off.inheritHostRTTs(fw)
+	assert.Nil(t, off.HostRTTs())
+	assert.Nil(t, r.Get("network.tcp.rtt.host.10.0.0.2"))
+	assert.Nil(t, r.Get("network.tcp.rtt.host.10.0.0.3"))
+}
+
+func TestFirewallCollector_HostRTT(t *testing.T) {
+	fw, r := newHostRTTFirewall(t, 2)
+	now := time.Now()
+	fw.hostRTTs.update(newHostRTTPeer(net.IPv4(10, 0, 0, 1), "host1"), 10, now)
+	fw.hostRTTs.update(newHostRTTPeer(net.IPv4(10, 0, 0, 2), "host2"), 20, now)
+	fw.hostRTTs.update(newHostRTTPeer(net.IPv4(10, 0, 0, 2), "host2"), 40, now)
+
+	pr := prometheus.NewRegistry()
+	require.NoError(t, pr.Register(NewFirewallCollector(r, "nebula", "")))
+	families, err := pr.Gather()
+	require.NoError(t, err)
+
+	var found bool
+	for _, f := range families {
+		if f.GetName() != "nebula_network_tcp_rtt_host" {
+			continue
+		}
+		found = true
+
+		require.Len(t, f.GetMetric(), 2)
+		sums := map[string]float64{}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			sums[labels["vpn_ip"]+" "+labels["name"]] = m.GetSummary().GetSampleSum()
+		}
+		assert.Equal(t, map[string]float64{"10.0.0.1 host1": 10, "10.0.0.2 host2": 60}, sums)
+	}
+	assert.True(t, found)
+}
+
+func TestFirewall_TCPRTTMinInterval(t *testing.T) {
+	l := test.NewLogger()
+	conf := config.NewC(l)
+	fw, err := NewFirewallFromConfig(l, &cert.NebulaCertificate{}, conf)
+	require.NoError(t, err)
+	assert.Zero(t, fw.tcpRTTMinInterval)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"tcp_rtt": map[interface{}]interface{}{"min_interval": "2s"},
+	}
+	fw, err = NewFirewallFromConfig(l, &cert.NebulaCertificate{}, conf)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, fw.tcpRTTMinInterval)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"tcp_rtt": map[interface{}]interface{}{"min_interval": "-1s"},
+	}
+	_, err = NewFirewallFromConfig(l, &cert.NebulaCertificate{}, conf)
+	assert.EqualError(t, err, "firewall.tcp_rtt.min_interval must not be negative")
+}
@@ -0,0 +1,82 @@
+package nebula
+
+import (
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// lintRule is a rule as it was loaded from the config, for lintRules
+type lintRule struct {
+	table     string
+	index     int
+	proto     uint8
+	startPort int32
+	endPort   int32
+	groups    []string
+	host      string
+	cidr      netip.Prefix
+	localCidr netip.Prefix
+	caName    string
+	caSha     string
+	opts      RuleOptions
+}
+
+// lintRules logs a warning for every rule in table that can never make a difference, because another rule allows
+// any host for the same direction, proto, port and ca. These are usually left overs or a mistake such as an accidental
+// `host: any`. Only plain allow rules are considered, deny rules and rules with a priority depend on their order.
+func lintRules(l *logrus.Logger, rules []lintRule) {
+	for _, r := range rules {
+		if r.opts != (RuleOptions{}) {
+			continue
+		}
+
+		for _, by := range rules {
+			if (by.table == r.table && by.index == r.index) || !by.shadows(r) {
+				continue
+			}
+
+			// Two rules that shadow each other are duplicates, only the later one is reported. Rule files are loaded
+			// after the inline rules.
+			if r.shadows(by) && (r.table == by.table && r.index < by.index || r.table < by.table) {
+				continue
+			}
+
+			if by.table == r.table {
+				l.Warnf("%s rule #%v; is shadowed by rule #%v which allows any host on the same proto and port", r.table, r.index, by.index)
+			} else {
+				l.Warnf("%s rule #%v; is shadowed by %s rule #%v which allows any host on the same proto and port", r.table, r.index, by.table, by.index)
+			}
+			break
+		}
+	}
+}
+
+// shadows returns true if r allows everything o does
+func (r lintRule) shadows(o lintRule) bool {
+	// Only rules in the port maps are evaluated together regardless of order
+	if !r.opts.inPortMaps() {
+		return false
+	}
+
+	if !(&FirewallRule{}).isAny(r.groups, r.host, r.cidr, r.localCidr) {
+		return false
+	}
+
+	if r.proto != firewall.ProtoAny && r.proto != o.proto {
+		return false
+	}
+
+	// Port any covers every port, fragments included
+	if r.startPort != firewall.PortAny && (o.startPort < r.startPort || o.endPort > r.endPort || o.startPort == firewall.PortAny) {
+		return false
+	}
+
+	// A rule without a ca applies to certificates from every ca, otherwise the ca must be the same
+	if r.caName == "" && r.caSha == "" {
+		return true
+	}
+
+	return r.caName == o.caName && r.caSha == o.caSha
+}
@@ -0,0 +1,67 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddFirewallRulesFromConfig_Lint(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	rule := func(kv ...interface{}) map[interface{}]interface{} {
+		m := map[interface{}]interface{}{}
+		for i := 0; i < len(kv); i += 2 {
+			m[kv[i]] = kv[i+1]
+		}
+		return m
+	}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		// 0: shadowed by the any rule on the same port
+		rule("port", "443", "proto", "tcp", "group", "web"),
+		// 1: allows everything on 443
+		rule("port", "443", "proto", "tcp", "host", "any"),
+		// 2: another proto is a different bucket
+		rule("port", "443", "proto", "udp", "group", "web"),
+		// 3: inside the range of rule 4
+		rule("port", "8080", "proto", "tcp", "cidr", "10.0.0.0/8"),
+		// 4: any host on a range, any protocol
+		rule("port", "8000-9000", "proto", "any", "group", "any"),
+		// 5: a different ca is a different bucket
+		rule("port", "22", "proto", "tcp", "group", "admin", "ca_name", "ca1"),
+		// 6: any host but only for ca2
+		rule("port", "22", "proto", "tcp", "host", "any", "ca_name", "ca2"),
+		// 7 and 8: duplicates, only the later one is reported
+		rule("port", "53", "proto", "udp", "host", "any"),
+		rule("port", "53", "proto", "udp", "host", "any"),
+		// 9: a deny is left alone
+		rule("port", "443", "proto", "tcp", "group", "bad", "action", "deny"),
+		// 10: nothing for every ca covers fragments
+		rule("port", "fragment", "proto", "tcp", "group", "web"),
+		// 11: any host on any port of any protocol, only for ca3 so it doesn't shadow the rest
+		rule("port", "any", "proto", "any", "host", "any", "ca_name", "ca3"),
+		// 12: port any covers fragments, shadowed by rule 11
+		rule("port", "fragment", "proto", "tcp", "group", "web", "ca_name", "ca3"),
+	}}
+
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}))
+	out := ob.String()
+
+	assert.Contains(t, out, "firewall.inbound rule #0; is shadowed by rule #1")
+	assert.NotContains(t, out, "rule #1; is shadowed")
+	assert.NotContains(t, out, "rule #2; is shadowed")
+	assert.Contains(t, out, "firewall.inbound rule #3; is shadowed by rule #4")
+	assert.NotContains(t, out, "rule #5; is shadowed")
+	assert.NotContains(t, out, "rule #7; is shadowed")
+	assert.Contains(t, out, "firewall.inbound rule #8; is shadowed by rule #7")
+	assert.NotContains(t, out, "rule #9; is shadowed")
+	assert.NotContains(t, out, "rule #10; is shadowed")
+	assert.Contains(t, out, "firewall.inbound rule #12; is shadowed by rule #11")
+}
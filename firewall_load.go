@@ -0,0 +1,218 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// parallelLoadMinPorts is how many port entries the rules for a port map must add before buildFirewallPort splits the
+// work between routines, below this the routines cost more than they save
+const parallelLoadMinPorts = 4096
+
+// portRule is what a rule adds to every port in its range
+type portRule struct {
+	startPort int32
+	endPort   int32
+	groups    []string
+	host      string
+	ip        netip.Prefix
+	localIp   netip.Prefix
+	caName    string
+	caSha     string
+}
+
+// firewallTableLoader is a FirewallInterface that collects the rules for one direction so the table can be built all
+// at once by build, see loadFirewallRules
+type firewallTableLoader struct {
+	f        *Firewall
+	incoming bool
+
+	// The rules for each port map, the rules with options, the rules without and the log only rules, in the order
+	// they were added. The ports of the ordered and log only rules are built from their rule.
+	ports   map[uint8][]portRule
+	ordered []*orderedRule
+	plain   []*plainRule
+	logOnly []*orderedRule
+
+	// What the rules add to the rule hashes
+	rules strings.Builder
+
+	// Some rule matches on ca_name
+	caNames bool
+
+	// Some rule has an expiry
+	timed bool
+}
+
+func newFirewallTableLoader(f *Firewall, incoming bool) *firewallTableLoader {
+	return &firewallTableLoader{f: f, incoming: incoming, ports: map[uint8][]portRule{}}
+}
+
+func (tl *firewallTableLoader) AddRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, opts RuleOptions) error {
+	r := portRule{startPort: startPort, endPort: endPort, groups: groups, host: host, ip: iputil.IPNet2Prefix(ip), localIp: iputil.IPNet2Prefix(localIp), caName: caName, caSha: caSha}
+
+	ruleString := tl.f.logRule(incoming, proto, r, opts)
+	tl.rules.WriteString(ruleString)
+	tl.rules.WriteString("\n")
+
+	if err := checkRuleDirection(incoming, opts); err != nil {
+		return err
+	}
+	if err := checkRule(proto, r, opts); err != nil {
+		return err
+	}
+	if r.caName != "" {
+		tl.caNames = true
+	}
+	if !opts.Expires.IsZero() {
+		tl.timed = true
+	}
+
+	if opts.LogOnly {
+		tl.logOnly = append(tl.logOnly, &orderedRule{proto: proto, opts: opts, rule: r, name: ruleName(opts, ruleString)})
+		return nil
+	}
+
+	if opts.inPortMaps() {
+		tl.ports[proto] = append(tl.ports[proto], r)
+	}
+
+	if !opts.plain() {
+		tl.ordered = append(tl.ordered, &orderedRule{proto: proto, opts: opts, rule: r, name: ruleName(opts, ruleString)})
+	} else {
+		tl.plain = append(tl.plain, newPlainRule(proto, r, ruleName(opts, ruleString)))
+	}
+
+	return nil
+}
+
+// build returns the table holding every rule that was added
+func (tl *firewallTableLoader) build() *FirewallTable {
+	workers := runtime.GOMAXPROCS(0)
+	ft := newFirewallTable()
+	ft.caNames = tl.caNames
+	ft.timed = tl.timed
+	ft.plain = tl.plain
+	ft.TCP = buildFirewallPort(tl.ports[firewall.ProtoTCP], workers)
+	ft.UDP = buildFirewallPort(tl.ports[firewall.ProtoUDP], workers)
+	ft.ICMP = buildFirewallPort(tl.ports[firewall.ProtoICMP], workers)
+	ft.AnyProto = buildFirewallPort(tl.ports[firewall.ProtoAny], workers)
+
+	for _, or := range tl.ordered {
+		or.ports = orderedPorts(or.rule, or.opts, workers)
+		ft.addOrdered(or)
+	}
+
+	for _, or := range tl.logOnly {
+		or.ports = orderedPorts(or.rule, or.opts, workers)
+		ft.logOnly = append(ft.logOnly, &logOnlyRule{orderedRule: or})
+	}
+
+	return ft
+}
+
+// buildFirewallPort returns a port map holding rules, which checkRule must have accepted. Large maps are built by
+// up to workers routines, each owning a slice of the port space and adding every rule that touches it in order, so the
+// result is the same as adding the rules one at a time. The slices are merged once they are all built.
+func buildFirewallPort(rules []portRule, workers int) firewallPort {
+	fp := firewallPort{}
+
+	total := 0
+	for _, r := range rules {
+		total += int(r.endPort-r.startPort) + 1
+	}
+
+	if total < parallelLoadMinPorts || workers < 2 {
+		for _, r := range rules {
+			_ = fp.addRule(r.startPort, r.endPort, r.groups, r.host, r.ip, r.localIp, r.caName, r.caSha)
+		}
+		return fp
+	}
+
+	// Fragment and any are ports too
+	const first, last = firewall.PortFragment, 65535
+	span := (last - first + int32(workers)) / int32(workers)
+
+	parts := make([]firewallPort, workers)
+	var wg sync.WaitGroup
+	for w := range parts {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			lo := first + int32(w)*span
+			hi := lo + span - 1
+
+			part := firewallPort{}
+			for _, r := range rules {
+				start, end := r.startPort, r.endPort
+				if start < lo {
+					start = lo
+				}
+				if end > hi {
+					end = hi
+				}
+				if start <= end {
+					_ = part.addRule(start, end, r.groups, r.host, r.ip, r.localIp, r.caName, r.caSha)
+				}
+			}
+			parts[w] = part
+		}(w)
+	}
+	wg.Wait()
+
+	// Every port belongs to exactly one part
+	for _, part := range parts {
+		for port, fc := range part {
+			fp[port] = fc
+		}
+	}
+
+	return fp
+}
+
+// loadFirewallRules loads firewall.outbound and firewall.inbound, and their rule files, into f, which must not be in use yet. The two are
+// independent so they are parsed and built at the same time, the rule hashes still list outbound before inbound.
+func loadFirewallRules(l *logrus.Logger, c *config.C, f *Firewall) error {
+	// Taken before the files are loaded, if one changes in between the next reload loads it again
+	f.ruleFiles = readRuleFiles(c)
+
+	loaders := []*firewallTableLoader{newFirewallTableLoader(f, false), newFirewallTableLoader(f, true)}
+	tables := make([]*FirewallTable, len(loaders))
+	errs := make([]error, len(loaders))
+
+	var wg sync.WaitGroup
+	for i, tl := range loaders {
+		wg.Add(1)
+		go func(i int, tl *firewallTableLoader) {
+			defer wg.Done()
+			if errs[i] = AddFirewallRulesFromConfig(l, tl.incoming, c, tl); errs[i] == nil {
+				tables[i] = tl.build()
+			}
+		}(i, tl)
+	}
+	wg.Wait()
+
+	// Report the same error as loading one direction after the other would
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	rs := *f.ruleset.Load()
+	rs.out, rs.in = tables[0], tables[1]
+	f.ruleset.Store(&rs)
+	f.rulesLock.Lock()
+	f.rules += loaders[0].rules.String() + loaders[1].rules.String()
+	f.rulesLock.Unlock()
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package nebula
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largeRuleConfig returns n rules for each direction, a mix of single ports, ranges wide enough to be built in
+// parallel and rules with options
+func largeRuleConfig(n int) map[interface{}]interface{} {
+	rules := func(group string) []interface{} {
+		rs := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			r := map[interface{}]interface{}{"proto": "tcp", "group": fmt.Sprintf("%s-%d", group, i%50)}
+			switch i % 10 {
+			case 0:
+				r["port"] = fmt.Sprintf("%d-%d", i%1000+1, i%1000+1000)
+			case 1:
+				r["port"] = "any"
+				r["proto"] = "udp"
+				r["cidr"] = fmt.Sprintf("10.%d.%d.0/24", i/256%256, i%256)
+			case 2:
+				r["port"] = fmt.Sprint(i%60000 + 1)
+				r["action"] = "deny"
+				r["priority"] = fmt.Sprint(i % 3)
+			default:
+				r["port"] = fmt.Sprint(i%60000 + 1)
+			}
+			rs = append(rs, r)
+		}
+		return rs
+	}
+
+	return map[interface{}]interface{}{"outbound": rules("out"), "inbound": rules("in")}
+}
+
+func TestLoadFirewallRules(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = largeRuleConfig(200)
+
+	// Loaded one rule at a time, the way it was always done
+	seq := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	require.NoError(t, AddFirewallRulesFromConfig(l, false, conf, seq))
+	require.NoError(t, AddFirewallRulesFromConfig(l, true, conf, seq))
+
+	for i := 0; i < 3; i++ {
+		fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+		require.NoError(t, loadFirewallRules(l, conf, fw))
+		assert.Equal(t, seq.GetRuleHashes(), fw.GetRuleHashes())
+		assert.Equal(t, seq.getRules(), fw.getRules())
+		assert.Equal(t, seq.InRules(), fw.InRules())
+		assert.Equal(t, seq.OutRules(), fw.OutRules())
+	}
+
+	// When both directions are bad the outbound error is reported, like loading them one after the other
+	bad := func(port string) []interface{} {
+		return []interface{}{map[interface{}]interface{}{"port": port, "proto": "tcp", "host": "any"}}
+	}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"outbound": bad("a"), "inbound": bad("b")}
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	assert.EqualError(t, loadFirewallRules(l, conf, fw), "firewall.outbound rule #0; port was not a number; `a`")
+	assert.Empty(t, fw.getRules())
+}
+
+func TestBuildFirewallPort(t *testing.T) {
+	rules := []portRule{
+		{startPort: 1, endPort: 65535, groups: []string{"a"}},
+		{startPort: -1, endPort: -1, host: "b"},
+		{startPort: 0, endPort: 0, host: "c", caName: "ca"},
+		{startPort: 100, endPort: 200, groups: []string{"d"}, caSha: "sha"},
+		{startPort: 150, endPort: 150, host: "any"},
+	}
+
+	// Above parallelLoadMinPorts, so split between routines
+	fp := buildFirewallPort(rules, 3)
+
+	seq := firewallPort{}
+	for _, r := range rules {
+		assert.NoError(t, seq.addRule(r.startPort, r.endPort, r.groups, r.host, r.ip, r.localIp, r.caName, r.caSha))
+	}
+	assert.Len(t, fp, 65537)
+	assert.Equal(t, seq, fp)
+}
+
+func BenchmarkLoadFirewallRules(b *testing.B) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = largeRuleConfig(5000)
+
+	b.Run("sequential", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+			_ = AddFirewallRulesFromConfig(l, false, conf, fw)
+			_ = AddFirewallRulesFromConfig(l, true, conf, fw)
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+			_ = loadFirewallRules(l, conf, fw)
+		}
+	})
+}
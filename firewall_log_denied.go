@@ -0,0 +1,109 @@
+package nebula
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// deniedLog decides which denied packets are logged, see firewall.log_denied. Every den packets the first num are
+// sampled, and the sampled packets are limited to burst logs a second.
+type deniedLog struct {
+	num   uint64
+	den   uint64
+	seen  atomic.Uint64
+	limit *connRateLimiter
+}
+
+// loadDeniedLog reads firewall.log_denied
+func (f *Firewall) loadDeniedLog(c *config.C) error {
+	if !c.GetBool("firewall.log_denied.enabled", false) {
+		return nil
+	}
+
+	num, den, err := parseSampleRate(c.GetString("firewall.log_denied.rate", "1/100"))
+	if err != nil {
+		return fmt.Errorf("firewall.log_denied.rate %w", err)
+	}
+
+	burst := c.GetInt("firewall.log_denied.burst", 10)
+	if burst < 1 {
+		return fmt.Errorf("firewall.log_denied.burst must be positive")
+	}
+
+	f.deniedLog = &deniedLog{
+		num:   num,
+		den:   den,
+		limit: newConnRateLimiter(burst, burst),
+	}
+	return nil
+}
+
+// parseSampleRate reads a sample rate written as a fraction, `1/100`, or as a number from 0 to 1, `0.01`
+func parseSampleRate(s string) (uint64, uint64, error) {
+	if n, d, ok := strings.Cut(s, "/"); ok {
+		num, err := strconv.ParseUint(strings.TrimSpace(n), 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("was not understood; `%s`", s)
+		}
+		den, err := strconv.ParseUint(strings.TrimSpace(d), 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("was not understood; `%s`", s)
+		}
+		if num == 0 || den < num {
+			return 0, 0, fmt.Errorf("must be more than 0 and at most 1; `%s`", s)
+		}
+		return num, den, nil
+	}
+
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("was not understood; `%s`", s)
+	}
+	if !(r > 0 && r <= 1) {
+		return 0, 0, fmt.Errorf("must be more than 0 and at most 1; `%s`", s)
+	}
+
+	const den = 10000
+	num := uint64(math.Max(1, math.Round(r*den)))
+	return num, den, nil
+}
+
+// sample returns true if the next denied packet should be logged
+func (d *deniedLog) sample(now int64) bool {
+	if (d.seen.Add(1)-1)%d.den >= d.num {
+		return false
+	}
+	return d.limit.allow(now)
+}
+
+// logDenied logs a packet Drop refused for reason if it is sampled. Only the addresses and ports of the packet are
+// logged, never its payload.
+func (f *Firewall) logDenied(fp firewall.Packet, incoming bool, h *HostInfo, reason error) {
+	if !f.deniedLog.sample(f.clock.Now().UnixNano()) {
+		return
+	}
+
+	direction := "incoming"
+	if !incoming {
+		direction = "outgoing"
+	}
+
+	h.logger(f.l).
+		WithField("direction", direction).
+		WithField("proto", firewall.ProtoName(fp.Protocol)).
+		WithField("localIp", fp.LocalIP).
+		WithField("localPort", fp.LocalPort).
+		WithField("remoteIp", fp.RemoteIP).
+		WithField("remotePort", fp.RemotePort).
+		WithField("fragment", fp.Fragment).
+		WithField("reason", reason).
+		WithField("action", f.dropAction(reason, incoming)).
+		WithField("rulesVersion", f.rulesVersion()).
+		Info("Firewall denied a packet")
+}
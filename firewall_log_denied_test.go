@@ -0,0 +1,165 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_LogDenied(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"log_denied": map[interface{}]interface{}{"enabled": true, "rate": "1/10", "burst": 2},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	clock := newFakeClock()
+	fw.clock = clock
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+
+	ob.Reset()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, p, true, h, cp, nil))
+	}
+	assert.Equal(t, 1, strings.Count(ob.String(), "Firewall denied a packet"))
+	for _, field := range []string{"direction=incoming", "proto=tcp", "localIp=1.2.3.4", "localPort=22", "remoteIp=1.2.3.4", "remotePort=40000", "certName=host1", `reason="no matching rule in firewall table"`, "action=drop", "rulesVersion=0"} {
+		assert.Contains(t, ob.String(), field)
+	}
+
+	// The sampled drops are limited to burst a second
+	clock.advance(time.Second)
+	ob.Reset()
+	for i := 0; i < 50; i++ {
+		fw.Drop(b, p, false, h, cp, nil)
+	}
+	assert.Equal(t, 2, strings.Count(ob.String(), "Firewall denied a packet"))
+	assert.Contains(t, ob.String(), "direction=outgoing")
+
+	clock.advance(time.Second)
+	ob.Reset()
+	for i := 0; i < 10; i++ {
+		fw.Drop(b, p, false, h, cp, nil)
+	}
+	assert.Equal(t, 1, strings.Count(ob.String(), "Firewall denied a packet"))
+
+	// Off by default
+	conf.Settings["firewall"] = map[interface{}]interface{}{}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Nil(t, fw.deniedLog)
+
+	for _, rate := range []string{"0/10", "2/1", "1/x", "1.5", "0", "lots"} {
+		conf.Settings["firewall"] = map[interface{}]interface{}{
+			"log_denied": map[interface{}]interface{}{"enabled": true, "rate": rate},
+		}
+		_, err = NewFirewallFromConfig(l, c, conf)
+		assert.Error(t, err, rate)
+	}
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"log_denied": map[interface{}]interface{}{"enabled": true, "burst": 0},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.log_denied.burst must be positive")
+}
+
+func Test_parseSampleRate(t *testing.T) {
+	num, den, err := parseSampleRate("1/100")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 100}, []uint64{num, den})
+
+	num, den, err = parseSampleRate("0.25")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2500, 10000}, []uint64{num, den})
+
+	num, den, err = parseSampleRate("1")
+	assert.NoError(t, err)
+	assert.Equal(t, num, den)
+
+	_, _, err = parseSampleRate("3/2")
+	assert.EqualError(t, err, "must be more than 0 and at most 1; `3/2`")
+}
+
+func TestFirewall_LogSpoofedLocal(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+	cp := cert.NewCAPool()
+
+	// A local ip that is not ours
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(10, 9, 9, 9)),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+
+	// Off by default
+	conf := config.NewC(l)
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	ob.Reset()
+	assert.Equal(t, ErrInvalidLocalIP, fw.Drop(b, p, true, h, cp, nil))
+	assert.NotContains(t, ob.String(), "local ip that is not handled here")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"log_spoofed_local": true}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	clock := newFakeClock()
+	fw.clock = clock
+
+	// The first drop is logged, then every hundredth
+	ob.Reset()
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, ErrInvalidLocalIP, fw.Drop(b, p, true, h, cp, nil))
+	}
+	assert.Equal(t, 2, strings.Count(ob.String(), "local ip that is not handled here"))
+	for _, field := range []string{"level=warning", "direction=incoming", "vpnIp=1.2.3.4", "certName=host1", "localIp=10.9.9.9", "localPort=22", "remoteIp=1.2.3.4", "remotePort=40000"} {
+		assert.Contains(t, ob.String(), field)
+	}
+
+	// Other drops are not logged as spoofed
+	p.LocalIP = iputil.Ip2VpnIp(ipNet.IP)
+	ob.Reset()
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, p, true, h, cp, nil))
+	}
+	assert.NotContains(t, ob.String(), "local ip that is not handled here")
+}
@@ -0,0 +1,62 @@
+package nebula
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// logOnlyRuleLogInterval is how often a log only rule logs a packet it matched, the rest are only counted
+const logOnlyRuleLogInterval = time.Second
+
+// logOnlyRule is a rule with action log, see RuleOptions.LogOnly
+type logOnlyRule struct {
+	*orderedRule
+
+	// Packets matched since the rule was loaded
+	hits atomic.Int64
+
+	// When the next match may be logged, in unix nanoseconds, and how many were not logged since the last one
+	nextLog    atomic.Int64
+	suppressed atomic.Int64
+}
+
+// logOnlyRules counts and logs every log only rule in table that matches a packet starting a new flow. They are
+// checked before the rules that decide the packet and have no say in it, so a policy can be measured before it is
+// enforced.
+func (f *Firewall) logOnlyRules(h *HostInfo, table *FirewallTable, fp firewall.Packet, pi packetInfo, incoming bool, caPool *cert.NebulaCAPool) {
+	for _, lr := range table.logOnly {
+		if !lr.match(fp, pi, incoming, h.ConnectionState.peerCert, caPool) {
+			continue
+		}
+
+		hits := lr.hits.Add(1)
+		f.metrics(incoming).logRuleHits.Inc(1)
+
+		now := f.clock.Now().UnixNano()
+		next := lr.nextLog.Load()
+		if now < next || !lr.nextLog.CompareAndSwap(next, now+int64(logOnlyRuleLogInterval)) {
+			lr.suppressed.Add(1)
+			continue
+		}
+
+		h.logger(f.l).
+			WithField("fwPacket", fp).
+			WithField("incoming", incoming).
+			WithField("rule", lr.name).
+			WithField("hits", hits).
+			WithField("suppressed", lr.suppressed.Swap(0)).
+			Info("Packet matched a log only firewall rule, it is not enforced")
+	}
+}
+
+// LogRuleHits returns how many packets each log only rule for a direction has matched, by rule name, see ruleName
+func (f *Firewall) LogRuleHits(incoming bool) map[string]int64 {
+	hits := map[string]int64{}
+	for _, lr := range f.ruleset.Load().table(incoming).logOnly {
+		hits[lr.name] += lr.hits.Load()
+	}
+	return hits
+}
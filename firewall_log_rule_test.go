@@ -0,0 +1,98 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_LogOnlyRules(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"enabled": false},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any"},
+			map[interface{}]interface{}{"port": "20-30", "proto": "tcp", "host": "any", "action": "log", "name": "block-legacy"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	clock := newFakeClock()
+	fw.clock = clock
+	assert.Contains(t, ob.String(), "Firewall log only rule added, it is not enforced")
+	assert.Contains(t, fw.getRules(), "logOnly: true, name: block-legacy")
+	assert.Empty(t, fw.InRules().ordered)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+	hits := fw.incomingMetrics.logRuleHits.Count()
+
+	// The log rule neither allows nor denies
+	ob.Reset()
+	assert.NoError(t, fw.Drop(b, p, true, h, cp, nil))
+	assert.NoError(t, fw.Drop(b, p, true, h, cp, nil))
+	p.LocalPort = 23
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, p, true, h, cp, nil))
+	p.LocalPort = 80
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, p, true, h, cp, nil))
+
+	assert.Equal(t, map[string]int64{"block-legacy": 3}, fw.LogRuleHits(true))
+	assert.Empty(t, fw.LogRuleHits(false))
+	assert.Equal(t, hits+3, fw.incomingMetrics.logRuleHits.Count())
+
+	// Matches are logged at most once a second
+	assert.Equal(t, 1, strings.Count(ob.String(), "Packet matched a log only firewall rule"))
+	assert.Contains(t, ob.String(), "rule=block-legacy")
+
+	clock.advance(time.Second)
+	ob.Reset()
+	p.LocalPort = 22
+	assert.NoError(t, fw.Drop(b, p, true, h, cp, nil))
+	assert.Contains(t, ob.String(), "hits=4")
+	assert.Contains(t, ob.String(), "suppressed=2")
+
+	// Rules added one at a time are log only the same way
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", "", RuleOptions{LogOnly: true}))
+	assert.Len(t, fw.InRules().logOnly, 1)
+	assert.True(t, fw.InRules().empty())
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, p, true, h, cp, nil))
+	assert.Len(t, fw.LogRuleHits(true), 1)
+
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", "", RuleOptions{LogOnly: true, Deny: true}), "log only rules can not deny or set a conntrack timeout")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "action": "log", "reject": true},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; reject is only supported with action deny")
+}
@@ -0,0 +1,49 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// Packets with a spoofed local ip are sampled like firewall.log_denied is by default
+const (
+	spoofedLocalLogNum   = 1
+	spoofedLocalLogDen   = 100
+	spoofedLocalLogBurst = 10
+)
+
+// loadSpoofedLocalLog reads firewall.log_spoofed_local
+func (f *Firewall) loadSpoofedLocalLog(c *config.C) {
+	if !c.GetBool("firewall.log_spoofed_local", false) {
+		return
+	}
+
+	f.spoofedLocalLog = &deniedLog{
+		num:   spoofedLocalLogNum,
+		den:   spoofedLocalLogDen,
+		limit: newConnRateLimiter(spoofedLocalLogBurst, spoofedLocalLogBurst),
+	}
+}
+
+// logSpoofedLocal logs a packet dropped with ErrInvalidLocalIP if it is sampled, naming the local ip that is not ours
+// and the peer it was to or from. Inbound it is the peer sending to an address we don't handle, either a routing
+// mistake on its side or a peer up to no good.
+func (f *Firewall) logSpoofedLocal(fp firewall.Packet, incoming bool, h *HostInfo) {
+	if !f.spoofedLocalLog.sample(f.clock.Now().UnixNano()) {
+		return
+	}
+
+	direction := "incoming"
+	if !incoming {
+		direction = "outgoing"
+	}
+
+	h.logger(f.l).
+		WithField("direction", direction).
+		WithField("proto", firewall.ProtoName(fp.Protocol)).
+		WithField("localIp", fp.LocalIP).
+		WithField("localPort", fp.LocalPort).
+		WithField("remoteIp", fp.RemoteIP).
+		WithField("remotePort", fp.RemotePort).
+		Warn("Firewall dropped a packet for a local ip that is not handled here")
+}
@@ -0,0 +1,110 @@
+package nebula
+
+import (
+	"net/netip"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// orderedPorts returns the port map of a single ordered or log only rule
+func orderedPorts(r portRule, opts RuleOptions, workers int) firewallPort {
+	if opts.MatchAll {
+		return matchAllPorts(r)
+	}
+	return buildFirewallPort([]portRule{r}, workers)
+}
+
+// matchAllPorts returns the port map of a rule with RuleOptions.MatchAll. Nothing else is ever added to it so every
+// port shares the one FirewallCA.
+func matchAllPorts(r portRule) firewallPort {
+	fr := newMatchAllRule(r)
+	fc := &FirewallCA{
+		CANames: make(map[string]*FirewallRule),
+		CAShas:  make(map[string]*FirewallRule),
+	}
+
+	switch {
+	case r.caName == "" && r.caSha == "":
+		fc.Any = fr
+	default:
+		if r.caSha != "" {
+			fc.CAShas[r.caSha] = fr
+		}
+		if r.caName != "" {
+			fc.CANames[r.caName] = fr
+		}
+	}
+
+	fp := firewallPort{}
+	for i := r.startPort; i <= r.endPort; i++ {
+		fp[i] = fc
+	}
+	return fp
+}
+
+// newMatchAllRule returns a FirewallRule that requires every condition of r. A condition that is `any` does not
+// constrain the rule, as it does not in a plain rule, and a rule with no conditions left matches anything.
+func newMatchAllRule(r portRule) *FirewallRule {
+	fr := &FirewallRule{
+		Hosts:     make(map[string]struct{}),
+		Groups:    make([][]string, 0),
+		CIDR:      cidr.NewTree4[struct{}](),
+		LocalCIDR: cidr.NewTree4[struct{}](),
+	}
+
+	if r.host != "" && r.host != "any" {
+		fr.Hosts[r.host] = struct{}{}
+		fr.MatchAll = true
+	}
+
+	if len(r.groups) > 0 && !(&FirewallRule{}).isAny(r.groups, "", netip.Prefix{}, netip.Prefix{}) {
+		fr.Groups = append(fr.Groups, r.groups)
+		fr.MatchAll = true
+	}
+
+	if r.ip.IsValid() && !r.ip.Contains(netip.IPv4Unspecified()) {
+		fr.CIDR.AddPrefix(r.ip, struct{}{})
+		fr.MatchAll = true
+	}
+
+	if r.localIp.IsValid() && !r.localIp.Contains(netip.IPv4Unspecified()) {
+		fr.LocalCIDR.AddPrefix(r.localIp, struct{}{})
+		fr.MatchAll = true
+	}
+
+	fr.Any = !fr.MatchAll
+	return fr
+}
+
+// matchAll is match for a rule with MatchAll, every condition it has must match rather than any one of them
+func (fr *FirewallRule) matchAll(p firewall.Packet, c *cert.NebulaCertificate) bool {
+	for _, sg := range fr.Groups {
+		for _, g := range sg {
+			if _, ok := c.Details.InvertedGroups[g]; !ok {
+				return false
+			}
+		}
+	}
+
+	if len(fr.Hosts) > 0 {
+		if _, ok := fr.Hosts[c.Details.Name]; !ok {
+			return false
+		}
+	}
+
+	if len(fr.CIDR.List()) > 0 {
+		if ok, _ := fr.CIDR.Contains(p.RemoteIP); !ok {
+			return false
+		}
+	}
+
+	if len(fr.LocalCIDR.List()) > 0 {
+		if ok, _ := fr.LocalCIDR.Contains(p.LocalIP); !ok {
+			return false
+		}
+	}
+
+	return true
+}
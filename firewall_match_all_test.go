@@ -0,0 +1,91 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_MatchAll(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 0, 0}}
+	c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host1", Ips: []*net.IPNet{&ipNet}}}
+
+	newPeer := func(ip net.IP, name string, groups ...string) *HostInfo {
+		inverted := make(map[string]struct{})
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+		h, _ := newTestHost(cert.NebulaCertificateDetails{Name: name, Groups: groups, InvertedGroups: inverted, Ips: []*net.IPNet{{IP: ip, Mask: net.IPMask{255, 255, 0, 0}}}})
+		return h
+	}
+	web := newPeer(net.IPv4(1, 2, 3, 5), "web", "a", "b")
+	webElsewhere := newPeer(net.IPv4(1, 2, 4, 5), "web", "a", "b")
+	other := newPeer(net.IPv4(1, 2, 3, 6), "other", "a", "b")
+	webNoB := newPeer(net.IPv4(1, 2, 3, 7), "web", "a")
+
+	cp := cert.NewCAPool()
+	b := tcpTestPacket(tcpSYN)
+	drop := func(fw *Firewall, h *HostInfo) error {
+		fp := firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+			RemoteIP:   h.vpnIp,
+			LocalPort:  22,
+			RemotePort: 40000,
+			Protocol:   firewall.ProtoTCP,
+		}
+		return fw.Drop(b, fp, true, h, cp, nil)
+	}
+
+	conf := config.NewC(l)
+	rule := map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "web", "groups": []interface{}{"a", "b"}, "cidr": "1.2.3.0/24"}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{rule}}
+
+	// By default any one of host, groups or cidr will do
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	for _, h := range []*HostInfo{web, webElsewhere, other, webNoB} {
+		assert.NoError(t, drop(fw, h))
+	}
+
+	// With match_all every one of them must match
+	rule["match_all"] = true
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Contains(t, fw.getRules(), "matchAll: true")
+	assert.Empty(t, fw.InRules().TCP)
+	assert.NoError(t, drop(fw, web))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, webElsewhere))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, other))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, webNoB))
+
+	// Rules added one at a time are the same
+	_, cidr, _ := net.ParseCIDR("1.2.3.0/24")
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{"a", "b"}, "web", cidr, nil, "", "", RuleOptions{MatchAll: true}))
+	assert.Equal(t, "22:{matchAll hosts=[web] groups=[[a b]] cidrs=[1.2.3.0/24]}", fw.InRules().ordered[0].ports.String())
+	assert.NoError(t, drop(fw, web))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, webElsewhere))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, other))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, webNoB))
+
+	// Conditions that are any don't constrain the rule
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{"any"}, "any", cidr, nil, "", "", RuleOptions{MatchAll: true}))
+	assert.NoError(t, drop(fw, web))
+	assert.NoError(t, drop(fw, other))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, webElsewhere))
+
+	rule["match_all"] = "sometimes"
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; match_all was not understood; `sometimes`")
+}
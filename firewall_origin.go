@@ -0,0 +1,81 @@
+package nebula
+
+import (
+	"fmt"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// RuleOrigin limits a rule to traffic this node sends or receives itself, or to traffic it forwards for the subnets
+// in its certificate or extra_local_cidrs, as on a node routing for unsafe_routes
+type RuleOrigin uint8
+
+const (
+	// OriginAny matches all traffic, the default
+	OriginAny RuleOrigin = iota
+	// OriginSelf matches packets whose local address is one of the addresses in our certificate
+	OriginSelf
+	// OriginForwarded matches packets whose local address is any other address we handle
+	OriginForwarded
+)
+
+func (o RuleOrigin) String() string {
+	switch o {
+	case OriginAny:
+		return "any"
+	case OriginSelf:
+		return "self"
+	case OriginForwarded:
+		return "forwarded"
+	default:
+		return fmt.Sprintf("RuleOrigin(%d)", uint8(o))
+	}
+}
+
+// parseRuleOrigin parses the origin of a rule, `self`, `forwarded` or `any`
+func parseRuleOrigin(s string) (RuleOrigin, error) {
+	switch s {
+	case "any":
+		return OriginAny, nil
+	case "self":
+		return OriginSelf, nil
+	case "forwarded":
+		return OriginForwarded, nil
+	default:
+		return OriginAny, fmt.Errorf("expected self, forwarded or any; `%s`", s)
+	}
+}
+
+// match returns true if a packet that was forwarded, or was not, has this origin
+func (o RuleOrigin) match(forwarded bool) bool {
+	switch o {
+	case OriginSelf:
+		return !forwarded
+	case OriginForwarded:
+		return forwarded
+	default:
+		return true
+	}
+}
+
+// forwarded returns true if fp is not to or from one of the addresses in our certificate. For inbound packets the
+// local address is the destination and for outbound packets it is the source.
+func (f *Firewall) forwarded(fp firewall.Packet) bool {
+	for _, ip := range f.selfIps {
+		if ip == fp.LocalIP {
+			return false
+		}
+	}
+	return true
+}
+
+// packetInfo returns the packetInfo for packet from the peer with peerCert at the current time, fp must have come
+// from packet
+func (f *Firewall) packetInfo(packet []byte, fp firewall.Packet, peerCert *cert.NebulaCertificate) packetInfo {
+	pi := newPacketInfo(packet, fp)
+	pi.forwarded = f.forwarded(fp)
+	pi.now = f.clock.Now()
+	pi.self = f.isSelf(peerCert)
+	return pi
+}
@@ -0,0 +1,90 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRuleOrigin(t *testing.T) {
+	for _, o := range []RuleOrigin{OriginAny, OriginSelf, OriginForwarded} {
+		parsed, err := parseRuleOrigin(o.String())
+		require.NoError(t, err)
+		assert.Equal(t, o, parsed)
+	}
+
+	_, err := parseRuleOrigin("relay")
+	assert.EqualError(t, err, "expected self, forwarded or any; `relay`")
+}
+
+func TestFirewall_RuleOrigin(t *testing.T) {
+	l := test.NewLogger()
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:    "host1",
+		Ips:     []*net.IPNet{&ipNet},
+		Subnets: []*net.IPNet{subnet},
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "origin": "self"},
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "any", "origin": "forwarded"},
+			map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "origin": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Contains(t, fw.getRules(), "origin: self")
+	assert.Contains(t, fw.getRules(), "origin: forwarded")
+	cp := cert.NewCAPool()
+
+	packet := func(local net.IP, proto uint8, port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(local),
+			RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+			LocalPort:  port,
+			RemotePort: 1000,
+			Protocol:   proto,
+		}
+	}
+	self := net.IPv4(1, 2, 3, 4)
+	routed := net.IPv4(10, 0, 0, 5)
+
+	assert.False(t, fw.forwarded(packet(self, firewall.ProtoTCP, 22)))
+	assert.True(t, fw.forwarded(packet(routed, firewall.ProtoTCP, 22)))
+
+	assert.NoError(t, fw.Drop([]byte{}, packet(self, firewall.ProtoTCP, 22), true, h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, packet(routed, firewall.ProtoTCP, 22), true, h, cp, nil))
+
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, packet(self, firewall.ProtoTCP, 80), true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, packet(routed, firewall.ProtoTCP, 80), true, h, cp, nil))
+
+	assert.NoError(t, fw.Drop([]byte{}, packet(self, firewall.ProtoUDP, 53), true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, packet(routed, firewall.ProtoUDP, 53), true, h, cp, nil))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "origin": "relay"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; origin was not understood; expected self, forwarded or any; `relay`")
+
+	err = fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{"any"}, "", nil, nil, "", "", RuleOptions{Origin: 7})
+	assert.EqualError(t, err, "unknown origin RuleOrigin(7)")
+}
@@ -0,0 +1,98 @@
+package nebula
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+)
+
+// firewallNativeRegistry holds the firewall metrics when stats.firewall_native is set, so they are exported by
+// firewallCollector and not by the go-metrics bridge. Every firewall uses it so the metrics carry over a reload.
+var firewallNativeRegistry = metrics.NewRegistry()
+
+// firewallSummaryQuantiles are the quantiles of the firewall histograms exported as prometheus summaries
+var firewallSummaryQuantiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// firewallMetricsRegistry returns the registry NewFirewallFromConfig registers firewall metrics with, nil for the
+// default registry
+func firewallMetricsRegistry(c *config.C) metrics.Registry {
+	if c.GetString("stats.type", "") == "prometheus" && c.GetBool("stats.firewall_native", false) {
+		return firewallNativeRegistry
+	}
+	return nil
+}
+
+// firewallCollector exports the metrics of a firewall registry as native prometheus metrics. Counters and meters
+// become counters with a _total suffix, gauges stay gauges and histograms and timers become summaries with their
+// count, sum and firewallSummaryQuantiles. Names have their dots replaced to fit prometheus naming, so
+// firewall.incoming.dropped.no_rule becomes firewall_incoming_dropped_no_rule_total. Values keep their units, the
+// lifetime and rtt histograms are in nanoseconds. The rtt histograms of each peer, see firewall.tcp_rtt.max_hosts, are
+// one summary, network_tcp_rtt_host, with vpn_ip and name labels.
+type firewallCollector struct {
+	r         metrics.Registry
+	namespace string
+	subsystem string
+}
+
+// NewFirewallCollector returns a prometheus collector for the firewall metrics in r, the registry given to
+// NewFirewall. Metrics are read from r on every scrape, none are described up front since a firewall registers some
+// of them lazily.
+func NewFirewallCollector(r metrics.Registry, namespace, subsystem string) prometheus.Collector {
+	return &firewallCollector{r: r, namespace: namespace, subsystem: subsystem}
+}
+
+func (fc *firewallCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (fc *firewallCollector) Collect(ch chan<- prometheus.Metric) {
+	fc.r.Each(func(name string, i interface{}) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			fc.send(ch, name, "_total", prometheus.CounterValue, float64(m.Count()))
+		case metrics.Meter:
+			fc.send(ch, name, "_total", prometheus.CounterValue, float64(m.Count()))
+		case metrics.Gauge:
+			fc.send(ch, name, "", prometheus.GaugeValue, float64(m.Value()))
+		case metrics.GaugeFloat64:
+			fc.send(ch, name, "", prometheus.GaugeValue, m.Value())
+		case *hostRTT:
+			s := m.Snapshot()
+			desc := prometheus.NewDesc(prometheus.BuildFQName(fc.namespace, fc.subsystem, "network_tcp_rtt_host"),
+				strings.TrimSuffix(hostRTTMetricPrefix, "."), []string{"vpn_ip", "name"}, nil)
+			fc.sendSummary(ch, desc, s.Count(), float64(s.Sum()), s.Percentiles(firewallSummaryQuantiles), m.vpnIp.String(), m.name)
+		case metrics.Histogram:
+			s := m.Snapshot()
+			fc.sendSummary(ch, fc.desc(name, ""), s.Count(), float64(s.Sum()), s.Percentiles(firewallSummaryQuantiles))
+		case metrics.Timer:
+			s := m.Snapshot()
+			fc.sendSummary(ch, fc.desc(name, ""), s.Count(), float64(s.Sum()), s.Percentiles(firewallSummaryQuantiles))
+		}
+	})
+}
+
+func (fc *firewallCollector) desc(name, suffix string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(fc.namespace, fc.subsystem, promName(name)+suffix), name, nil, nil)
+}
+
+func (fc *firewallCollector) send(ch chan<- prometheus.Metric, name, suffix string, t prometheus.ValueType, v float64) {
+	ch <- prometheus.MustNewConstMetric(fc.desc(name, suffix), t, v)
+}
+
+func (fc *firewallCollector) sendSummary(ch chan<- prometheus.Metric, desc *prometheus.Desc, count int64, sum float64, percentiles []float64, labelValues ...string) {
+	quantiles := make(map[float64]float64, len(firewallSummaryQuantiles))
+	for i, q := range firewallSummaryQuantiles {
+		quantiles[q] = percentiles[i]
+	}
+	ch <- prometheus.MustNewConstSummary(desc, uint64(count), sum, quantiles, labelValues...)
+}
+
+// promName returns name with everything prometheus does not allow in a metric name replaced by an underscore
+func promName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
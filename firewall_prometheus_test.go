@@ -0,0 +1,69 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromName(t *testing.T) {
+	assert.Equal(t, "firewall_incoming_dropped_no_rule", promName("firewall.incoming.dropped.no_rule"))
+	assert.Equal(t, "firewall_conntrack_evicted_tcp_unestablished", promName("firewall.conntrack.evicted.tcp_unestablished"))
+	assert.Equal(t, "a_b_c", promName("a-b c"))
+}
+
+func TestFirewallCollector(t *testing.T) {
+	r := metrics.NewRegistry()
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+	fw.incomingMetrics.droppedNoRuleTCP.Inc(3)
+	fw.metricLifetimeUDP.Update(10)
+	fw.metricLifetimeUDP.Update(30)
+	fw.EmitStats()
+
+	pr := prometheus.NewRegistry()
+	require.NoError(t, pr.Register(NewFirewallCollector(r, "nebula", "")))
+	families, err := pr.Gather()
+	require.NoError(t, err)
+
+	byName := map[string]*dto.MetricFamily{}
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+
+	counter := byName["nebula_firewall_incoming_dropped_no_rule_tcp_total"]
+	require.NotNil(t, counter)
+	assert.Equal(t, dto.MetricType_COUNTER, counter.GetType())
+	assert.Equal(t, float64(3), counter.GetMetric()[0].GetCounter().GetValue())
+	assert.Equal(t, "firewall.incoming.dropped.no_rule.tcp", counter.GetHelp())
+
+	gauge := byName["nebula_firewall_conntrack_count"]
+	require.NotNil(t, gauge)
+	assert.Equal(t, dto.MetricType_GAUGE, gauge.GetType())
+	assert.Zero(t, gauge.GetMetric()[0].GetGauge().GetValue())
+
+	summary := byName["nebula_firewall_conntrack_lifetime_udp"]
+	require.NotNil(t, summary)
+	assert.Equal(t, dto.MetricType_SUMMARY, summary.GetType())
+	assert.Equal(t, uint64(2), summary.GetMetric()[0].GetSummary().GetSampleCount())
+	assert.Equal(t, float64(40), summary.GetMetric()[0].GetSummary().GetSampleSum())
+	assert.Len(t, summary.GetMetric()[0].GetSummary().GetQuantile(), len(firewallSummaryQuantiles))
+}
+
+func TestFirewallMetricsRegistry(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+	assert.Nil(t, firewallMetricsRegistry(c))
+
+	c.Settings["stats"] = map[interface{}]interface{}{"type": "prometheus", "firewall_native": true}
+	assert.Equal(t, firewallNativeRegistry, firewallMetricsRegistry(c))
+
+	c.Settings["stats"] = map[interface{}]interface{}{"type": "graphite", "firewall_native": true}
+	assert.Nil(t, firewallMetricsRegistry(c))
+}
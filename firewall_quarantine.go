@@ -0,0 +1,229 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// ErrPeerQuarantined is returned for every packet to or from a peer that was denied too often, see firewall.quarantine.
+// No reject is sent for it.
+var ErrPeerQuarantined = errors.New("peer is quarantined after repeated firewall denials")
+
+// quarantinePeer is the denial count of one peer in the current window and, while it is quarantined, when that ends.
+// Times are in unix nanoseconds.
+type quarantinePeer struct {
+	windowStart int64
+	denials     int
+	until       int64
+}
+
+// firewallQuarantine cuts off peers whose inbound packets are denied by the rules more than threshold times within
+// window, for duration. Peers with a certificate name in excludeHosts or a group in excludeGroups are never cut off.
+type firewallQuarantine struct {
+	threshold     int
+	window        time.Duration
+	duration      time.Duration
+	excludeHosts  map[string]struct{}
+	excludeGroups map[string]struct{}
+
+	lock      sync.Mutex
+	peers     map[iputil.VpnIp]*quarantinePeer
+	lastPrune int64
+
+	// How many peers are quarantined, so packets are only looked up while there are any
+	active atomic.Int64
+
+	metricQuarantined metrics.Counter
+	metricLifted      metrics.Counter
+	metricDropped     metrics.Counter
+}
+
+// loadQuarantine reads firewall.quarantine
+func (f *Firewall) loadQuarantine(c *config.C) error {
+	if !c.GetBool("firewall.quarantine.enabled", false) {
+		return nil
+	}
+
+	threshold := c.GetInt("firewall.quarantine.threshold", 1000)
+	if threshold < 1 {
+		return fmt.Errorf("firewall.quarantine.threshold must be positive")
+	}
+
+	window := c.GetDuration("firewall.quarantine.window", time.Minute)
+	if window <= 0 {
+		return fmt.Errorf("firewall.quarantine.window must be positive")
+	}
+
+	duration := c.GetDuration("firewall.quarantine.duration", 10*time.Minute)
+	if duration <= 0 {
+		return fmt.Errorf("firewall.quarantine.duration must be positive")
+	}
+
+	q := &firewallQuarantine{
+		threshold:         threshold,
+		window:            window,
+		duration:          duration,
+		excludeHosts:      map[string]struct{}{},
+		excludeGroups:     map[string]struct{}{},
+		peers:             map[iputil.VpnIp]*quarantinePeer{},
+		metricQuarantined: metrics.GetOrRegisterCounter("firewall.quarantine.quarantined", f.metricsRegistry),
+		metricLifted:      metrics.GetOrRegisterCounter("firewall.quarantine.lifted", f.metricsRegistry),
+		metricDropped:     metrics.GetOrRegisterCounter("firewall.dropped.quarantined", f.metricsRegistry),
+	}
+
+	for _, h := range c.GetStringSlice("firewall.quarantine.exclude_hosts", nil) {
+		q.excludeHosts[h] = struct{}{}
+	}
+	for _, g := range c.GetStringSlice("firewall.quarantine.exclude_groups", nil) {
+		q.excludeGroups[g] = struct{}{}
+	}
+
+	f.quarantine = q
+	return nil
+}
+
+// inheritQuarantine takes over the peers old has quarantined, and the denials it has counted, if quarantine is still
+// enabled
+func (f *Firewall) inheritQuarantine(old *Firewall) {
+	if f.quarantine == nil || old.quarantine == nil {
+		return
+	}
+
+	old.quarantine.lock.Lock()
+	defer old.quarantine.lock.Unlock()
+	f.quarantine.peers = old.quarantine.peers
+	f.quarantine.active.Store(old.quarantine.active.Load())
+	old.quarantine.peers = map[iputil.VpnIp]*quarantinePeer{}
+	old.quarantine.active.Store(0)
+}
+
+// quarantined returns true if h is quarantined, lifting a quarantine that has run its course
+func (f *Firewall) quarantined(h *HostInfo) bool {
+	q := f.quarantine
+	if q.active.Load() == 0 {
+		return false
+	}
+
+	now := f.clock.Now().UnixNano()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	p := q.peers[h.vpnIp]
+	if p == nil || p.until == 0 {
+		return false
+	}
+
+	if now >= p.until {
+		f.liftQuarantine(h.vpnIp, p, now)
+		return false
+	}
+
+	q.metricDropped.Inc(1)
+	return true
+}
+
+// liftQuarantine ends the quarantine of p, caller must hold the quarantine lock
+func (f *Firewall) liftQuarantine(vpnIp iputil.VpnIp, p *quarantinePeer, now int64) {
+	q := f.quarantine
+	p.until = 0
+	p.denials = 0
+	p.windowStart = now
+	q.active.Add(-1)
+	q.metricLifted.Inc(1)
+	f.l.WithField("vpnIp", vpnIp).Info("Lifted firewall quarantine of peer")
+}
+
+// countDenial counts an inbound packet from h that the rules denied for reason, quarantining h once it has been denied
+// more than the threshold within the window
+func (f *Firewall) countDenial(h *HostInfo, reason error) {
+	switch reason {
+	case ErrNoMatchingRule, ErrDeniedByRule, ErrRejectedByRule, ErrDroppedByRule:
+	default:
+		return
+	}
+
+	q := f.quarantine
+	now := f.clock.Now().UnixNano()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if now-q.lastPrune >= int64(q.window) {
+		f.pruneQuarantine(now)
+	}
+
+	p := q.peers[h.vpnIp]
+	if p == nil {
+		p = &quarantinePeer{windowStart: now}
+		q.peers[h.vpnIp] = p
+	}
+
+	if p.until != 0 {
+		return
+	}
+
+	if now-p.windowStart >= int64(q.window) {
+		p.windowStart = now
+		p.denials = 0
+	}
+
+	p.denials++
+	if p.denials <= q.threshold {
+		return
+	}
+
+	if q.excluded(h) {
+		p.windowStart = now
+		p.denials = 0
+		return
+	}
+
+	p.until = now + int64(q.duration)
+	q.active.Add(1)
+	q.metricQuarantined.Inc(1)
+	h.logger(f.l).
+		WithField("denials", p.denials).
+		WithField("window", q.window).
+		WithField("duration", q.duration).
+		Warn("Quarantined peer after repeated firewall denials, all of its packets are dropped")
+}
+
+// pruneQuarantine forgets peers that have not been denied for a window and lifts quarantines that have run their
+// course, caller must hold the quarantine lock
+func (f *Firewall) pruneQuarantine(now int64) {
+	q := f.quarantine
+	q.lastPrune = now
+	for vpnIp, p := range q.peers {
+		if p.until != 0 {
+			if now < p.until {
+				continue
+			}
+			f.liftQuarantine(vpnIp, p, now)
+		}
+
+		if now-p.windowStart >= int64(q.window) {
+			delete(q.peers, vpnIp)
+		}
+	}
+}
+
+// excluded returns true if the certificate of h puts it on the exclusion lists
+func (q *firewallQuarantine) excluded(h *HostInfo) bool {
+	peerCert := h.ConnectionState.peerCert
+	if _, ok := q.excludeHosts[peerCert.Details.Name]; ok {
+		return true
+	}
+
+	for _, g := range peerCert.Details.Groups {
+		if _, ok := q.excludeGroups[g]; ok {
+			return true
+		}
+	}
+
+	return false
+}
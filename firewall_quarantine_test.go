@@ -0,0 +1,110 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_Quarantine(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host1", Ips: []*net.IPNet{&ipNet}}}
+
+	newPeer := func(ip net.IP, name string, groups ...string) *HostInfo {
+		h, _ := newTestHost(cert.NebulaCertificateDetails{Name: name, Groups: groups, Ips: []*net.IPNet{{IP: ip, Mask: net.IPMask{255, 255, 255, 0}}}})
+		return h
+	}
+	h := newPeer(net.IPv4(1, 2, 3, 5), "host2")
+	trusted := newPeer(net.IPv4(1, 2, 3, 6), "host3", "ops")
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"quarantine": map[interface{}]interface{}{
+			"enabled":        true,
+			"threshold":      3,
+			"window":         "1m",
+			"duration":       "10m",
+			"exclude_groups": []interface{}{"ops"},
+		},
+		"inbound":  []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any"}},
+		"outbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"}},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	clock := newFakeClock()
+	fw.clock = clock
+	quarantined := fw.quarantine.metricQuarantined.Count()
+	lifted := fw.quarantine.metricLifted.Count()
+
+	cp := cert.NewCAPool()
+	b := tcpTestPacket(tcpSYN)
+	packet := func(h *HostInfo, port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+			RemoteIP:   h.vpnIp,
+			LocalPort:  port,
+			RemotePort: 40000,
+			Protocol:   firewall.ProtoTCP,
+		}
+	}
+
+	// Allowed packets are not counted, and the window starts over once it has passed
+	assert.NoError(t, fw.Drop(b, packet(h, 22), true, h, cp, nil))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, packet(h, 80), true, h, cp, nil))
+	}
+	clock.advance(time.Minute)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, packet(h, 80), true, h, cp, nil))
+	}
+	assert.Equal(t, quarantined, fw.quarantine.metricQuarantined.Count())
+
+	// The denial over the threshold quarantines the peer, even its established flows and outbound packets are dropped
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, packet(h, 80), true, h, cp, nil))
+	assert.Equal(t, quarantined+1, fw.quarantine.metricQuarantined.Count())
+	assert.Contains(t, ob.String(), "Quarantined peer after repeated firewall denials")
+	assert.Equal(t, ErrPeerQuarantined, fw.Drop(b, packet(h, 22), true, h, cp, nil))
+	assert.Equal(t, ErrPeerQuarantined, fw.Drop(b, packet(h, 22), false, h, cp, nil))
+	assert.False(t, ShouldReject(ErrPeerQuarantined, true))
+
+	// Excluded peers are never quarantined
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, packet(trusted, 80), true, trusted, cp, nil))
+	}
+	assert.NoError(t, fw.Drop(b, packet(trusted, 22), true, trusted, cp, nil))
+
+	// Quarantine carries over on reload
+	nfw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	nfw.clock = clock
+	nfw.inheritQuarantine(fw)
+	assert.NoError(t, fw.Drop(b, packet(h, 22), true, h, cp, nil))
+	assert.Equal(t, ErrPeerQuarantined, nfw.Drop(b, packet(h, 22), true, h, cp, nil))
+
+	// And is lifted after the duration
+	ob.Reset()
+	clock.advance(10 * time.Minute)
+	assert.NoError(t, nfw.Drop(b, packet(h, 22), true, h, cp, nil))
+	assert.Equal(t, lifted+1, nfw.quarantine.metricLifted.Count())
+	assert.Contains(t, ob.String(), "Lifted firewall quarantine of peer")
+	assert.Zero(t, nfw.quarantine.active.Load())
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"quarantine": map[interface{}]interface{}{"enabled": true, "threshold": 0},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.quarantine.threshold must be positive")
+}
@@ -0,0 +1,92 @@
+package nebula
+
+import (
+	"fmt"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// defaultRejectICMPRate is how many icmp rejects may be sent a second when firewall.reject_icmp_rate is not set
+const defaultRejectICMPRate = 100
+
+// loadRejectICMPRate reads firewall.reject_icmp_rate and firewall.reject_icmp_burst
+func (f *Firewall) loadRejectICMPRate(c *config.C) error {
+	rate := c.GetInt("firewall.reject_icmp_rate", defaultRejectICMPRate)
+	if rate < 0 {
+		return fmt.Errorf("firewall.reject_icmp_rate must not be negative")
+	}
+
+	if rate == 0 {
+		f.rejectICMPRate = nil
+		return nil
+	}
+
+	burst := c.GetInt("firewall.reject_icmp_burst", rate)
+	if burst < 1 {
+		return fmt.Errorf("firewall.reject_icmp_burst must be positive")
+	}
+
+	f.rejectICMPRate = newConnRateLimiter(rate, burst)
+	return nil
+}
+
+// loadRejectICMPCode reads firewall.reject_icmp_code
+func (f *Firewall) loadRejectICMPCode(c *config.C) error {
+	code := c.GetString("firewall.reject_icmp_code", "port-unreachable")
+	switch code {
+	case "port-unreachable":
+		f.rejectICMPCode = iputil.RejectICMPCodePortUnreachable
+	case "admin-prohibited":
+		f.rejectICMPCode = iputil.RejectICMPCodeAdminProhibited
+	default:
+		return fmt.Errorf("firewall.reject_icmp_code must be `port-unreachable` or `admin-prohibited`, got `%s`", code)
+	}
+
+	return nil
+}
+
+// setRejectICMPCode gives an icmp reject made by iputil.CreateRejectPacket the code from firewall.reject_icmp_code
+func (f *Firewall) setRejectICMPCode(reject []byte) {
+	if reject[9] == firewall.ProtoICMP && f.rejectICMPCode != iputil.RejectICMPCodePortUnreachable {
+		iputil.SetRejectICMPCode(reject, f.rejectICMPCode)
+	}
+}
+
+// allowReject returns true if the reject packet made by iputil.CreateRejectPacket may be sent. A tcp reset always may,
+// an icmp destination unreachable is held to the reject rate so a flood of denied packets can't become a flood of icmp.
+// Rejects for inbound packets go back through the tunnel to h and are limited for each peer, rejects for outbound
+// packets go to local applications and share one limit.
+func (f *Firewall) allowReject(reject []byte, incoming bool, h *HostInfo) bool {
+	if reject[9] != firewall.ProtoICMP {
+		return true
+	}
+
+	if r := f.rejectICMPRate; r != nil {
+		now := f.clock.Now().UnixNano()
+		allowed := false
+		if incoming {
+			allowed = r.allowFrom(&h.rejectTAT, now)
+		} else {
+			allowed = r.allow(now)
+		}
+
+		if !allowed {
+			f.metrics(incoming).rejectICMPLimited.Inc(1)
+			return false
+		}
+	}
+
+	return true
+}
+
+// rejectSent counts a reject for a packet dropped in the incoming or outgoing direction once it has been written out,
+// rejects that are made but fail to send are not counted
+func (f *Firewall) rejectSent(reject []byte, incoming bool) {
+	m := f.metrics(incoming)
+	m.rejected.Inc(1)
+	if reject[9] == firewall.ProtoICMP {
+		m.rejectICMPSent.Inc(1)
+	}
+}
@@ -0,0 +1,146 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+func TestFirewall_RejectICMPRate(t *testing.T) {
+	fw, clock, _ := newClockedFirewall()
+	require.NoError(t, fw.loadRejectICMPRate(firewallConfig(map[interface{}]interface{}{"reject_icmp_rate": 2, "reject_icmp_burst": 1})))
+
+	// An outbound udp packet to a forbidden destination, answered with a port unreachable to the local sender
+	h := ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + 8,
+		TTL:      64,
+		Protocol: firewall.ProtoUDP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+	}
+	b, err := h.Marshal()
+	require.NoError(t, err)
+	b = append(b, 0x9c, 0x40, 0, 53, 0, 8, 0, 0)
+
+	reject := iputil.CreateRejectPacket(b, make([]byte, iputil.MaxRejectPacketSize))
+	require.NotEmpty(t, reject)
+	assert.Equal(t, uint8(firewall.ProtoICMP), reject[9])
+	assert.Equal(t, b[12:16], reject[16:20])
+	assert.Equal(t, []byte{3, 3}, reject[20:22])
+	assert.Equal(t, b, reject[28:])
+
+	// The burst goes out, the next waits for the bucket to refill. Rejects are only counted as sent once written out.
+	assert.True(t, fw.allowReject(reject, false, nil))
+	assert.Zero(t, fw.outgoingMetrics.rejectICMPSent.Count())
+	fw.rejectSent(reject, false)
+	assert.False(t, fw.allowReject(reject, false, nil))
+	assert.Equal(t, int64(1), fw.outgoingMetrics.rejectICMPSent.Count())
+	assert.Equal(t, int64(1), fw.outgoingMetrics.rejected.Count())
+	assert.Equal(t, int64(1), fw.outgoingMetrics.rejectICMPLimited.Count())
+
+	clock.advance(500 * time.Millisecond)
+	assert.True(t, fw.allowReject(reject, false, nil))
+	fw.rejectSent(reject, false)
+	assert.Equal(t, int64(2), fw.outgoingMetrics.rejectICMPSent.Count())
+
+	// A tcp reset is never held back, it is only counted in rejected
+	h.Protocol = firewall.ProtoTCP
+	h.TotalLen = ipv4.HeaderLen + 20
+	b, err = h.Marshal()
+	require.NoError(t, err)
+	b = append(b, make([]byte, 20)...)
+	b[ipv4.HeaderLen+12] = 5 << 4
+	rst := iputil.CreateRejectPacket(b, make([]byte, iputil.MaxRejectPacketSize))
+	require.NotEmpty(t, rst)
+	for i := 0; i < 3; i++ {
+		assert.True(t, fw.allowReject(rst, false, nil))
+		fw.rejectSent(rst, false)
+	}
+	assert.Equal(t, int64(2), fw.outgoingMetrics.rejectICMPSent.Count())
+	assert.Equal(t, int64(5), fw.outgoingMetrics.rejected.Count())
+
+	// Rejects for inbound packets are limited for each peer
+	var peer1, peer2 HostInfo
+	assert.True(t, fw.allowReject(reject, true, &peer1))
+	fw.rejectSent(reject, true)
+	assert.False(t, fw.allowReject(reject, true, &peer1))
+	assert.True(t, fw.allowReject(reject, true, &peer2))
+	fw.rejectSent(reject, true)
+	assert.Equal(t, int64(2), fw.incomingMetrics.rejectICMPSent.Count())
+	assert.Equal(t, int64(2), fw.incomingMetrics.rejected.Count())
+	assert.Equal(t, int64(1), fw.incomingMetrics.rejectICMPLimited.Count())
+	assert.Equal(t, int64(2), fw.outgoingMetrics.rejectICMPSent.Count())
+
+	// 0 turns the limit off
+	require.NoError(t, fw.loadRejectICMPRate(firewallConfig(map[interface{}]interface{}{"reject_icmp_rate": 0})))
+	assert.Nil(t, fw.rejectICMPRate)
+	for i := 0; i < 3; i++ {
+		assert.True(t, fw.allowReject(reject, false, nil))
+	}
+
+	assert.EqualError(t, fw.loadRejectICMPRate(firewallConfig(map[interface{}]interface{}{"reject_icmp_rate": -1})), "firewall.reject_icmp_rate must not be negative")
+	assert.EqualError(t, fw.loadRejectICMPRate(firewallConfig(map[interface{}]interface{}{"reject_icmp_burst": 0})), "firewall.reject_icmp_burst must be positive")
+}
+
+// firewallConfig returns a config whose firewall section is settings
+func firewallConfig(settings map[interface{}]interface{}) *config.C {
+	c := config.NewC(test.NewLogger())
+	c.Settings["firewall"] = settings
+	return c
+}
+
+func TestFirewall_RejectICMPCode(t *testing.T) {
+	l := test.NewLogger()
+	fw, err := NewFirewallFromConfig(l, &cert.NebulaCertificate{}, firewallConfig(nil))
+	require.NoError(t, err)
+	assert.Equal(t, uint8(iputil.RejectICMPCodePortUnreachable), fw.rejectICMPCode)
+
+	h := ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + 8,
+		TTL:      64,
+		Protocol: firewall.ProtoUDP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+	}
+	b, err := h.Marshal()
+	require.NoError(t, err)
+	b = append(b, 0x9c, 0x40, 0, 53, 0, 8, 0, 0)
+
+	// The default leaves the port unreachable alone
+	reject := iputil.CreateRejectPacket(b, make([]byte, iputil.MaxRejectPacketSize))
+	fw.setRejectICMPCode(reject)
+	assert.Equal(t, []byte{3, 3}, reject[20:22])
+
+	fw, err = NewFirewallFromConfig(l, &cert.NebulaCertificate{}, firewallConfig(map[interface{}]interface{}{"reject_icmp_code": "admin-prohibited"}))
+	require.NoError(t, err)
+	fw.setRejectICMPCode(reject)
+	assert.Equal(t, []byte{3, 13}, reject[20:22])
+
+	// A tcp reset has no code to change
+	h.Protocol = firewall.ProtoTCP
+	h.TotalLen = ipv4.HeaderLen + 20
+	b, err = h.Marshal()
+	require.NoError(t, err)
+	b = append(b, make([]byte, 20)...)
+	b[ipv4.HeaderLen+12] = 5 << 4
+	rst := iputil.CreateRejectPacket(b, make([]byte, iputil.MaxRejectPacketSize))
+	want := append([]byte(nil), rst...)
+	fw.setRejectICMPCode(rst)
+	assert.Equal(t, want, rst)
+
+	_, err = NewFirewallFromConfig(l, &cert.NebulaCertificate{}, firewallConfig(map[interface{}]interface{}{"reject_icmp_code": "host-unreachable"}))
+	assert.EqualError(t, err, "firewall.reject_icmp_code must be `port-unreachable` or `admin-prohibited`, got `host-unreachable`")
+}
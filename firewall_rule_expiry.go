@@ -0,0 +1,122 @@
+package nebula
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ruleExpiryInterval is how often timed rules are checked for having expired, see startRuleExpiry
+const ruleExpiryInterval = time.Second
+
+// parseRuleExpires returns when a rule with the expires field s stops matching, s is an RFC3339 time or a duration
+// from now
+func parseRuleExpires(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 time nor a duration", s)
+	}
+
+	if d <= 0 {
+		return time.Time{}, fmt.Errorf("duration must be positive")
+	}
+
+	return now.Add(d), nil
+}
+
+// expired returns true if the rule has an expiry and it has passed at now. A zero now is unknown and taken not to be.
+func (o RuleOptions) expired(now time.Time) bool {
+	return !o.Expires.IsZero() && !now.IsZero() && !now.Before(o.Expires)
+}
+
+// ruleExpiry bumps rulesVersion as timed rules expire, see startRuleExpiry
+type ruleExpiry struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// startRuleExpiry starts a goroutine that checks every ruleExpiryInterval for rules that expired since the last check,
+// logging each once and bumping rulesVersion so conntrack entries they allowed are revalidated. It does nothing for a
+// firewall without timed rules and is stopped by Destroy.
+func (f *Firewall) startRuleExpiry() {
+	if f.ruleExpiry != nil || (!f.InRules().timed && !f.OutRules().timed) {
+		return
+	}
+
+	e := &ruleExpiry{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	f.ruleExpiry = e
+
+	go func() {
+		defer close(e.done)
+
+		t := time.NewTicker(ruleExpiryInterval)
+		defer t.Stop()
+
+		last := f.clock.Now()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-t.C:
+				now := f.clock.Now()
+				f.expireRules(last, now)
+				last = now
+			}
+		}
+	}()
+}
+
+// stopRuleExpiry stops the goroutine started by startRuleExpiry and waits for it to exit, it is safe to call if it is
+// not running
+func (f *Firewall) stopRuleExpiry() {
+	if f.ruleExpiry == nil {
+		return
+	}
+
+	f.ruleExpiry.stopOnce.Do(func() {
+		close(f.ruleExpiry.stop)
+	})
+	<-f.ruleExpiry.done
+}
+
+// expireRules logs every rule that expired after since and no later than now and bumps rulesVersion if there were any,
+// returning how many there were
+func (f *Firewall) expireRules(since, now time.Time) int {
+	conntrack := f.Conntrack
+	conntrack.lockAll()
+	defer conntrack.unlockAll()
+
+	rs := f.ruleset.Load()
+	n := 0
+	for _, incoming := range []bool{true, false} {
+		for _, or := range rs.table(incoming).ordered {
+			if or.opts.Expires.IsZero() || !or.opts.expired(now) || or.opts.expired(since) {
+				continue
+			}
+
+			f.l.WithField("firewallRule", or.fields(incoming)).
+				WithField("expires", or.opts.Expires).
+				Info("Firewall rule has expired")
+			n++
+		}
+	}
+
+	if n > 0 {
+		f.bumpRulesVersion(f.GetRuleHashes())
+	}
+
+	return n
+}
+
+// fields returns the fields to log the rule with
+func (or *orderedRule) fields(incoming bool) m {
+	return ruleFields(incoming, or.proto, or.rule, or.opts)
+}
@@ -0,0 +1,122 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRuleExpires(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	expires, err := parseRuleExpires("2024-01-01T18:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC), expires)
+
+	expires, err = parseRuleExpires("90m", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(90*time.Minute), expires)
+
+	_, err = parseRuleExpires("18:00", now)
+	assert.EqualError(t, err, `"18:00" is neither an RFC3339 time nor a duration`)
+	_, err = parseRuleExpires("-1h", now)
+	assert.EqualError(t, err, "duration must be positive")
+}
+
+func TestFirewall_RuleExpires(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "host1", "expires": "1h"},
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "any", "expires": "2000-01-01T00:00:00Z"},
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Contains(t, fw.getRules(), "expires: 2000-01-01T00:00:00Z")
+	assert.True(t, fw.InRules().timed)
+	clock := &fakeClock{now: time.Now()}
+	fw.clock = clock
+	cp := cert.NewCAPool()
+
+	packet := func(port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+			RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+			LocalPort:  port,
+			RemotePort: 1000,
+			Protocol:   firewall.ProtoTCP,
+		}
+	}
+
+	assert.NoError(t, fw.Drop([]byte{}, packet(22), true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, packet(443), true, h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, packet(80), true, h, cp, nil))
+
+	// Nothing expires within the hour
+	since := clock.Now()
+	clock.advance(time.Hour - time.Second)
+	assert.Zero(t, fw.expireRules(since, clock.Now()))
+	rulesVersion := fw.rulesVersion()
+
+	// The ssh rule expires, is logged once and the flow it allowed is dropped on its next packet
+	since = clock.Now()
+	clock.advance(time.Second)
+	ob.Reset()
+	assert.Equal(t, 1, fw.expireRules(since, clock.Now()))
+	assert.Equal(t, rulesVersion+1, fw.rulesVersion())
+	assert.Equal(t, 1, strings.Count(ob.String(), "Firewall rule has expired"))
+	assert.Contains(t, ob.String(), "startPort:22")
+
+	since = clock.Now()
+	clock.advance(time.Minute)
+	assert.Zero(t, fw.expireRules(since, clock.Now()))
+	assert.Equal(t, rulesVersion+1, fw.rulesVersion())
+
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, packet(22), true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, packet(443), true, h, cp, nil))
+
+	// Only started for a firewall with timed rules
+	fw.startRuleExpiry()
+	assert.NotNil(t, fw.ruleExpiry)
+	fw.Destroy()
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any"}},
+	}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	fw.startRuleExpiry()
+	assert.Nil(t, fw.ruleExpiry)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "expires": "soon"}},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; expires was not understood; \"soon\" is neither an RFC3339 time nor a duration")
+}
@@ -0,0 +1,98 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+
+	"github.com/slackhq/nebula/config"
+	"gopkg.in/yaml.v2"
+)
+
+// configRule is a rule to load along with where it came from, for errors
+type configRule struct {
+	table string
+	index int
+	rule  interface{}
+}
+
+// configRules returns the rules in key, firewall.inbound or firewall.outbound, followed by the rules in the file named
+// by key_file. Rules from the file are reported as key_file and the path of the file.
+func configRules(c *config.C, key string) ([]configRule, error) {
+	var rules []configRule
+	if r := c.Get(key); r != nil {
+		rs, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s failed to parse, should be an array of rules", key)
+		}
+
+		for i, t := range rs {
+			rules = append(rules, configRule{table: key, index: i, rule: t})
+		}
+	}
+
+	path := c.GetString(key+"_file", "")
+	if path == "" {
+		return rules, nil
+	}
+
+	table := key + "_file " + path
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to read: %w", key+"_file", err)
+	}
+
+	var r interface{}
+	if err := yaml.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s failed to parse: %w", table, err)
+	}
+
+	// An empty file has no rules
+	if r == nil {
+		return rules, nil
+	}
+
+	rs, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s failed to parse, should be an array of rules", table)
+	}
+
+	for i, t := range rs {
+		rules = append(rules, configRule{table: table, index: i, rule: t})
+	}
+
+	return rules, nil
+}
+
+// ruleFiles is the sha256 of each rule file that the rules were loaded from, by path, to see if they changed on reload.
+// A file that could not be read has a zero sum.
+type ruleFiles map[string][sha256.Size]byte
+
+// readRuleFiles returns the sums of the files named by firewall.inbound_file and firewall.outbound_file
+func readRuleFiles(c *config.C) ruleFiles {
+	rf := ruleFiles{}
+	for _, key := range []string{"firewall.outbound_file", "firewall.inbound_file"} {
+		if path := c.GetString(key, ""); path != "" {
+			rf[path] = ruleFileSum(path)
+		}
+	}
+	return rf
+}
+
+func ruleFileSum(path string) [sha256.Size]byte {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(b)
+}
+
+// changed returns true if any of the rule files has changed since the sums were taken, or can no longer be read
+func (rf ruleFiles) changed() bool {
+	for path, sum := range rf {
+		if s := ruleFileSum(path); s != sum || s == [sha256.Size]byte{} {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package nebula
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_RuleFile(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	path := filepath.Join(t.TempDir(), "inbound.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- port: 443
+  proto: tcp
+  host: any
+- port: 22
+  proto: tcp
+  host: any
+`), 0600))
+
+	c := &cert.NebulaCertificate{}
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound":      []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "admin"}},
+		"inbound_file": path,
+	}
+
+	// Rules from the file are added after the inline rules
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	rules := fw.getRules()
+	assert.Contains(t, rules, "startPort: 443")
+	assert.Less(t, bytes.Index([]byte(rules), []byte("host: admin")), bytes.Index([]byte(rules), []byte("startPort: 443")))
+	assert.Contains(t, ob.String(), "firewall.inbound rule #0; is shadowed by firewall.inbound_file "+path+" rule #1")
+	assert.False(t, fw.ruleFiles.changed())
+
+	// A change to the file is seen on reload
+	require.NoError(t, os.WriteFile(path, []byte("- {port: 443, proto: tcp, host: any}\n"), 0600))
+	assert.True(t, fw.ruleFiles.changed())
+	require.NoError(t, fw.Reload(conf))
+	assert.False(t, fw.ruleFiles.changed())
+	assert.Contains(t, fw.getRules(), "startPort: 443")
+
+	// An empty file has no rules
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+
+	// Errors point at the rule in the file
+	require.NoError(t, os.WriteFile(path, []byte("- {port: 443, proto: tcp, host: any}\n- {port: 22, proto: sctp, host: any}\n"), 0600))
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound_file "+path+" rule #1; proto was not understood; `sctp`")
+	var rce *RuleConfigError
+	require.ErrorAs(t, err, &rce)
+	assert.Equal(t, "firewall.inbound_file "+path, rce.Table)
+	assert.Equal(t, 1, rce.Index)
+
+	require.NoError(t, os.WriteFile(path, []byte("port: 443\n"), 0600))
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound_file "+path+" failed to parse, should be an array of rules")
+
+	require.NoError(t, os.Remove(path))
+	assert.True(t, fw.ruleFiles.changed())
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.ErrorContains(t, err, "firewall.inbound_file failed to read")
+}
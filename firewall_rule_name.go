@@ -0,0 +1,99 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// ruleName returns what a rule is called in debug logs, the name it was given or else its rule string, which is the
+// same from one load of the rules to the next
+func ruleName(opts RuleOptions, ruleString string) string {
+	if opts.Name != "" {
+		return opts.Name
+	}
+	return ruleString
+}
+
+// plain returns true if the options do nothing but name the rule, such a rule is only kept in the port maps
+func (o RuleOptions) plain() bool {
+	o.Name = ""
+	return o == RuleOptions{}
+}
+
+// plainRule is a rule that is only in the port maps, matched on its own to tell which rule allowed a packet
+type plainRule struct {
+	proto uint8
+	rule  portRule
+	ca    *FirewallCA
+	name  string
+}
+
+func newPlainRule(proto uint8, r portRule, name string) *plainRule {
+	pr := &plainRule{
+		proto: proto,
+		rule:  r,
+		ca: &FirewallCA{
+			CANames: make(map[string]*FirewallRule),
+			CAShas:  make(map[string]*FirewallRule),
+		},
+		name: name,
+	}
+
+	// checkRule has accepted the rule so this can't fail
+	_ = pr.ca.addRule(r.groups, r.host, r.ip, r.localIp, r.caName, r.caSha)
+	return pr
+}
+
+// match returns true if the rule matches p, as the port maps it was added to would
+func (pr *plainRule) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+	if pr.proto != firewall.ProtoAny && pr.proto != p.Protocol {
+		return false
+	}
+
+	if pr.rule.startPort != firewall.PortAny {
+		port := packetPort(p, incoming)
+		if port < pr.rule.startPort || port > pr.rule.endPort {
+			return false
+		}
+	}
+
+	return pr.ca.match(p, c, caPool)
+}
+
+// matchedRule returns the name of the rule that decides p, empty if no rule matches. It repeats the work of evaluate
+// and is only meant for debug logs.
+func (ft *FirewallTable) matchedRule(p firewall.Packet, pi packetInfo, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) string {
+	ok, rule := ft.evaluate(p, pi, incoming, c, caPool)
+	if rule != nil {
+		return rule.name
+	}
+	if !ok {
+		return ""
+	}
+
+	// The port maps allowed it, they only say that one of the plain rules did
+	for _, pr := range ft.plain {
+		if pr.match(p, incoming, c, caPool) {
+			return pr.name
+		}
+	}
+
+	return ""
+}
+
+// logMatchedRule logs the rule that decided whether a new flow is allowed, to answer why a packet was dropped
+func (f *Firewall) logMatchedRule(h *HostInfo, table *FirewallTable, fp firewall.Packet, pi packetInfo, incoming bool, allowed bool, caPool *cert.NebulaCAPool) {
+	entry := h.logger(f.l).
+		WithField("fwPacket", fp).
+		WithField("incoming", incoming)
+
+	name := table.matchedRule(fp, pi, incoming, h.ConnectionState.peerCert, caPool)
+	switch {
+	case name == "":
+		entry.Debugln("dropping new flow, no firewall rule matched")
+	case allowed:
+		entry.WithField("rule", name).Debugln("allowing new flow by firewall rule")
+	default:
+		entry.WithField("rule", name).Debugln("dropping new flow by firewall rule")
+	}
+}
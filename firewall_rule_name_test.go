@@ -0,0 +1,99 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_RuleNames(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	l.SetLevel(logrus.DebugLevel)
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "name": "ssh"},
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "any"},
+			map[interface{}]interface{}{"port": "20-30", "proto": "tcp", "host": "any", "action": "deny", "name": "no-legacy"},
+			map[interface{}]interface{}{"port": "8000-9000", "proto": "tcp", "host": "any", "priority": 5, "name": "web-alt"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Contains(t, fw.getRules(), "name: ssh")
+
+	// A name alone keeps a rule out of the ordered rules
+	assert.Len(t, fw.InRules().ordered, 2)
+	assert.Len(t, fw.InRules().plain, 2)
+
+	cp := cert.NewCAPool()
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+
+	// At the default priority a deny wins, even over the named allow
+	ob.Reset()
+	assert.Equal(t, ErrDeniedByRule, fw.Drop(b, p, true, h, cp, nil))
+	assert.Contains(t, ob.String(), "dropping new flow by firewall rule")
+	assert.Contains(t, ob.String(), "rule=no-legacy")
+
+	// An unnamed rule goes by its rule string
+	ob.Reset()
+	p.LocalPort = 80
+	assert.NoError(t, fw.Drop(b, p, true, h, cp, nil))
+	assert.Contains(t, ob.String(), "allowing new flow by firewall rule")
+	assert.Contains(t, ob.String(), "startPort: 80, endPort: 80")
+
+	ob.Reset()
+	p.LocalPort = 8080
+	assert.NoError(t, fw.Drop(b, p, true, h, cp, nil))
+	assert.Contains(t, ob.String(), "rule=web-alt")
+
+	ob.Reset()
+	p.LocalPort = 443
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, p, true, h, cp, nil))
+	assert.Contains(t, ob.String(), "dropping new flow, no firewall rule matched")
+	assert.NotContains(t, ob.String(), "rule=")
+
+	// Rules added one at a time are named the same way
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", "", RuleOptions{Name: "everything"}))
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 443, 443, []string{}, "host2", nil, nil, "", "", RuleOptions{}))
+	assert.Empty(t, fw.InRules().ordered)
+	assert.Equal(t, "everything", fw.InRules().matchedRule(p, packetInfo{length: -1}, true, c, cp))
+
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 443, 443, []string{}, "host1", nil, nil, "", "", RuleOptions{}))
+	assert.Contains(t, fw.InRules().matchedRule(p, packetInfo{length: -1}, true, c, cp), "host: host1")
+	p.LocalPort = 444
+	assert.Empty(t, fw.InRules().matchedRule(p, packetInfo{length: -1}, true, c, cp))
+}
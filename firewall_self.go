@@ -0,0 +1,29 @@
+package nebula
+
+import (
+	"bytes"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+// hostSelf is the host of a rule that matches our own certificate, see RuleOptions.SelfPeer
+const hostSelf = "self"
+
+// isSelf returns true if c is our own certificate, as it is for traffic from this node to its own overlay address.
+// Certificates are told apart by their signature, another certificate with our name is not us.
+func (f *Firewall) isSelf(c *cert.NebulaCertificate) bool {
+	if c == nil || f.certificate == nil {
+		return false
+	}
+
+	if c == f.certificate {
+		return true
+	}
+
+	return len(c.Signature) > 0 && bytes.Equal(c.Signature, f.certificate.Signature)
+}
+
+// matchSelf returns true if a rule with o matches a packet, self is true if the peer certificate is our own
+func (o RuleOptions) matchSelf(self bool) bool {
+	return !o.SelfPeer || self
+}
@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_SelfTraffic(t *testing.T) {
+	l := test.NewLogger()
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	h, self := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+	self.Signature = []byte("self")
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"},
+		},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "8080", "proto": "tcp", "host": "self"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, self, conf)
+	require.NoError(t, err)
+	assert.Contains(t, fw.getRules(), "host: self")
+	cp := cert.NewCAPool()
+
+	// The same packet as it leaves and as it comes back in, both addresses are ours
+	out := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  40000,
+		RemotePort: 8080,
+		Protocol:   firewall.ProtoTCP,
+	}
+	in := out
+	in.LocalPort, in.RemotePort = out.RemotePort, out.LocalPort
+
+	// An empty tcp segment, enough for conntrack
+	b := make([]byte, 40)
+	b[0] = 0x45
+	b[32] = 5 << 4
+	b[33] = tcpSYN
+
+	assert.NoError(t, fw.Drop(b, out, false, h, cp, nil))
+	assert.NoError(t, fw.Drop(b, in, true, h, cp, nil))
+
+	// Replies go out and come back in on the conntrack entries
+	assert.NoError(t, fw.Drop(b, in, false, h, cp, nil))
+	assert.NoError(t, fw.Drop(b, out, true, h, cp, nil))
+
+	// Other ports are not allowed in
+	other := in
+	other.LocalPort = 22
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, other, true, h, cp, nil))
+
+	// A copy of our certificate is still us
+	h.ConnectionState.peerCert = &cert.NebulaCertificate{Details: self.Details, Signature: []byte("self")}
+	in.RemotePort++
+	assert.NoError(t, fw.Drop(b, in, true, h, cp, nil))
+
+	// A peer with our name but its own certificate is not
+	peerIp := net.IPNet{IP: net.IPv4(1, 2, 3, 5), Mask: net.IPMask{255, 255, 255, 0}}
+	ph, peer := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&peerIp},
+	})
+	peer.Signature = []byte("peer")
+	in.RemoteIP = iputil.Ip2VpnIp(peerIp.IP)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, in, true, ph, cp, nil))
+
+	// And a peer can't claim our address
+	in.RemoteIP = iputil.Ip2VpnIp(ipNet.IP)
+	in.RemotePort++
+	assert.Equal(t, ErrInvalidRemoteIP, fw.Drop(b, in, true, ph, cp, nil))
+}
+
+func TestFirewall_IsSelf(t *testing.T) {
+	self := &cert.NebulaCertificate{Signature: []byte("self")}
+	fw := &Firewall{certificate: self}
+
+	assert.True(t, fw.isSelf(self))
+	assert.True(t, fw.isSelf(&cert.NebulaCertificate{Signature: []byte("self")}))
+	assert.False(t, fw.isSelf(&cert.NebulaCertificate{Signature: []byte("peer")}))
+	assert.False(t, fw.isSelf(nil))
+
+	// Unsigned certificates are only ever themselves
+	fw.certificate = &cert.NebulaCertificate{}
+	assert.False(t, fw.isSelf(&cert.NebulaCertificate{}))
+}
@@ -0,0 +1,19 @@
+package nebula
+
+import "github.com/slackhq/nebula/firewall"
+
+// matchSourcePort returns true if the source port of p is in the source port range of a rule with o. The rule's own
+// port is the destination, so the source is the remote end inbound and our end outbound. A fragment has no ports and
+// never matches a rule with a source port.
+func (o RuleOptions) matchSourcePort(p firewall.Packet, incoming bool) bool {
+	if o.SourcePortStart == 0 {
+		return true
+	}
+
+	sourcePort := int32(p.RemotePort)
+	if !incoming {
+		sourcePort = int32(p.LocalPort)
+	}
+
+	return !p.Fragment && sourcePort >= o.SourcePortStart && sourcePort <= o.SourcePortEnd
+}
@@ -0,0 +1,114 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_SourcePort(t *testing.T) {
+	l := test.NewLogger()
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name: "host1",
+			Ips:  []*net.IPNet{&ipNet},
+		},
+	}
+
+	peerIp := net.IPNet{IP: net.IPv4(1, 2, 3, 5), Mask: net.IPMask{255, 255, 255, 0}}
+	h, _ := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host2",
+		Ips:  []*net.IPNet{&peerIp},
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "source_port": "5353"},
+		},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "8080", "proto": "tcp", "host": "any", "source_port": "1024-"},
+			map[interface{}]interface{}{"port": "9090", "proto": "tcp", "host": "any", "source_port": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+	assert.Contains(t, fw.getRules(), "sourcePort: 1024-65535")
+	assert.Contains(t, fw.getRules(), "sourcePort: 5353-5353")
+	cp := cert.NewCAPool()
+
+	b := tcpTestPacket(tcpSYN)
+	in := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(peerIp.IP),
+		LocalPort:  8080,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	// Inbound the source port is the remote port
+	assert.NoError(t, fw.Drop(b, in, true, h, cp, nil))
+	in.RemotePort = 1023
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, in, true, h, cp, nil))
+
+	// source_port: any leaves the rule unconstrained and in the port maps
+	in.LocalPort = 9090
+	assert.NoError(t, fw.Drop(b, in, true, h, cp, nil))
+
+	// Fragments have no ports to check
+	frag := in
+	frag.LocalPort, frag.RemotePort, frag.Fragment = 8080, 40001, true
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, frag, true, h, cp, nil))
+
+	// Outbound the source port is the local port
+	out := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(peerIp.IP),
+		LocalPort:  5353,
+		RemotePort: 53,
+		Protocol:   firewall.ProtoUDP,
+	}
+	assert.NoError(t, fw.Drop([]byte{}, out, false, h, cp, nil))
+	out.LocalPort = 5354
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, out, false, h, cp, nil))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "icmp", "host": "any", "source_port": "1024-"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, &c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; source_port is only supported with proto tcp or udp")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "source_port": "fragment"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, &c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; source_port can not be fragment")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "source_port": "high"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, &c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; source_port was not a number; `high`")
+
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoICMP, 0, 0, []string{}, "any", nil, nil, "", "", RuleOptions{SourcePortStart: 1, SourcePortEnd: 2}), "source port is only supported for tcp and udp rules")
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 1, 1, []string{}, "any", nil, nil, "", "", RuleOptions{SourcePortStart: 2, SourcePortEnd: 1}), "source port range 2-1 is not valid")
+}
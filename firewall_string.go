@@ -0,0 +1,228 @@
+package nebula
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// String renders the rule compactly for tests and debug logs, hosts are sorted and cidrs are in address order
+func (fr *FirewallRule) String() string {
+	if fr == nil {
+		return "none"
+	}
+
+	if fr.Any {
+		return "any"
+	}
+
+	var parts []string
+	if fr.MatchAll {
+		parts = append(parts, "matchAll")
+	}
+	if hosts := fr.hosts(); len(hosts) > 0 {
+		parts = append(parts, fmt.Sprintf("hosts=%v", hosts))
+	}
+	if len(fr.Groups) > 0 {
+		parts = append(parts, fmt.Sprintf("groups=%v", fr.Groups))
+	}
+	if cidrs := treeCIDRs(fr.CIDR); len(cidrs) > 0 {
+		parts = append(parts, fmt.Sprintf("cidrs=%v", cidrs))
+	}
+	if cidrs := treeCIDRs(fr.LocalCIDR); len(cidrs) > 0 {
+		parts = append(parts, fmt.Sprintf("localCidrs=%v", cidrs))
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+func (fr *FirewallRule) MarshalJSON() ([]byte, error) {
+	if fr.Any {
+		return json.Marshal(m{"any": true})
+	}
+
+	return json.Marshal(struct {
+		MatchAll   bool       `json:"matchAll,omitempty"`
+		Hosts      []string   `json:"hosts,omitempty"`
+		Groups     [][]string `json:"groups,omitempty"`
+		CIDRs      []string   `json:"cidrs,omitempty"`
+		LocalCIDRs []string   `json:"localCidrs,omitempty"`
+	}{
+		MatchAll:   fr.MatchAll,
+		Hosts:      fr.hosts(),
+		Groups:     fr.Groups,
+		CIDRs:      treeCIDRs(fr.CIDR),
+		LocalCIDRs: treeCIDRs(fr.LocalCIDR),
+	})
+}
+
+func (fr *FirewallRule) hosts() []string {
+	hosts := make([]string, 0, len(fr.Hosts))
+	for h := range fr.Hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// treeCIDRs returns the cidrs in tree, in address order
+func treeCIDRs(tree *cidr.Tree4[struct{}]) []string {
+	if tree == nil {
+		return nil
+	}
+
+	var cidrs []string
+	tree.Each(func(cidr *net.IPNet, _ struct{}) bool {
+		cidrs = append(cidrs, cidr.String())
+		return true
+	})
+	return cidrs
+}
+
+// String renders the rules for any ca and then for each ca name and sha, sorted
+func (fc *FirewallCA) String() string {
+	var parts []string
+	if fc.Any != nil {
+		parts = append(parts, "{"+fc.Any.String()+"}")
+	}
+	for _, name := range sortedKeys(fc.CANames) {
+		parts = append(parts, fmt.Sprintf("caName=%s{%s}", name, fc.CANames[name]))
+	}
+	for _, sha := range sortedKeys(fc.CAShas) {
+		parts = append(parts, fmt.Sprintf("caSha=%s{%s}", sha, fc.CAShas[sha]))
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (fc *FirewallCA) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Any     *FirewallRule            `json:"any,omitempty"`
+		CANames map[string]*FirewallRule `json:"caNames,omitempty"`
+		CAShas  map[string]*FirewallRule `json:"caShas,omitempty"`
+	}{
+		Any:     fc.Any,
+		CANames: fc.CANames,
+		CAShas:  fc.CAShas,
+	})
+}
+
+func sortedKeys(rules map[string]*FirewallRule) []string {
+	keys := make([]string, 0, len(rules))
+	for k := range rules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// firewallPortRange is a run of ports in a firewallPort that all have the same rules
+type firewallPortRange struct {
+	start, end int32
+	ca         *FirewallCA
+	rendered   string
+}
+
+func (r firewallPortRange) port() string {
+	switch {
+	case r.start == firewall.PortAny:
+		return "any"
+	case r.start == firewall.PortFragment:
+		return "fragment"
+	case r.start == r.end:
+		return fmt.Sprint(r.start)
+	default:
+		return fmt.Sprintf("%d-%d", r.start, r.end)
+	}
+}
+
+// ranges returns the ports in order, with consecutive ports that render the same merged. A port range in a rule is
+// stored on every port in it, this turns it back into one range.
+func (fp firewallPort) ranges() []firewallPortRange {
+	ports := make([]int32, 0, len(fp))
+	for p := range fp {
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+	var ranges []firewallPortRange
+	for _, p := range ports {
+		rendered := fp[p].String()
+		if n := len(ranges); n > 0 && p > firewall.PortAny && ranges[n-1].start > firewall.PortAny &&
+			ranges[n-1].end+1 == p && ranges[n-1].rendered == rendered {
+			ranges[n-1].end = p
+			continue
+		}
+
+		ranges = append(ranges, firewallPortRange{start: p, end: p, ca: fp[p], rendered: rendered})
+	}
+
+	return ranges
+}
+
+// String renders each port or range of ports with the same rules as port:{rules}, in port order
+func (fp firewallPort) String() string {
+	ranges := fp.ranges()
+	if len(ranges) == 0 {
+		return "none"
+	}
+
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = r.port() + ":" + r.rendered
+	}
+	return strings.Join(parts, "; ")
+}
+
+// MarshalJSON renders an object keyed by port or range of ports, as String does
+func (fp firewallPort) MarshalJSON() ([]byte, error) {
+	out := make(map[string]*FirewallCA, len(fp))
+	for _, r := range fp.ranges() {
+		out[r.port()] = r.ca
+	}
+	return json.Marshal(out)
+}
+
+// String renders the port maps of each protocol that has rules. Rules that are only in the ordered rules are not
+// here, see Firewall.getRules.
+func (ft *FirewallTable) String() string {
+	var parts []string
+	for _, p := range []struct {
+		name string
+		fp   firewallPort
+	}{{"tcp", ft.TCP}, {"udp", ft.UDP}, {"icmp", ft.ICMP}, {"any", ft.AnyProto}} {
+		if len(p.fp) > 0 {
+			parts = append(parts, p.name+"=["+p.fp.String()+"]")
+		}
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+func (ft *FirewallTable) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TCP      firewallPort `json:"tcp,omitempty"`
+		UDP      firewallPort `json:"udp,omitempty"`
+		ICMP     firewallPort `json:"icmp,omitempty"`
+		AnyProto firewallPort `json:"any,omitempty"`
+	}{
+		TCP:      ft.TCP,
+		UDP:      ft.UDP,
+		ICMP:     ft.ICMP,
+		AnyProto: ft.AnyProto,
+	})
+}
@@ -0,0 +1,53 @@
+package nebula
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_String(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	assert.Equal(t, "none", fw.InRules().String())
+
+	_, ti, _ := net.ParseCIDR("10.0.0.0/8")
+	_, ti2, _ := net.ParseCIDR("1.2.3.0/24")
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{}, "host2", nil, nil, "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{}, "host1", ti, nil, "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{"g1", "g2"}, "", ti2, nil, "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 1000, 1002, []string{}, "any", nil, nil, "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 1003, 1003, []string{}, "host1", nil, nil, "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoUDP, 0, 0, []string{}, "", nil, ti, "ca1", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, -1, -1, []string{}, "any", nil, nil, "", "abc"))
+
+	assert.Equal(t, "hosts=[host1 host2] groups=[[g1 g2]] cidrs=[1.2.3.0/24 10.0.0.0/8]", fw.InRules().TCP[22].Any.String())
+	assert.Equal(t, "{any}", fw.InRules().TCP[1000].String())
+	assert.Equal(t, "22:{hosts=[host1 host2] groups=[[g1 g2]] cidrs=[1.2.3.0/24 10.0.0.0/8]}; 1000-1002:{any}; 1003:{hosts=[host1]}", fw.InRules().TCP.String())
+	assert.Equal(t,
+		"tcp=[22:{hosts=[host1 host2] groups=[[g1 g2]] cidrs=[1.2.3.0/24 10.0.0.0/8]}; 1000-1002:{any}; 1003:{hosts=[host1]}] "+
+			"udp=[any:caName=ca1{localCidrs=[10.0.0.0/8]}] any=[fragment:caSha=abc{any}]",
+		fw.InRules().String(),
+	)
+
+	b, err := json.Marshal(fw.InRules())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"tcp": {
+			"22": {"any": {"hosts": ["host1", "host2"], "groups": [["g1", "g2"]], "cidrs": ["1.2.3.0/24", "10.0.0.0/8"]}},
+			"1000-1002": {"any": {"any": true}},
+			"1003": {"any": {"hosts": ["host1"]}}
+		},
+		"udp": {"any": {"caNames": {"ca1": {"localCidrs": ["10.0.0.0/8"]}}}},
+		"any": {"fragment": {"caShas": {"abc": {"any": true}}}}
+	}`, string(b))
+}
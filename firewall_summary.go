@@ -0,0 +1,95 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/firewall"
+)
+
+// firewallTableSummary counts the rules in one FirewallTable, see Firewall.LogSummary
+type firewallTableSummary struct {
+	rules    int
+	tcp      int
+	udp      int
+	icmp     int
+	anyProto int
+
+	// Rules that match any host, see FirewallRule.isAny
+	anyHost int
+
+	// Rules limited to hosts signed by a given ca_name or ca_sha
+	caScoped int
+
+	// The ip and local_ip cidrs across all rules
+	cidrs int
+
+	// Rules with action log, which are not enforced and not counted above
+	logOnly int
+}
+
+func (ft *FirewallTable) summary() firewallTableSummary {
+	var s firewallTableSummary
+	add := func(proto uint8, r portRule) {
+		s.rules++
+		switch proto {
+		case firewall.ProtoTCP:
+			s.tcp++
+		case firewall.ProtoUDP:
+			s.udp++
+		case firewall.ProtoICMP:
+			s.icmp++
+		case firewall.ProtoAny:
+			s.anyProto++
+		}
+
+		if (&FirewallRule{}).isAny(r.groups, r.host, r.ip, r.localIp) {
+			s.anyHost++
+		}
+
+		if r.caName != "" || r.caSha != "" {
+			s.caScoped++
+		}
+
+		if r.ip.IsValid() {
+			s.cidrs++
+		}
+		if r.localIp.IsValid() {
+			s.cidrs++
+		}
+	}
+
+	for _, or := range ft.ordered {
+		add(or.proto, or.rule)
+	}
+	for _, pr := range ft.plain {
+		add(pr.proto, pr.rule)
+	}
+	s.logOnly = len(ft.logOnly)
+
+	return s
+}
+
+func (s firewallTableSummary) fields() m {
+	return m{
+		"rules":    s.rules,
+		"tcp":      s.tcp,
+		"udp":      s.udp,
+		"icmp":     s.icmp,
+		"anyProto": s.anyProto,
+		"anyHost":  s.anyHost,
+		"caScoped": s.caScoped,
+		"cidrs":    s.cidrs,
+		"logOnly":  s.logOnly,
+	}
+}
+
+// LogSummary logs one line counting the compiled rules, a quick check that the intended policy was loaded without a
+// log line for every rule
+func (f *Firewall) LogSummary() {
+	in := f.InRules().summary()
+	out := f.OutRules().summary()
+
+	f.l.WithField("inbound", in.fields()).
+		WithField("outbound", out.fields()).
+		WithField("cidrs", in.cidrs+out.cidrs).
+		WithField("firewallHashes", f.GetRuleHashes()).
+		Info("Firewall rules summary")
+}
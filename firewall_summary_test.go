@@ -0,0 +1,55 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_LogSummary(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	l.SetLevel(logrus.InfoLevel)
+	l.SetFormatter(&logrus.JSONFormatter{})
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name: "host1",
+			Ips:  []*net.IPNet{{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}},
+		},
+	}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"},
+		},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "icmp", "host": "any"},
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "cidr": "10.0.0.0/8", "local_cidr": "1.2.3.0/24"},
+			map[interface{}]interface{}{"port": "53", "proto": "udp", "group": "dns", "ca_name": "ca1"},
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "host": "host2", "action": "deny"},
+			map[interface{}]interface{}{"port": "8080", "proto": "tcp", "host": "any", "action": "log"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	require.NoError(t, err)
+
+	assert.Equal(t, firewallTableSummary{rules: 4, tcp: 2, udp: 1, icmp: 1, anyHost: 1, caScoped: 1, cidrs: 2, logOnly: 1}, fw.InRules().summary())
+	assert.Equal(t, firewallTableSummary{rules: 1, anyProto: 1, anyHost: 1}, fw.OutRules().summary())
+
+	ob.Reset()
+	fw.LogSummary()
+	assert.Contains(t, ob.String(), `"msg":"Firewall rules summary"`)
+	assert.Contains(t, ob.String(), `"cidrs":2`)
+	assert.Contains(t, ob.String(), `"firewallHashes":"`+fw.GetRuleHashes()+`"`)
+	assert.Contains(t, ob.String(), `"outbound":{"anyHost":1,"anyProto":1,"caScoped":0,"cidrs":0,"icmp":0,"logOnly":0,"rules":1,"tcp":0,"udp":0}`)
+}
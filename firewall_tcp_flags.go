@@ -0,0 +1,80 @@
+package nebula
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tcpFlagNames are the tcp flags a rule may match on
+var tcpFlagNames = []struct {
+	name string
+	flag uint8
+}{
+	{"syn", tcpSYN},
+	{"ack", tcpACK},
+	{"fin", tcpFIN},
+	{"rst", tcpRST},
+	{"psh", tcpPSH},
+	{"urg", tcpURG},
+}
+
+// parseTCPFlags parses the tcp_flags of a rule, a comma separated list of flags that must be set, or must be clear
+// when prefixed with `!`. `ack,!syn` matches packets with ack set and syn clear, whatever the other flags are.
+// The returned flags are the ones that must be set and mask holds every flag that was listed.
+func parseTCPFlags(s string) (flags uint8, mask uint8, err error) {
+	for _, f := range strings.Split(s, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		unset := strings.HasPrefix(f, "!")
+		f = strings.TrimPrefix(f, "!")
+
+		var flag uint8
+		for _, n := range tcpFlagNames {
+			if n.name == f {
+				flag = n.flag
+				break
+			}
+		}
+
+		if flag == 0 {
+			return 0, 0, fmt.Errorf("unknown tcp flag `%s`", f)
+		}
+
+		if mask&flag != 0 {
+			return 0, 0, fmt.Errorf("tcp flag `%s` was given more than once", f)
+		}
+
+		mask |= flag
+		if !unset {
+			flags |= flag
+		}
+	}
+
+	return flags, mask, nil
+}
+
+// tcpFlagsString formats flags and mask the way parseTCPFlags reads them, the flags that must be set first
+func tcpFlagsString(flags uint8, mask uint8) string {
+	var set, unset []string
+	for _, n := range tcpFlagNames {
+		switch {
+		case mask&n.flag == 0:
+		case flags&n.flag != 0:
+			set = append(set, n.name)
+		default:
+			unset = append(unset, "!"+n.name)
+		}
+	}
+
+	return strings.Join(append(set, unset...), ",")
+}
+
+// matchTCPFlags returns true if the tcp flags of the packet pi describes are the ones a rule with o asks for. Flags are
+// unknown without a packet, as when conntrack is revalidated in the background, and are taken to match. A packet
+// without a tcp header never matches.
+func (o RuleOptions) matchTCPFlags(pi packetInfo) bool {
+	if o.TCPFlagsMask == 0 || pi.length < 0 {
+		return true
+	}
+
+	return pi.hasTCPFlags && pi.tcpFlags&o.TCPFlagsMask == o.TCPFlags
+}
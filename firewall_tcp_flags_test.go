@@ -0,0 +1,108 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTCPFlags(t *testing.T) {
+	flags, mask, err := parseTCPFlags("ack")
+	require.NoError(t, err)
+	assert.Equal(t, uint8(tcpACK), flags)
+	assert.Equal(t, uint8(tcpACK), mask)
+
+	flags, mask, err = parseTCPFlags("!syn")
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), flags)
+	assert.Equal(t, uint8(tcpSYN), mask)
+
+	flags, mask, err = parseTCPFlags(" ACK, !syn,!rst ")
+	require.NoError(t, err)
+	assert.Equal(t, uint8(tcpACK), flags)
+	assert.Equal(t, uint8(tcpACK|tcpSYN|tcpRST), mask)
+	assert.Equal(t, "ack,!syn,!rst", tcpFlagsString(flags, mask))
+
+	_, _, err = parseTCPFlags("ack,bogus")
+	assert.EqualError(t, err, "unknown tcp flag `bogus`")
+	_, _, err = parseTCPFlags("")
+	assert.EqualError(t, err, "unknown tcp flag ``")
+	_, _, err = parseTCPFlags("syn,!syn")
+	assert.EqualError(t, err, "tcp flag `syn` was given more than once")
+}
+
+func TestFirewall_RuleTCPFlags(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "tcp_flags": "ack,!syn"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Contains(t, fw.getRules(), "tcpFlags: ack,!syn")
+	cp := cert.NewCAPool()
+
+	// segment builds an inbound tcp segment to port 22 from port sport with flags
+	segment := func(sport byte, flags byte) ([]byte, firewall.Packet) {
+		b := []byte{
+			0x45, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x00, 0x40, firewall.ProtoTCP, 0x00, 0x00,
+			1, 2, 3, 4,
+			1, 2, 3, 4,
+			0x9c, sport, 0x00, 0x16, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+			0x50, flags, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00,
+		}
+		fp := firewall.Packet{}
+		require.NoError(t, newPacket(b, true, &fp))
+		return b, fp
+	}
+
+	// A new connection is not allowed
+	b, fp := segment(1, tcpSYN)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, true, h, cp, nil))
+	b, fp = segment(1, tcpSYN|tcpACK)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, true, h, cp, nil))
+
+	// Established traffic is, with any of the other flags
+	b, fp = segment(2, tcpACK)
+	assert.NoError(t, fw.Drop(b, fp, true, h, cp, nil))
+	b, fp = segment(3, tcpACK|tcpPSH|tcpFIN)
+	assert.NoError(t, fw.Drop(b, fp, true, h, cp, nil))
+
+	// A segment too short to hold the flags never matches
+	b, fp = segment(4, tcpACK)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b[:30], fp, true, h, cp, nil))
+
+	// Without a packet the flags are taken to match
+	assert.True(t, fw.InRules().match(fp, packetInfo{length: -1}, true, c, cp))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "tcp_flags": "ack"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; tcp_flags is only supported with proto tcp")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "tcp_flags": "ack,nope"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; tcp_flags did not parse; unknown tcp flag `nope`")
+
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 1, 1, []string{}, "any", nil, nil, "", "", RuleOptions{TCPFlags: tcpACK, TCPFlagsMask: tcpACK}), "tcp flags are only supported for tcp rules")
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 1, 1, []string{}, "any", nil, nil, "", "", RuleOptions{TCPFlags: tcpACK}), "tcp flags are not all in the tcp flags mask")
+}
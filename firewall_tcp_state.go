@@ -0,0 +1,171 @@
+package nebula
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// tcpState is a simplified version of the linux conntrack tcp state machine, it only looks at flags and does not
+// validate sequence numbers
+type tcpState uint8
+
+const (
+	// tcpStateNone is used for entries whose tcp flags were never seen, they use the plain tcp timeout
+	tcpStateNone tcpState = iota
+	tcpStateSynSent
+	tcpStateSynRecv
+	tcpStateEstablished
+	// The side that started the flow sent a FIN
+	tcpStateFinWait
+	// The other side sent a FIN
+	tcpStateCloseWait
+	// Both sides sent a FIN
+	tcpStateTimeWait
+	// Either side sent a RST
+	tcpStateClose
+	tcpStateMax
+)
+
+var tcpStateNames = [tcpStateMax]string{"none", "syn_sent", "syn_recv", "established", "fin_wait", "close_wait", "time_wait", "close"}
+
+func (s tcpState) String() string {
+	if s < tcpStateMax {
+		return tcpStateNames[s]
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// halfOpen returns true if the flow is still in its handshake
+func (s tcpState) halfOpen() bool {
+	return s == tcpStateSynSent || s == tcpStateSynRecv
+}
+
+// newTCPState returns the state for a flow that starts with a packet carrying flags
+func newTCPState(flags uint8) tcpState {
+	if flags&(tcpSYN|tcpACK) == tcpSYN {
+		return tcpStateSynSent
+	}
+
+	// We missed the handshake, assume the flow is up and let the flags take it from there
+	return tcpStateEstablished.next(flags, true)
+}
+
+// next returns the state after a packet carrying flags, fromInitiator is true if the packet was sent by the side that
+// started the flow
+func (s tcpState) next(flags uint8, fromInitiator bool) tcpState {
+	if flags&tcpRST != 0 {
+		return tcpStateClose
+	}
+
+	switch s {
+	case tcpStateSynSent:
+		if !fromInitiator && flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK {
+			return tcpStateSynRecv
+		}
+	case tcpStateSynRecv:
+		if fromInitiator && flags&(tcpSYN|tcpACK) == tcpACK {
+			s = tcpStateEstablished
+		}
+	}
+
+	if flags&tcpFIN == 0 {
+		return s
+	}
+
+	switch s {
+	case tcpStateFinWait:
+		if !fromInitiator {
+			return tcpStateTimeWait
+		}
+	case tcpStateCloseWait:
+		if fromInitiator {
+			return tcpStateTimeWait
+		}
+	case tcpStateTimeWait, tcpStateClose:
+	default:
+		if fromInitiator {
+			return tcpStateFinWait
+		}
+		return tcpStateCloseWait
+	}
+
+	return s
+}
+
+// tcpFlags returns the tcp flags from packet, false if the packet does not contain them
+func tcpFlags(packet []byte, fp firewall.Packet) (uint8, bool) {
+	if fp.Protocol != firewall.ProtoTCP || fp.Fragment || len(packet) < 1 {
+		return 0, false
+	}
+
+	ihl := int(packet[0]&0x0f) << 2
+	if len(packet) < ihl+14 {
+		return 0, false
+	}
+
+	return packet[ihl+13], true
+}
+
+// updateTCPState moves the conn along the tcp state machine and returns the timeout for its new state.
+// incoming is the direction of the packet, caller must hold the conntrack lock.
+func (f *Firewall) updateTCPState(c *conn, packet []byte, fp firewall.Packet, incoming bool) time.Duration {
+	if flags, ok := tcpFlags(packet, fp); ok {
+		if c.tcpState == tcpStateNone {
+			c.tcpState = newTCPState(flags)
+		} else {
+			prev := c.tcpState
+			c.tcpState = c.tcpState.next(flags, incoming == c.incoming)
+			if c.tcpState == tcpStateClose && prev != tcpStateClose {
+				f.metricTCPClosedByRST.Inc(1)
+			}
+		}
+	}
+
+	return f.tcpTimeout(c)
+}
+
+// tcpTimeout returns the timeout for the current state of a tcp conn. Until the flow has been seen in both directions
+// it is capped at the syn timeout, so unanswered flows such as those from a SYN scan do not linger.
+// Caller must hold the conntrack lock.
+func (f *Firewall) tcpTimeout(c *conn) time.Duration {
+	t := f.tcpTimeouts[c.tcpState]
+	if t > f.tcpSynTimeout && !c.bidirectional() {
+		return f.tcpSynTimeout
+	}
+	return t
+}
+
+// loadTCPTimeouts reads the per state tcp timeouts from config, established defaults to the tcp timeout and the
+// handshake states default to the syn timeout
+func (f *Firewall) loadTCPTimeouts(c *config.C) error {
+	f.tcpSynTimeout = c.GetDuration("firewall.conntrack.tcp_syn_timeout", time.Second*60)
+	if f.tcpSynTimeout <= 0 {
+		return fmt.Errorf("firewall.conntrack.tcp_syn_timeout must be positive")
+	}
+
+	defaults := [tcpStateMax]time.Duration{
+		tcpStateNone:        f.TCPTimeout,
+		tcpStateSynSent:     f.tcpSynTimeout,
+		tcpStateSynRecv:     f.tcpSynTimeout,
+		tcpStateEstablished: f.TCPTimeout,
+		tcpStateFinWait:     time.Second * 120,
+		tcpStateCloseWait:   time.Second * 60,
+		tcpStateTimeWait:    time.Second * 120,
+		tcpStateClose:       time.Second * 10,
+	}
+
+	for s := tcpStateSynSent; s < tcpStateMax; s++ {
+		key := "firewall.conntrack.tcp_" + s.String() + "_timeout"
+		f.tcpTimeouts[s] = c.GetDuration(key, defaults[s])
+		if f.tcpTimeouts[s] <= 0 {
+			return fmt.Errorf("%s must be positive", key)
+		}
+	}
+
+	// The timer wheel was sized for the protocol timeouts, make sure it can handle the tcp states as well
+	f.fitTimerWheel(append(f.tcpTimeouts[:], f.tcpSynTimeout)...)
+	return nil
+}
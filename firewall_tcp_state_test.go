@@ -0,0 +1,205 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tcpState_next(t *testing.T) {
+	tests := []struct {
+		name          string
+		from          tcpState
+		flags         uint8
+		fromInitiator bool
+		to            tcpState
+	}{
+		{"syn ack", tcpStateSynSent, tcpSYN | tcpACK, false, tcpStateSynRecv},
+		{"syn retransmit", tcpStateSynSent, tcpSYN, true, tcpStateSynSent},
+		{"syn ack from initiator", tcpStateSynSent, tcpSYN | tcpACK, true, tcpStateSynSent},
+		{"handshake ack", tcpStateSynRecv, tcpACK, true, tcpStateEstablished},
+		{"syn ack retransmit", tcpStateSynRecv, tcpSYN | tcpACK, false, tcpStateSynRecv},
+		{"data", tcpStateEstablished, tcpACK, false, tcpStateEstablished},
+		{"initiator fin", tcpStateEstablished, tcpFIN | tcpACK, true, tcpStateFinWait},
+		{"responder fin", tcpStateEstablished, tcpFIN | tcpACK, false, tcpStateCloseWait},
+		{"fin retransmit", tcpStateFinWait, tcpFIN, true, tcpStateFinWait},
+		{"second fin", tcpStateFinWait, tcpFIN, false, tcpStateTimeWait},
+		{"second fin other way", tcpStateCloseWait, tcpFIN, true, tcpStateTimeWait},
+		{"ack after fins", tcpStateTimeWait, tcpACK, true, tcpStateTimeWait},
+		{"rst", tcpStateEstablished, tcpRST, false, tcpStateClose},
+		{"rst during handshake", tcpStateSynSent, tcpRST | tcpACK, false, tcpStateClose},
+		{"rst after fins", tcpStateTimeWait, tcpRST, true, tcpStateClose},
+		{"fin after rst", tcpStateClose, tcpFIN, true, tcpStateClose},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.to, tt.from.next(tt.flags, tt.fromInitiator))
+		})
+	}
+
+	assert.Equal(t, tcpStateSynSent, newTCPState(tcpSYN))
+	assert.Equal(t, tcpStateEstablished, newTCPState(tcpACK))
+	assert.Equal(t, tcpStateFinWait, newTCPState(tcpFIN|tcpACK))
+	assert.Equal(t, "unknown(200)", tcpState(200).String())
+}
+
+// tcpTestPacket returns an ipv4 packet with a 20 byte ip header and a tcp header with flags set
+func tcpTestPacket(flags uint8) []byte {
+	b := make([]byte, 40)
+	b[0] = 0x45
+	b[9] = firewall.ProtoTCP
+	b[20+12] = 5 << 4
+	b[20+13] = flags
+	return b
+}
+
+func TestFirewall_TCPState(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{
+			"tcp_timeout":           "1h",
+			"tcp_syn_timeout":       "30s",
+			"tcp_syn_sent_timeout":  "10s",
+			"tcp_time_wait_timeout": "5s",
+		},
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "any"}},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	fw.metricsRegistry = metrics.NewRegistry()
+
+	// The timer wheel was resized for the shortest state timeout
+	assert.Equal(t, 5*time.Second, fw.Conntrack.shards[0].TimerWheel.tickDuration)
+	assert.Equal(t, time.Hour, fw.tcpTimeouts[tcpStateEstablished])
+	assert.Equal(t, 30*time.Second, fw.tcpTimeouts[tcpStateSynRecv])
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  80,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	cp := cert.NewCAPool()
+
+	step := func(flags uint8, incoming bool, state tcpState, timeout time.Duration) {
+		t.Helper()
+		now := time.Now()
+		assert.NoError(t, fw.Drop(tcpTestPacket(flags), p, incoming, h, cp, nil))
+		ct := fw.Conntrack.conns()[p]
+		assert.Equal(t, state, ct.tcpState)
+		assert.WithinDuration(t, now.Add(timeout), ct.Expires, time.Second)
+	}
+
+	// Remote host connects to us
+	step(tcpSYN, true, tcpStateSynSent, 10*time.Second)
+	step(tcpSYN|tcpACK, false, tcpStateSynRecv, 30*time.Second)
+	step(tcpACK, true, tcpStateEstablished, time.Hour)
+	step(tcpACK, false, tcpStateEstablished, time.Hour)
+
+	entries := fw.ListConntrack(ConntrackFilter{})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "established", entries[0].TCPState)
+
+	fw.EmitStats()
+	assert.Equal(t, int64(1), fw.metricsRegistry.Get("firewall.conntrack.tcp.established").(metrics.Gauge).Value())
+	assert.Equal(t, int64(0), fw.metricsRegistry.Get("firewall.conntrack.tcp.syn_sent").(metrics.Gauge).Value())
+
+	// We close first
+	step(tcpFIN|tcpACK, false, tcpStateCloseWait, 60*time.Second)
+	step(tcpFIN|tcpACK, true, tcpStateTimeWait, 5*time.Second)
+	step(tcpACK, false, tcpStateTimeWait, 5*time.Second)
+
+	// A reset closes the flow quickly
+	p.RemotePort = 40002
+	rsts := fw.metricTCPClosedByRST.Count()
+	// Picked up mid stream, so the timer wheel first hears about it for the syn timeout from now
+	step(tcpACK, true, tcpStateEstablished, 30*time.Second)
+	step(tcpRST, false, tcpStateClose, 10*time.Second)
+	step(tcpRST, true, tcpStateClose, 10*time.Second)
+	assert.Equal(t, rsts+1, fw.metricTCPClosedByRST.Count())
+
+	// The timer wheel is told about the shorter timeout
+	found := false
+	tw := fw.Conntrack.shard(p).TimerWheel
+	tw.Advance(time.Now().Add(15 * time.Second))
+	for {
+		ep, has := tw.Purge()
+		if !has {
+			break
+		}
+		found = found || ep == p
+	}
+	assert.True(t, found)
+
+	// Flows without usable flags are held to the syn timeout as well until they are answered
+	p.RemotePort = 40001
+	now := time.Now()
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Equal(t, tcpStateNone, fw.Conntrack.conns()[p].tcpState)
+	assert.WithinDuration(t, now.Add(30*time.Second), fw.Conntrack.conns()[p].Expires, time.Second)
+	step(tcpACK, false, tcpStateEstablished, time.Hour)
+
+	// A half open flow stays at the syn timeout, even if it was picked up mid stream, until it is answered
+	p.RemotePort = 40003
+	lc := firewall.NewConntrackCache()
+	step(tcpACK, true, tcpStateEstablished, 30*time.Second)
+	step(tcpACK, true, tcpStateEstablished, 30*time.Second)
+	assert.NoError(t, fw.Drop(tcpTestPacket(tcpACK), p, true, h, cp, lc))
+	assert.NotContains(t, lc.Entries, p)
+	step(tcpACK, false, tcpStateEstablished, time.Hour)
+	assert.NoError(t, fw.Drop(tcpTestPacket(tcpACK), p, true, h, cp, lc))
+	assert.Contains(t, lc.Entries, p)
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["conntrack"] = map[interface{}]interface{}{"tcp_fin_wait_timeout": "0s"}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.tcp_fin_wait_timeout must be positive")
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["conntrack"] = map[interface{}]interface{}{"tcp_syn_timeout": "-1s"}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.tcp_syn_timeout must be positive")
+}
+
+func TestFirewall_TCPHalfOpen(t *testing.T) {
+	fw, clock, r := newClockedFirewall()
+
+	fw.addConn(tcpTestPacket(tcpSYN), firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoTCP}, true, RuleOptions{})
+	fw.addConn(tcpTestPacket(tcpSYN), firewall.Packet{RemotePort: 2, Protocol: firewall.ProtoTCP}, true, RuleOptions{})
+	fw.addConn(tcpTestPacket(tcpSYN), firewall.Packet{RemotePort: 3, Protocol: firewall.ProtoTCP}, false, RuleOptions{})
+	fw.addConn(tcpTestPacket(tcpACK), firewall.Packet{RemotePort: 4, Protocol: firewall.ProtoTCP}, true, RuleOptions{})
+
+	// The second inbound flow answers and is still half open until the handshake ack
+	fp := firewall.Packet{RemotePort: 2, Protocol: firewall.ProtoTCP}
+	ok, _ := fw.inConns(fw.ruleset.Load(), tcpTestPacket(tcpSYN|tcpACK), fp, false, nil, nil, nil, netip.Addr{})
+	require.True(t, ok)
+
+	fw.EmitStats()
+	assert.Equal(t, int64(2), r.Get("firewall.conntrack.tcp.half_open_inbound").(metrics.Gauge).Value())
+
+	ok, _ = fw.inConns(fw.ruleset.Load(), tcpTestPacket(tcpACK), fp, true, nil, nil, nil, netip.Addr{})
+	require.True(t, ok)
+	fw.EmitStats()
+	assert.Equal(t, int64(1), r.Get("firewall.conntrack.tcp.half_open_inbound").(metrics.Gauge).Value())
+
+	// Both unanswered flows expire without finishing the handshake, the others were up
+	clock.advance(2 * time.Second)
+	assert.Equal(t, 4, fw.sweepConntrack())
+	assert.Equal(t, int64(2), fw.metricTCPHandshakeExpired.Count())
+}
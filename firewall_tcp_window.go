@@ -0,0 +1,283 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/slackhq/nebula/firewall"
+)
+
+// ErrTCPOutOfWindow is returned for a tcp packet of a tracked flow whose sequence or ack numbers are outside what
+// either side could have sent, see firewall.conntrack.tcp_strict
+var ErrTCPOutOfWindow = errors.New("tcp packet is outside the window of its flow")
+
+// tcpMaxAckWindow is how far behind the data sent an ack may be when the sender has not advertised a window yet
+const tcpMaxAckWindow = 66000
+
+// tcpOptWindowScale is the tcp option kind of the window scale option, RFC 7323
+const tcpOptWindowScale = 3
+
+// tcpOptTimestamps is the tcp option kind of the timestamps option, RFC 7323
+const tcpOptTimestamps = 8
+
+// tcpMaxWindowScale is the largest window scale RFC 7323 allows, larger values are taken to be this
+const tcpMaxWindowScale = 14
+
+// tcpSegment is what window tracking needs from a tcp header
+type tcpSegment struct {
+	seq     uint32
+	ack     uint32
+	win     uint32
+	flags   uint8
+	dataLen uint32
+
+	// The window scale option, only looked for in SYN packets
+	wscale    uint8
+	hasWscale bool
+}
+
+// parseTCPSegment reads the tcp header of packet, false if the packet is too short to hold one
+func parseTCPSegment(packet []byte, fp firewall.Packet) (tcpSegment, bool) {
+	if fp.Protocol != firewall.ProtoTCP || fp.Fragment || len(packet) < 1 {
+		return tcpSegment{}, false
+	}
+
+	ihl := int(packet[0]&0x0f) << 2
+	if len(packet) < ihl+20 {
+		return tcpSegment{}, false
+	}
+
+	tcp := packet[ihl:]
+	doff := int(tcp[12]>>4) << 2
+	if doff < 20 || len(tcp) < doff {
+		return tcpSegment{}, false
+	}
+
+	s := tcpSegment{
+		seq:     binary.BigEndian.Uint32(tcp[4:8]),
+		ack:     binary.BigEndian.Uint32(tcp[8:12]),
+		flags:   tcp[13],
+		win:     uint32(binary.BigEndian.Uint16(tcp[14:16])),
+		dataLen: uint32(len(tcp) - doff),
+	}
+
+	if s.flags&tcpSYN != 0 {
+		s.wscale, s.hasWscale = tcpWindowScale(tcp[20:doff])
+	}
+
+	return s, true
+}
+
+// tcpWindowScale returns the window scale option from the tcp options in opts
+func tcpWindowScale(opts []byte) (uint8, bool) {
+	o, ok := tcpOption(opts, tcpOptWindowScale, 3)
+	if !ok {
+		return 0, false
+	}
+
+	if o[0] > tcpMaxWindowScale {
+		return tcpMaxWindowScale, true
+	}
+	return o[0], true
+}
+
+// tcpTimestamps returns TSval and TSecr from the timestamps option in the tcp options in opts
+func tcpTimestamps(opts []byte) (tsVal, tsEcr uint32, ok bool) {
+	o, ok := tcpOption(opts, tcpOptTimestamps, 10)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return binary.BigEndian.Uint32(o[0:4]), binary.BigEndian.Uint32(o[4:8]), true
+}
+
+// tcpOption returns the data of the first option of kind with length in the tcp options in opts, false if there is
+// none. An option of kind with another length is skipped. The walk stops at the end of options or at an option whose
+// length doesn't fit what is left, what follows can't be trusted.
+func tcpOption(opts []byte, kind, length uint8) ([]byte, bool) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			return nil, false
+		case 1:
+			opts = opts[1:]
+			continue
+		}
+
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return nil, false
+		}
+
+		if opts[0] == kind && opts[1] == length {
+			return opts[2:length], true
+		}
+
+		opts = opts[opts[1]:]
+	}
+
+	return nil, false
+}
+
+// end returns the sequence number after the segment, SYN and FIN take one each
+func (s tcpSegment) end() uint32 {
+	end := s.seq + s.dataLen
+	if s.flags&tcpSYN != 0 {
+		end++
+	}
+	if s.flags&tcpFIN != 0 {
+		end++
+	}
+	return end
+}
+
+// tcpWindow tracks the sequence space of both sides of a tcp flow whose handshake we saw, it is a simplified version
+// of the window tracking in linux conntrack
+type tcpWindow struct {
+	// The side that started the flow and the side that answered
+	initiator tcpWindowSide
+	responder tcpWindowSide
+}
+
+// tcpWindowSide is what one side of a flow has sent and may send
+type tcpWindowSide struct {
+	// The sequence number after the last byte sent
+	end uint32
+	// The highest sequence number this side may send, what the other side acked plus its window
+	maxEnd uint32
+	// The largest window this side advertised, scaled
+	maxWin uint32
+	// The window scale of this side
+	scale uint8
+	// The SYN of this side was seen
+	seen bool
+}
+
+// newTCPWindow returns the window for a flow that starts with packet, nil unless it is a SYN. Flows without a window
+// are not checked.
+func newTCPWindow(packet []byte, fp firewall.Packet) *tcpWindow {
+	s, ok := parseTCPSegment(packet, fp)
+	if !ok || s.flags&(tcpSYN|tcpACK|tcpRST) != tcpSYN {
+		return nil
+	}
+
+	w := &tcpWindow{}
+	w.initiator.syn(s)
+	return w
+}
+
+// syn starts the side that sent SYN s
+func (side *tcpWindowSide) syn(s tcpSegment) {
+	// The window in a SYN is never scaled
+	win := s.win
+	if win == 0 {
+		win = 1
+	}
+
+	*side = tcpWindowSide{end: s.end(), maxWin: win, seen: true}
+	side.maxEnd = side.end
+	if s.hasWscale {
+		side.scale = s.wscale
+	} else {
+		// Scaling is off unless both sides ask for it, the responder has not answered yet
+		side.scale = 0xff
+	}
+}
+
+// check returns true if packet, sent by the initiator if fromInitiator is set, is within the window of the flow and
+// moves the window along if so. Packets that can't be checked are let through. Caller must hold the conntrack lock.
+func (w *tcpWindow) check(packet []byte, fp firewall.Packet, fromInitiator bool) bool {
+	s, ok := parseTCPSegment(packet, fp)
+	if !ok {
+		return true
+	}
+
+	sender, receiver := &w.initiator, &w.responder
+	if !fromInitiator {
+		sender, receiver = receiver, sender
+	}
+
+	if s.flags&(tcpSYN|tcpACK|tcpRST) == tcpSYN {
+		if fromInitiator && !w.responder.seen {
+			// A retransmitted SYN, maybe with a new sequence number
+			w.initiator.syn(s)
+		}
+		return true
+	}
+
+	if !w.responder.seen {
+		if fromInitiator || s.flags&(tcpSYN|tcpACK) != tcpSYN|tcpACK {
+			// Nothing to check against until the responder answers, the state machine takes care of these
+			return true
+		}
+
+		// The SYN-ACK must acknowledge the SYN
+		if s.ack != w.initiator.end {
+			return false
+		}
+
+		w.responder.syn(s)
+		if w.initiator.scale == 0xff || !s.hasWscale {
+			w.initiator.scale, w.responder.scale = 0, 0
+		}
+		// The initiator advertised its window in the SYN
+		w.responder.maxEnd = w.responder.end + w.initiator.maxWin
+		w.initiator.maxEnd = s.ack + w.responder.maxWin
+		return true
+	}
+
+	win := s.win << sender.scale
+	if s.flags&tcpSYN != 0 {
+		// A retransmitted SYN-ACK is unscaled
+		win = s.win
+	}
+
+	end := s.end()
+	ack := s.ack
+	if s.flags&tcpACK == 0 {
+		ack = receiver.end
+	}
+
+	maxAckWin := sender.maxWin
+	if maxAckWin == 0 {
+		maxAckWin = tcpMaxAckWindow
+	}
+
+	// Data must fit in the window the receiver gave us, and may be a retransmission of up to a window back. Keepalives
+	// and window probes sit one byte behind end and pass both. Acks must be for data the receiver sent, and not older
+	// than a window of ours.
+	if !seqBefore(s.seq, sender.maxEnd+1) ||
+		!seqAfter(end, sender.end-receiver.maxWin-1) ||
+		!seqBefore(ack, receiver.end+1) ||
+		!seqAfter(ack, receiver.end-maxAckWin-1) {
+		return false
+	}
+
+	if win > sender.maxWin {
+		sender.maxWin = win
+	}
+	if seqAfter(end, sender.end) {
+		sender.end = end
+	}
+	if s.flags&tcpACK != 0 {
+		maxEnd := ack + win
+		if win == 0 {
+			// Window probes may still be sent
+			maxEnd++
+		}
+		if seqAfter(maxEnd, receiver.maxEnd) {
+			receiver.maxEnd = maxEnd
+		}
+	}
+
+	return true
+}
+
+// seqBefore returns true if sequence number a comes before b, allowing for wrap around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// seqAfter returns true if sequence number a comes after b, allowing for wrap around
+func seqAfter(a, b uint32) bool {
+	return int32(b-a) < 0
+}
@@ -0,0 +1,211 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeqBeforeAfter(t *testing.T) {
+	assert.True(t, seqBefore(1, 2))
+	assert.False(t, seqBefore(2, 2))
+	assert.True(t, seqAfter(2, 1))
+	assert.False(t, seqAfter(2, 2))
+
+	// Across the wrap
+	assert.True(t, seqBefore(0xfffffff0, 0x10))
+	assert.True(t, seqAfter(0x10, 0xfffffff0))
+}
+
+func TestTCPWindowScale(t *testing.T) {
+	scale, ok := tcpWindowScale([]byte{2, 4, 0x05, 0xb4, 1, 3, 3, 7})
+	assert.True(t, ok)
+	assert.Equal(t, uint8(7), scale)
+
+	scale, ok = tcpWindowScale([]byte{3, 3, 20})
+	assert.True(t, ok)
+	assert.Equal(t, uint8(tcpMaxWindowScale), scale)
+
+	_, ok = tcpWindowScale([]byte{2, 4, 0x05, 0xb4})
+	assert.False(t, ok)
+	_, ok = tcpWindowScale([]byte{0, 3, 3, 7})
+	assert.False(t, ok)
+	_, ok = tcpWindowScale([]byte{3, 3})
+	assert.False(t, ok)
+	_, ok = tcpWindowScale([]byte{8, 0, 3, 3, 7})
+	assert.False(t, ok)
+}
+
+func TestTCPTimestamps(t *testing.T) {
+	// The options of a SYN from linux, mss, sack permitted, timestamps, nop and window scale
+	opts := []byte{2, 4, 0xff, 0xd7, 4, 2, 8, 10, 0x26, 0xa0, 0xc0, 0x1f, 0, 0, 0, 0, 1, 3, 3, 10}
+	tsVal, tsEcr, ok := tcpTimestamps(opts)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0x26a0c01f), tsVal)
+	assert.Equal(t, uint32(0), tsEcr)
+
+	// The window scale is still found past it
+	scale, ok := tcpWindowScale(opts)
+	assert.True(t, ok)
+	assert.Equal(t, uint8(10), scale)
+
+	// The options of later segments, nop nop timestamps
+	tsVal, tsEcr, ok = tcpTimestamps([]byte{1, 1, 8, 10, 0x26, 0xa0, 0xc0, 0x51, 0xeb, 0x27, 0xf0, 0x25})
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0x26a0c051), tsVal)
+	assert.Equal(t, uint32(0xeb27f025), tsEcr)
+
+	for name, opts := range map[string][]byte{
+		"nil":                nil,
+		"no timestamps":      {2, 4, 0x05, 0xb4, 1, 3, 3, 7},
+		"after end":          {0, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2},
+		"truncated":          {1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0},
+		"kind only":          {1, 1, 8},
+		"wrong length":       {8, 6, 0, 0, 0, 1},
+		"zero length":        {8, 0, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2},
+		"length past end":    {2, 20, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2},
+		"length one":         {3, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2},
+		"long length at end": {8, 255},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, ok := tcpTimestamps(opts)
+			assert.False(t, ok)
+		})
+	}
+
+	// Every length of options up to the most a tcp header holds, filled with every kind and length, must not read past
+	// the end
+	for n := 0; n <= 40; n++ {
+		for b := 0; b < 256; b++ {
+			opts := make([]byte, n)
+			for i := range opts {
+				opts[i] = byte(b)
+			}
+			if n > 0 {
+				opts[0] = tcpOptTimestamps
+			}
+
+			assert.NotPanics(t, func() {
+				tcpTimestamps(opts)
+			}, "length %d, fill %d", n, b)
+		}
+	}
+}
+
+func TestFirewall_TCPStrict(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"tcp_strict": true},
+		"inbound":   []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any"}},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	// segment builds a tcp segment of the flow between remote port sport and local port 22, inbound if incoming is set.
+	// A non zero wscale is sent as the window scale option.
+	segment := func(sport uint16, incoming bool, flags uint8, seq, ack uint32, win uint16, wscale uint8, data int) ([]byte, firewall.Packet) {
+		opts := []byte{}
+		if wscale != 0 {
+			opts = []byte{1, 3, 3, wscale}
+		}
+
+		b := make([]byte, 20+20+len(opts)+data)
+		copy(b, []byte{0x45, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, firewall.ProtoTCP, 0x00, 0x00, 1, 2, 3, 4, 1, 2, 3, 4})
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+
+		tcp := b[20:]
+		src, dst := sport, uint16(22)
+		if !incoming {
+			src, dst = dst, src
+		}
+		binary.BigEndian.PutUint16(tcp[0:2], src)
+		binary.BigEndian.PutUint16(tcp[2:4], dst)
+		binary.BigEndian.PutUint32(tcp[4:8], seq)
+		binary.BigEndian.PutUint32(tcp[8:12], ack)
+		tcp[12] = byte((20+len(opts))/4) << 4
+		tcp[13] = flags
+		binary.BigEndian.PutUint16(tcp[14:16], win)
+		copy(tcp[20:], opts)
+
+		fp := firewall.Packet{}
+		require.NoError(t, newPacket(b, incoming, &fp))
+		return b, fp
+	}
+	drop := func(b []byte, fp firewall.Packet, incoming bool) error {
+		return fw.Drop(b, fp, incoming, h, cp, nil)
+	}
+
+	// The handshake, the client asks for a window scale of 7 and so do we
+	b, fp := segment(1000, true, tcpSYN, 1000, 0, 65535, 7, 0)
+	require.NoError(t, drop(b, fp, true))
+	b, fp = segment(1000, false, tcpSYN|tcpACK, 5000, 1001, 65535, 7, 0)
+	require.NoError(t, drop(b, fp, false))
+	b, fp = segment(1000, true, tcpACK, 1001, 5001, 512, 0, 0)
+	require.NoError(t, drop(b, fp, true))
+
+	window := fw.Conntrack.shard(fp).Conns[fp].window
+	require.NotNil(t, window)
+	assert.Equal(t, uint8(7), window.initiator.scale)
+	assert.Equal(t, uint32(512<<7), window.initiator.maxWin)
+
+	// Data, its retransmission and a keepalive one byte back
+	b, fp = segment(1000, true, tcpACK|tcpPSH, 1001, 5001, 512, 0, 100)
+	assert.NoError(t, drop(b, fp, true))
+	assert.NoError(t, drop(b, fp, true))
+	b, fp = segment(1000, true, tcpACK, 1100, 5001, 512, 0, 0)
+	assert.NoError(t, drop(b, fp, true))
+
+	// Our reply acks it all
+	b, fp = segment(1000, false, tcpACK|tcpPSH, 5001, 1101, 512, 0, 200)
+	assert.NoError(t, drop(b, fp, false))
+
+	// Data far past the window we gave, acks for data we never sent, and a rst from nowhere are dropped
+	b, fp = segment(1000, true, tcpACK|tcpPSH, 1001+100000000, 5201, 512, 0, 10)
+	assert.Equal(t, ErrTCPOutOfWindow, drop(b, fp, true))
+	b, fp = segment(1000, true, tcpACK, 1101, 900000, 512, 0, 0)
+	assert.Equal(t, ErrTCPOutOfWindow, drop(b, fp, true))
+	b, fp = segment(1000, true, tcpRST, 3000000000, 0, 0, 0, 0)
+	assert.Equal(t, ErrTCPOutOfWindow, drop(b, fp, true))
+	assert.Equal(t, int64(3), fw.metricTCPOutOfWindow.Count())
+	assert.Equal(t, tcpStateEstablished, fw.Conntrack.shard(fp).Conns[fp].tcpState, "dropped packets do not move the state")
+
+	// Data up to the scaled window is fine
+	b, fp = segment(1000, true, tcpACK|tcpPSH, 1101+512<<7-10, 5201, 512, 0, 10)
+	assert.NoError(t, drop(b, fp, true))
+
+	// A SYN-ACK that does not ack the SYN is dropped
+	b, fp = segment(1001, true, tcpSYN, 1000, 0, 65535, 0, 0)
+	require.NoError(t, drop(b, fp, true))
+	b, fp = segment(1001, false, tcpSYN|tcpACK, 5000, 77, 65535, 0, 0)
+	assert.Equal(t, ErrTCPOutOfWindow, drop(b, fp, false))
+
+	// A flow picked up mid stream is not checked
+	b, fp = segment(1002, true, tcpACK, 1000, 5000, 512, 0, 0)
+	require.NoError(t, drop(b, fp, true))
+	assert.Nil(t, fw.Conntrack.shard(fp).Conns[fp].window)
+	b, fp = segment(1002, true, tcpACK, 1000+100000000, 5000, 512, 0, 10)
+	assert.NoError(t, drop(b, fp, true))
+
+	// Off by default
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any"}},
+	}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	b, fp = segment(1000, true, tcpSYN, 1000, 0, 65535, 7, 0)
+	require.NoError(t, drop(b, fp, true))
+	assert.Nil(t, fw.Conntrack.shard(fp).Conns[fp].window)
+}
@@ -3,9 +3,17 @@ package nebula
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"math"
 	"net"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,18 +24,21 @@ import (
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
 )
 
 func TestNewFirewall(t *testing.T) {
 	l := test.NewLogger()
 	c := &cert.NebulaCertificate{}
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c)
-	conntrack := fw.Conntrack
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Len(t, fw.Conntrack.shards, 1)
+	conntrack := fw.Conntrack.shards[0]
 	assert.NotNil(t, conntrack)
 	assert.NotNil(t, conntrack.Conns)
 	assert.NotNil(t, conntrack.TimerWheel)
-	assert.NotNil(t, fw.InRules)
-	assert.NotNil(t, fw.OutRules)
+	assert.NotNil(t, fw.InRules())
+	assert.NotNil(t, fw.OutRules())
 	assert.Equal(t, time.Second, fw.TCPTimeout)
 	assert.Equal(t, time.Minute, fw.UDPTimeout)
 	assert.Equal(t, time.Hour, fw.DefaultTimeout)
@@ -36,114 +47,196 @@ func TestNewFirewall(t *testing.T) {
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Second, time.Hour, time.Minute, c)
+	fw = NewFirewall(l, time.Second, time.Hour, time.Minute, c, nil)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Hour, time.Second, time.Minute, c)
+	fw = NewFirewall(l, time.Hour, time.Second, time.Minute, c, nil)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Hour, time.Minute, time.Second, c)
+	fw = NewFirewall(l, time.Hour, time.Minute, time.Second, c, nil)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Minute, time.Hour, time.Second, c)
+	fw = NewFirewall(l, time.Minute, time.Hour, time.Second, c, nil)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Minute, time.Second, time.Hour, c)
+	fw = NewFirewall(l, time.Minute, time.Second, time.Hour, c, nil)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 }
 
+func TestNewFirewall_MetricsRegistry(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+
+	r1 := metrics.NewRegistry()
+	r2 := metrics.NewRegistry()
+	fw1 := NewFirewall(l, time.Second, time.Minute, time.Hour, c, r1)
+	fw2 := NewFirewall(l, time.Second, time.Minute, time.Hour, c, r2)
+
+	fw1.addConn([]byte{}, firewall.Packet{LocalPort: 1}, true, RuleOptions{})
+	fw1.FlushConntrack()
+	assert.Equal(t, int64(1), fw1.metricConntrackFlushed.Count())
+	assert.Equal(t, int64(0), fw2.metricConntrackFlushed.Count())
+	assert.Same(t, fw1.metricConntrackFlushed, r1.Get("firewall.conntrack.flushed"))
+	assert.NotSame(t, fw1.metricConntrackFlushed, metrics.DefaultRegistry.Get("firewall.conntrack.flushed"))
+
+	// EmitStats should use the same registry
+	fw2.addConn([]byte{}, firewall.Packet{LocalPort: 1}, true, RuleOptions{})
+	fw2.EmitStats()
+	assert.Equal(t, int64(1), r2.Get("firewall.conntrack.count").(metrics.Gauge).Value())
+	assert.Nil(t, r1.Get("firewall.conntrack.count"))
+
+	// nil uses the global registry
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Same(t, fw.metricConntrackFlushed, metrics.DefaultRegistry.Get("firewall.conntrack.flushed"))
+}
+
 func TestFirewall_AddRule(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
 	l.SetOutput(ob)
 
 	c := &cert.NebulaCertificate{}
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c)
-	assert.NotNil(t, fw.InRules)
-	assert.NotNil(t, fw.OutRules)
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.NotNil(t, fw.InRules())
+	assert.NotNil(t, fw.OutRules())
 
 	_, ti, _ := net.ParseCIDR("1.2.3.4/32")
 
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoTCP, 1, 1, []string{}, "", nil, nil, "", ""))
 	// An empty rule is any
-	assert.True(t, fw.InRules.TCP[1].Any.Any)
-	assert.Empty(t, fw.InRules.TCP[1].Any.Groups)
-	assert.Empty(t, fw.InRules.TCP[1].Any.Hosts)
+	assert.True(t, fw.InRules().TCP[1].Any.Any)
+	assert.Empty(t, fw.InRules().TCP[1].Any.Groups)
+	assert.Empty(t, fw.InRules().TCP[1].Any.Hosts)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 1, 1, []string{"g1"}, "", nil, nil, "", ""))
-	assert.False(t, fw.InRules.UDP[1].Any.Any)
-	assert.Contains(t, fw.InRules.UDP[1].Any.Groups[0], "g1")
-	assert.Empty(t, fw.InRules.UDP[1].Any.Hosts)
+	assert.False(t, fw.InRules().UDP[1].Any.Any)
+	assert.Contains(t, fw.InRules().UDP[1].Any.Groups[0], "g1")
+	assert.Empty(t, fw.InRules().UDP[1].Any.Hosts)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoICMP, 1, 1, []string{}, "h1", nil, nil, "", ""))
-	assert.False(t, fw.InRules.ICMP[1].Any.Any)
-	assert.Empty(t, fw.InRules.ICMP[1].Any.Groups)
-	assert.Contains(t, fw.InRules.ICMP[1].Any.Hosts, "h1")
+	assert.False(t, fw.InRules().ICMP[1].Any.Any)
+	assert.Empty(t, fw.InRules().ICMP[1].Any.Groups)
+	assert.Contains(t, fw.InRules().ICMP[1].Any.Hosts, "h1")
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 1, 1, []string{}, "", ti, nil, "", ""))
-	assert.False(t, fw.OutRules.AnyProto[1].Any.Any)
-	assert.Empty(t, fw.OutRules.AnyProto[1].Any.Groups)
-	assert.Empty(t, fw.OutRules.AnyProto[1].Any.Hosts)
-	ok, _ := fw.OutRules.AnyProto[1].Any.CIDR.Match(iputil.Ip2VpnIp(ti.IP))
+	assert.False(t, fw.OutRules().AnyProto[1].Any.Any)
+	assert.Empty(t, fw.OutRules().AnyProto[1].Any.Groups)
+	assert.Empty(t, fw.OutRules().AnyProto[1].Any.Hosts)
+	ok, _ := fw.OutRules().AnyProto[1].Any.CIDR.Match(iputil.Ip2VpnIp(ti.IP))
 	assert.True(t, ok)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 1, 1, []string{}, "", nil, ti, "", ""))
-	assert.False(t, fw.OutRules.AnyProto[1].Any.Any)
-	assert.Empty(t, fw.OutRules.AnyProto[1].Any.Groups)
-	assert.Empty(t, fw.OutRules.AnyProto[1].Any.Hosts)
-	ok, _ = fw.OutRules.AnyProto[1].Any.LocalCIDR.Match(iputil.Ip2VpnIp(ti.IP))
+	assert.False(t, fw.OutRules().AnyProto[1].Any.Any)
+	assert.Empty(t, fw.OutRules().AnyProto[1].Any.Groups)
+	assert.Empty(t, fw.OutRules().AnyProto[1].Any.Hosts)
+	ok, _ = fw.OutRules().AnyProto[1].Any.LocalCIDR.Match(iputil.Ip2VpnIp(ti.IP))
 	assert.True(t, ok)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 1, 1, []string{"g1"}, "", nil, nil, "ca-name", ""))
-	assert.Contains(t, fw.InRules.UDP[1].CANames, "ca-name")
+	assert.Contains(t, fw.InRules().UDP[1].CANames, "ca-name")
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 1, 1, []string{"g1"}, "", nil, nil, "", "ca-sha"))
-	assert.Contains(t, fw.InRules.UDP[1].CAShas, "ca-sha")
+	assert.Contains(t, fw.InRules().UDP[1].CAShas, "ca-sha")
 
 	// Set any and clear fields
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{"g1", "g2"}, "h1", ti, ti, "", ""))
-	assert.Equal(t, []string{"g1", "g2"}, fw.OutRules.AnyProto[0].Any.Groups[0])
-	assert.Contains(t, fw.OutRules.AnyProto[0].Any.Hosts, "h1")
-	ok, _ = fw.OutRules.AnyProto[0].Any.CIDR.Match(iputil.Ip2VpnIp(ti.IP))
+	assert.Equal(t, []string{"g1", "g2"}, fw.OutRules().AnyProto[0].Any.Groups[0])
+	assert.Contains(t, fw.OutRules().AnyProto[0].Any.Hosts, "h1")
+	ok, _ = fw.OutRules().AnyProto[0].Any.CIDR.Match(iputil.Ip2VpnIp(ti.IP))
 	assert.True(t, ok)
-	ok, _ = fw.OutRules.AnyProto[0].Any.LocalCIDR.Match(iputil.Ip2VpnIp(ti.IP))
+	ok, _ = fw.OutRules().AnyProto[0].Any.LocalCIDR.Match(iputil.Ip2VpnIp(ti.IP))
 	assert.True(t, ok)
 
 	// run twice just to make sure
 	//TODO: these ANY rules should clear the CA firewall portion
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
-	assert.True(t, fw.OutRules.AnyProto[0].Any.Any)
-	assert.Empty(t, fw.OutRules.AnyProto[0].Any.Groups)
-	assert.Empty(t, fw.OutRules.AnyProto[0].Any.Hosts)
+	assert.True(t, fw.OutRules().AnyProto[0].Any.Any)
+	assert.Empty(t, fw.OutRules().AnyProto[0].Any.Groups)
+	assert.Empty(t, fw.OutRules().AnyProto[0].Any.Hosts)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
-	assert.True(t, fw.OutRules.AnyProto[0].Any.Any)
+	assert.True(t, fw.OutRules().AnyProto[0].Any.Any)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	_, anyIp, _ := net.ParseCIDR("0.0.0.0/0")
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "", anyIp, nil, "", ""))
-	assert.True(t, fw.OutRules.AnyProto[0].Any.Any)
+	assert.True(t, fw.OutRules().AnyProto[0].Any.Any)
 
 	// Test error conditions
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Error(t, fw.AddRule(true, math.MaxUint8, 0, 0, []string{}, "", nil, nil, "", ""))
 	assert.Error(t, fw.AddRule(true, firewall.ProtoAny, 10, 0, []string{}, "", nil, nil, "", ""))
 }
 
+func TestFirewall_AddRulePrefix(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+
+	// A rule added with prefixes is the same rule as one added with the equivalent cidrs
+	_, ti, _ := net.ParseCIDR("1.2.3.0/24")
+	fw1 := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	require.NoError(t, fw1.AddRule(true, firewall.ProtoTCP, 1, 1, []string{}, "", ti, ti, "", ""))
+	fw2 := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	tp := netip.MustParsePrefix("1.2.3.0/24")
+	require.NoError(t, fw2.AddRulePrefix(true, firewall.ProtoTCP, 1, 1, []string{}, "", tp, tp, "", "", RuleOptions{}))
+	assert.Equal(t, fw1.GetRuleHashes(), fw2.GetRuleHashes())
+	assert.Equal(t, fw1.InRules().String(), fw2.InRules().String())
+
+	ok, _ := fw2.InRules().TCP[1].Any.CIDR.ContainsAddr(netip.MustParseAddr("1.2.3.4"))
+	assert.True(t, ok)
+	ok, _ = fw2.InRules().TCP[1].Any.LocalCIDR.ContainsAddr(netip.MustParseAddr("1.2.4.4"))
+	assert.False(t, ok)
+
+	// The zero Prefix is no cidr, a prefix holding 0.0.0.0 is any
+	require.NoError(t, fw2.AddRulePrefix(true, firewall.ProtoTCP, 2, 2, []string{"g1"}, "", netip.Prefix{}, netip.Prefix{}, "", "", RuleOptions{}))
+	assert.False(t, fw2.InRules().TCP[2].Any.Any)
+	require.NoError(t, fw2.AddRulePrefix(true, firewall.ProtoTCP, 3, 3, []string{}, "", netip.MustParsePrefix("0.0.0.0/0"), netip.Prefix{}, "", "", RuleOptions{}))
+	assert.True(t, fw2.InRules().TCP[3].Any.Any)
+}
+
+func BenchmarkFirewall_AddRule(b *testing.B) {
+	l := test.NewLogger()
+	l.SetOutput(io.Discard)
+	c := &cert.NebulaCertificate{}
+	_, ti, _ := net.ParseCIDR("1.2.3.0/24")
+	tp := netip.MustParsePrefix("1.2.3.0/24")
+
+	// The same rule is added over and over, the rule string for the hashes is cleared so it doesn't grow
+	b.Run("net", func(b *testing.B) {
+		fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			fw.rules = ""
+			_ = fw.AddRuleWithOptions(true, firewall.ProtoTCP, 1, 1, nil, "", ti, ti, "", "", RuleOptions{})
+		}
+	})
+
+	b.Run("netip", func(b *testing.B) {
+		fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			fw.rules = ""
+			_ = fw.AddRulePrefix(true, firewall.ProtoTCP, 1, 1, nil, "", tp, tp, "", "", RuleOptions{})
+		}
+	})
+}
+
 func TestFirewall_Drop(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
@@ -158,71 +251,95 @@ func TestFirewall_Drop(t *testing.T) {
 		Fragment:   false,
 	}
 
-	ipNet := net.IPNet{
-		IP:   net.IPv4(1, 2, 3, 4),
-		Mask: net.IPMask{255, 255, 255, 0},
-	}
-
-	c := cert.NebulaCertificate{
-		Details: cert.NebulaCertificateDetails{
-			Name:           "host1",
-			Ips:            []*net.IPNet{&ipNet},
-			Groups:         []string{"default-group"},
-			InvertedGroups: map[string]struct{}{"default-group": {}},
-			Issuer:         "signer-shasum",
-		},
-	}
-	h := HostInfo{
-		ConnectionState: &ConnectionState{
-			peerCert: &c,
-		},
-		vpnIp: iputil.Ip2VpnIp(ipNet.IP),
-	}
-	h.CreateRemoteCIDR(&c)
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		Groups:         []string{"default-group"},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+		Issuer:         "signer-shasum",
+	})
 
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
 	cp := cert.NewCAPool()
 
 	// Drop outbound
-	assert.Equal(t, fw.Drop([]byte{}, p, false, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop([]byte{}, p, false, h, cp, nil), ErrNoMatchingRule)
 	// Allow inbound
 	resetConntrack(fw)
-	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
 	// Allow outbound because conntrack
-	assert.NoError(t, fw.Drop([]byte{}, p, false, &h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
 
 	// test remote mismatch
 	oldRemote := p.RemoteIP
 	p.RemoteIP = iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 10))
-	assert.Equal(t, fw.Drop([]byte{}, p, false, &h, cp, nil), ErrInvalidRemoteIP)
+	assert.Equal(t, fw.Drop([]byte{}, p, false, h, cp, nil), ErrInvalidRemoteIP)
 	p.RemoteIP = oldRemote
 
 	// ensure signer doesn't get in the way of group checks
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "", "signer-shasum"))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "", "signer-shasum-bad"))
-	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, nil), ErrNoMatchingRule)
 
 	// test caSha doesn't drop on match
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "", "signer-shasum-bad"))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "", "signer-shasum"))
-	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
 
 	// ensure ca name doesn't get in the way of group checks
 	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "ca-good", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "ca-good-bad", ""))
-	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, nil), ErrNoMatchingRule)
 
 	// test caName doesn't drop on match
 	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "ca-good-bad", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "ca-good", ""))
-	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+}
+
+func TestFirewall_DropAllowedMetrics(t *testing.T) {
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		InvertedGroups: map[string]struct{}{},
+	})
+
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	// The first packet is allowed by the rules, the rest of the flow and its replies by conntrack
+	require.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	require.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	require.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
+	assert.Equal(t, int64(1), fw.metricAllowedRule.Count())
+	assert.Equal(t, int64(2), fw.metricAllowedConntrack.Count())
+
+	// Denied packets count as neither
+	p.RemotePort = 91
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, false, h, cp, nil))
+	assert.Equal(t, int64(1), fw.metricAllowedRule.Count())
+	assert.Equal(t, int64(2), fw.metricAllowedConntrack.Count())
+
+	// Without conntrack every packet is allowed by the rules
+	fw.conntrackDisabled = true
+	require.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	require.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Equal(t, int64(3), fw.metricAllowedRule.Count())
+	assert.Equal(t, int64(2), fw.metricAllowedConntrack.Count())
 }
 
 func BenchmarkFirewallTable_match(b *testing.B) {
@@ -230,7 +347,7 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 		TCP: firewallPort{},
 	}
 
-	_, n, _ := net.ParseCIDR("172.1.1.1/32")
+	n := netip.MustParsePrefix("172.1.1.1/32")
 	_ = ft.TCP.addRule(10, 10, []string{"good-group"}, "good-host", n, n, "", "")
 	_ = ft.TCP.addRule(10, 10, []string{"good-group2"}, "good-host", n, n, "", "")
 	_ = ft.TCP.addRule(10, 10, []string{"good-group3"}, "good-host", n, n, "", "")
@@ -239,20 +356,23 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 	cp := cert.NewCAPool()
 
 	b.Run("fail on proto", func(b *testing.B) {
+		b.ReportAllocs()
 		c := &cert.NebulaCertificate{}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoUDP}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoUDP}, packetInfo{}, true, c, cp)
 		}
 	})
 
 	b.Run("fail on port", func(b *testing.B) {
+		b.ReportAllocs()
 		c := &cert.NebulaCertificate{}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 1}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 1}, packetInfo{}, true, c, cp)
 		}
 	})
 
 	b.Run("fail all group, name, and cidr", func(b *testing.B) {
+		b.ReportAllocs()
 		_, ip, _ := net.ParseCIDR("9.254.254.254/32")
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
@@ -262,11 +382,12 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10}, packetInfo{}, true, c, cp)
 		}
 	})
 
 	b.Run("pass on group", func(b *testing.B) {
+		b.ReportAllocs()
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
 				InvertedGroups: map[string]struct{}{"good-group": {}},
@@ -274,11 +395,12 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10}, packetInfo{}, true, c, cp)
 		}
 	})
 
 	b.Run("pass on name", func(b *testing.B) {
+		b.ReportAllocs()
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
 				InvertedGroups: map[string]struct{}{"nope": {}},
@@ -286,11 +408,12 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10}, packetInfo{}, true, c, cp)
 		}
 	})
 
 	b.Run("pass on ip", func(b *testing.B) {
+		b.ReportAllocs()
 		ip := iputil.Ip2VpnIp(net.IPv4(172, 1, 1, 1))
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
@@ -299,11 +422,12 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10, RemoteIP: ip}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10, RemoteIP: ip}, packetInfo{}, true, c, cp)
 		}
 	})
 
 	b.Run("pass on local ip", func(b *testing.B) {
+		b.ReportAllocs()
 		ip := iputil.Ip2VpnIp(net.IPv4(172, 1, 1, 1))
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
@@ -312,13 +436,14 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10, LocalIP: ip}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 10, LocalIP: ip}, packetInfo{}, true, c, cp)
 		}
 	})
 
 	_ = ft.TCP.addRule(0, 0, []string{"good-group"}, "good-host", n, n, "", "")
 
 	b.Run("pass on ip with any port", func(b *testing.B) {
+		b.ReportAllocs()
 		ip := iputil.Ip2VpnIp(net.IPv4(172, 1, 1, 1))
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
@@ -327,11 +452,12 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 100, RemoteIP: ip}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 100, RemoteIP: ip}, packetInfo{}, true, c, cp)
 		}
 	})
 
 	b.Run("pass on local ip with any port", func(b *testing.B) {
+		b.ReportAllocs()
 		ip := iputil.Ip2VpnIp(net.IPv4(172, 1, 1, 1))
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
@@ -340,11 +466,233 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 100, LocalIP: ip}, true, c, cp)
+			ft.match(firewall.Packet{Protocol: firewall.ProtoTCP, LocalPort: 100, LocalIP: ip}, packetInfo{}, true, c, cp)
+		}
+	})
+}
+
+func BenchmarkFirewall_Drop(b *testing.B) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	})
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoTCP,
+	}
+	packet := make([]byte, 100)
+	cp := cert.NewCAPool()
+
+	newFw := func() *Firewall {
+		fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, c, metrics.NewRegistry())
+		_ = fw.AddRule(true, firewall.ProtoTCP, 10, 10, []string{"default-group"}, "", nil, nil, "", "")
+		return fw
+	}
+
+	b.Run("pass on local cache", func(b *testing.B) {
+		fw := newFw()
+		cache := firewall.NewConntrackCache()
+		_ = fw.Drop(packet, p, true, h, cp, cache)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			_ = fw.Drop(packet, p, true, h, cp, cache)
+		}
+	})
+
+	b.Run("pass on conntrack", func(b *testing.B) {
+		fw := newFw()
+		_ = fw.Drop(packet, p, true, h, cp, nil)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			_ = fw.Drop(packet, p, true, h, cp, nil)
+		}
+	})
+
+	for _, budget := range []int{1, defaultPurgeBudget, 64} {
+		b.Run(fmt.Sprintf("pass on conntrack with expired backlog and purge budget %d", budget), func(b *testing.B) {
+			fw := newFw()
+			fw.purgeBudget = budget
+			_ = fw.Drop(packet, p, true, h, cp, nil)
+			conntrack := fw.Conntrack.shard(p)
+			tw := conntrack.TimerWheel
+
+			// Keep enough expired entries waiting that every packet purges its whole budget
+			refill := func() {
+				for i := 0; i < 1024; i++ {
+					fp := firewall.Packet{LocalPort: uint16(i + 1), RemotePort: 1, Protocol: firewall.ProtoUDP}
+					fw.addConn(packet, fp, true, RuleOptions{})
+					conntrack.Conns[fp].Expires = time.Time{}
+				}
+				tw.lastTick = tw.lastTick.Add(-tw.wheelDuration - tw.tickDuration)
+				tw.Advance(time.Now())
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if tw.Expired() < budget {
+					b.StopTimer()
+					refill()
+					b.StartTimer()
+				}
+				_ = fw.Drop(packet, p, true, h, cp, nil)
+			}
+		})
+	}
+
+	b.Run("pass on rule", func(b *testing.B) {
+		fw := newFw()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			// Keep conntrack empty so every packet goes through the rules
+			fw.Conntrack.shard(p).remove(p)
+			_ = fw.Drop(packet, p, true, h, cp, nil)
+		}
+	})
+
+	b.Run("pass on rule without conntrack", func(b *testing.B) {
+		fw := newFw()
+		fw.conntrackDisabled = true
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			_ = fw.Drop(packet, p, true, h, cp, nil)
+		}
+	})
+
+	// A rule with an underlay cidr, matched against the underlay given as a net.IP and as a netip.Addr
+	underlayCIDR := netip.MustParsePrefix("10.0.0.0/8")
+	newUnderlayFw := func() *Firewall {
+		fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, c, metrics.NewRegistry())
+		_ = fw.AddRuleWithOptions(true, firewall.ProtoTCP, 10, 10, []string{"default-group"}, "", nil, nil, "", "", RuleOptions{UnderlayCIDR: underlayCIDR})
+		fw.conntrackDisabled = true
+		return fw
+	}
+
+	b.Run("pass on underlay rule from net.IP", func(b *testing.B) {
+		fw := newUnderlayFw()
+		underlay := net.IPv4(10, 1, 1, 1)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			_ = fw.DropFromUnderlay(packet, p, true, h, cp, nil, underlay)
+		}
+	})
+
+	b.Run("pass on underlay rule from netip.Addr", func(b *testing.B) {
+		fw := newUnderlayFw()
+		underlay := netip.MustParseAddr("10.1.1.1")
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			_ = fw.DropFromUnderlayAddr(packet, p, true, h, cp, nil, underlay)
+		}
+	})
+
+	b.Run("pass on revalidation", func(b *testing.B) {
+		fw := newFw()
+		_ = fw.Drop(packet, p, true, h, cp, nil)
+		c := fw.Conntrack.conns()[p]
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			// Pretend a reload happened before every packet
+			c.rulesVersion = fw.rulesVersion() - 1
+			_ = fw.Drop(packet, p, true, h, cp, nil)
+		}
+	})
+
+	b.Run("fail on rule", func(b *testing.B) {
+		fw := newFw()
+		fp := p
+		fp.LocalPort = 11
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			_ = fw.Drop(packet, fp, true, h, cp, nil)
+		}
+	})
+
+	b.Run("fail on remote ip", func(b *testing.B) {
+		fw := newFw()
+		fp := p
+		fp.RemoteIP = iputil.Ip2VpnIp(net.IPv4(9, 9, 9, 9))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			_ = fw.Drop(packet, fp, true, h, cp, nil)
 		}
 	})
 }
 
+func BenchmarkFirewall_DropParallel(b *testing.B) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	})
+
+	packet := make([]byte, 100)
+	cp := cert.NewCAPool()
+
+	b.Run("pass on rule without conntrack", func(b *testing.B) {
+		fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, c, metrics.NewRegistry())
+		fw.conntrackDisabled = true
+		_ = fw.AddRule(true, firewall.ProtoTCP, 10, 10, []string{"default-group"}, "", nil, nil, "", "")
+
+		var next uint32
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			p := firewall.Packet{
+				LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+				RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+				LocalPort:  10,
+				RemotePort: uint16(atomic.AddUint32(&next, 1)),
+				Protocol:   firewall.ProtoTCP,
+			}
+			for pb.Next() {
+				_ = fw.Drop(packet, p, true, h, cp, nil)
+			}
+		})
+	})
+
+	for _, shards := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprintf("pass on conntrack with %d shards", shards), func(b *testing.B) {
+			fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, c, metrics.NewRegistry())
+			fw.Conntrack = newFirewallConntrack(shards, time.Second, time.Minute)
+			_ = fw.AddRule(true, firewall.ProtoTCP, 10, 10, []string{"default-group"}, "", nil, nil, "", "")
+
+			var next uint32
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Every routine has its own flow, like routines reading from different tun queues
+				p := firewall.Packet{
+					LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+					RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+					LocalPort:  10,
+					RemotePort: uint16(atomic.AddUint32(&next, 1)),
+					Protocol:   firewall.ProtoTCP,
+				}
+				for pb.Next() {
+					_ = fw.Drop(packet, p, true, h, cp, nil)
+				}
+			})
+		})
+	}
+}
+
 func TestFirewall_Drop2(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
@@ -364,47 +712,1374 @@ func TestFirewall_Drop2(t *testing.T) {
 		Mask: net.IPMask{255, 255, 255, 0},
 	}
 
-	c := cert.NebulaCertificate{
-		Details: cert.NebulaCertificateDetails{
-			Name:           "host1",
-			Ips:            []*net.IPNet{&ipNet},
-			InvertedGroups: map[string]struct{}{"default-group": {}, "test-group": {}},
-		},
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		Ips:            []*net.IPNet{&ipNet},
+		InvertedGroups: map[string]struct{}{"default-group": {}, "test-group": {}},
+	})
+
+	h1, _ := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		Ips:            []*net.IPNet{&ipNet},
+		InvertedGroups: map[string]struct{}{"default-group": {}, "test-group-not": {}},
+	})
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group", "test-group"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	// h1/c1 lacks the proper groups
+	assert.Error(t, fw.Drop([]byte{}, p, true, h1, cp, nil), ErrNoMatchingRule)
+	// c has the proper groups
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+}
+
+func TestFirewall_Drop3(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  1,
+		RemotePort: 1,
+		Protocol:   firewall.ProtoUDP,
+		Fragment:   false,
 	}
-	h := HostInfo{
-		ConnectionState: &ConnectionState{
-			peerCert: &c,
-		},
-		vpnIp: iputil.Ip2VpnIp(ipNet.IP),
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
 	}
-	h.CreateRemoteCIDR(&c)
 
-	c1 := cert.NebulaCertificate{
+	c := cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Name:           "host1",
-			Ips:            []*net.IPNet{&ipNet},
-			InvertedGroups: map[string]struct{}{"default-group": {}, "test-group-not": {}},
+			Name: "host-owner",
+			Ips:  []*net.IPNet{&ipNet},
 		},
 	}
-	h1 := HostInfo{
-		ConnectionState: &ConnectionState{
-			peerCert: &c1,
-		},
+
+	h1, _ := newTestHost(cert.NebulaCertificateDetails{
+		Name:   "host1",
+		Ips:    []*net.IPNet{&ipNet},
+		Issuer: "signer-sha-bad",
+	})
+
+	h2, _ := newTestHost(cert.NebulaCertificateDetails{
+		Name:   "host2",
+		Ips:    []*net.IPNet{&ipNet},
+		Issuer: "signer-sha",
+	})
+
+	h3, _ := newTestHost(cert.NebulaCertificateDetails{
+		Name:   "host3",
+		Ips:    []*net.IPNet{&ipNet},
+		Issuer: "signer-sha-bad",
+	})
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 1, 1, []string{}, "host1", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 1, 1, []string{}, "", nil, nil, "", "signer-sha"))
+	cp := cert.NewCAPool()
+
+	// c1 should pass because host match
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h1, cp, nil))
+	// c2 should pass because ca sha match
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h2, cp, nil))
+	// c3 should fail because no match
+	resetConntrack(fw)
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h3, cp, nil), ErrNoMatchingRule)
+}
+
+func TestFirewall_DropConntrackReload(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+		Fragment:   false,
 	}
-	h1.CreateRemoteCIDR(&c1)
 
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
-	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group", "test-group"}, "", nil, nil, "", ""))
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		Groups:         []string{"default-group"},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+		Issuer:         "signer-shasum",
+	})
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	// Drop outbound
+	assert.Equal(t, fw.Drop([]byte{}, p, false, h, cp, nil), ErrNoMatchingRule)
+	// Allow inbound
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	// Allow outbound because conntrack
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
+
+	oldFw := fw
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 10, 10, []string{"any"}, "", nil, nil, "", ""))
+	fw.Conntrack = oldFw.Conntrack
+	setRulesVersion(fw, oldFw.rulesVersion()+1)
+
+	// Allow outbound because conntrack and new rules allow port 10
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
+
+	oldFw = fw
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 11, 11, []string{"any"}, "", nil, nil, "", ""))
+	fw.Conntrack = oldFw.Conntrack
+	setRulesVersion(fw, oldFw.rulesVersion()+1)
+
+	// Drop outbound because conntrack doesn't match new ruleset
+	assert.Equal(t, fw.Drop([]byte{}, p, false, h, cp, nil), ErrNoMatchingRule)
+}
+
+func TestFirewall_InheritConntrack(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	oldFw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, oldFw.AddRule(false, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
 	cp := cert.NewCAPool()
 
-	// h1/c1 lacks the proper groups
-	assert.Error(t, fw.Drop([]byte{}, p, true, &h1, cp, nil), ErrNoMatchingRule)
-	// c has the proper groups
-	resetConntrack(fw)
-	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	// An outbound flow is established before the reload
+	assert.NoError(t, oldFw.Drop([]byte{}, p, false, h, cp, nil))
+
+	// Keep using the old firewall while the new one takes over, like a routine that hasn't noticed the swap yet
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fp := p
+		for i := 0; i < 100; i++ {
+			fp.RemotePort = uint16(1000 + i)
+			oldFw.Drop([]byte{}, fp, false, h, cp, nil)
+		}
+	}()
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	fw.InheritConntrack(oldFw)
+	<-done
+
+	assert.Equal(t, oldFw.rulesVersion()+1, fw.rulesVersion())
+	assert.Same(t, oldFw.Conntrack, fw.Conntrack)
+	assert.Len(t, fw.Conntrack.conns(), 101)
+
+	// The return traffic is still allowed without an inbound rule, the entry is revalidated against the new rules
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.Equal(t, fw.rulesVersion(), fw.Conntrack.conns()[p].rulesVersion)
+
+	// A wrapped rulesVersion starts over with an empty conntrack
+	oldFw = fw
+	setRulesVersion(oldFw, math.MaxUint16)
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	fw.InheritConntrack(oldFw)
+	assert.Equal(t, uint16(0), fw.rulesVersion())
+	assert.NotSame(t, oldFw.Conntrack, fw.Conntrack)
+	assert.Empty(t, fw.Conntrack.conns())
+}
+
+func TestFirewall_DropLocalCacheReload(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+		Fragment:   false,
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	})
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 10, 10, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+	cache := firewall.NewConntrackCache()
+
+	// Allow inbound, the flow is cached once it has seen a reply
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, cache))
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, cache))
+	assert.Contains(t, cache.Entries, p)
+	assert.Equal(t, fw.rulesVersion(), cache.Entries[p])
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, cache))
+
+	// Install rules that no longer allow the flow, the cached entry must not be trusted
+	oldFw := fw
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 11, 11, []string{"any"}, "", nil, nil, "", ""))
+	fw.Conntrack = oldFw.Conntrack
+	setRulesVersion(fw, oldFw.rulesVersion()+1)
+
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, cache), ErrNoMatchingRule)
+
+	// Rules replaced in place bump the rulesVersion as well, the stream is cached again once allowed
+	fw.RestoreRules(oldFw.SnapshotRules())
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, cache))
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, cache))
+	assert.Contains(t, cache.Entries, p)
+	assert.Equal(t, fw.rulesVersion(), cache.Entries[p])
+
+	// And stops with the first packet after a reload that forbids it, without waiting for the cache to be reset
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "11", "proto": "any", "group": "any"}},
+	}
+	assert.NoError(t, fw.Reload(conf))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, cache), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, cache), ErrNoMatchingRule)
+}
+
+func TestFirewall_DropRevalidateBudget(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	p1 := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	p2 := p1
+	p2.RemotePort = 91
+
+	fw := NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 10, 10, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+	assert.NoError(t, fw.Drop([]byte{}, p1, true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p2, true, h, cp, nil))
+
+	// Install rules that no longer allow either flow with a budget of one revalidation per tick
+	oldFw := fw
+	fw = NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 11, 11, []string{"any"}, "", nil, nil, "", ""))
+	fw.Conntrack = oldFw.Conntrack
+	setRulesVersion(fw, oldFw.rulesVersion()+1)
+	fw.revalidateBudget = 1
+
+	// The first flow uses up the budget and is dropped, the second passes under the old rules for now
+	cache := firewall.NewConntrackCache()
+	assert.Equal(t, fw.Drop([]byte{}, p1, true, h, cp, cache), ErrNoMatchingRule)
+	assert.NoError(t, fw.Drop([]byte{}, p2, true, h, cp, cache))
+	assert.Empty(t, cache.Entries)
+
+	// Dropping instead of passing
+	fw.revalidateOverflowDrop = true
+	assert.Equal(t, fw.Drop([]byte{}, p2, true, h, cp, nil), ErrRevalidationDeferred)
+
+	// The next tick refills the budget
+	fw.Conntrack.shards[0].revalidateRefill = time.Time{}
+	assert.Equal(t, fw.Drop([]byte{}, p2, true, h, cp, nil), ErrNoMatchingRule)
+}
+
+func TestFirewall_DropForwarded(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	// Traffic from the peer that we forward on to a network behind us
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(10, 2, 1, 1)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "any", "local_cidr": "10.2.0.0/16"}},
+	}
+
+	// The forwarded destination is not ours
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, nil), ErrInvalidLocalIP)
+
+	// Now we handle the routed networks, local_cidr decides what can be reached
+	conf.Settings["firewall"].(map[interface{}]interface{})["extra_local_cidrs"] = []interface{}{"10.2.0.0/16", "10.3.0.0/16"}
+	fw, err = NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+
+	p.LocalIP = iputil.Ip2VpnIp(net.IPv4(10, 3, 1, 1))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, nil), ErrNoMatchingRule)
+
+	p.LocalIP = iputil.Ip2VpnIp(net.IPv4(10, 4, 1, 1))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, nil), ErrInvalidLocalIP)
+
+	// The peer still can't use addresses outside of its certificate
+	p.LocalIP = iputil.Ip2VpnIp(net.IPv4(10, 2, 1, 1))
+	p.RemoteIP = iputil.Ip2VpnIp(net.IPv4(10, 2, 1, 2))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, h, cp, nil), ErrInvalidRemoteIP)
+
+	conf.Settings["firewall"].(map[interface{}]interface{})["extra_local_cidrs"] = []interface{}{"nope"}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.extra_local_cidrs entry #0; nope did not parse; invalid CIDR address: nope")
+}
+
+func TestFirewall_DropRelated(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	myIpNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 5),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	h, _ := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	})
+
+	myCert := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name: "me",
+			Ips:  []*net.IPNet{&myIpNet},
+		},
+	}
+
+	// An outbound udp packet from us to the remote host
+	udp := []byte{
+		0x45, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x40, firewall.ProtoUDP, 0x00, 0x00,
+		1, 2, 3, 5,
+		1, 2, 3, 4,
+		0x13, 0x88, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00,
+	}
+	udpFp := firewall.Packet{}
+	assert.NoError(t, newPacket(udp, false, &udpFp))
+
+	// The remote host answers with an icmp port unreachable containing our packet
+	icmp := append([]byte{
+		0x45, 0x00, 0x00, 0x38, 0x00, 0x00, 0x00, 0x00, 0x40, firewall.ProtoICMP, 0x00, 0x00,
+		1, 2, 3, 4,
+		1, 2, 3, 5,
+		icmpDestinationUnreachable, 3, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}, udp...)
+	icmpFp := firewall.Packet{}
+	assert.NoError(t, newPacket(icmp, true, &icmpFp))
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &myCert, nil)
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoUDP, 53, 53, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	// Not allowed without the related option
+	assert.NoError(t, fw.Drop(udp, udpFp, false, h, cp, nil))
+	assert.Equal(t, fw.Drop(icmp, icmpFp, true, h, cp, nil), ErrNoMatchingRule)
+
+	// Allowed with the related option
+	fw.allowRelated = true
+	assert.NoError(t, fw.Drop(icmp, icmpFp, true, h, cp, nil))
+	assert.Equal(t, int64(1), fw.incomingMetrics.allowedRelated.Count())
+
+	// The option is on by default in config and can be turned off under either name
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{}
+	cfw, err := NewFirewallFromConfig(l, &myCert, conf)
+	assert.NoError(t, err)
+	assert.True(t, cfw.allowRelated)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"conntrack": map[interface{}]interface{}{"allow_related": false}}
+	cfw, err = NewFirewallFromConfig(l, &myCert, conf)
+	assert.NoError(t, err)
+	assert.False(t, cfw.allowRelated)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"conntrack": map[interface{}]interface{}{"allow_related_icmp": false}}
+	cfw, err = NewFirewallFromConfig(l, &myCert, conf)
+	assert.NoError(t, err)
+	assert.False(t, cfw.allowRelated)
+
+	// Not allowed if the flow is unknown
+	resetConntrack(fw)
+	assert.Equal(t, fw.Drop(icmp, icmpFp, true, h, cp, nil), ErrNoMatchingRule)
+
+	// Not allowed for icmp messages that are not errors
+	assert.NoError(t, fw.Drop(udp, udpFp, false, h, cp, nil))
+	icmp[20] = 8
+	assert.Equal(t, fw.Drop(icmp, icmpFp, true, h, cp, nil), ErrNoMatchingRule)
+	icmp[20] = icmpDestinationUnreachable
+
+	// Not allowed if the embedded packet is truncated
+	assert.Equal(t, fw.Drop(icmp[:40], icmpFp, true, h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(icmp[:12], icmpFp, true, h, cp, nil), ErrNoMatchingRule)
+
+	// Not allowed if the embedded packet is a later fragment
+	icmp[34] = 0x01
+	assert.Equal(t, fw.Drop(icmp, icmpFp, true, h, cp, nil), ErrNoMatchingRule)
+	icmp[34] = 0x00
+	assert.NoError(t, fw.Drop(icmp, icmpFp, true, h, cp, nil))
+
+	// Not allowed if the embedded flow belongs to a different host
+	copy(icmp[44:48], []byte{1, 2, 4, 4})
+	assert.Equal(t, fw.Drop(icmp, icmpFp, true, h, cp, nil), ErrNoMatchingRule)
+}
+
+func TestFirewall_DropICMPEcho(t *testing.T) {
+	l := test.NewLogger()
+
+	myIpNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 5),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	h, _ := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	myCert := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name: "me",
+			Ips:  []*net.IPNet{&myIpNet},
+		},
+	}
+
+	// echo builds an echo request from us or an echo reply from the remote host with identifier id
+	echo := func(request bool, id byte) ([]byte, firewall.Packet) {
+		b := []byte{
+			0x45, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x40, firewall.ProtoICMP, 0x00, 0x00,
+			1, 2, 3, 5,
+			1, 2, 3, 4,
+			icmpEchoRequest, 0x00, 0x00, 0x00, 0x00, id, 0x00, 0x01,
+		}
+		if !request {
+			copy(b[12:20], []byte{1, 2, 3, 4, 1, 2, 3, 5})
+			b[20] = icmpEchoReply
+		}
+
+		fp := firewall.Packet{}
+		assert.NoError(t, newPacket(b, !request, &fp))
+		return b, fp
+	}
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &myCert, nil)
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoICMP, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	// Two ping sessions to the same host get their own entries
+	req1, req1Fp := echo(true, 1)
+	req2, req2Fp := echo(true, 2)
+	assert.NoError(t, fw.Drop(req1, req1Fp, false, h, cp, nil))
+	assert.NoError(t, fw.Drop(req2, req2Fp, false, h, cp, nil))
+	assert.Len(t, fw.Conntrack.conns(), 2)
+
+	// Replies map back to their request
+	rep1, rep1Fp := echo(false, 1)
+	assert.Equal(t, req1Fp, rep1Fp)
+	assert.NoError(t, fw.Drop(rep1, rep1Fp, true, h, cp, nil))
+	assert.Equal(t, uint64(1), fw.Conntrack.conns()[req1Fp].inPackets)
+	assert.Equal(t, uint64(0), fw.Conntrack.conns()[req2Fp].inPackets)
+
+	// A reply nobody asked for is not allowed
+	rep3, rep3Fp := echo(false, 3)
+	assert.Equal(t, fw.Drop(rep3, rep3Fp, true, h, cp, nil), ErrNoMatchingRule)
+
+	// Rules do not match on the identifier
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &myCert, nil)
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoICMP, 1, 1, []string{"any"}, "", nil, nil, "", ""))
+	assert.Equal(t, fw.Drop(req1, req1Fp, false, h, cp, nil), ErrNoMatchingRule)
+
+	// Unless they ask to
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &myCert, nil)
+	id := uint16(2)
+	assert.Nil(t, fw.AddRuleWithOptions(false, firewall.ProtoICMP, 0, 0, []string{"any"}, "", nil, nil, "", "", RuleOptions{ICMPID: &id}))
+	assert.Equal(t, fw.Drop(req1, req1Fp, false, h, cp, nil), ErrNoMatchingRule)
+	assert.NoError(t, fw.Drop(req2, req2Fp, false, h, cp, nil))
+	assert.Empty(t, fw.OutRules().ICMP)
+	assert.NotEqual(t, NewFirewall(l, time.Second, time.Minute, time.Hour, &myCert, nil).GetRuleHash(), fw.GetRuleHash())
+
+	// A deny for one identifier leaves the rest alone
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &myCert, nil)
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoICMP, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRuleWithOptions(false, firewall.ProtoICMP, 0, 0, []string{"any"}, "", nil, nil, "", "", RuleOptions{ICMPID: &id, Deny: true}))
+	assert.NoError(t, fw.Drop(req1, req1Fp, false, h, cp, nil))
+	assert.Equal(t, fw.Drop(req2, req2Fp, false, h, cp, nil), ErrDeniedByRule)
+
+	assert.EqualError(t, fw.AddRuleWithOptions(false, firewall.ProtoUDP, 0, 0, []string{"any"}, "", nil, nil, "", "", RuleOptions{ICMPID: &id}), "icmp id is only supported for icmp rules")
+}
+
+func TestFirewall_DropTunnelKey(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	// An esp packet whose spi split across the ports looks like port 443
+	b := []byte{
+		0x45, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x40, firewall.ProtoESP, 0x00, 0x00,
+		1, 2, 3, 4,
+		1, 2, 3, 4,
+		0x00, 0x00, 0x01, 0xbb, 0x00, 0x00, 0x00, 0x01,
+	}
+	fp := firewall.Packet{}
+	require.NoError(t, newPacket(b, true, &fp))
+	require.Equal(t, uint16(443), fp.RemotePort)
+	cp := cert.NewCAPool()
+
+	// A port rule doesn't match on the spi, whichever half of it lines up with the port
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 443, 443, []string{"any"}, "", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 443, 443, []string{"any"}, "", nil, nil, "", ""))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, false, h, cp, nil))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, true, h, cp, nil))
+
+	fp.LocalPort, fp.RemotePort = fp.RemotePort, fp.LocalPort
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, true, h, cp, nil))
+
+	// The same for gre, any port still takes both
+	fp.Protocol = firewall.ProtoGRE
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, fp, true, h, cp, nil))
+
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	assert.NoError(t, fw.Drop(b, fp, true, h, cp, nil))
+	fp.Protocol = firewall.ProtoESP
+	assert.NoError(t, fw.Drop(b, fp, true, h, cp, nil))
+}
+
+func TestFirewall_FlushConntrack(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, metrics.NewRegistry())
+	hostA := iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4))
+	hostB := iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5))
+	fill := func() {
+		for _, fp := range []firewall.Packet{
+			{RemoteIP: hostA, LocalPort: 1, Protocol: firewall.ProtoTCP},
+			{RemoteIP: hostA, LocalPort: 2, Protocol: firewall.ProtoUDP},
+			{RemoteIP: hostB, LocalPort: 1, Protocol: firewall.ProtoTCP},
+		} {
+			fw.addConn([]byte{}, fp, true, RuleOptions{})
+		}
+	}
+
+	fill()
+	assert.Equal(t, 2, fw.FlushConntrackFor(hostA))
+	assert.Len(t, fw.Conntrack.conns(), 1)
+	assert.Equal(t, 0, fw.FlushConntrackFor(hostA))
+
+	fill()
+	assert.Equal(t, 2, fw.FlushConntrackProto(firewall.ProtoTCP))
+	assert.Len(t, fw.Conntrack.conns(), 1)
+
+	fill()
+	tw := fw.Conntrack.shards[0].TimerWheel
+	assert.Equal(t, 3, fw.FlushConntrack())
+	assert.Empty(t, fw.Conntrack.conns())
+	assert.NotSame(t, tw, fw.Conntrack.shards[0].TimerWheel)
+	assert.Equal(t, tw.wheelLen, fw.Conntrack.shards[0].TimerWheel.wheelLen)
+	assert.Equal(t, int64(7), fw.metricConntrackFlushed.Count())
+}
+
+func TestFirewall_ConntrackProtoCounts(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	r := metrics.NewRegistry()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+	fw.Conntrack = newFirewallConntrack(4, time.Second, time.Hour)
+
+	gauges := func() []int64 {
+		t.Helper()
+		fw.EmitStats()
+		var v []int64
+		for _, name := range conntrackProtoNames {
+			v = append(v, r.Get("firewall.conntrack.count."+name).(metrics.Gauge).Value())
+		}
+		return v
+	}
+
+	for i := 0; i < 20; i++ {
+		fw.addConn([]byte{}, firewall.Packet{RemotePort: uint16(i + 1), Protocol: firewall.ProtoTCP}, true, RuleOptions{})
+		fw.addConn([]byte{}, firewall.Packet{RemotePort: uint16(i + 1), Protocol: firewall.ProtoUDP}, true, RuleOptions{})
+	}
+	fw.addConn([]byte{}, firewall.Packet{Protocol: firewall.ProtoICMP}, true, RuleOptions{})
+	fw.addConn([]byte{}, firewall.Packet{Protocol: 47}, true, RuleOptions{})
+	// Replacing an entry does not count it twice
+	fw.addConn([]byte{}, firewall.Packet{Protocol: 47}, true, RuleOptions{})
+	assert.Equal(t, []int64{20, 20, 1, 1}, gauges())
+
+	// Expired entries
+	udp := firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoUDP}
+	fw.Conntrack.conns()[udp].Expires = time.Now().Add(-time.Second)
+	assert.True(t, fw.evict(fw.Conntrack.shard(udp), udp))
+	assert.False(t, fw.evict(fw.Conntrack.shard(udp), udp))
+	assert.Equal(t, []int64{20, 19, 1, 1}, gauges())
+
+	// Flushes
+	assert.Equal(t, 20, fw.FlushConntrackProto(firewall.ProtoTCP))
+	assert.Equal(t, []int64{0, 19, 1, 1}, gauges())
+	assert.Equal(t, 21, fw.FlushConntrack())
+	assert.Equal(t, []int64{0, 0, 0, 0}, gauges())
+
+	// With verify_counts a count that drifted is corrected and logged
+	fw.addConn([]byte{}, udp, true, RuleOptions{})
+	fw.Conntrack.shard(udp).protoCounts[conntrackProtoTCP] = 5
+	assert.Equal(t, []int64{5, 1, 0, 0}, gauges())
+	assert.NotContains(t, ob.String(), "out of step")
+
+	fw.verifyConntrackCounts = true
+	assert.Equal(t, []int64{0, 1, 0, 0}, gauges())
+	assert.Contains(t, ob.String(), "conntrack protocol counts were out of step with conntrack, corrected")
+}
+
+func TestFirewall_ConntrackAgeGauges(t *testing.T) {
+	r := metrics.NewRegistry()
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+
+	ages := func() (int64, int64) {
+		t.Helper()
+		fw.EmitStats()
+		return r.Get("firewall.conntrack.oldest_age").(metrics.Gauge).Value(),
+			r.Get("firewall.conntrack.newest_age").(metrics.Gauge).Value()
+	}
+
+	oldest, newest := ages()
+	assert.Zero(t, oldest)
+	assert.Zero(t, newest)
+
+	for i := 0; i < 3; i++ {
+		fw.addConn([]byte{}, firewall.Packet{RemotePort: uint16(i + 1), Protocol: firewall.ProtoUDP}, true, RuleOptions{})
+	}
+	conns := fw.Conntrack.conns()
+	conns[firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoUDP}].started = time.Now().Add(-time.Hour)
+	conns[firewall.Packet{RemotePort: 2, Protocol: firewall.ProtoUDP}].started = time.Now().Add(-time.Minute)
+
+	oldest, newest = ages()
+	assert.GreaterOrEqual(t, oldest, time.Hour.Nanoseconds())
+	assert.Less(t, oldest, (time.Hour + time.Minute).Nanoseconds())
+	assert.Less(t, newest, time.Minute.Nanoseconds())
+}
+
+func TestFirewall_ConntrackShards(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"shards": 3, "revalidate_budget": 6},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+
+	// Rounded up to a power of two
+	assert.Len(t, fw.Conntrack.shards, 4)
+	assert.Equal(t, uint32(3), fw.Conntrack.mask)
+
+	// Flows are spread over the shards and can still be found
+	n := 1000
+	for i := 0; i < n; i++ {
+		fw.addConn([]byte{}, firewall.Packet{RemotePort: uint16(i + 1), Protocol: firewall.ProtoUDP}, true, RuleOptions{})
+	}
+	assert.Len(t, fw.Conntrack.conns(), n)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{}), n)
+	for _, s := range fw.Conntrack.shards {
+		assert.NotEmpty(t, s.Conns)
+	}
+
+	for i := 0; i < n; i++ {
+		fp := firewall.Packet{RemotePort: uint16(i + 1), Protocol: firewall.ProtoUDP}
+		assert.Contains(t, fw.Conntrack.shard(fp).Conns, fp)
+	}
+
+	// The revalidate budget is split between the shards
+	s := fw.Conntrack.shards[0]
+	assert.True(t, fw.takeRevalidation(s))
+	assert.Equal(t, 1, s.revalidateLeft)
+
+	assert.Equal(t, n, fw.FlushConntrack())
+	assert.Empty(t, fw.Conntrack.conns())
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"shards": 0},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.shards must be positive")
+}
+
+func TestFirewall_ListConntrack(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, metrics.NewRegistry())
+	hostA := iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4))
+	hostB := iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5))
+	local := iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 6))
+
+	fw.addConn([]byte{}, firewall.Packet{LocalIP: local, RemoteIP: hostA, LocalPort: 22, RemotePort: 5000, Protocol: firewall.ProtoTCP}, true, RuleOptions{})
+	fw.addConn([]byte{}, firewall.Packet{LocalIP: local, RemoteIP: hostA, LocalPort: 5001, RemotePort: 53, Protocol: firewall.ProtoUDP}, false, RuleOptions{})
+	fw.addConn([]byte{}, firewall.Packet{LocalIP: local, RemoteIP: hostB, LocalPort: 22, RemotePort: 5002, Protocol: firewall.ProtoTCP}, true, RuleOptions{})
+	setRulesVersion(fw, 3)
+	fw.addConn([]byte{}, firewall.Packet{LocalIP: local, RemoteIP: hostB, Protocol: firewall.ProtoICMP}, false, RuleOptions{})
+
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{}), 4)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{Limit: 2}), 2)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{RemoteIP: hostA}), 2)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{LocalIP: local}), 4)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{LocalIP: hostA}), 0)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{Protocol: firewall.ProtoTCP}), 2)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{Port: 22}), 2)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{Port: 53}), 1)
+	assert.Len(t, fw.ListConntrack(ConntrackFilter{RemoteIP: hostB, Port: 22, Protocol: firewall.ProtoTCP}), 1)
+
+	entries := fw.ListConntrack(ConntrackFilter{Protocol: firewall.ProtoUDP})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint16(53), entries[0].Packet.RemotePort)
+	assert.False(t, entries[0].Incoming)
+	assert.Equal(t, uint16(0), entries[0].RulesVersion)
+	assert.False(t, entries[0].RTTTracking)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), entries[0].Expires, time.Second)
+
+	entries = fw.ListConntrack(ConntrackFilter{Protocol: firewall.ProtoICMP})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint16(3), entries[0].RulesVersion)
+}
+
+func TestFirewall_ConntrackCounters(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	assert.NoError(t, fw.Drop(make([]byte, 100), p, true, h, cp, nil))
+	assert.NoError(t, fw.Drop(make([]byte, 50), p, true, h, cp, nil))
+	assert.NoError(t, fw.Drop(make([]byte, 1000), p, false, h, cp, nil))
+
+	entries := fw.ListConntrack(ConntrackFilter{})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint64(2), entries[0].InPackets)
+	assert.Equal(t, uint64(150), entries[0].InBytes)
+	assert.Equal(t, uint64(1), entries[0].OutPackets)
+	assert.Equal(t, uint64(1000), entries[0].OutBytes)
+
+	// Lifecycle counters
+	assert.Equal(t, int64(1), fw.metricConntrackCreated.Count())
+	assert.Equal(t, int64(2), fw.metricConntrackRefreshed.Count())
+
+	// Expired through the timer wheel
+	shard := fw.Conntrack.shard(p)
+	fw.Conntrack.conns()[p].Expires = time.Now().Add(-time.Second)
+	assert.True(t, fw.evict(shard, p))
+	assert.Equal(t, int64(1), fw.metricConntrackExpired.Count())
+
+	// Removed because the new rules no longer allow it
+	assert.NoError(t, fw.Drop(make([]byte, 100), p, true, h, cp, nil))
+	fw.Conntrack.conns()[p].rulesVersion--
+	fw.ruleset.Load().in = newFirewallTable()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(make([]byte, 100), p, true, h, cp, nil))
+	assert.Equal(t, int64(1), fw.metricConntrackRevalidateFailed.Count())
+	assert.Equal(t, int64(2), fw.metricConntrackCreated.Count())
+	assert.Equal(t, int64(2), fw.metricConntrackRefreshed.Count())
+
+	for _, name := range []string{"created", "refreshed", "expired", "revalidate_failed", "flushed"} {
+		assert.NotNil(t, fw.metricsRegistry.Get("firewall.conntrack."+name))
+	}
+
+	// Every way out of conntrack records how long the entry lived
+	assert.Equal(t, int64(2), fw.metricLifetimeUDP.Count())
+	fw.addConn([]byte{}, p, true, RuleOptions{})
+	fw.Conntrack.conns()[p].started = time.Now().Add(-time.Minute)
+	fw.addConn([]byte{}, firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoTCP}, true, RuleOptions{})
+	fw.addConn([]byte{}, firewall.Packet{Protocol: firewall.ProtoICMP}, true, RuleOptions{})
+	assert.Equal(t, 1, fw.FlushConntrackProto(firewall.ProtoUDP))
+	assert.Equal(t, 2, fw.FlushConntrack())
+	assert.Equal(t, int64(3), fw.metricLifetimeUDP.Count())
+	assert.GreaterOrEqual(t, fw.metricLifetimeUDP.Max(), time.Minute.Nanoseconds())
+	assert.Equal(t, int64(1), fw.metricLifetimeTCP.Count())
+	assert.Equal(t, int64(1), fw.metricLifetimeOther.Count())
+	assert.Same(t, fw.metricLifetimeOther, fw.metricsRegistry.Get("firewall.conntrack.lifetime.other"))
+}
+
+func TestFirewall_RuleConntrackTimeout(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	// A dns server with a short reply window next to general udp
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "conntrack_timeout": "5s"},
+			map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, fw.Conntrack.shards[0].TimerWheel.tickDuration)
+
+	dns := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  53,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoUDP,
+	}
+	other := dns
+	other.LocalPort = 123
+	cp := cert.NewCAPool()
+
+	// The query uses the rule timeout
+	now := time.Now()
+	assert.NoError(t, fw.Drop([]byte{}, dns, true, h, cp, nil))
+	assert.WithinDuration(t, now.Add(5*time.Second), fw.Conntrack.conns()[dns].Expires, time.Second)
+
+	// And so does the reply
+	fw.Conntrack.conns()[dns].Expires = now
+	assert.NoError(t, fw.Drop([]byte{}, dns, false, h, cp, nil))
+	assert.WithinDuration(t, now.Add(5*time.Second), fw.Conntrack.conns()[dns].Expires, time.Second)
+
+	// Other udp keeps the protocol timeout, until the reply makes it a stream
+	assert.NoError(t, fw.Drop([]byte{}, other, true, h, cp, nil))
+	assert.WithinDuration(t, now.Add(fw.UDPTimeout), fw.Conntrack.conns()[other].Expires, time.Second)
+	assert.NoError(t, fw.Drop([]byte{}, other, false, h, cp, nil))
+	assert.WithinDuration(t, now.Add(fw.udpStreamTimeout), fw.Conntrack.conns()[other].Expires, time.Second)
+
+	// The dns flow is gone shortly after it goes quiet
+	shard := fw.Conntrack.shard(dns)
+	shard.TimerWheel.Advance(time.Now().Add(11 * time.Second))
+	fw.Conntrack.conns()[dns].Expires = time.Now().Add(-time.Second)
+	for {
+		ep, has := shard.TimerWheel.Purge()
+		if !has {
+			break
+		}
+		fw.evict(shard, ep)
+	}
+	assert.NotContains(t, fw.Conntrack.conns(), dns)
+	assert.Contains(t, fw.Conntrack.conns(), other)
+
+	// Rules with a timeout are part of the rule hash
+	plain := NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+	assert.Nil(t, plain.AddRule(true, firewall.ProtoUDP, 53, 53, []string{}, "any", nil, nil, "", ""))
+	withTimeout := NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+	assert.Nil(t, withTimeout.AddRuleWithOptions(true, firewall.ProtoUDP, 53, 53, []string{}, "any", nil, nil, "", "", RuleOptions{ConntrackTimeout: time.Second}))
+	assert.NotEqual(t, plain.GetRuleHash(), withTimeout.GetRuleHash())
+	assert.EqualError(t, withTimeout.AddRuleWithOptions(true, firewall.ProtoTCP, 53, 53, []string{}, "any", nil, nil, "", "", RuleOptions{ConntrackTimeout: time.Second}), "conntrack timeout is only supported for udp rules")
+}
+
+func TestRuleOptions_list(t *testing.T) {
+	// A plain rule adds nothing to the rule string, so its hash is what it always was
+	assert.Empty(t, RuleOptions{}.ruleString())
+
+	opts := RuleOptions{Priority: 10, TCPFlags: tcpSYN, TCPFlagsMask: tcpSYN | tcpACK, SourcePortStart: 1000, SourcePortEnd: 2000, SelfPeer: true}
+	assert.Equal(t, ", priority: 10, tcpFlags: syn,!ack, host: self, sourcePort: 1000-2000", opts.ruleString())
+
+	// The log has the same options as the rule string
+	fields := ruleFields(true, firewall.ProtoTCP, portRule{startPort: 22, endPort: 22, host: "any"}, opts)
+	assert.Equal(t, 10, fields["priority"])
+	assert.Equal(t, "syn,!ack", fields["tcpFlags"])
+	assert.Equal(t, hostSelf, fields["host"])
+	assert.Equal(t, "1000-2000", fields["sourcePort"])
+	assert.Equal(t, "incoming", fields["direction"])
+	assert.Equal(t, "", fields["ip"])
+}
+
+func TestFirewall_RuleConntrackTimeoutReload(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	rules := func(timeout string) map[interface{}]interface{} {
+		in := []interface{}{map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "any"}}
+		if timeout != "" {
+			in = append(in, map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "any", "conntrack_timeout": timeout})
+		}
+		return map[interface{}]interface{}{"inbound": in}
+	}
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  123,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoUDP,
+	}
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = rules("")
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	tick := fw.Conntrack.shards[0].TimerWheel.tickDuration
+	assert.Greater(t, tick, time.Second)
+
+	// A HUP adds a rule with a timeout below the tick of the conntrack we inherit, its timer wheels are refit
+	conf.Settings["firewall"] = rules("1s")
+	nfw, err := NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+	nfw.InheritConntrack(fw)
+	assert.Same(t, fw.Conntrack, nfw.Conntrack)
+	shard := nfw.Conntrack.shard(p)
+	assert.Equal(t, time.Second, shard.TimerWheel.tickDuration)
+	assert.Contains(t, nfw.Conntrack.conns(), p)
+
+	// The tracked flow was added back to the new wheel and still expires
+	nfw.Conntrack.conns()[p].Expires = time.Now().Add(-time.Second)
+	shard.TimerWheel.Advance(time.Now().Add(nfw.UDPTimeout + 2*time.Second))
+	for {
+		ep, has := shard.TimerWheel.Purge()
+		if !has {
+			break
+		}
+		nfw.evict(shard, ep)
+	}
+	assert.NotContains(t, nfw.Conntrack.conns(), p)
+
+	// A reload in place widens the wheels for a shorter or longer rule timeout, the sweeper keeps up
+	nfw.startConntrackSweeper()
+	defer nfw.stopConntrackSweeper()
+	conf.Settings["firewall"] = rules("500ms")
+	assert.NoError(t, nfw.Reload(conf))
+	assert.Equal(t, 500*time.Millisecond, nfw.Conntrack.shards[0].TimerWheel.tickDuration)
+	conf.Settings["firewall"] = rules("48h")
+	assert.NoError(t, nfw.Reload(conf))
+	assert.Equal(t, 500*time.Millisecond, nfw.Conntrack.shards[0].TimerWheel.tickDuration)
+	assert.Equal(t, 48*time.Hour, nfw.Conntrack.shards[0].TimerWheel.wheelDuration)
+}
+
+func TestFirewall_DecidingRuleOptions(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		Groups:         []string{"default-group"},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	})
+
+	fp := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  53,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoUDP,
+	}
+	cp := cert.NewCAPool()
+
+	// Both rules allow the packet, the port maps are checked before rules with length bounds so the second decides
+	fw := NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 53, 53, []string{"default-group"}, "", nil, nil, "", "", RuleOptions{MinLen: 1, ConntrackTimeout: 5 * time.Second}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 53, 53, []string{}, "any", nil, nil, "", "", RuleOptions{ConntrackTimeout: 30 * time.Second}))
+
+	now := time.Now()
+	assert.NoError(t, fw.Drop(make([]byte, 20), fp, true, h, cp, nil))
+	assert.Equal(t, 30*time.Second, fw.Conntrack.conns()[fp].timeout)
+	assert.WithinDuration(t, now.Add(30*time.Second), fw.Conntrack.conns()[fp].Expires, time.Second)
+
+	// A rule that doesn't match the peer's groups does not lend its options to the one that allows the packet
+	fw = NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 53, 53, []string{"other-group"}, "", nil, nil, "", "", RuleOptions{ConntrackTimeout: 5 * time.Second}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 53, 53, []string{}, "any", nil, nil, "", "", RuleOptions{ConntrackTimeout: 30 * time.Second}))
+	assert.NoError(t, fw.Drop(make([]byte, 20), fp, true, h, cp, nil))
+	assert.Equal(t, 30*time.Second, fw.Conntrack.conns()[fp].timeout)
+}
+
+func TestFirewall_UDPStreamTimeout(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "any"}},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, fw.udpStreamTimeout)
+	assert.Equal(t, 30*time.Minute, fw.Conntrack.shards[0].TimerWheel.wheelDuration)
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  40000,
+		RemotePort: 53,
+		Protocol:   firewall.ProtoUDP,
+	}
+	cache := firewall.NewConntrackCache()
+
+	// An unanswered flow keeps the short timeout, and more packets the same way stay out of the routine cache so the
+	// first reply is seen
+	now := time.Now()
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, cache))
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, cache))
+	assert.Empty(t, cache.Entries)
+	assert.WithinDuration(t, now.Add(fw.UDPTimeout), fw.Conntrack.conns()[p].Expires, time.Second)
+
+	// The reply makes it a stream
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, cache))
+	assert.WithinDuration(t, now.Add(30*time.Minute), fw.Conntrack.conns()[p].Expires, time.Second)
+	assert.Contains(t, cache.Entries, p)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"udp_stream_timeout": "0s"},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.udp_stream_timeout must be positive")
+}
+
+func TestFirewall_RulePriority(t *testing.T) {
+	l := test.NewLogger()
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		Ips:            []*net.IPNet{&ipNet},
+		Groups:         []string{"default-group"},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	})
+	admin := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "admin1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"admin"},
+			InvertedGroups: map[string]struct{}{"admin": {}},
+		},
+	}
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  80,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	cp := cert.NewCAPool()
+	port := func(proto uint8, port uint16) firewall.Packet {
+		np := p
+		np.Protocol = proto
+		np.LocalPort = port
+		return np
+	}
+
+	fw := NewFirewall(l, time.Hour, time.Hour, time.Hour, c, nil)
+
+	// A broad allow with a narrow deny above it, and an even narrower allow above that
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoTCP, 0, 0, []string{}, "any", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", "", RuleOptions{Priority: 10, Deny: true}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{"admin"}, "", nil, nil, "", "", RuleOptions{Priority: 20}))
+	assert.True(t, fw.InRules().match(port(firewall.ProtoTCP, 80), packetInfo{}, true, c, cp))
+	assert.False(t, fw.InRules().match(port(firewall.ProtoTCP, 22), packetInfo{}, true, c, cp))
+	assert.True(t, fw.InRules().match(port(firewall.ProtoTCP, 22), packetInfo{}, true, &admin, cp))
+
+	// A broad deny with a narrow allow above it
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 0, 0, []string{}, "any", nil, nil, "", "", RuleOptions{Deny: true}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 53, 53, []string{}, "any", nil, nil, "", "", RuleOptions{Priority: 5}))
+	assert.True(t, fw.InRules().match(port(firewall.ProtoUDP, 53), packetInfo{}, true, c, cp))
+	assert.False(t, fw.InRules().match(port(firewall.ProtoUDP, 54), packetInfo{}, true, c, cp))
+
+	// At the default priority deny wins, whatever order the rules were added in
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 443, 443, []string{"default-group"}, "", nil, nil, "", "", RuleOptions{Deny: true}))
+	assert.False(t, fw.InRules().match(port(firewall.ProtoTCP, 443), packetInfo{}, true, c, cp))
+	assert.True(t, fw.InRules().match(port(firewall.ProtoTCP, 443), packetInfo{}, true, &admin, cp))
+
+	// Below the default priority the first rule to match still decides, in the order they were added
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoICMP, 0, 0, []string{}, "any", nil, nil, "", "", RuleOptions{Priority: -1}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoICMP, 0, 0, []string{"admin"}, "", nil, nil, "", "", RuleOptions{Priority: -1, Deny: true}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoAny, 0, 0, []string{"admin"}, "", nil, nil, "", "", RuleOptions{Priority: -2, Deny: true}))
+	assert.True(t, fw.InRules().match(port(firewall.ProtoICMP, 0), packetInfo{}, true, &admin, cp))
+	assert.True(t, fw.InRules().match(port(firewall.ProtoICMP, 0), packetInfo{}, true, c, cp))
+	assert.True(t, fw.InRules().match(port(firewall.ProtoUDP, 53), packetInfo{}, true, &admin, cp))
+
+	// The ordered rules are sorted by priority
+	var priorities []int
+	for _, or := range fw.InRules().ordered {
+		priorities = append(priorities, or.opts.Priority)
+	}
+	assert.Equal(t, []int{20, 10, 5, 0, 0, -1, -1, -2}, priorities)
+
+	// Existing flows are revalidated against deny rules after a reload
+	assert.NoError(t, fw.Drop([]byte{}, port(firewall.ProtoTCP, 8080), true, h, cp, nil))
+	setRulesVersion(fw, fw.rulesVersion()+1)
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 8080, 8080, []string{}, "any", nil, nil, "", "", RuleOptions{Deny: true}))
+	assert.Equal(t, ErrDeniedByRule, fw.Drop([]byte{}, port(firewall.ProtoTCP, 8080), true, h, cp, nil))
+
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 53, 53, []string{}, "any", nil, nil, "", "", RuleOptions{ConntrackTimeout: time.Second, Deny: true}), "conntrack timeout is not supported for deny rules")
+}
+
+func TestFirewall_RuleLength(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  80,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoUDP,
+	}
+	cp := cert.NewCAPool()
+
+	// Only packets of 64 to 1400 bytes may start a flow
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 80, 80, []string{}, "any", nil, nil, "", "", RuleOptions{MinLen: 64, MaxLen: 1400}))
+	assert.Empty(t, fw.InRules().UDP)
+	assert.Equal(t, fw.Drop(make([]byte, 63), p, true, h, cp, nil), ErrNoMatchingRule)
+	assert.Equal(t, fw.Drop(make([]byte, 1401), p, true, h, cp, nil), ErrNoMatchingRule)
+	assert.NoError(t, fw.Drop(make([]byte, 64), p, true, h, cp, nil))
+
+	// Later packets of the flow are not checked
+	assert.NoError(t, fw.Drop(make([]byte, 10), p, true, h, cp, nil))
+
+	// Deny tiny packets on top of a plain allow, an open upper bound
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 80, 80, []string{}, "any", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 80, 80, []string{}, "any", nil, nil, "", "", RuleOptions{MaxLen: 20, Deny: true}))
+	assert.Equal(t, fw.Drop(make([]byte, 20), p, true, h, cp, nil), ErrDeniedByRule)
+	assert.NoError(t, fw.Drop(make([]byte, 9000), p, true, h, cp, nil))
+
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 80, 80, []string{}, "any", nil, nil, "", "", RuleOptions{MinLen: -1}), "packet length bounds must not be negative")
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoUDP, 80, 80, []string{}, "any", nil, nil, "", "", RuleOptions{MinLen: 10, MaxLen: 5}), "min length is greater than max length")
+}
+
+func TestFirewall_DropReject(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	cp := cert.NewCAPool()
+
+	fw := NewFirewall(l, time.Hour, time.Hour, time.Hour, c, metrics.NewRegistry())
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", "", RuleOptions{Deny: true, Reject: true}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 23, 23, []string{}, "any", nil, nil, "", "", RuleOptions{Deny: true}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 25, 25, []string{}, "any", nil, nil, "", "", RuleOptions{Deny: true, NoReject: true}))
+
+	// A rule that rejects says so, whatever the global setting
+	err := fw.Drop([]byte{}, p, true, h, cp, nil)
+	assert.Equal(t, ErrRejectedByRule, err)
+	assert.True(t, ShouldReject(err, false))
+	assert.Equal(t, int64(1), fw.incomingMetrics.droppedDenyRule.Count())
+
+	// Other drops follow the global setting
+	p.LocalPort = 23
+	err = fw.Drop([]byte{}, p, true, h, cp, nil)
+	assert.Equal(t, ErrDeniedByRule, err)
+	assert.False(t, ShouldReject(err, false))
+	assert.True(t, ShouldReject(err, true))
+
+	p.LocalPort = 24
+	err = fw.Drop([]byte{}, p, true, h, cp, nil)
+	assert.Equal(t, ErrNoMatchingRule, err)
+	assert.False(t, ShouldReject(err, false))
+	assert.True(t, ShouldReject(err, true))
+	assert.Equal(t, int64(2), fw.incomingMetrics.droppedDenyRule.Count())
+	assert.Equal(t, int64(1), fw.incomingMetrics.droppedNoRule.Count())
+
+	// As does a rule that drops silently
+	p.LocalPort = 25
+	err = fw.Drop([]byte{}, p, true, h, cp, nil)
+	assert.Equal(t, ErrDroppedByRule, err)
+	assert.False(t, ShouldReject(err, true))
+	assert.Equal(t, int64(3), fw.incomingMetrics.droppedDenyRule.Count())
+
+	fw.InSendReject = true
+	assert.Equal(t, "drop", fw.dropAction(ErrDroppedByRule, true))
+	assert.Equal(t, "reject", fw.dropAction(ErrDeniedByRule, true))
+	assert.Equal(t, "drop", fw.dropAction(ErrDeniedByRule, false))
+	assert.Equal(t, "reject", fw.dropAction(ErrRejectedByRule, false))
+
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", "", RuleOptions{Reject: true}), "reject is only supported for deny rules")
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", "", RuleOptions{NoReject: true}), "reject is only supported for deny rules")
+	assert.EqualError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", "", RuleOptions{Deny: true, Reject: true, NoReject: true}), "a rule can not both reject and not reject")
+}
+
+func TestFirewall_DropNoRuleMetrics(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	r := metrics.NewRegistry()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, r)
+	cp := cert.NewCAPool()
+
+	drop := func(proto uint8, incoming bool) {
+		p := firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+			RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+			LocalPort:  10,
+			RemotePort: 90,
+			Protocol:   proto,
+		}
+		assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, incoming, h, cp, nil))
+	}
+
+	drop(firewall.ProtoTCP, true)
+	drop(firewall.ProtoUDP, true)
+	drop(firewall.ProtoUDP, true)
+	drop(firewall.ProtoICMP, true)
+	drop(47, true)
+	drop(firewall.ProtoUDP, false)
+
+	count := func(name string) int64 {
+		return r.Get(name).(metrics.Counter).Count()
+	}
+
+	// The total is kept alongside the split
+	assert.Equal(t, int64(5), count("firewall.incoming.dropped.no_rule"))
+	assert.Equal(t, int64(1), count("firewall.incoming.dropped.no_rule.tcp"))
+	assert.Equal(t, int64(2), count("firewall.incoming.dropped.no_rule.udp"))
+	assert.Equal(t, int64(1), count("firewall.incoming.dropped.no_rule.icmp"))
+	assert.Equal(t, int64(1), count("firewall.incoming.dropped.no_rule.other"))
+
+	assert.Equal(t, int64(1), count("firewall.outgoing.dropped.no_rule"))
+	assert.Equal(t, int64(1), count("firewall.outgoing.dropped.no_rule.udp"))
+	assert.Equal(t, int64(0), count("firewall.outgoing.dropped.no_rule.tcp"))
+}
+
+func TestFirewall_DropLogger(t *testing.T) {
+	l := test.NewLogger()
+
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+	})
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.NoError(t, fw.AddRule(true, firewall.ProtoUDP, 10, 10, []string{"any"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	type dropped struct {
+		fp       firewall.Packet
+		incoming bool
+		reason   error
+	}
+	var drops []dropped
+	fw.DropLogger = func(fp firewall.Packet, incoming bool, reason error) {
+		// No firewall lock may be held
+		for _, s := range fw.Conntrack.shards {
+			if assert.True(t, s.TryLock()) {
+				s.Unlock()
+			}
+		}
+		drops = append(drops, dropped{fp, incoming, reason})
+	}
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	// Allowed packets are not passed on
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
+	assert.Empty(t, drops)
+
+	// Every reason is
+	noRule := p
+	noRule.LocalPort = 11
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, noRule, true, h, cp, nil))
+
+	badRemote := p
+	badRemote.RemoteIP = iputil.Ip2VpnIp(net.IPv4(1, 2, 4, 4))
+	assert.Equal(t, ErrInvalidRemoteIP, fw.Drop([]byte{}, badRemote, false, h, cp, nil))
+
+	setRulesVersion(fw, fw.rulesVersion()+1)
+	fw.revalidateBudget = 1
+	fw.revalidateOverflowDrop = true
+	fw.Conntrack.shards[0].revalidateRefill = time.Now().Add(time.Hour)
+	assert.Equal(t, ErrRevalidationDeferred, fw.Drop([]byte{}, p, true, h, cp, nil))
+
+	assert.Equal(t, []dropped{
+		{noRule, true, ErrNoMatchingRule},
+		{badRemote, false, ErrInvalidRemoteIP},
+		{p, true, ErrRevalidationDeferred},
+	}, drops)
 }
 
-func TestFirewall_Drop3(t *testing.T) {
+func TestFirewall_SnapshotRestoreRules(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
 	l.SetOutput(ob)
@@ -412,85 +2087,45 @@ func TestFirewall_Drop3(t *testing.T) {
 	p := firewall.Packet{
 		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
 		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
-		LocalPort:  1,
-		RemotePort: 1,
+		LocalPort:  10,
+		RemotePort: 90,
 		Protocol:   firewall.ProtoUDP,
 		Fragment:   false,
 	}
 
-	ipNet := net.IPNet{
-		IP:   net.IPv4(1, 2, 3, 4),
-		Mask: net.IPMask{255, 255, 255, 0},
-	}
-
-	c := cert.NebulaCertificate{
-		Details: cert.NebulaCertificateDetails{
-			Name: "host-owner",
-			Ips:  []*net.IPNet{&ipNet},
-		},
-	}
-
-	c1 := cert.NebulaCertificate{
-		Details: cert.NebulaCertificateDetails{
-			Name:   "host1",
-			Ips:    []*net.IPNet{&ipNet},
-			Issuer: "signer-sha-bad",
-		},
-	}
-	h1 := HostInfo{
-		ConnectionState: &ConnectionState{
-			peerCert: &c1,
-		},
-		vpnIp: iputil.Ip2VpnIp(ipNet.IP),
-	}
-	h1.CreateRemoteCIDR(&c1)
-
-	c2 := cert.NebulaCertificate{
-		Details: cert.NebulaCertificateDetails{
-			Name:   "host2",
-			Ips:    []*net.IPNet{&ipNet},
-			Issuer: "signer-sha",
-		},
-	}
-	h2 := HostInfo{
-		ConnectionState: &ConnectionState{
-			peerCert: &c2,
-		},
-		vpnIp: iputil.Ip2VpnIp(ipNet.IP),
-	}
-	h2.CreateRemoteCIDR(&c2)
-
-	c3 := cert.NebulaCertificate{
-		Details: cert.NebulaCertificateDetails{
-			Name:   "host3",
-			Ips:    []*net.IPNet{&ipNet},
-			Issuer: "signer-sha-bad",
-		},
-	}
-	h3 := HostInfo{
-		ConnectionState: &ConnectionState{
-			peerCert: &c3,
-		},
-		vpnIp: iputil.Ip2VpnIp(ipNet.IP),
-	}
-	h3.CreateRemoteCIDR(&c3)
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	})
 
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
-	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 1, 1, []string{}, "host1", nil, nil, "", ""))
-	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 1, 1, []string{}, "", nil, nil, "", "signer-sha"))
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 10, 10, []string{"any"}, "", nil, nil, "", ""))
 	cp := cert.NewCAPool()
 
-	// c1 should pass because host match
-	assert.NoError(t, fw.Drop([]byte{}, p, true, &h1, cp, nil))
-	// c2 should pass because ca sha match
-	resetConntrack(fw)
-	assert.NoError(t, fw.Drop([]byte{}, p, true, &h2, cp, nil))
-	// c3 should fail because no match
-	resetConntrack(fw)
-	assert.Equal(t, fw.Drop([]byte{}, p, true, &h3, cp, nil), ErrNoMatchingRule)
+	snap := fw.SnapshotRules()
+	hashes := fw.GetRuleHashes()
+
+	// Allow inbound and track it
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+
+	// Install a different ruleset, the tracked flow no longer matches
+	newFw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, nil)
+	assert.Nil(t, newFw.AddRule(true, firewall.ProtoAny, 11, 11, []string{"any"}, "", nil, nil, "", ""))
+	fw.RestoreRules(newFw.SnapshotRules())
+	assert.Equal(t, uint16(1), fw.rulesVersion())
+	assert.NotEqual(t, hashes, fw.GetRuleHashes())
+	assert.Equal(t, fw.Drop([]byte{}, p, false, h, cp, nil), ErrNoMatchingRule)
+
+	// Revert to the original ruleset and confirm the hashes and tables came back
+	fw.RestoreRules(snap)
+	assert.Equal(t, uint16(2), fw.rulesVersion())
+	assert.Equal(t, hashes, fw.GetRuleHashes())
+	assert.Same(t, snap.inRules, fw.InRules())
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
 }
 
-func TestFirewall_DropConntrackReload(t *testing.T) {
+func TestFirewall_Reload(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
 	l.SetOutput(ob)
@@ -504,57 +2139,102 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 		Fragment:   false,
 	}
 
-	ipNet := net.IPNet{
-		IP:   net.IPv4(1, 2, 3, 4),
-		Mask: net.IPMask{255, 255, 255, 0},
-	}
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name:           "host1",
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	})
 
-	c := cert.NebulaCertificate{
-		Details: cert.NebulaCertificateDetails{
-			Name:           "host1",
-			Ips:            []*net.IPNet{&ipNet},
-			Groups:         []string{"default-group"},
-			InvertedGroups: map[string]struct{}{"default-group": {}},
-			Issuer:         "signer-shasum",
-		},
+	rule := func(port string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"port": port, "proto": "any", "host": "any"}
 	}
-	h := HostInfo{
-		ConnectionState: &ConnectionState{
-			peerCert: &c,
-		},
-		vpnIp: iputil.Ip2VpnIp(ipNet.IP),
-	}
-	h.CreateRemoteCIDR(&c)
 
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
-	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{rule("10")}}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
 	cp := cert.NewCAPool()
 
-	// Drop outbound
-	assert.Equal(t, fw.Drop([]byte{}, p, false, &h, cp, nil), ErrNoMatchingRule)
-	// Allow inbound
-	resetConntrack(fw)
-	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
-	// Allow outbound because conntrack
-	assert.NoError(t, fw.Drop([]byte{}, p, false, &h, cp, nil))
+	// Allow inbound and track it
+	assert.NoError(t, fw.Drop([]byte{}, p, true, h, cp, nil))
+	hashes := fw.GetRuleHashes()
+	inRules := fw.InRules()
+	conntrack := fw.Conntrack
 
-	oldFw := fw
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
-	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 10, 10, []string{"any"}, "", nil, nil, "", ""))
-	fw.Conntrack = oldFw.Conntrack
-	fw.rulesVersion = oldFw.rulesVersion + 1
+	// A rejected config leaves everything as it was
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{rule("11"), rule("a")}}
+	assert.EqualError(t, fw.Reload(conf), "firewall.inbound rule #1; port was not a number; `a`")
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound":           []interface{}{rule("11")},
+		"extra_local_cidrs": []interface{}{"bad"},
+	}
+	assert.Error(t, fw.Reload(conf))
+	assert.Equal(t, uint16(0), fw.rulesVersion())
+	assert.Equal(t, hashes, fw.GetRuleHashes())
+	assert.Same(t, inRules, fw.InRules())
+	assert.NoError(t, fw.Drop([]byte{}, p, false, h, cp, nil))
+
+	// A good config replaces the rules, the tracked flow no longer matches
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound":           []interface{}{rule("11")},
+		"extra_local_cidrs": []interface{}{"10.0.0.0/8"},
+	}
+	assert.NoError(t, fw.Reload(conf))
+	assert.Equal(t, uint16(1), fw.rulesVersion())
+	assert.NotEqual(t, hashes, fw.GetRuleHashes())
+	assert.Same(t, conntrack, fw.Conntrack)
+	assert.Equal(t, fw.Drop([]byte{}, p, false, h, cp, nil), ErrNoMatchingRule)
+
+	// The extra local cidrs came along with the rules
+	extra := p
+	extra.LocalIP = iputil.Ip2VpnIp(net.IPv4(10, 1, 1, 1))
+	extra.LocalPort = 11
+	assert.NoError(t, fw.Drop([]byte{}, extra, true, h, cp, nil))
+}
 
-	// Allow outbound because conntrack and new rules allow port 10
-	assert.NoError(t, fw.Drop([]byte{}, p, false, &h, cp, nil))
+func TestFirewall_RuleHashConcurrent(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
 
-	oldFw = fw
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
-	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 11, 11, []string{"any"}, "", nil, nil, "", ""))
-	fw.Conntrack = oldFw.Conntrack
-	fw.rulesVersion = oldFw.rulesVersion + 1
+	c := &cert.NebulaCertificate{}
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c, metrics.NewRegistry())
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoTCP, 80, 80, []string{}, "any", nil, nil, "", ""))
+	snap := fw.SnapshotRules()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Read the hashes the way stats and logging do while the rules change underneath
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					fw.EmitStats()
+					_ = fw.GetRuleHashes()
+				}
+			}
+		}()
+	}
 
-	// Drop outbound because conntrack doesn't match new ruleset
-	assert.Equal(t, fw.Drop([]byte{}, p, false, &h, cp, nil), ErrNoMatchingRule)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, int32(i+1), int32(i+1), []string{}, "any", nil, nil, "", ""))
+		if i%10 == 0 {
+			fw.RestoreRules(snap)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// The hashes always describe the rules as a whole
+	rules := fw.getRules()
+	assert.Equal(t, "SHA:"+ruleHash(rules)+",FNV:"+strconv.FormatUint(uint64(ruleHashFNV(rules)), 10), fw.GetRuleHashes())
+	fw.EmitStats()
+	assert.Equal(t, int64(fw.GetRuleHashFNV()), fw.metricsRegistry.Get("firewall.rules.hash").(metrics.Gauge).Value())
 }
 
 func BenchmarkLookup(b *testing.B) {
@@ -661,6 +2341,22 @@ func Test_parsePort(t *testing.T) {
 	assert.Equal(t, int32(0), e)
 	assert.Nil(t, err)
 
+	s, e, err = parsePort("1024-")
+	assert.Equal(t, int32(1024), s)
+	assert.Equal(t, int32(65535), e)
+	assert.Nil(t, err)
+
+	s, e, err = parsePort(" -1023")
+	assert.Equal(t, int32(1), s)
+	assert.Equal(t, int32(1023), e)
+	assert.Nil(t, err)
+
+	_, _, err = parsePort("a-")
+	assert.EqualError(t, err, "beginning range was not a number; `a`")
+
+	_, _, err = parsePort("-b")
+	assert.EqualError(t, err, "ending range was not a number; `b`")
+
 	s, e, err = parsePort("9919")
 	assert.Equal(t, int32(9919), s)
 	assert.Equal(t, int32(9919), e)
@@ -814,6 +2510,296 @@ func TestAddFirewallRulesFromConfig(t *testing.T) {
 	mf.nextCallReturn = errors.New("test error")
 	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a"}}}
 	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; `test error`")
+
+	// Test conntrack_timeout
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "a", "conntrack_timeout": "5s"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoUDP, startPort: 53, endPort: 53, host: "a", opts: RuleOptions{ConntrackTimeout: 5 * time.Second}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "53", "proto": "tcp", "host": "a", "conntrack_timeout": "5s"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; conntrack_timeout is only supported with proto udp")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "a", "conntrack_timeout": "soon"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; conntrack_timeout did not parse; time: invalid duration \"soon\"")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "53", "proto": "udp", "host": "a", "conntrack_timeout": "-1s"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; conntrack_timeout must be positive")
+
+	// Test action and priority
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "action": "deny", "priority": 10}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoTCP, startPort: 22, endPort: 22, host: "a", opts: RuleOptions{Priority: 10, Deny: true}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "action": "allow", "priority": "-5"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoTCP, startPort: 22, endPort: 22, host: "a", opts: RuleOptions{Priority: -5}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "action": "deny", "reject": true}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoTCP, startPort: 22, endPort: 22, host: "a", opts: RuleOptions{Deny: true, Reject: true}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "action": "reject"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoTCP, startPort: 22, endPort: 22, host: "a", opts: RuleOptions{Deny: true, Reject: true}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "action": "drop"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoTCP, startPort: 22, endPort: 22, host: "a", opts: RuleOptions{Deny: true, NoReject: true}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "action": "drop", "reject": true}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; reject can not be true with action drop")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "reject": true}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; reject is only supported with action deny")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "action": "deny", "reject": "maybe"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; reject was not understood; `maybe`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "action": "nope"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; action was not understood; `nope`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "a", "priority": "high"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; priority did not parse; strconv.Atoi: parsing \"high\": invalid syntax")
+
+	// Test icmp_id
+	icmpID := uint16(1234)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "icmp", "host": "a", "icmp_id": 1234}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoICMP, startPort: 0, endPort: 0, host: "a", opts: RuleOptions{ICMPID: &icmpID}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "a", "icmp_id": 1234}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; icmp_id is only supported with proto icmp")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "icmp", "host": "a", "icmp_id": 70000}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; icmp_id did not parse; strconv.ParseUint: parsing \"70000\": value out of range")
+
+	// Test min_len and max_len
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "a", "min_len": 64, "max_len": "1400"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoTCP, startPort: 80, endPort: 80, host: "a", opts: RuleOptions{MinLen: 64, MaxLen: 1400}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "a", "min_len": "big"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; min_len did not parse; strconv.Atoi: parsing \"big\": invalid syntax")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "a", "max_len": 0}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; max_len must be positive")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "a", "min_len": 100, "max_len": 50}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; min_len is greater than max_len")
+}
+
+func TestAddFirewallRulesFromConfig_ProtoMismatch(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	mf := &mockFirewall{}
+
+	// code with tcp is matched as a port
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"outbound": []interface{}{
+		map[interface{}]interface{}{"port": "any", "proto": "icmp", "host": "a"},
+		map[interface{}]interface{}{"code": "3", "proto": "tcp", "host": "a"},
+	}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, false, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: false, proto: firewall.ProtoTCP, startPort: 3, endPort: 3, groups: nil, host: "a", ip: nil, localIp: nil}, mf.lastCall)
+	assert.Contains(t, ob.String(), "firewall.outbound rule #1; code is only meaningful for icmp, it will be matched as a tcp port")
+	assert.NotContains(t, ob.String(), "rule #0")
+
+	// A port with icmp can never match
+	ob.Reset()
+	conf = config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "fragment", "proto": "icmp", "host": "a"},
+		map[interface{}]interface{}{"code": "any", "proto": "icmp", "host": "a"},
+		map[interface{}]interface{}{"port": "80", "proto": "icmp", "host": "a"},
+	}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Contains(t, ob.String(), "firewall.inbound rule #2; port is not meaningful for icmp")
+	assert.NotContains(t, ob.String(), "rule #0")
+	assert.NotContains(t, ob.String(), "rule #1")
+}
+
+func TestAddFirewallRulesFromConfig_ProtoList(t *testing.T) {
+	l := test.NewLogger()
+	conf := config.NewC(l)
+
+	// Each proto is added in order, however the list was written
+	mf := &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "53", "proto": []interface{}{"udp", "tcp", "udp"}, "host": "a"},
+	}}
+	assert.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, []addRuleCall{
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 53, endPort: 53, host: "a"},
+		{incoming: true, proto: firewall.ProtoUDP, startPort: 53, endPort: 53, host: "a"},
+	}, mf.calls)
+
+	c := &cert.NebulaCertificate{}
+	hashes := func(protos ...interface{}) string {
+		conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "53", "proto": protos, "host": "a"},
+		}}
+		fw, err := NewFirewallFromConfig(l, c, conf)
+		require.NoError(t, err)
+		return fw.GetRuleHashes()
+	}
+	assert.Equal(t, hashes("tcp", "udp"), hashes("udp", "tcp"))
+
+	// A list of one is the same as the scalar
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "any", "proto": []interface{}{"any"}, "host": "a"},
+	}}
+	assert.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, []addRuleCall{{incoming: true, proto: firewall.ProtoAny, host: "a"}}, mf.calls)
+
+	// Options that need a proto are checked against all of them
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "53", "proto": []interface{}{"tcp", "udp"}, "host": "a", "source_port": "1024-"},
+	}}
+	assert.NoError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "53", "proto": []interface{}{"tcp", "udp"}, "host": "a", "conntrack_timeout": "1m"},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; conntrack_timeout is only supported with proto udp")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "53", "proto": []interface{}{"tcp", "any"}, "host": "a"},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; proto any can not be listed with other protos")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "53", "proto": []interface{}{"tcp", "sctp"}, "host": "a"},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; proto was not understood; `sctp`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "53", "proto": []interface{}{}, "host": "a"},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; proto list is empty")
+}
+
+func TestAddFirewallRulesFromConfig_GroupSets(t *testing.T) {
+	l := test.NewLogger()
+	conf := config.NewC(l)
+
+	// The flat form is a single set
+	mf := &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "1", "proto": "tcp", "groups": []interface{}{"a", "b"}},
+	}}
+	assert.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, []addRuleCall{
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 1, endPort: 1, groups: []string{"a", "b"}},
+	}, mf.calls)
+
+	// The nested form adds a rule for every set
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "1", "proto": "tcp", "host": "h", "groups": []interface{}{
+			[]interface{}{"a", "b"},
+			[]interface{}{"c"},
+		}},
+	}}
+	assert.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, []addRuleCall{
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 1, endPort: 1, groups: []string{"a", "b"}, host: "h"},
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 1, endPort: 1, groups: []string{"c"}, host: "h"},
+	}, mf.calls)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "1", "proto": "tcp", "groups": []interface{}{[]interface{}{"a", "b"}, "c"}},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; groups mixes groups and lists of groups, entry #1 should be a list")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "1", "proto": "tcp", "groups": []interface{}{[]interface{}{"a"}, []interface{}{}}},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; groups entry #1 is an empty list")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "1", "proto": "tcp", "group": "a", "groups": []interface{}{[]interface{}{"b"}}},
+	}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; only one of group or groups should be defined, both provided")
+
+	// (a AND b) OR c
+	c := &cert.NebulaCertificate{}
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, c, metrics.NewRegistry())
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "1", "proto": "tcp", "groups": []interface{}{
+			[]interface{}{"a", "b"},
+			[]interface{}{"c"},
+		}},
+	}}
+	assert.NoError(t, AddFirewallRulesFromConfig(l, true, conf, fw))
+
+	p := firewall.Packet{LocalPort: 1, Protocol: firewall.ProtoTCP}
+	for _, tc := range []struct {
+		groups []string
+		want   bool
+	}{
+		{[]string{"a"}, false},
+		{[]string{"b"}, false},
+		{[]string{"a", "b"}, true},
+		{[]string{"c"}, true},
+		{[]string{"a", "c"}, true},
+		{[]string{"d"}, false},
+	} {
+		c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{}}}
+		for _, g := range tc.groups {
+			c.Details.InvertedGroups[g] = struct{}{}
+		}
+		assert.Equal(t, tc.want, fw.InRules().match(p, packetInfo{length: -1}, true, c, nil), tc.groups)
+	}
+}
+
+func TestAddFirewallRulesFromConfig_RuleConfigError(t *testing.T) {
+	l := test.NewLogger()
+	mf := &mockFirewall{}
+
+	load := func(rules ...interface{}) *RuleConfigError {
+		conf := config.NewC(l)
+		conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": rules}
+		err := AddFirewallRulesFromConfig(l, true, conf, mf)
+		var rce *RuleConfigError
+		if !assert.ErrorAs(t, err, &rce) {
+			return &RuleConfigError{}
+		}
+		return rce
+	}
+
+	ok := map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"}
+
+	// The field that is wrong and the underlying error are kept, the message is the same as always
+	rce := load(ok, map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any", "cidr": "nope"})
+	assert.Equal(t, "firewall.inbound", rce.Table)
+	assert.Equal(t, 1, rce.Index)
+	assert.Equal(t, "cidr", rce.Field)
+	var pe *net.ParseError
+	assert.ErrorAs(t, rce, &pe)
+	assert.EqualError(t, rce, "firewall.inbound rule #1; cidr did not parse; invalid CIDR address: nope")
+
+	rce = load(map[interface{}]interface{}{"code": "a", "proto": "icmp", "host": "any"})
+	assert.Equal(t, 0, rce.Index)
+	assert.Equal(t, "code", rce.Field)
+
+	rce = load(map[interface{}]interface{}{"port": "any", "proto": "udp", "host": "any", "tcp_flags": "ack"})
+	assert.Equal(t, "tcp_flags", rce.Field)
+
+	// Rules that are wrong as a whole have no field
+	rce = load(map[interface{}]interface{}{"port": "any", "proto": "any"})
+	assert.Equal(t, "", rce.Field)
+	assert.EqualError(t, rce, "firewall.inbound rule #0; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided")
+
+	addErr := errors.New("test error")
+	mf.nextCallReturn = addErr
+	rce = load(ok)
+	assert.Equal(t, "", rce.Field)
+	assert.ErrorIs(t, rce, addErr)
+	assert.EqualError(t, rce, "firewall.inbound rule #0; `test error`")
 }
 
 func TestTCPRTTTracking(t *testing.T) {
@@ -830,83 +2816,390 @@ func TestTCPRTTTracking(t *testing.T) {
 	binary.BigEndian.PutUint32(b[60+4:60+8], 1)
 
 	c := &conn{}
-	setTCPRTTTracking(c, b)
+	f.setTCPRTTTracking(c, b, time.Now())
 	assert.Equal(t, uint32(1), c.Seq)
 
 	// Bad ack - no ack flag
 	binary.BigEndian.PutUint32(b[60+8:60+12], 80)
-	assert.False(t, f.checkTCPRTT(c, b))
+	assert.False(t, f.checkTCPRTT(c, b, time.Now()))
 
 	// Bad ack, number is too low
 	binary.BigEndian.PutUint32(b[60+8:60+12], 0)
 	b[60+13] = uint8(0x10)
-	assert.False(t, f.checkTCPRTT(c, b))
+	assert.False(t, f.checkTCPRTT(c, b, time.Now()))
 
 	// Good ack
 	binary.BigEndian.PutUint32(b[60+8:60+12], 80)
-	assert.True(t, f.checkTCPRTT(c, b))
+	assert.True(t, f.checkTCPRTT(c, b, time.Now()))
 	assert.Equal(t, uint32(0), c.Seq)
 
 	// Set SEQ to 1
 	binary.BigEndian.PutUint32(b[60+4:60+8], 1)
 	c = &conn{}
-	setTCPRTTTracking(c, b)
+	f.setTCPRTTTracking(c, b, time.Now())
 	assert.Equal(t, uint32(1), c.Seq)
 
 	// Good acks
 	binary.BigEndian.PutUint32(b[60+8:60+12], 81)
-	assert.True(t, f.checkTCPRTT(c, b))
+	assert.True(t, f.checkTCPRTT(c, b, time.Now()))
 	assert.Equal(t, uint32(0), c.Seq)
 
 	// Set SEQ to max uint32 - 20
 	binary.BigEndian.PutUint32(b[60+4:60+8], ^uint32(0)-20)
 	c = &conn{}
-	setTCPRTTTracking(c, b)
+	f.setTCPRTTTracking(c, b, time.Now())
 	assert.Equal(t, ^uint32(0)-20, c.Seq)
 
 	// Good acks
 	binary.BigEndian.PutUint32(b[60+8:60+12], 81)
-	assert.True(t, f.checkTCPRTT(c, b))
+	assert.True(t, f.checkTCPRTT(c, b, time.Now()))
 	assert.Equal(t, uint32(0), c.Seq)
 
 	// Set SEQ to max uint32 / 2
 	binary.BigEndian.PutUint32(b[60+4:60+8], ^uint32(0)/2)
 	c = &conn{}
-	setTCPRTTTracking(c, b)
+	f.setTCPRTTTracking(c, b, time.Now())
 	assert.Equal(t, ^uint32(0)/2, c.Seq)
 
 	// Below
 	binary.BigEndian.PutUint32(b[60+8:60+12], ^uint32(0)/2-1)
-	assert.False(t, f.checkTCPRTT(c, b))
+	assert.False(t, f.checkTCPRTT(c, b, time.Now()))
 	assert.Equal(t, ^uint32(0)/2, c.Seq)
 
 	// Halfway below
 	binary.BigEndian.PutUint32(b[60+8:60+12], uint32(0))
-	assert.False(t, f.checkTCPRTT(c, b))
+	assert.False(t, f.checkTCPRTT(c, b, time.Now()))
 	assert.Equal(t, ^uint32(0)/2, c.Seq)
 
 	// Halfway above is ok
 	binary.BigEndian.PutUint32(b[60+8:60+12], ^uint32(0))
-	assert.True(t, f.checkTCPRTT(c, b))
+	assert.True(t, f.checkTCPRTT(c, b, time.Now()))
 	assert.Equal(t, uint32(0), c.Seq)
 
 	// Set SEQ to max uint32
 	binary.BigEndian.PutUint32(b[60+4:60+8], ^uint32(0))
 	c = &conn{}
-	setTCPRTTTracking(c, b)
+	f.setTCPRTTTracking(c, b, time.Now())
 	assert.Equal(t, ^uint32(0), c.Seq)
 
 	// Halfway + 1 above
 	binary.BigEndian.PutUint32(b[60+8:60+12], ^uint32(0)/2+1)
-	assert.False(t, f.checkTCPRTT(c, b))
+	assert.False(t, f.checkTCPRTT(c, b, time.Now()))
 	assert.Equal(t, ^uint32(0), c.Seq)
 
 	// Halfway above
 	binary.BigEndian.PutUint32(b[60+8:60+12], ^uint32(0)/2)
-	assert.True(t, f.checkTCPRTT(c, b))
+	assert.True(t, f.checkTCPRTT(c, b, time.Now()))
+	assert.Equal(t, uint32(0), c.Seq)
+
+	// FIN packets are not timed
+	b[60+13] = tcpFIN | tcpACK
+	c = &conn{}
+	f.setTCPRTTTracking(c, b, time.Now())
 	assert.Equal(t, uint32(0), c.Seq)
 }
 
+func TestTCPRTTTracking_Malformed(t *testing.T) {
+	f := Firewall{
+		metricTCPRTT: metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015)),
+	}
+
+	// The smallest packet that is timed, a 20 byte ip header, a 20 byte tcp header and a byte of data
+	b := make([]byte, ipv4.HeaderLen+21)
+	b[0] = 0x45
+	b[ipv4.HeaderLen+12] = 5 << 4
+	binary.BigEndian.PutUint32(b[ipv4.HeaderLen+4:], 100)
+	c := &conn{}
+	f.setTCPRTTTracking(c, b[:ipv4.HeaderLen+20], time.Now())
+	assert.Zero(t, c.Seq)
+	f.setTCPRTTTracking(c, b, time.Now())
+	assert.Equal(t, uint32(100), c.Seq)
+
+	// The smallest ack the helpers read, a 20 byte ip header and the tcp header up to the flags
+	b = b[:ipv4.HeaderLen+tcpRTTHeaderLen]
+	b[ipv4.HeaderLen+13] = tcpACK
+	binary.BigEndian.PutUint32(b[ipv4.HeaderLen+8:], 101)
+	assert.True(t, f.checkTCPRTT(c, b, time.Now()))
+
+	for name, p := range map[string][]byte{
+		"nil":                 nil,
+		"empty":               {},
+		"ip header only":      b[:ipv4.HeaderLen],
+		"truncated flags":     b[:ipv4.HeaderLen+tcpRTTHeaderLen-1],
+		"ip header too short": append([]byte{0x44}, b[1:]...),
+		"ip header too long":  append([]byte{0x4f}, b[1:]...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := &conn{}
+			f.setTCPRTTTracking(c, p, time.Now())
+			assert.Equal(t, uint32(0), c.Seq)
+
+			// Tracking is left as it was
+			c = &conn{Seq: 100}
+			assert.False(t, f.checkTCPRTT(c, p, time.Now()))
+			assert.Equal(t, uint32(100), c.Seq)
+		})
+	}
+	assert.Equal(t, int64(1), f.metricTCPRTT.Count())
+
+	// Every ip header length with every length of packet up to the largest header the helpers can read, filled with
+	// every flag so nothing is skipped for the flags
+	for ihl := 0; ihl < 16; ihl++ {
+		for n := 0; n <= 60+tcpRTTHeaderLen; n++ {
+			p := bytes.Repeat([]byte{0xff}, n)
+			if n > 0 {
+				p[0] = 0x40 | byte(ihl)
+			}
+
+			assert.NotPanics(t, func() {
+				c := &conn{}
+				f.setTCPRTTTracking(c, p, time.Now())
+				c.Seq = 1
+				f.checkTCPRTT(c, p, time.Now())
+			}, "ihl %d, length %d", ihl, n)
+		}
+	}
+}
+
+func TestTCPRTTTracking_Continuous(t *testing.T) {
+	f := Firewall{
+		metricTCPRTT: metrics.NewHistogram(metrics.NewUniformSample(100)),
+	}
+
+	// data returns a packet we send with n bytes of data starting at seq, ack returns one acking up to ack
+	data := func(seq uint32, n int) []byte {
+		b := make([]byte, ipv4.HeaderLen+20+n)
+		b[0] = 0x45
+		b[ipv4.HeaderLen+12] = 5 << 4
+		b[ipv4.HeaderLen+13] = tcpACK
+		binary.BigEndian.PutUint32(b[ipv4.HeaderLen+4:], seq)
+		return b
+	}
+	ack := func(ack uint32) []byte {
+		b := data(0, 0)
+		binary.BigEndian.PutUint32(b[ipv4.HeaderLen+8:], ack)
+		return b
+	}
+
+	// Every packet after an ack is timed, so the flow keeps adding samples
+	start := time.Now()
+	c := &conn{}
+	f.setTCPRTTTracking(c, data(1000, 100), start)
+	assert.Equal(t, uint32(1000), c.Seq)
+	assert.True(t, f.checkTCPRTT(c, ack(1100), start.Add(10*time.Millisecond)))
+	f.setTCPRTTTracking(c, data(1100, 100), start.Add(20*time.Millisecond))
+	assert.Equal(t, uint32(1100), c.Seq)
+	assert.True(t, f.checkTCPRTT(c, ack(1200), start.Add(35*time.Millisecond)))
+	assert.Equal(t, int64(2), f.metricTCPRTT.Count())
+	assert.Equal(t, int64(15*time.Millisecond), f.metricTCPRTT.Max())
+
+	// Packets without data are not timed, they are never acked on their own
+	f.setTCPRTTTracking(c, data(1200, 0), start)
+	assert.Zero(t, c.Seq)
+
+	// A retransmission of the packet being timed gives up on it, the ack could be for either
+	f.setTCPRTTTracking(c, data(1200, 100), start.Add(time.Second))
+	assert.Equal(t, uint32(1200), c.Seq)
+	f.setTCPRTTTracking(c, data(1200, 100), start.Add(2*time.Second))
+	assert.Zero(t, c.Seq)
+	assert.False(t, f.checkTCPRTT(c, ack(1300), start.Add(2*time.Second+10*time.Millisecond)))
+
+	// Retransmissions of older data are never timed, even when nothing is being timed
+	f.setTCPRTTTracking(c, data(1100, 100), start.Add(3*time.Second))
+	assert.Zero(t, c.Seq)
+	f.setTCPRTTTracking(c, data(1250, 100), start.Add(3*time.Second))
+	assert.Zero(t, c.Seq)
+	assert.Equal(t, uint32(1350), c.sentEnd)
+
+	// New data is
+	f.setTCPRTTTracking(c, data(1350, 100), start.Add(3*time.Second))
+	assert.Equal(t, uint32(1350), c.Seq)
+	assert.True(t, f.checkTCPRTT(c, ack(1450), start.Add(3*time.Second+5*time.Millisecond)))
+	assert.Equal(t, int64(3), f.metricTCPRTT.Count())
+
+	// With a minimum interval, the next packet timed is the first sent that long after the last one timed
+	f.tcpRTTMinInterval = time.Second
+	f.setTCPRTTTracking(c, data(1450, 100), start.Add(3*time.Second+500*time.Millisecond))
+	assert.Zero(t, c.Seq)
+	f.setTCPRTTTracking(c, data(1550, 100), start.Add(4*time.Second))
+	assert.Equal(t, uint32(1550), c.Seq)
+	assert.True(t, f.checkTCPRTT(c, ack(1650), start.Add(4*time.Second+5*time.Millisecond)))
+
+	// Across the wrap of the sequence numbers
+	f.tcpRTTMinInterval = 0
+	c = &conn{}
+	f.setTCPRTTTracking(c, data(0xffffff00, 0x80), start)
+	assert.Equal(t, uint32(0xffffff00), c.Seq)
+	assert.True(t, f.checkTCPRTT(c, ack(0xffffff80), start))
+	f.setTCPRTTTracking(c, data(0xffffff80, 0x100), start)
+	assert.Equal(t, uint32(0xffffff80), c.Seq)
+	assert.Equal(t, uint32(0x80), c.sentEnd)
+	assert.True(t, f.checkTCPRTT(c, ack(0x80), start))
+	f.setTCPRTTTracking(c, data(0xffffff80, 0x100), start)
+	assert.Zero(t, c.Seq)
+	f.setTCPRTTTracking(c, data(0x80, 0x100), start)
+	assert.Equal(t, uint32(0x80), c.Seq)
+}
+
+// rttCapture is a tcp flow over loopback with timestamps on, a client connecting, sending ping, reading pong and
+// closing. Every packet is as captured, ip header included.
+var rttCapture = []struct {
+	name     string
+	outbound bool
+	hex      string
+}{
+	{"syn", true, "4500003c655840004006d7617f0000017f00000191a6b813f039a1db00000000a002ffd7fe3000000204ffd70402080a26a0c01f000000000103030a"},
+	{"syn-ack", false, "4500003c0000400040063cba7f0000017f000001b81391a68075c737f039a1dca012ffcbfe3000000204ffd70402080aeb27f02526a0c01f0103030a"},
+	{"ack", true, "45000034655940004006d7687f0000017f00000191a6b813f039a1dc8075c73880100040fe2800000101080a26a0c01feb27f025"},
+	{"ping", true, "45000038655a40004006d7637f0000017f00000191a6b813f039a1dc8075c73880180040fe2c00000101080a26a0c051eb27f02570696e67"},
+	{"ack ping", false, "45000034320a400040060ab87f0000017f000001b81391a68075c738f039a1e080100040fe2800000101080aeb27f05726a0c051"},
+	{"pong", false, "45000038320b400040060ab37f0000017f000001b81391a68075c738f039a1e080180040fe2c00000101080aeb27f08926a0c051706f6e67"},
+	{"ack pong", true, "45000034655b40004006d7667f0000017f00000191a6b813f039a1e08075c73c80100040fe2800000101080a26a0c083eb27f089"},
+	{"server fin", false, "45000034320c400040060ab67f0000017f000001b81391a68075c73cf039a1e080110040fe2800000101080aeb27f0bb26a0c083"},
+	{"ack server fin", true, "45000034655c40004006d7657f0000017f00000191a6b813f039a1e08075c73d80100040fe2800000101080a26a0c0e1eb27f0bb"},
+	{"client fin", true, "45000034655d40004006d7647f0000017f00000191a6b813f039a1e08075c73d80110040fe2800000101080a26a0c14beb27f0bb"},
+	{"ack client fin", false, "450000340000400040063cc27f0000017f000001b81391a68075c73df039a1e180100040908b00000101080aeb27f15226a0c14b"},
+}
+
+// rttCapturePacket returns the packet from rttCapture called name
+func rttCapturePacket(t *testing.T, name string) []byte {
+	for _, p := range rttCapture {
+		if p.name == name {
+			b, err := hex.DecodeString(p.hex)
+			require.NoError(t, err)
+			return b
+		}
+	}
+	t.Fatalf("no packet %s", name)
+	return nil
+}
+
+func TestTCPRTTTracking_Timestamps(t *testing.T) {
+	f := Firewall{
+		metricTCPRTT: metrics.NewHistogram(metrics.NewUniformSample(100)),
+	}
+
+	// Play the flow from the client side, each packet a millisecond apart. The syn and ping are timed by their TSval,
+	// the acks that carry no data and the fins are not.
+	start := time.Now()
+	c := &conn{}
+	var samples []string
+	for i, p := range rttCapture {
+		now := start.Add(time.Duration(i) * time.Millisecond)
+		b := rttCapturePacket(t, p.name)
+		if p.outbound {
+			f.setTCPRTTTracking(c, b, now)
+		} else if f.checkTCPRTT(c, b, now) {
+			samples = append(samples, p.name)
+		}
+		assert.Zero(t, c.Seq, p.name)
+	}
+
+	assert.Equal(t, []string{"syn-ack", "ack ping"}, samples)
+	assert.Equal(t, int64(2), f.metricTCPRTT.Count())
+	assert.Equal(t, int64(time.Millisecond), f.metricTCPRTT.Min())
+	assert.Equal(t, int64(time.Millisecond), f.metricTCPRTT.Max())
+	assert.False(t, c.tsPending)
+
+	// The ping is timed by its TSval, not its sequence number
+	c = &conn{}
+	f.setTCPRTTTracking(c, rttCapturePacket(t, "ping"), start)
+	assert.True(t, c.tsPending)
+	assert.Equal(t, uint32(0x26a0c051), c.tsVal)
+	assert.Zero(t, c.Seq)
+
+	// Packets without the ack flag, and an echo of an earlier TSval, don't end the wait
+	noAck := rttCapturePacket(t, "ack ping")
+	noAck[ipv4.HeaderLen+13] = 0
+	assert.False(t, f.checkTCPRTT(c, noAck, start))
+	assert.False(t, f.checkTCPRTT(c, rttCapturePacket(t, "syn-ack"), start))
+	assert.True(t, c.tsPending)
+
+	// An echo of a later TSval means the ack we wanted was missed, nothing is recorded and the next packet is timed
+	later := rttCapturePacket(t, "ack ping")
+	binary.BigEndian.PutUint32(later[ipv4.HeaderLen+28:], 0x26a0c052)
+	assert.False(t, f.checkTCPRTT(c, later, start.Add(time.Second)))
+	assert.False(t, c.tsPending)
+	assert.Equal(t, int64(2), f.metricTCPRTT.Count())
+
+	// Sending the ping again is a retransmission and is not timed, the data after it is
+	f.setTCPRTTTracking(c, rttCapturePacket(t, "ping"), start)
+	assert.False(t, c.tsPending)
+	next := rttCapturePacket(t, "ping")
+	binary.BigEndian.PutUint32(next[ipv4.HeaderLen+4:], 0xf039a1e0)
+	f.setTCPRTTTracking(c, next, start)
+	assert.True(t, c.tsPending)
+
+	// An inbound packet without timestamps can't end the wait either
+	noTS := rttCapturePacket(t, "ack ping")
+	copy(noTS[ipv4.HeaderLen+20:], bytes.Repeat([]byte{1}, 12))
+	assert.False(t, f.checkTCPRTT(c, noTS, start))
+	assert.True(t, c.tsPending)
+
+	assert.True(t, f.checkTCPRTT(c, rttCapturePacket(t, "ack ping"), start.Add(3*time.Millisecond)))
+	assert.Equal(t, int64(3), f.metricTCPRTT.Count())
+	assert.Equal(t, int64(3*time.Millisecond), f.metricTCPRTT.Max())
+}
+
+func TestTCPRTTTracking_TimestampsFallback(t *testing.T) {
+	f := Firewall{
+		metricTCPRTT: metrics.NewHistogram(metrics.NewUniformSample(100)),
+	}
+
+	// stripped returns the packet called name with its timestamps option replaced by nops
+	stripped := func(name string) []byte {
+		b := rttCapturePacket(t, name)
+		copy(b[ipv4.HeaderLen+20:ipv4.HeaderLen+32], bytes.Repeat([]byte{1}, 12))
+		return b
+	}
+
+	// Without timestamps the ping is timed by its sequence number, and the ack of it is still found
+	start := time.Now()
+	c := &conn{}
+	f.setTCPRTTTracking(c, stripped("ping"), start)
+	assert.False(t, c.tsPending)
+	assert.Equal(t, uint32(0xf039a1dc), c.Seq)
+	assert.True(t, f.checkTCPRTT(c, stripped("ack ping"), start.Add(time.Millisecond)))
+	assert.Zero(t, c.Seq)
+	assert.Equal(t, int64(time.Millisecond), f.metricTCPRTT.Max())
+
+	// Options that can't be walked are as good as none
+	for name, mangle := range map[string]func(b []byte){
+		"timestamps length too long":  func(b []byte) { b[ipv4.HeaderLen+23] = 20 },
+		"timestamps length too short": func(b []byte) { b[ipv4.HeaderLen+23] = 6 },
+		"option length zero":          func(b []byte) { b[ipv4.HeaderLen+20] = 2; b[ipv4.HeaderLen+21] = 0 },
+		"end of options first":        func(b []byte) { b[ipv4.HeaderLen+20] = 0 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := rttCapturePacket(t, "ping")
+			mangle(b)
+			c := &conn{}
+			f.setTCPRTTTracking(c, b, start)
+			assert.False(t, c.tsPending)
+			assert.Equal(t, uint32(0xf039a1dc), c.Seq)
+		})
+	}
+
+	// Without a data offset that fits there is no telling how much data there is, nothing is timed
+	for name, doff := range map[string]byte{"data offset past the end": 15, "data offset below minimum": 4} {
+		t.Run(name, func(t *testing.T) {
+			b := rttCapturePacket(t, "ping")
+			b[ipv4.HeaderLen+12] = doff << 4
+			c := &conn{}
+			f.setTCPRTTTracking(c, b, start)
+			assert.False(t, c.tsPending)
+			assert.Zero(t, c.Seq)
+			assert.Zero(t, c.sentEnd)
+		})
+	}
+
+	// A timestamps option cut short by the end of the packet
+	b := rttCapturePacket(t, "ack ping")[:ipv4.HeaderLen+30]
+	c = &conn{tsPending: true, tsVal: 0x26a0c051}
+	assert.False(t, f.checkTCPRTT(c, b, start))
+	assert.True(t, c.tsPending)
+}
+
 func TestFirewall_convertRule(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
@@ -954,14 +3247,16 @@ type addRuleCall struct {
 	localIp   *net.IPNet
 	caName    string
 	caSha     string
+	opts      RuleOptions
 }
 
 type mockFirewall struct {
 	lastCall       addRuleCall
+	calls          []addRuleCall
 	nextCallReturn error
 }
 
-func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error {
+func (mf *mockFirewall) AddRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, opts RuleOptions) error {
 	mf.lastCall = addRuleCall{
 		incoming:  incoming,
 		proto:     proto,
@@ -973,7 +3268,9 @@ func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, end
 		localIp:   localIp,
 		caName:    caName,
 		caSha:     caSha,
+		opts:      opts,
 	}
+	mf.calls = append(mf.calls, mf.lastCall)
 
 	err := mf.nextCallReturn
 	mf.nextCallReturn = nil
@@ -981,7 +3278,104 @@ func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, end
 }
 
 func resetConntrack(fw *Firewall) {
-	fw.Conntrack.Lock()
-	fw.Conntrack.Conns = map[firewall.Packet]*conn{}
-	fw.Conntrack.Unlock()
+	fw.Conntrack.lockAll()
+	for _, s := range fw.Conntrack.shards {
+		s.clear()
+	}
+	fw.Conntrack.unlockAll()
+}
+
+// newTestHost returns a tunnel to a peer with a certificate from details, as Drop is given them. The certificate has
+// the vpn ip 1.2.3.4/24 unless details has ips of its own, the tunnel is to the first of them.
+func newTestHost(details cert.NebulaCertificateDetails) (*HostInfo, *cert.NebulaCertificate) {
+	if len(details.Ips) == 0 {
+		details.Ips = []*net.IPNet{{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}}
+	}
+
+	c := &cert.NebulaCertificate{Details: details}
+	h := &HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: c,
+		},
+		vpnIp: iputil.Ip2VpnIp(details.Ips[0].IP),
+	}
+	h.CreateRemoteCIDR(c)
+
+	return h, c
+}
+
+// setRulesVersion puts the rules in use back in place with version v, as a reload would with new rules
+func setRulesVersion(fw *Firewall, v uint16) {
+	rs := *fw.ruleset.Load()
+	rs.version = v
+	fw.ruleset.Store(&rs)
+}
+
+// conns returns every entry in conntrack, across all shards
+func (ct *FirewallConntrack) conns() map[firewall.Packet]*conn {
+	ct.lockAll()
+	defer ct.unlockAll()
+
+	conns := map[firewall.Packet]*conn{}
+	for _, s := range ct.shards {
+		for fp, c := range s.Conns {
+			conns[fp] = c
+		}
+	}
+	return conns
+}
+
+func TestFirewall_ConntrackForHost(t *testing.T) {
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, metrics.NewRegistry())
+	hostA := iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4))
+	hostB := iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5))
+
+	fw.addConn([]byte{}, firewall.Packet{RemoteIP: hostA, LocalPort: 22, RemotePort: 5000, Protocol: firewall.ProtoTCP}, true, RuleOptions{})
+	fw.addConn([]byte{}, firewall.Packet{RemoteIP: hostA, LocalPort: 5001, RemotePort: 53, Protocol: firewall.ProtoUDP}, false, RuleOptions{})
+	fw.addConn([]byte{}, firewall.Packet{RemoteIP: hostB, Protocol: firewall.ProtoICMP}, false, RuleOptions{})
+
+	entries := fw.ConntrackForHost(hostA)
+	assert.Len(t, entries, 2)
+	for _, e := range entries {
+		assert.Equal(t, hostA, e.Packet.RemoteIP)
+	}
+	assert.Len(t, fw.ConntrackForHost(hostB), 1)
+	assert.Empty(t, fw.ConntrackForHost(iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 6))))
+
+	// Entries are copies
+	entries[0].Incoming = !entries[0].Incoming
+	assert.Equal(t, !entries[0].Incoming, fw.Conntrack.shard(entries[0].Packet).Conns[entries[0].Packet].incoming)
+
+	fw.FlushConntrackFor(hostA)
+	assert.Empty(t, fw.ConntrackForHost(hostA))
+}
+
+func TestFirewall_ConntrackHighWater(t *testing.T) {
+	r := metrics.NewRegistry()
+	fw := NewFirewall(test.NewLogger(), time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{}, r)
+	fw.Conntrack = newFirewallConntrack(4, time.Second, time.Hour)
+
+	highWater := func() int64 {
+		t.Helper()
+		fw.EmitStats()
+		return r.Get("firewall.conntrack.high_water").(metrics.Gauge).Value()
+	}
+
+	assert.Zero(t, highWater())
+
+	for i := 0; i < 10; i++ {
+		fw.addConn([]byte{}, firewall.Packet{RemotePort: uint16(i + 1), Protocol: firewall.ProtoUDP}, true, RuleOptions{})
+	}
+	assert.Equal(t, int64(10), fw.Conntrack.size.Load())
+	fw.FlushConntrackFor(0)
+	assert.Zero(t, fw.Conntrack.size.Load())
+
+	// The spike is seen even though conntrack is empty again
+	assert.Equal(t, int64(10), highWater())
+	assert.Zero(t, highWater())
+
+	// Entries that are still there count towards the next period
+	fw.addConn([]byte{}, firewall.Packet{RemotePort: 1, Protocol: firewall.ProtoUDP}, true, RuleOptions{})
+	assert.Equal(t, int64(1), highWater())
+	assert.Equal(t, int64(1), highWater())
 }
@@ -0,0 +1,84 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// checkRuleDirection returns an error if a rule with opts can not be added for the direction, checkRule does the rest
+func checkRuleDirection(incoming bool, opts RuleOptions) error {
+	// Outbound packets have not picked an underlay yet
+	if opts.UnderlayCIDR.IsValid() && !incoming {
+		return fmt.Errorf("underlay cidr is only supported for inbound rules")
+	}
+
+	return nil
+}
+
+// matchUnderlay returns true if a rule with o matches a packet that arrived on underlay. An unknown underlay fails
+// closed, an allow rule with an underlay cidr does not match it and a deny rule does. Background revalidation has no
+// underlay, it leaves inbound flows to their next packet when the rules have an underlay cidr, see hasUnderlayRules.
+func (o RuleOptions) matchUnderlay(underlay netip.Addr) bool {
+	if !o.UnderlayCIDR.IsValid() {
+		return true
+	}
+
+	if !underlay.IsValid() {
+		return o.Deny
+	}
+
+	return o.UnderlayCIDR.Contains(underlay)
+}
+
+// hasUnderlayRules returns true if any rule in ft has an underlay cidr
+func (ft *FirewallTable) hasUnderlayRules() bool {
+	for _, or := range ft.ordered {
+		if or.opts.UnderlayCIDR.IsValid() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// underlayIP returns the underlay address the listener for routine q is bound to, the zero Addr if it is not known
+func (f *Interface) underlayIP(q int) netip.Addr {
+	if q < len(f.underlayIPs) {
+		return f.underlayIPs[q]
+	}
+	return netip.Addr{}
+}
+
+// loadUnderlayIPs records the underlay address each routine's listener is bound to, for firewall rules with an
+// underlay_cidr. A listener on the wildcard address is recorded as such and only matches an underlay_cidr that holds
+// it, the address a packet was sent to is not known, see warnUnderlayRules.
+func (f *Interface) loadUnderlayIPs() {
+	f.underlayIPs = make([]netip.Addr, f.routines)
+	for i := range f.underlayIPs {
+		li := f.outside
+		if i > 0 && i < len(f.writers) {
+			li = f.writers[i]
+		}
+
+		if addr, err := li.LocalAddr(); err == nil && addr != nil {
+			ip, _ := netip.AddrFromSlice(addr.IP)
+			f.underlayIPs[i] = ip.Unmap()
+		}
+	}
+}
+
+// warnUnderlayRules logs a warning if fw has inbound rules with an underlay_cidr while a listener is bound to the
+// wildcard address, those rules only match an underlay_cidr that holds the wildcard address itself.
+func (f *Interface) warnUnderlayRules(fw *Firewall) {
+	if !fw.InRules().hasUnderlayRules() {
+		return
+	}
+
+	for _, ip := range f.underlayIPs {
+		if ip.IsUnspecified() {
+			f.l.WithField("underlayIP", ip).
+				Warn("Firewall rules with an underlay_cidr will not match, listen.host is the wildcard address")
+			return
+		}
+	}
+}
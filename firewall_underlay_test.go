@@ -0,0 +1,169 @@
+package nebula
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_UnderlayCIDR(t *testing.T) {
+	l := test.NewLogger()
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"conntrack": map[interface{}]interface{}{"enabled": false},
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"},
+		},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "underlay_cidr": "10.0.0.0/8"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	require.NoError(t, err)
+	assert.Contains(t, fw.getRules(), "underlayCidr: 10.0.0.0/8")
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+
+	assert.NoError(t, fw.DropFromUnderlay(b, p, true, h, cp, nil, net.IPv4(10, 1, 1, 1)))
+	assert.Equal(t, ErrNoMatchingRule, fw.DropFromUnderlay(b, p, true, h, cp, nil, net.IPv4(192, 168, 1, 1)))
+
+	// A wildcard listener doesn't know the address the packet was sent to
+	assert.Equal(t, ErrNoMatchingRule, fw.DropFromUnderlay(b, p, true, h, cp, nil, net.IPv4zero))
+
+	// The same with a netip.Addr, ipv4 mapped into ipv6 is ipv4
+	assert.NoError(t, fw.DropFromUnderlayAddr(b, p, true, h, cp, nil, netip.MustParseAddr("10.1.1.1")))
+	assert.NoError(t, fw.DropFromUnderlayAddr(b, p, true, h, cp, nil, netip.MustParseAddr("::ffff:10.1.1.1")))
+	assert.Equal(t, ErrNoMatchingRule, fw.DropFromUnderlayAddr(b, p, true, h, cp, nil, netip.MustParseAddr("192.168.1.1")))
+
+	// An unknown underlay fails closed
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(b, p, true, h, cp, nil))
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any", "underlay_cidr": "10.0.0.0/8"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.outbound rule #0; underlay_cidr is only supported for inbound rules")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any", "underlay_cidr": "10.0.0.0"},
+		},
+	}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.inbound rule #0; underlay_cidr did not parse; invalid CIDR address: 10.0.0.0")
+
+	underlay := netip.MustParsePrefix("10.0.0.0/8")
+	assert.EqualError(t, fw.AddRuleWithOptions(false, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", "", RuleOptions{UnderlayCIDR: underlay}), "underlay cidr is only supported for inbound rules")
+}
+
+func TestInterface_underlayIPs(t *testing.T) {
+	f := &Interface{routines: 2, outside: udp.NoopConn{}, writers: []udp.Conn{udp.NoopConn{}, udp.NoopConn{}}}
+	f.loadUnderlayIPs()
+	assert.Len(t, f.underlayIPs, 2)
+	assert.False(t, f.underlayIP(0).IsValid())
+	assert.False(t, f.underlayIP(5).IsValid())
+}
+
+func TestFirewall_UnderlayCIDRUnknown(t *testing.T) {
+	l := test.NewLogger()
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	h, c := newTestHost(cert.NebulaCertificateDetails{
+		Name: "host1",
+		Ips:  []*net.IPNet{&ipNet},
+	})
+	cp := cert.NewCAPool()
+	lookup := func(iputil.VpnIp) *HostInfo { return h }
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  22,
+		RemotePort: 40000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	b := tcpTestPacket(tcpSYN)
+	inside := netip.MustParseAddr("10.1.1.1")
+	underlay := netip.MustParsePrefix("10.0.0.0/8")
+
+	// A deny rule with an underlay cidr matches an unknown underlay
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, c, nil)
+	fw.conntrackDisabled = true
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", ""))
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", "", RuleOptions{Priority: 10, Deny: true, UnderlayCIDR: underlay}))
+	assert.Equal(t, ErrDeniedByRule, fw.Drop(b, p, true, h, cp, nil))
+	assert.Equal(t, ErrDeniedByRule, fw.DropFromUnderlayAddr(b, p, true, h, cp, nil, inside))
+	assert.NoError(t, fw.DropFromUnderlayAddr(b, p, true, h, cp, nil, netip.MustParseAddr("192.168.1.1")))
+
+	// A flow allowed by an underlay cidr is only revalidated by a packet that arrived on the underlay
+	fw = NewFirewall(l, time.Minute, time.Minute, time.Minute, c, nil)
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoTCP, 22, 22, []string{}, "any", nil, nil, "", "", RuleOptions{UnderlayCIDR: underlay}))
+	require.NoError(t, fw.DropFromUnderlayAddr(b, p, true, h, cp, nil, inside))
+	fw.RestoreRules(fw.SnapshotRules())
+
+	kept, dropped, ok := fw.revalidateConntrack(lookup, cp, make(chan struct{}))
+	assert.True(t, ok)
+	assert.Zero(t, kept+dropped)
+	assert.NoError(t, fw.Drop(tcpTestPacket(tcpSYN|tcpACK), p, false, h, cp, nil))
+	assert.NotEqual(t, fw.rulesVersion(), fw.Conntrack.conns()[p].rulesVersion)
+
+	assert.NoError(t, fw.DropFromUnderlayAddr(tcpTestPacket(tcpACK), p, true, h, cp, nil, inside))
+	assert.Equal(t, fw.rulesVersion(), fw.Conntrack.conns()[p].rulesVersion)
+
+	// And dropped if that underlay is no longer allowed
+	fw.RestoreRules(fw.SnapshotRules())
+	assert.Equal(t, ErrNoMatchingRule, fw.DropFromUnderlayAddr(tcpTestPacket(tcpACK), p, true, h, cp, nil, netip.MustParseAddr("192.168.1.1")))
+	assert.NotContains(t, fw.Conntrack.conns(), p)
+}
+
+func TestInterface_warnUnderlayRules(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	c := cert.NebulaCertificate{}
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, &c, nil)
+	f := &Interface{l: l, underlayIPs: []netip.Addr{netip.IPv4Unspecified()}}
+
+	// Nothing to warn about without underlay rules
+	f.warnUnderlayRules(fw)
+	assert.Empty(t, ob.String())
+
+	require.NoError(t, fw.AddRuleWithOptions(true, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", "", RuleOptions{UnderlayCIDR: netip.MustParsePrefix("10.0.0.0/8")}))
+	f.underlayIPs = []netip.Addr{netip.MustParseAddr("10.1.1.1")}
+	ob.Reset()
+	f.warnUnderlayRules(fw)
+	assert.Empty(t, ob.String())
+
+	f.underlayIPs = append(f.underlayIPs, netip.IPv6Unspecified())
+	f.warnUnderlayRules(fw)
+	assert.Contains(t, ob.String(), "listen.host is the wildcard address")
+}
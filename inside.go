@@ -9,7 +9,7 @@ import (
 	"github.com/slackhq/nebula/udp"
 )
 
-func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache *firewall.ConntrackCache) {
 	err := newPacket(packet, false, fwPacket)
 	if err != nil {
 		if f.l.Level >= logrus.DebugLevel {
@@ -49,7 +49,7 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 	})
 
 	if hostinfo == nil {
-		f.rejectInside(packet, out, q)
+		f.rejectInside(packet, out, q, nil)
 		if f.l.Level >= logrus.DebugLevel {
 			f.l.WithField("vpnIp", fwPacket.RemoteIP).
 				WithField("fwPacket", fwPacket).
@@ -67,34 +67,43 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, nil, packet, nb, out, q)
 
 	} else {
-		f.rejectInside(packet, out, q)
+		f.rejectInside(packet, out, q, dropReason)
 		if f.l.Level >= logrus.DebugLevel {
 			hostinfo.logger(f.l).
 				WithField("fwPacket", fwPacket).
 				WithField("reason", dropReason).
+				WithField("action", f.firewall.dropAction(dropReason, false)).
 				Debugln("dropping outbound packet")
 		}
 	}
 }
 
-func (f *Interface) rejectInside(packet []byte, out []byte, q int) {
-	if !f.firewall.InSendReject {
+// rejectInside answers an outbound packet that was dropped with a reject written back to the local sender through
+// the tun device, a tcp reset or an icmp destination unreachable, if outbound_action or the deny rule ask for one
+func (f *Interface) rejectInside(packet []byte, out []byte, q int, dropReason error) {
+	if !ShouldReject(dropReason, f.firewall.OutSendReject) {
 		return
 	}
 
 	out = iputil.CreateRejectPacket(packet, out)
-	if len(out) == 0 {
+	if len(out) == 0 || !f.firewall.allowReject(out, false, nil) {
 		return
 	}
+	f.firewall.setRejectICMPCode(out)
 
 	_, err := f.readers[q].Write(out)
 	if err != nil {
 		f.l.WithError(err).Error("Failed to write to tun")
+		return
 	}
+
+	f.firewall.rejectSent(out, false)
 }
 
-func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *HostInfo, nb, out []byte, q int) {
-	if !f.firewall.OutSendReject {
+// rejectOutside answers an inbound packet that was dropped with a reject sent back to the peer through the tunnel, if
+// inbound_action or the deny rule ask for one. ICMP rejects come from our vpn ip.
+func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *HostInfo, nb, out []byte, q int, dropReason error) {
+	if !ShouldReject(dropReason, f.firewall.InSendReject) {
 		return
 	}
 
@@ -113,7 +122,20 @@ func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *
 		return
 	}
 
-	f.sendNoMetrics(header.Message, 0, ci, hostinfo, nil, out, nb, packet, q)
+	if !f.firewall.allowReject(out, true, hostinfo) {
+		return
+	}
+
+	// The peer only takes packets from addresses in our certificate, and an error about a packet we route for comes
+	// from us rather than the address it was for
+	if out[9] == firewall.ProtoICMP {
+		iputil.SetRejectSource(out, f.myVpnIp)
+	}
+	f.firewall.setRejectICMPCode(out)
+
+	if f.sendNoMetrics(header.Message, 0, ci, hostinfo, nil, out, nb, packet, q) {
+		f.firewall.rejectSent(out, true)
+	}
 }
 
 func (f *Interface) Handshake(vpnIp iputil.VpnIp) {
@@ -255,10 +277,11 @@ func (f *Interface) SendVia(via *HostInfo,
 	f.connectionManager.RelayUsed(relay.LocalIndex)
 }
 
-func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udp.Addr, p, nb, out []byte, q int) {
+// sendNoMetrics returns true if the packet was written to the udp socket or handed to a relay
+func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udp.Addr, p, nb, out []byte, q int) bool {
 	if ci.eKey == nil {
 		//TODO: log warning
-		return
+		return false
 	}
 	useRelay := remote == nil && hostinfo.remote == nil
 	fullOut := out
@@ -305,7 +328,7 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 			WithField("udpAddr", remote).WithField("counter", c).
 			WithField("attemptedCounter", c).
 			Error("Failed to encrypt outgoing packet")
-		return
+		return false
 	}
 
 	if remote != nil {
@@ -313,12 +336,14 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
+			return false
 		}
 	} else if hostinfo.remote != nil {
 		err = f.writers[q].WriteTo(out, hostinfo.remote)
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
+			return false
 		}
 	} else {
 		// Try to send via a relay
@@ -330,9 +355,12 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 				continue
 			}
 			f.SendVia(relayHostInfo, relay, out, nb, fullOut[:header.Len+len(out)], true)
-			break
+			return true
 		}
+		return false
 	}
+
+	return true
 }
 
 func isMulticast(ip iputil.VpnIp) bool {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"runtime"
 	"sync/atomic"
@@ -87,6 +88,9 @@ type Interface struct {
 	writers []udp.Conn
 	readers []io.ReadWriteCloser
 
+	// The underlay address each routine's listener is bound to, see loadUnderlayIPs
+	underlayIPs []netip.Addr
+
 	metricHandshakes    metrics.Histogram
 	messageMetrics      *MessageMetrics
 	cachedPacketMetrics *cachedPacketMetrics
@@ -236,6 +240,9 @@ func (f *Interface) activate() {
 }
 
 func (f *Interface) run() {
+	f.loadUnderlayIPs()
+	f.warnUnderlayRules(f.firewall)
+
 	// Launch n queues to read packets from udp
 	for i := 0; i < f.routines; i++ {
 		go f.listenOut(i)
@@ -259,7 +266,7 @@ func (f *Interface) listenOut(i int) {
 	}
 
 	lhh := f.lightHouse.NewRequestHandler()
-	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
+	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout, f.firewall.metricsRegistry)
 	li.ListenOut(readOutsidePackets(f), lhHandleRequest(lhh, f), conntrackCache, i)
 }
 
@@ -271,7 +278,7 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 	fwPacket := &firewall.Packet{}
 	nb := make([]byte, 12, 12)
 
-	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
+	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout, f.firewall.metricsRegistry)
 
 	for {
 		n, err := reader.Read(packet)
@@ -312,8 +319,10 @@ func (f *Interface) reloadDisconnectInvalid(c *config.C) {
 
 func (f *Interface) reloadFirewall(c *config.C) {
 	//TODO: need to trigger/detect if the certificate changed too
-	if c.HasChanged("firewall") == false {
+	if c.HasChanged("firewall") == false && !f.firewall.ruleFiles.changed() {
 		f.l.Debug("No firewall config change detected")
+		// The audit log may have been rotated
+		f.firewall.auditLog.Reopen()
 		return
 	}
 
@@ -324,29 +333,28 @@ func (f *Interface) reloadFirewall(c *config.C) {
 	}
 
 	oldFw := f.firewall
-	conntrack := oldFw.Conntrack
-	conntrack.Lock()
-	defer conntrack.Unlock()
-
-	fw.rulesVersion = oldFw.rulesVersion + 1
-	// If rulesVersion is back to zero, we have wrapped all the way around. Be
-	// safe and just reset conntrack in this case.
-	if fw.rulesVersion == 0 {
-		f.l.WithField("firewallHashes", fw.GetRuleHashes()).
-			WithField("oldFirewallHashes", oldFw.GetRuleHashes()).
-			WithField("rulesVersion", fw.rulesVersion).
-			Warn("firewall rulesVersion has overflowed, resetting conntrack")
-	} else {
-		fw.Conntrack = conntrack
-	}
-
+	fw.DropLogger = oldFw.DropLogger
+	fw.OnNewConn = oldFw.OnNewConn
+	fw.inheritFlowEvents(oldFw)
+	fw.inheritDropEvents(oldFw)
+	fw.inheritQuarantine(oldFw)
+	fw.inheritHostRTTs(oldFw)
+	fw.InheritConntrack(oldFw)
+	fw.startConntrackSweeper()
+	fw.startRuleExpiry()
 	f.firewall = fw
+	f.warnUnderlayRules(fw)
+	if fw.revalidateOnReload {
+		fw.startConntrackRevalidation(f.hostMap.QueryVpnIp, f.pki.GetCAPool())
+	}
 
+	fw.auditLog.Record(auditTriggerReload, oldFw.getRules(), fw.getRules(), fw.rulesVersion())
 	oldFw.Destroy()
 	f.l.WithField("firewallHashes", fw.GetRuleHashes()).
 		WithField("oldFirewallHashes", oldFw.GetRuleHashes()).
-		WithField("rulesVersion", fw.rulesVersion).
+		WithField("rulesVersion", fw.rulesVersion()).
 		Info("New firewall has been installed")
+	fw.LogSummary()
 }
 
 func (f *Interface) reloadSendRecvError(c *config.C) {
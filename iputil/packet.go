@@ -6,6 +6,14 @@ import (
 	"golang.org/x/net/ipv4"
 )
 
+const (
+	// RejectICMPCodePortUnreachable is the icmp destination unreachable code CreateRejectPacket uses
+	RejectICMPCodePortUnreachable = 3
+	// RejectICMPCodeAdminProhibited is the icmp destination unreachable code for communication administratively
+	// prohibited, see SetRejectICMPCode
+	RejectICMPCodeAdminProhibited = 13
+)
+
 const (
 	// Need 96 bytes for the largest reject packet:
 	// - 20 byte ipv4 header
@@ -22,11 +30,37 @@ func CreateRejectPacket(packet []byte, out []byte) []byte {
 	switch packet[9] {
 	case 6: // tcp
 		return ipv4CreateRejectTCPPacket(packet, out)
+	case 1: // icmp
+		// Never send an icmp error about an icmp error, two hosts rejecting each other's rejects would loop forever
+		if isICMPError(packet) {
+			return nil
+		}
+		return ipv4CreateRejectICMPPacket(packet, out)
 	default:
 		return ipv4CreateRejectICMPPacket(packet, out)
 	}
 }
 
+// isICMPError returns true if the ipv4 icmp packet is an error message, or if its type can't be seen
+func isICMPError(packet []byte) bool {
+	ihl := int(packet[0]&0x0f) << 2
+	// Only the first fragment carries the icmp header
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 || len(packet) <= ihl {
+		return true
+	}
+
+	switch packet[ihl] {
+	case 3, // destination unreachable
+		4,  // source quench
+		5,  // redirect
+		11, // time exceeded
+		12: // parameter problem
+		return true
+	}
+
+	return false
+}
+
 func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
 	ihl := int(packet[0]&0x0f) << 2
 
@@ -89,13 +123,33 @@ func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
 	return out
 }
 
+// SetRejectSource changes the source address of an icmp reject made by CreateRejectPacket to src. The reject comes from
+// the address the dropped packet was sent to, which may be one we route for rather than our own.
+func SetRejectSource(out []byte, src VpnIp) {
+	binary.BigEndian.PutUint32(out[12:16], uint32(src))
+
+	out[10] = 0
+	out[11] = 0
+	binary.BigEndian.PutUint16(out[10:], tcpipChecksum(out[:ipv4.HeaderLen], 0))
+}
+
+// SetRejectICMPCode changes the destination unreachable code of an icmp reject made by CreateRejectPacket to code
+func SetRejectICMPCode(out []byte, code uint8) {
+	icmpOut := out[ipv4.HeaderLen:]
+	icmpOut[1] = code
+
+	icmpOut[2] = 0
+	icmpOut[3] = 0
+	binary.BigEndian.PutUint16(icmpOut[2:], tcpipChecksum(icmpOut, 0))
+}
+
 func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 	const tcpLen = 20
 
 	ihl := int(packet[0]&0x0f) << 2
 	outLen := ipv4.HeaderLen + tcpLen
 
-	if len(packet) < ihl+tcpLen {
+	if ihl < ipv4.HeaderLen || len(packet) < ihl+tcpLen {
 		// We need at least this many bytes for this to be a valid packet
 		return nil
 	}
@@ -103,6 +157,32 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 		return nil
 	}
 
+	// Only the first fragment has the tcp header to answer
+	if binary.BigEndian.Uint16(packet[6:])&0x1fff != 0 {
+		return nil
+	}
+
+	tcpIn := packet[ihl:]
+	dataOffset := int(tcpIn[12]>>4) << 2
+	if dataOffset < tcpLen {
+		return nil
+	}
+
+	// Never answer a reset with a reset, two hosts rejecting each other's resets would loop forever
+	if tcpIn[13]&0b00000100 != 0 {
+		return nil
+	}
+
+	// The segment ends where the ip packet says it does, the buffer may be longer
+	ipEnd := int(binary.BigEndian.Uint16(packet[2:]))
+	if ipEnd > len(packet) {
+		ipEnd = len(packet)
+	}
+	segLen := ipEnd - ihl - dataOffset
+	if segLen < 0 {
+		segLen = 0
+	}
+
 	out = out[:outLen]
 
 	ipHdr := out[0:ipv4.HeaderLen]
@@ -126,7 +206,6 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 	binary.BigEndian.PutUint16(ipHdr[10:], tcpipChecksum(ipHdr, 0))
 
 	// TCP RST
-	tcpIn := packet[ihl:]
 	var ackSeq, seq uint32
 	outFlags := byte(0b00000100) // RST
 
@@ -139,7 +218,7 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 		inSyn := uint32((tcpIn[13] & 0b00000010) >> 1)
 		inFin := uint32(tcpIn[13] & 0b00000001)
 		// seq from the packet + syn + fin + tcp segment length
-		ackSeq = binary.BigEndian.Uint32(tcpIn[4:]) + inSyn + inFin + uint32(len(tcpIn)) - uint32(tcpIn[12]>>4)<<2
+		ackSeq = binary.BigEndian.Uint32(tcpIn[4:]) + inSyn + inFin + uint32(segLen)
 		outFlags |= 0b00010000 // ACK
 	}
 
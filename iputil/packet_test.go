@@ -1,6 +1,7 @@
 package iputil
 
 import (
+	"encoding/binary"
 	"net"
 	"testing"
 
@@ -13,7 +14,7 @@ func Test_CreateRejectPacket(t *testing.T) {
 		Len:      20,
 		Src:      net.IPv4(10, 0, 0, 1),
 		Dst:      net.IPv4(10, 0, 0, 2),
-		Protocol: 1, // ICMP
+		Protocol: 17, // UDP
 	}
 
 	b, err := h.Marshal()
@@ -28,12 +29,35 @@ func Test_CreateRejectPacket(t *testing.T) {
 	assert.NotNil(t, rejectPacket)
 	assert.Len(t, rejectPacket, expectedLen)
 
-	// ICMP with max header len
+	// The source of an ICMP reject can be changed, the header checksum still adds up
+	SetRejectSource(rejectPacket, Ip2VpnIp(net.IPv4(10, 0, 0, 3)))
+	assert.Equal(t, net.IPv4(10, 0, 0, 3).To4(), net.IP(rejectPacket[12:16]))
+	assert.Equal(t, net.IPv4(10, 0, 0, 1).To4(), net.IP(rejectPacket[16:20]))
+	assert.Zero(t, tcpipChecksum(rejectPacket[:ipv4.HeaderLen], 0))
+
+	// So can the code, the icmp checksum still adds up
+	assert.Equal(t, uint8(RejectICMPCodePortUnreachable), rejectPacket[ipv4.HeaderLen+1])
+	assert.Zero(t, tcpipChecksum(rejectPacket[ipv4.HeaderLen:], 0))
+	SetRejectICMPCode(rejectPacket, RejectICMPCodeAdminProhibited)
+	assert.Equal(t, uint8(RejectICMPCodeAdminProhibited), rejectPacket[ipv4.HeaderLen+1])
+	assert.Zero(t, tcpipChecksum(rejectPacket[ipv4.HeaderLen:], 0))
+
+	// An ICMP error is never rejected, other ICMP is
+	b[9] = 1
+	b[ipv4.HeaderLen] = 3
+	assert.Nil(t, CreateRejectPacket(b, out))
+	b[ipv4.HeaderLen] = 11
+	assert.Nil(t, CreateRejectPacket(b, out))
+	b[ipv4.HeaderLen] = 8
+	assert.NotNil(t, CreateRejectPacket(b, out))
+	assert.Nil(t, CreateRejectPacket(b[:ipv4.HeaderLen], out))
+
+	// UDP with max header len
 	h = ipv4.Header{
 		Len:      60,
 		Src:      net.IPv4(10, 0, 0, 1),
 		Dst:      net.IPv4(10, 0, 0, 2),
-		Protocol: 1, // ICMP
+		Protocol: 17, // UDP
 		Options:  make([]byte, 40),
 	}
 
@@ -64,6 +88,7 @@ func Test_CreateRejectPacket(t *testing.T) {
 	}
 	b = append(b, []byte{0, 3, 0, 4}...)
 	b = append(b, make([]byte, 16)...)
+	b[60+12] = 5 << 4 // data offset
 
 	expectedLen = ipv4.HeaderLen + 20
 	out = make([]byte, expectedLen)
@@ -71,3 +96,97 @@ func Test_CreateRejectPacket(t *testing.T) {
 	assert.NotNil(t, rejectPacket)
 	assert.Len(t, rejectPacket, expectedLen)
 }
+
+// tcpRejectTestPacket returns an ipv4 tcp packet from 10.0.0.1:1000 to 10.0.0.2:22 with a 20 byte tcp header
+func tcpRejectTestPacket(t *testing.T, seq, ack uint32, flags byte, payload int) []byte {
+	h := ipv4.Header{
+		Len:      20,
+		TotalLen: 20 + 20 + payload,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+		Protocol: 6,
+	}
+
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("h.Marhshal: %v", err)
+	}
+
+	tcp := make([]byte, 20+payload)
+	binary.BigEndian.PutUint16(tcp[0:], 1000)
+	binary.BigEndian.PutUint16(tcp[2:], 22)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	return append(b, tcp...)
+}
+
+func Test_CreateRejectPacketTCP(t *testing.T) {
+	const (
+		fin = 0b00000001
+		syn = 0b00000010
+		rst = 0b00000100
+		psh = 0b00001000
+		ack = 0b00010000
+	)
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		seq     uint32
+		ack     uint32
+		flags   byte
+		noReply bool
+	}{
+		// Without an ack the reset acks everything the segment used, so the sender takes it as being about its segment
+		{name: "syn", packet: tcpRejectTestPacket(t, 100, 0, syn, 0), seq: 0, ack: 101, flags: rst | ack},
+		{name: "syn with data", packet: tcpRejectTestPacket(t, 100, 0, syn, 10), seq: 0, ack: 111, flags: rst | ack},
+		{name: "syn fin", packet: tcpRejectTestPacket(t, 100, 0, syn|fin, 0), seq: 0, ack: 102, flags: rst | ack},
+		// With an ack the reset takes its sequence number from it, which the receiver will find in its window
+		{name: "mid stream", packet: tcpRejectTestPacket(t, 5000, 9000, ack|psh, 100), seq: 9000, ack: 0, flags: rst},
+		{name: "fin ack", packet: tcpRejectTestPacket(t, 5000, 9000, ack|fin, 0), seq: 9000, ack: 0, flags: rst},
+		// Never a reset for a reset
+		{name: "rst", packet: tcpRejectTestPacket(t, 5000, 0, rst, 0), noReply: true},
+		{name: "rst ack", packet: tcpRejectTestPacket(t, 5000, 9000, rst|ack, 0), noReply: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := CreateRejectPacket(tt.packet, make([]byte, MaxRejectPacketSize))
+			if tt.noReply {
+				assert.Nil(t, out)
+				return
+			}
+
+			assert.Len(t, out, ipv4.HeaderLen+20)
+			assert.Equal(t, net.IPv4(10, 0, 0, 2).To4(), net.IP(out[12:16]))
+			assert.Equal(t, net.IPv4(10, 0, 0, 1).To4(), net.IP(out[16:20]))
+			assert.Zero(t, tcpipChecksum(out[:ipv4.HeaderLen], 0))
+
+			tcp := out[ipv4.HeaderLen:]
+			assert.Equal(t, uint16(22), binary.BigEndian.Uint16(tcp[0:]))
+			assert.Equal(t, uint16(1000), binary.BigEndian.Uint16(tcp[2:]))
+			assert.Equal(t, tt.seq, binary.BigEndian.Uint32(tcp[4:]))
+			assert.Equal(t, tt.ack, binary.BigEndian.Uint32(tcp[8:]))
+			assert.Equal(t, tt.flags, tcp[13])
+			assert.Zero(t, tcpipChecksum(tcp, ipv4PseudoheaderChecksum(out[12:16], out[16:20], 6, 20)))
+		})
+	}
+
+	// The segment length comes from the ip header, not the size of the buffer it is in
+	b := tcpRejectTestPacket(t, 100, 0, syn, 10)
+	b = append(b, make([]byte, 50)...)
+	out := CreateRejectPacket(b, make([]byte, MaxRejectPacketSize))
+	assert.Equal(t, uint32(111), binary.BigEndian.Uint32(out[ipv4.HeaderLen+8:]))
+
+	// Later fragments have no tcp header to answer
+	b = tcpRejectTestPacket(t, 100, 0, syn, 0)
+	binary.BigEndian.PutUint16(b[6:], 10)
+	assert.Nil(t, CreateRejectPacket(b, make([]byte, MaxRejectPacketSize)))
+
+	// Nor does a header too short to hold the ports and flags
+	b = tcpRejectTestPacket(t, 100, 0, syn, 0)
+	b[20+12] = 4 << 4
+	assert.Nil(t, CreateRejectPacket(b, make([]byte, MaxRejectPacketSize)))
+}
@@ -53,6 +53,43 @@ func Ip2VpnIp(ip []byte) VpnIp {
 	return VpnIp(binary.BigEndian.Uint32(ip))
 }
 
+// Addr2VpnIp returns the VpnIp of an ipv4 address, or of an ipv4 address mapped into ipv6. Anything else is 0.
+func Addr2VpnIp(addr netip.Addr) VpnIp {
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return 0
+	}
+	b := addr.As4()
+	return VpnIp(binary.BigEndian.Uint32(b[:]))
+}
+
+// IPNet2Prefix returns ipNet as a netip.Prefix without allocating, an ipv4 address in 16 bytes becomes an ipv4
+// prefix. The address is not masked so the prefix prints the same as ipNet does. A nil ipNet or one with a non
+// canonical mask returns the zero Prefix, which is not valid.
+func IPNet2Prefix(ipNet *net.IPNet) netip.Prefix {
+	if ipNet == nil {
+		return netip.Prefix{}
+	}
+
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return netip.Prefix{}
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	if bits == 0 {
+		return netip.Prefix{}
+	}
+
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		if bits == 128 {
+			ones -= 96
+		}
+	}
+	return netip.PrefixFrom(addr, ones)
+}
+
 func ToNetIpAddr(ip net.IP) (netip.Addr, error) {
 	addr, ok := netip.AddrFromSlice(ip)
 	if !ok {
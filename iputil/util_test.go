@@ -2,6 +2,7 @@ package iputil
 
 import (
 	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,3 +16,25 @@ func TestVpnIp_String(t *testing.T) {
 	assert.Equal(t, "1.1.1.1", Ip2VpnIp(net.ParseIP("1.1.1.1")).String())
 	assert.Equal(t, "0.0.0.0", Ip2VpnIp(net.ParseIP("0.0.0.0")).String())
 }
+
+func TestAddr2VpnIp(t *testing.T) {
+	assert.Equal(t, Ip2VpnIp(net.ParseIP("1.2.3.4")), Addr2VpnIp(netip.MustParseAddr("1.2.3.4")))
+	assert.Equal(t, Ip2VpnIp(net.ParseIP("1.2.3.4")), Addr2VpnIp(netip.MustParseAddr("::ffff:1.2.3.4")))
+	assert.Equal(t, VpnIp(0), Addr2VpnIp(netip.MustParseAddr("fd00::1")))
+	assert.Equal(t, VpnIp(0), Addr2VpnIp(netip.Addr{}))
+}
+
+func TestIPNet2Prefix(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.1.0.0/16")
+	assert.Equal(t, netip.MustParsePrefix("10.1.0.0/16"), IPNet2Prefix(n))
+
+	// 16 byte ipv4 addresses and masks become ipv4, the address is not masked
+	assert.Equal(t, "1.2.3.4/24", IPNet2Prefix(&net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.CIDRMask(24, 32)}).String())
+	assert.Equal(t, "1.2.3.4/24", IPNet2Prefix(&net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.CIDRMask(120, 128)}).String())
+
+	_, n, _ = net.ParseCIDR("fd00::/8")
+	assert.Equal(t, netip.MustParsePrefix("fd00::/8"), IPNet2Prefix(n))
+
+	assert.False(t, IPNet2Prefix(nil).IsValid())
+	assert.False(t, IPNet2Prefix(&net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 0, 255, 0}}).IsValid())
+}
@@ -66,6 +66,16 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		return nil, util.ContextualizeIfNeeded("Error while loading firewall rules", err)
 	}
 	l.WithField("firewallHashes", fw.GetRuleHashes()).Info("Firewall started")
+	fw.LogSummary()
+	fw.auditLog.Record(auditTriggerStartup, "", fw.getRules(), fw.rulesVersion())
+
+	if n, err := fw.LoadConntrackState(); err != nil {
+		l.WithError(err).Warn("Ignoring conntrack state file")
+	} else if n > 0 {
+		l.WithField("entries", n).Info("Restored conntrack state")
+	}
+	fw.startConntrackSweeper()
+	fw.startRuleExpiry()
 
 	// TODO: make sure mask is 4 bytes
 	tunCidr := certificate.Details.Ips[0]
@@ -112,14 +122,19 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 	}
 
-	// EXPERIMENTAL
-	// Intentionally not documented yet while we do more testing and determine
-	// a good default value.
-	conntrackCacheTimeout := c.GetDuration("firewall.conntrack.routine_cache_timeout", 0)
-	if routines > 1 && !c.IsSet("firewall.conntrack.routine_cache_timeout") {
+	// routine_cache_timeout is the older, undocumented name
+	conntrackCacheKey := "firewall.conntrack.cache_timeout"
+	if !c.IsSet(conntrackCacheKey) {
+		conntrackCacheKey = "firewall.conntrack.routine_cache_timeout"
+	}
+	conntrackCacheTimeout := c.GetDuration(conntrackCacheKey, 0)
+	if routines > 1 && !c.IsSet(conntrackCacheKey) {
 		// Use a different default if we are running with multiple routines
 		conntrackCacheTimeout = 1 * time.Second
 	}
+	if conntrackCacheTimeout < 0 {
+		return nil, util.NewContextualError("firewall.conntrack.cache_timeout must not be negative", nil, nil)
+	}
 	if conntrackCacheTimeout > 0 {
 		l.WithField("duration", conntrackCacheTimeout).Info("Using routine-local conntrack cache")
 	}
@@ -21,6 +21,12 @@ const (
 	minFwPacketLen = 4
 )
 
+// GRE header flags that say which optional fields follow the protocol type, RFC 2890
+const (
+	greChecksumPresent = 0x80
+	greKeyPresent      = 0x20
+)
+
 func readOutsidePackets(f *Interface) udp.EncReader {
 	return func(
 		addr *udp.Addr,
@@ -31,13 +37,13 @@ func readOutsidePackets(f *Interface) udp.EncReader {
 		lhh udp.LightHouseHandlerFunc,
 		nb []byte,
 		q int,
-		localCache firewall.ConntrackCache,
+		localCache *firewall.ConntrackCache,
 	) {
 		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, localCache)
 	}
 }
 
-func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
+func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache *firewall.ConntrackCache) {
 	err := h.Parse(packet)
 	if err != nil {
 		// TODO: best if we return this and let caller log
@@ -256,6 +262,7 @@ func (f *Interface) closeTunnel(hostInfo *HostInfo) {
 	if final {
 		// We no longer have any tunnels with this vpn ip, clear learned lighthouse state to lower memory usage
 		f.lightHouse.DeleteVpnIp(hostInfo.vpnIp)
+		f.firewall.ForgetHostRTT(hostInfo.vpnIp)
 	}
 }
 
@@ -361,9 +368,55 @@ func newPacket(data []byte, incoming bool, fp *firewall.Packet) error {
 		}
 	}
 
+	// Like linux conntrack, the identifier of an echo request or reply stands in for both ports. Each ping session gets
+	// its own conntrack entry and the reply maps back to the request. We need the full 8 byte icmp header for this.
+	if fp.Protocol == firewall.ProtoICMP && !fp.Fragment && len(data) >= ihl+8 {
+		switch data[ihl] {
+		case icmpEchoRequest, icmpEchoReply:
+			id := binary.BigEndian.Uint16(data[ihl+4 : ihl+6])
+			fp.LocalPort = id
+			fp.RemotePort = id
+		}
+	}
+
+	// Tunnels have no ports, the ESP SPI or the GRE key tells them apart instead so each tunnel between two hosts gets
+	// its own conntrack entry. Like the echo identifier the key is not flipped by direction, packets carrying the same
+	// key either way share the entry. ESP uses a different SPI each way so each direction is a flow of its own. Packets
+	// without a key are tracked by their addresses alone.
+	if !fp.Fragment && (fp.Protocol == firewall.ProtoESP || fp.Protocol == firewall.ProtoGRE) {
+		fp.LocalPort = 0
+		fp.RemotePort = 0
+		if key, ok := tunnelKey(data[ihl:], fp.Protocol); ok {
+			fp.LocalPort = uint16(key >> 16)
+			fp.RemotePort = uint16(key)
+		}
+	}
+
 	return nil
 }
 
+// tunnelKey returns the ESP SPI or the GRE key from the start of an ESP or GRE header, false if there is none
+func tunnelKey(b []byte, proto uint8) (uint32, bool) {
+	off := 0
+	if proto == firewall.ProtoGRE {
+		if len(b) < 4 || b[0]&greKeyPresent == 0 {
+			return 0, false
+		}
+
+		// The key follows the checksum if there is one
+		off = 4
+		if b[0]&greChecksumPresent != 0 {
+			off += 4
+		}
+	}
+
+	if len(b) < off+4 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(b[off : off+4]), true
+}
+
 func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []byte, h *header.H, nb []byte) ([]byte, error) {
 	var err error
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], mc, nb)
@@ -380,7 +433,7 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 	return out, nil
 }
 
-func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
+func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache *firewall.ConntrackCache) bool {
 	var err error
 
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], messageCounter, nb)
@@ -404,14 +457,15 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 		return false
 	}
 
-	dropReason := f.firewall.Drop(out, *fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	dropReason := f.firewall.DropFromUnderlayAddr(out, *fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache, f.underlayIP(q))
 	if dropReason != nil {
 		// NOTE: We give `packet` as the `out` here since we already decrypted from it and we don't need it anymore
 		// This gives us a buffer to build the reject packet in
-		f.rejectOutside(out, hostinfo.ConnectionState, hostinfo, nb, packet, q)
+		f.rejectOutside(out, hostinfo.ConnectionState, hostinfo, nb, packet, q, dropReason)
 		if f.l.Level >= logrus.DebugLevel {
 			hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
 				WithField("reason", dropReason).
+				WithField("action", f.firewall.dropAction(dropReason, true)).
 				Debugln("dropping inbound packet")
 		}
 		return false
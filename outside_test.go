@@ -80,4 +80,71 @@ func Test_newPacket(t *testing.T) {
 	assert.Equal(t, p.RemoteIP, iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 2)))
 	assert.Equal(t, p.RemotePort, uint16(6))
 	assert.Equal(t, p.LocalPort, uint16(5))
+
+	// icmp echo identifier is used for both ports
+	h = ipv4.Header{
+		Version:  1,
+		Protocol: firewall.ProtoICMP,
+		Len:      100,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+	}
+
+	b, _ = h.Marshal()
+	echo := append(b, []byte{icmpEchoRequest, 0, 0, 0, 0x12, 0x34, 0, 1}...)
+	err = newPacket(echo, false, p)
+
+	assert.Nil(t, err)
+	assert.Equal(t, p.Protocol, uint8(firewall.ProtoICMP))
+	assert.Equal(t, p.LocalPort, uint16(0x1234))
+	assert.Equal(t, p.RemotePort, uint16(0x1234))
+
+	// other icmp messages and truncated echos have no ports
+	err = newPacket(append(b, []byte{icmpDestinationUnreachable, 3, 0, 0, 0x12, 0x34, 0, 1}...), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, p.LocalPort, uint16(0))
+	assert.Equal(t, p.RemotePort, uint16(0))
+
+	err = newPacket(echo[:len(echo)-1], true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, p.LocalPort, uint16(0))
+	assert.Equal(t, p.RemotePort, uint16(0))
+
+	// the esp spi is split across the ports the same way in both directions
+	h.Protocol = firewall.ProtoESP
+	b, _ = h.Marshal()
+	esp := append(b, []byte{0x12, 0x34, 0x56, 0x78, 0, 0, 0, 1}...)
+	for _, incoming := range []bool{true, false} {
+		err = newPacket(esp, incoming, p)
+		assert.Nil(t, err)
+		assert.Equal(t, p.Protocol, uint8(firewall.ProtoESP))
+		assert.Equal(t, p.LocalPort, uint16(0x1234))
+		assert.Equal(t, p.RemotePort, uint16(0x5678))
+	}
+
+	// so is a gre key, which follows the checksum when there is one
+	h.Protocol = firewall.ProtoGRE
+	b, _ = h.Marshal()
+	gre := append(b, []byte{greKeyPresent, 0, 0x08, 0x00, 0xab, 0xcd, 0x00, 0x01}...)
+	err = newPacket(gre, true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, p.LocalPort, uint16(0xabcd))
+	assert.Equal(t, p.RemotePort, uint16(0x0001))
+
+	greChecksum := append(b, []byte{greChecksumPresent | greKeyPresent, 0, 0x08, 0x00, 0xff, 0xff, 0, 0, 0xab, 0xcd, 0x00, 0x02}...)
+	err = newPacket(greChecksum, false, p)
+	assert.Nil(t, err)
+	assert.Equal(t, p.LocalPort, uint16(0xabcd))
+	assert.Equal(t, p.RemotePort, uint16(0x0002))
+
+	// gre without a key, or with a truncated one, is tracked by address pair
+	err = newPacket(append(b, []byte{0, 0, 0x08, 0x00, 0xab, 0xcd, 0x00, 0x01}...), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, p.LocalPort, uint16(0))
+	assert.Equal(t, p.RemotePort, uint16(0))
+
+	err = newPacket(gre[:len(gre)-1], true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, p.LocalPort, uint16(0))
+	assert.Equal(t, p.RemotePort, uint16(0))
 }
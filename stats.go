@@ -114,6 +114,11 @@ func startPrometheusStats(l *logrus.Logger, i time.Duration, c *config.C, buildV
 	pr.MustRegister(g)
 	g.Set(1)
 
+	// Firewall metrics registered with their own registry are exported natively instead of through the bridge
+	if c.GetBool("stats.firewall_native", false) {
+		pr.MustRegister(NewFirewallCollector(firewallNativeRegistry, namespace, subsystem))
+	}
+
 	var startFn func()
 	if !configTest {
 		startFn = func() {
@@ -15,8 +15,8 @@ type TimerWheel[T any] struct {
 	// Cheat on finding the length of the wheel
 	wheelLen int
 
-	// Last time we ticked, since we are lazy ticking
-	lastTick *time.Time
+	// Last time we ticked, since we are lazy ticking. A value rather than a pointer so Advance doesn't allocate
+	lastTick time.Time
 
 	// Durations of a tick and the entire wheel
 	tickDuration  time.Duration
@@ -28,6 +28,9 @@ type TimerWheel[T any] struct {
 	// Singly linked list of items that have timed out of the wheel
 	expired *TimeoutList[T]
 
+	// How many items are in the expired list, waiting for Purge
+	expiredLen int
+
 	// Item cache to avoid garbage collect
 	itemCache   *TimeoutItem[T]
 	itemsCached int
@@ -42,6 +45,9 @@ type LockingTimerWheel[T any] struct {
 type TimeoutList[T any] struct {
 	Head *TimeoutItem[T]
 	Tail *TimeoutItem[T]
+
+	// How many items are in the list
+	len int
 }
 
 // TimeoutItem Represents an item within a tick
@@ -111,6 +117,7 @@ func (tw *TimerWheel[T]) Add(v T, timeout time.Duration) *TimeoutItem[T] {
 		tw.wheel[i].Tail.Next = ti
 		tw.wheel[i].Tail = ti
 	}
+	tw.wheel[i].len++
 
 	return ti
 }
@@ -125,6 +132,7 @@ func (tw *TimerWheel[T]) Purge() (T, bool) {
 
 	ti := tw.expired.Head
 	tw.expired.Head = ti.Next
+	tw.expiredLen--
 
 	if tw.expired.Head == nil {
 		tw.expired.Tail = nil
@@ -143,6 +151,31 @@ func (tw *TimerWheel[T]) Purge() (T, bool) {
 	return ti.Item, true
 }
 
+// Expired returns how many expired items are waiting to be removed by Purge. Items only expire when Advance passes over
+// them, so this does not count items that are overdue because the wheel has not been advanced.
+func (tw *TimerWheel[T]) Expired() int {
+	return tw.expiredLen
+}
+
+// Soonest calls fn for up to max items still in the wheel, starting with the ones that expire next, until fn returns
+// false. Expired items waiting for Purge are not visited. At most one trip around the wheel is made so the cost is
+// bounded by max and the length of the wheel, not by how many items there are.
+func (tw *TimerWheel[T]) Soonest(max int, fn func(T) bool) {
+	for i := 1; i <= tw.wheelLen && max > 0; i++ {
+		tick := tw.current + i
+		if tick >= tw.wheelLen {
+			tick -= tw.wheelLen
+		}
+
+		for ti := tw.wheel[tick].Head; ti != nil && max > 0; ti = ti.Next {
+			max--
+			if !fn(ti.Item) {
+				return
+			}
+		}
+	}
+}
+
 // findWheel find the next position in the wheel for the provided timeout given the current tick
 func (tw *TimerWheel[T]) findWheel(timeout time.Duration) (i int) {
 	if timeout < tw.tickDuration {
@@ -169,12 +202,12 @@ func (tw *TimerWheel[T]) findWheel(timeout time.Duration) (i int) {
 // Advance will move the wheel forward by the appropriate number of ticks for the provided time and all items
 // passed over will be moved to the expired list. Calling Purge is necessary to remove them entirely.
 func (tw *TimerWheel[T]) Advance(now time.Time) {
-	if tw.lastTick == nil {
-		tw.lastTick = &now
+	if tw.lastTick.IsZero() {
+		tw.lastTick = now
 	}
 
 	// We want to round down
-	ticks := int(now.Sub(*tw.lastTick) / tw.tickDuration)
+	ticks := int(now.Sub(tw.lastTick) / tw.tickDuration)
 	adv := ticks
 	if ticks > tw.wheelLen {
 		ticks = tw.wheelLen
@@ -195,15 +228,16 @@ func (tw *TimerWheel[T]) Advance(now time.Time) {
 				tw.expired.Tail.Next = tw.wheel[tw.current].Head
 				tw.expired.Tail = tw.wheel[tw.current].Tail
 			}
+			tw.expiredLen += tw.wheel[tw.current].len
 
 			tw.wheel[tw.current].Head = nil
 			tw.wheel[tw.current].Tail = nil
+			tw.wheel[tw.current].len = 0
 		}
 	}
 
 	// Advance the tick based on duration to avoid losing some accuracy
-	newTick := tw.lastTick.Add(tw.tickDuration * time.Duration(adv))
-	tw.lastTick = &newTick
+	tw.lastTick = tw.lastTick.Add(tw.tickDuration * time.Duration(adv))
 }
 
 func (lw *LockingTimerWheel[T]) Add(v T, timeout time.Duration) *TimeoutItem[T] {
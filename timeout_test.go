@@ -13,7 +13,7 @@ func TestNewTimerWheel(t *testing.T) {
 	tw := NewTimerWheel[firewall.Packet](time.Second, time.Second*10)
 	assert.Equal(t, 12, tw.wheelLen)
 	assert.Equal(t, 0, tw.current)
-	assert.Nil(t, tw.lastTick)
+	assert.True(t, tw.lastTick.IsZero())
 	assert.Equal(t, time.Second*1, tw.tickDuration)
 	assert.Equal(t, time.Second*10, tw.wheelDuration)
 	assert.Len(t, tw.wheel, 12)
@@ -106,12 +106,47 @@ func TestTimerWheel_Add(t *testing.T) {
 	}
 }
 
+func TestTimerWheel_Soonest(t *testing.T) {
+	tw := NewTimerWheel[firewall.Packet](time.Second, time.Second*10)
+	tw.current = 8
+
+	later := firewall.Packet{LocalPort: 3}
+	sooner := firewall.Packet{LocalPort: 1}
+	soon := firewall.Packet{LocalPort: 2}
+	tw.Add(later, time.Second*5)
+	tw.Add(sooner, time.Second*1)
+	tw.Add(soon, time.Second*1)
+
+	var seen []uint16
+	visit := func(fp firewall.Packet) bool {
+		seen = append(seen, fp.LocalPort)
+		return true
+	}
+
+	// Around the end of the wheel, in the order they expire
+	tw.Soonest(10, visit)
+	assert.Equal(t, []uint16{1, 2, 3}, seen)
+
+	// Limited by max
+	seen = nil
+	tw.Soonest(2, visit)
+	assert.Equal(t, []uint16{1, 2}, seen)
+
+	// Or by fn
+	seen = nil
+	tw.Soonest(10, func(fp firewall.Packet) bool {
+		seen = append(seen, fp.LocalPort)
+		return false
+	})
+	assert.Equal(t, []uint16{1}, seen)
+}
+
 func TestTimerWheel_Purge(t *testing.T) {
 	// First advance should set the lastTick and do nothing else
 	tw := NewTimerWheel[firewall.Packet](time.Second, time.Second*10)
-	assert.Nil(t, tw.lastTick)
+	assert.True(t, tw.lastTick.IsZero())
 	tw.Advance(time.Now())
-	assert.NotNil(t, tw.lastTick)
+	assert.False(t, tw.lastTick.IsZero())
 	assert.Equal(t, 0, tw.current)
 
 	fps := []firewall.Packet{
@@ -127,10 +162,11 @@ func TestTimerWheel_Purge(t *testing.T) {
 	tw.Add(fps[3], time.Second*2)
 
 	ta := time.Now().Add(time.Second * 3)
-	lastTick := *tw.lastTick
+	lastTick := tw.lastTick
 	tw.Advance(ta)
 	assert.Equal(t, 3, tw.current)
 	assert.True(t, tw.lastTick.After(lastTick))
+	assert.Equal(t, 4, tw.Expired())
 
 	// Make sure we get all 4 packets back
 	for i := 0; i < 4; i++ {
@@ -139,6 +175,8 @@ func TestTimerWheel_Purge(t *testing.T) {
 		assert.Equal(t, fps[i], p)
 	}
 
+	assert.Zero(t, tw.Expired())
+
 	// Make sure there aren't any leftover
 	_, ok := tw.Purge()
 	assert.False(t, ok)
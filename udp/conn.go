@@ -17,7 +17,7 @@ type EncReader func(
 	lhh LightHouseHandlerFunc,
 	nb []byte,
 	q int,
-	localCache firewall.ConntrackCache,
+	localCache *firewall.ConntrackCache,
 )
 
 type Conn interface {